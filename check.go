@@ -16,6 +16,13 @@ const (
 	// StateFragmented means that endpoint (caller) has received fragmented
 	// frame and waits for continuation parts.
 	StateFragmented
+	// StateUnmasked means that endpoints agreed (out of band) that frames
+	// sent from client to server are not masked.
+	//
+	// Note that this is not compliant with RFC6455 and must be used only when
+	// both endpoints are under control (e.g. within trusted network or
+	// behind TLS). Any compliant peer will fail the connection.
+	StateUnmasked
 )
 
 // Is checks whether the s has v enabled.
@@ -45,6 +52,10 @@ func (s State) Extended() bool { return s.Is(StateExtended) }
 // Fragmented reports whether state is fragmented.
 func (s State) Fragmented() bool { return s.Is(StateFragmented) }
 
+// Unmasked reports whether state allows client to server frames to be not
+// masked.
+func (s State) Unmasked() bool { return s.Is(StateUnmasked) }
+
 // ProtocolError describes error during checking/parsing websocket frames or
 // headers.
 type ProtocolError string
@@ -67,8 +78,16 @@ var (
 	ErrProtocolStatusCodeNoMeaning        = ProtocolError("status code has no meaning yet")
 	ErrProtocolStatusCodeUnknown          = ProtocolError("status code is not defined in spec")
 	ErrProtocolInvalidUTF8                = ProtocolError("invalid utf8 sequence in close reason")
+	ErrProtocolFrameAfterClose            = ProtocolError("frame received after close frame")
 )
 
+// ErrProtocolControlFragmented is returned by CheckHeader() when control frame
+// has FIN bit unset. Control frames must not be fragmented, thus connection
+// should be closed with StatusProtocolError (1002) code after receiving it.
+//
+// It is the same error as ErrProtocolControlNotFinal.
+var ErrProtocolControlFragmented = ErrProtocolControlNotFinal
+
 // CheckHeader checks h to contain valid header data for given state s.
 //
 // Note that zero state (0) means that state is clean,
@@ -82,7 +101,7 @@ func CheckHeader(h Header, s State) error {
 			return ErrProtocolControlPayloadOverflow
 		}
 		if !h.Fin {
-			return ErrProtocolControlNotFinal
+			return ErrProtocolControlFragmented
 		}
 	}
 
@@ -99,7 +118,7 @@ func CheckHeader(h Header, s State) error {
 	// as defined in Section 7.4.1. A server MUST NOT mask any frames that it sends to the client.
 	// A client MUST close a connection if it detects a masked frame. In this case, it MAY use the
 	// status code 1002 (protocol error) as defined in Section 7.4.1.
-	case s.ServerSide() && !h.Masked:
+	case s.ServerSide() && !h.Masked && !s.Unmasked():
 		return ErrProtocolMaskRequired
 	case s.ClientSide() && h.Masked:
 		return ErrProtocolMaskUnexpected
@@ -2,6 +2,7 @@ package ws
 
 import (
 	"encoding/binary"
+	"io"
 )
 
 // Cipher applies XOR cipher to the payload using mask.
@@ -56,6 +57,39 @@ func Cipher(payload []byte, mask [4]byte, offset int) {
 	}
 }
 
+// Unmask unmasks given payload in place using mask.
+// It is the same as Cipher(payload, mask, 0).
+func Unmask(payload []byte, mask [4]byte) {
+	Cipher(payload, mask, 0)
+}
+
+// UnmaskReader returns io.Reader that unmasks bytes read from r using mask.
+// Offset is the number of payload bytes already processed before r, so that
+// mask rotation continues correctly across chunks of the same payload.
+//
+// Note that returned reader unmasks bytes in place within buffer passed to
+// its Read() method.
+func UnmaskReader(r io.Reader, mask [4]byte, offset int) io.Reader {
+	return &unmaskReader{
+		r:    r,
+		mask: mask,
+		pos:  offset,
+	}
+}
+
+type unmaskReader struct {
+	r    io.Reader
+	mask [4]byte
+	pos  int
+}
+
+func (u *unmaskReader) Read(p []byte) (n int, err error) {
+	n, err = u.r.Read(p)
+	Cipher(p[:n], u.mask, u.pos)
+	u.pos += n
+	return n, err
+}
+
 // remain maps position in masking key [0,4) to number
 // of bytes that need to be processed manually inside Cipher().
 var remain = [4]int{0, 3, 2, 1}
@@ -1,7 +1,10 @@
 package ws
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -110,6 +113,67 @@ func TestCipherChops(t *testing.T) {
 	}
 }
 
+func TestUnmask(t *testing.T) {
+	p := []byte("Hello, XOR!")
+	m := [4]byte{1, 2, 3, 4}
+	exp := cipherNaive(p, m, 0)
+
+	Unmask(p, m)
+	if !bytes.Equal(p, exp) {
+		t.Errorf("unexpected Unmask() result: %v; want %v", p, exp)
+	}
+}
+
+func TestUnmaskReader(t *testing.T) {
+	p := make([]byte, 1024)
+	rand.Read(p)
+
+	var m [4]byte
+	rand.Read(m[:])
+
+	exp := cipherNaive(p, m, 0)
+
+	for _, split := range []int{0, 1, 3, 5, 8, 513} {
+		t.Run(fmt.Sprintf("%d", split), func(t *testing.T) {
+			// Read the head of the payload in one piece and the rest through
+			// separate reader started at given offset, chunked by one byte.
+			head, err := ioutil.ReadAll(UnmaskReader(
+				bytes.NewReader(copyBytes(p[:split])), m, 0,
+			))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tail, err := ioutil.ReadAll(UnmaskReader(
+				&chunkReader{bytes.NewReader(copyBytes(p[split:])), 1}, m, split,
+			))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if act := append(head, tail...); !bytes.Equal(act, exp) {
+				t.Errorf("unexpected unmasked bytes:\nact:\t%x\nexp:\t%x", act, exp)
+			}
+		})
+	}
+}
+
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	return c.r.Read(p)
+}
+
+func copyBytes(p []byte) []byte {
+	cp := make([]byte, len(p))
+	copy(cp, p)
+	return cp
+}
+
 func cipherNaive(p []byte, m [4]byte, pos int) []byte {
 	r := make([]byte, len(p))
 	copy(r, p)
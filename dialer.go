@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -22,6 +23,7 @@ import (
 const (
 	DefaultClientReadBufferSize  = 4096
 	DefaultClientWriteBufferSize = 4096
+	DefaultClientMaxHeaderBytes  = 64 << 10
 )
 
 // Handshake represents handshake result.
@@ -31,6 +33,72 @@ type Handshake struct {
 
 	// Extensions is the list of negotiated extensions.
 	Extensions []httphead.Option
+
+	// Compressed reports whether "permessage-deflate" extension was
+	// successfully negotiated. It is false if extension was offered but not
+	// accepted.
+	Compressed bool
+
+	// Unmasked reports whether frames sent from client to server are agreed
+	// to be not masked. It is set by Dialer with DisableMasking option and by
+	// upgraders with AllowUnmaskedClient option.
+	//
+	// When it is true, StateUnmasked should be set in state used to
+	// read/write frames (e.g. by wsutil).
+	Unmasked bool
+
+	// TLS holds TLS connection state if connection was established over
+	// TLS (e.g. for "wss" scheme). It could be used to verify peer
+	// certificates after handshake. It is nil for plain connections. It is
+	// set by Dialer.Dial() only; see ConnectionState() for other cases.
+	TLS *tls.ConnectionState
+
+	// protocolIndex holds index of the selected protocol in the list of
+	// protocols offered by Dialer plus one. That is, zero value means that no
+	// protocol was selected.
+	protocolIndex int
+}
+
+// SelectedProtocolIndex returns index of the selected Protocol in the
+// Dialer.Protocols list offered by client. It returns -1 if server did not
+// select any protocol or if hs was not received by Dialer.
+//
+// Note that if server selects protocol which was not offered, Dialer returns
+// ErrHandshakeBadSubProtocol error and SelectedProtocolIndex returns -1.
+func (hs Handshake) SelectedProtocolIndex() int {
+	return hs.protocolIndex - 1
+}
+
+// ExtensionParam describes a negotiated extension and its parameters.
+type ExtensionParam struct {
+	// Name is the extension name, e.g. "permessage-deflate".
+	Name string
+
+	// Params holds extension parameters. Parameters without value (such as
+	// "server_no_context_takeover") are mapped to empty string.
+	Params map[string]string
+}
+
+// ExtensionParams returns the list of negotiated extensions with their
+// parameters parsed from hs.Extensions, in the same order. It is useful for
+// logging and debugging purposes; it allocates on every call.
+func (hs Handshake) ExtensionParams() []ExtensionParam {
+	if len(hs.Extensions) == 0 {
+		return nil
+	}
+	ret := make([]ExtensionParam, len(hs.Extensions))
+	for i, opt := range hs.Extensions {
+		params := make(map[string]string)
+		opt.Parameters.ForEach(func(k, v []byte) bool {
+			params[string(k)] = string(v)
+			return true
+		})
+		ret[i] = ExtensionParam{
+			Name:   string(opt.Name),
+			Params: params,
+		}
+	}
+	return ret
 }
 
 // Errors used by the websocket client.
@@ -40,6 +108,46 @@ var (
 	ErrHandshakeBadExtensions  = fmt.Errorf("unexpected extensions in %q header", headerSecProtocol)
 )
 
+// SecAcceptError is returned by Dialer when the server responds with
+// Sec-WebSocket-Accept value that does not match the one computed from the
+// sent Sec-WebSocket-Key. This is often caused by proxies rewriting the key.
+//
+// Neither of the values are secret, so both are reported by Error() to ease
+// diagnosis. SecAcceptError matches ErrHandshakeBadSecAccept when used with
+// errors.Is().
+type SecAcceptError struct {
+	Expected string
+	Received string
+}
+
+func newSecAcceptError(accept, nonce []byte, fn func(string) string) *SecAcceptError {
+	var expect string
+	if fn != nil {
+		expect = fn(string(nonce))
+	} else {
+		p := make([]byte, acceptSize)
+		initAcceptFromNonce(p, nonce)
+		expect = string(p)
+	}
+	return &SecAcceptError{
+		Expected: expect,
+		Received: string(accept),
+	}
+}
+
+// Error implements error interface.
+func (e *SecAcceptError) Error() string {
+	return fmt.Sprintf(
+		"%s: expected %q, received %q",
+		ErrHandshakeBadSecAccept, e.Expected, e.Received,
+	)
+}
+
+// Is reports whether target is ErrHandshakeBadSecAccept.
+func (e *SecAcceptError) Is(target error) bool {
+	return target == ErrHandshakeBadSecAccept
+}
+
 // DefaultDialer is dialer that holds no options and is used by Dial function.
 var DefaultDialer Dialer
 
@@ -48,15 +156,52 @@ func Dial(ctx context.Context, urlstr string) (net.Conn, *bufio.Reader, Handshak
 	return DefaultDialer.Dial(ctx, urlstr)
 }
 
+// BufferPool is an interface for getting and returning buffered readers and
+// writers used by Dialer. It is similar to net/http/httputil.BufferPool, but
+// deals with bufio types to keep handshake allocation free.
+//
+// GetReader() and GetWriter() receive buffer size configured for Dialer and
+// may return buffer of greater size. Put methods are called when buffer is
+// no longer used by Dialer; implementation should Reset() it to not hold the
+// connection.
+type BufferPool interface {
+	GetReader(r io.Reader, size int) *bufio.Reader
+	PutReader(*bufio.Reader)
+	GetWriter(w io.Writer, size int) *bufio.Writer
+	PutWriter(*bufio.Writer)
+}
+
 // Dialer contains options for establishing websocket connection to an url.
 type Dialer struct {
 	// ReadBufferSize and WriteBufferSize is an I/O buffer sizes.
 	// They used to read and write http data while upgrading to WebSocket.
-	// Allocated buffers are pooled with sync.Pool to avoid extra allocations.
+	// Allocated buffers are pooled with sync.Pool to avoid extra allocations,
+	// unless BufferPool is set.
+	//
+	// Buffers are returned to the pool right after the handshake, except the
+	// case when Dial() returns non-nil *bufio.Reader: then it is caller's
+	// responsibility to return it with PutReader() (or with
+	// BufferPool.PutReader() if BufferPool is set) when buffered data is
+	// consumed (or connection is closed).
+	//
+	// Inner pools are shared between dialers and are segregated by buffer
+	// size, so it is better to use the same sizes across dialers to get more
+	// reuse.
+	//
+	// If a size is zero then default value is used, that is
+	// DefaultClientReadBufferSize and DefaultClientWriteBufferSize.
 	//
-	// If a size is zero then default value is used.
+	// Larger buffers trade memory for fewer syscalls. This matters when
+	// the *bufio.Reader returned from Dial() is used to read the session's
+	// frames too, e.g. for high-throughput binary streams.
 	ReadBufferSize, WriteBufferSize int
 
+	// BufferPool is an optional pool of I/O buffers used during handshake.
+	// If it is nil, inner pools are used. It is useful when client makes
+	// lots of short-lived connections and already has own buffer pool to
+	// share with.
+	BufferPool BufferPool
+
 	// Timeout is the maximum amount of time a Dial() will wait for a connect
 	// and an handshake to complete.
 	//
@@ -64,11 +209,44 @@ type Dialer struct {
 	Timeout time.Duration
 
 	// Protocols is the list of subprotocols that the client wants to speak,
-	// ordered by preference.
+	// ordered by preference. Each of them must be a valid HTTP token (see
+	// IsValidProtocolToken()), otherwise ErrHandshakeBadProtocolToken is
+	// returned before sending the request.
 	//
 	// See https://tools.ietf.org/html/rfc6455#section-4.1
 	Protocols []string
 
+	// ProtocolMatch is an optional function that reports whether subprotocol
+	// echoed by server in the "Sec-WebSocket-Protocol" header matches one of
+	// the offered protocols. It is called once with the whole Protocols list.
+	//
+	// If it returns true, Handshake.Protocol is set to offered protocol
+	// which is exactly equal to echoed one, or to the first offered protocol
+	// which is equal to it case-insensitively. If there is no such protocol
+	// (that is, custom function accepted something else), echoed value is
+	// used as is and Handshake.SelectedProtocolIndex() returns -1.
+	//
+	// If ProtocolMatch is nil, echoed value must be exactly (case-sensitive)
+	// equal to one of Protocols, as subprotocol tokens are case-sensitive.
+	// Custom function could be used to accept, for example, servers that
+	// echo protocol in different case:
+	//
+	//	d := ws.Dialer{
+	//		Protocols: []string{"Chat"},
+	//		ProtocolMatch: func(offered []string, echoed string) bool {
+	//			for _, p := range offered {
+	//				if strings.EqualFold(p, echoed) {
+	//					return true
+	//				}
+	//			}
+	//			return false
+	//		},
+	//	}
+	//
+	// If echoed protocol is not matched, ErrHandshakeBadSubProtocol is
+	// returned.
+	ProtocolMatch func(offered []string, echoed string) bool
+
 	// Extensions is the list of extensions that client wants to speak.
 	//
 	// Note that if server decides to use some of this extensions, Dial() will
@@ -87,6 +265,13 @@ type Dialer struct {
 	// land.
 	Header HandshakeHeader
 
+	// Origin and UserAgent are optional values of the "Origin" and
+	// "User-Agent" request headers respectively. Empty value means that
+	// header is not sent. If Header already provides some of these headers
+	// (see HandshakeHeaderGet()), corresponding field is ignored, so the
+	// header is never duplicated.
+	Origin, UserAgent string
+
 	// OnStatusError is the callback that will be called after receiving non
 	// "101 Continue" HTTP response status. It receives an io.Reader object
 	// representing server response bytes. That is, it gives ability to parse
@@ -96,6 +281,33 @@ type Dialer struct {
 	// The arguments are only valid until the callback returns.
 	OnStatusError func(status int, reason []byte, resp io.Reader)
 
+	// ResponseError changes the type of error returned after receiving non
+	// "101 Switching Protocols" response from StatusError to *ResponseError,
+	// which also holds reason phrase and headers of the response. Headers
+	// are read before OnStatusError is called; bytes read are still passed
+	// to it.
+	//
+	// *ResponseError unwraps to StatusError, so it could be inspected with
+	// errors.Is() and errors.As(), but not compared with == operator.
+	ResponseError bool
+
+	// MaxHeaderBytes is the maximum number of bytes Dialer reads while
+	// parsing headers of the response for ResponseError. When it is
+	// exceeded, the rest of headers is not parsed and ResponseError contains
+	// only headers read before the limit.
+	//
+	// If it is zero then DefaultClientMaxHeaderBytes is used. If it is
+	// negative then no limit is applied.
+	MaxHeaderBytes int
+
+	// OnWroteRequest is the callback that will be called after handshake
+	// request was successfully written to the connection. It receives exact
+	// bytes of the request sent to the server, which could be useful for
+	// logging or audit purposes.
+	//
+	// The argument is only valid until the callback returns.
+	OnWroteRequest func(req []byte)
+
 	// OnHeader is the callback that will be called after successful parsing of
 	// header, that is not used during WebSocket handshake procedure. That is,
 	// it will be called with non-websocket headers, which could be relevant
@@ -108,8 +320,26 @@ type Dialer struct {
 
 	// NetDial is the function that is used to get plain tcp connection.
 	// If it is not nil, then it is used instead of net.Dialer.
+	// If both NetDial and NetDialer are set, then NetDial is used.
 	NetDial func(ctx context.Context, network, addr string) (net.Conn, error)
 
+	// NetDialer is the net.Dialer that is used to get plain tcp connection
+	// when NetDial is nil. It allows to tune options like KeepAlive,
+	// LocalAddr or Control without replacing the whole dial procedure.
+	// Note that NetDialer.Timeout and NetDialer.Deadline are applied in
+	// addition to the Timeout field and context passed to Dial().
+	// If it is nil, then the net.Dialer with zero options is used.
+	NetDialer *net.Dialer
+
+	// Network is the network name passed to NetDial or NetDialer to get
+	// plain tcp connection. It could be used to prefer IPv4 or IPv6 in dual
+	// stack environments. Valid values are "tcp", "tcp4" and "tcp6".
+	// If it is empty, then "tcp" is used.
+	//
+	// Note that custom NetDial receives this value as network argument and
+	// is free to ignore it.
+	Network string
+
 	// TLSClient is the callback that will be called after successful dial with
 	// received connection and its remote host name. If it is nil, then the
 	// default tls.Client() will be used.
@@ -122,6 +352,14 @@ type Dialer struct {
 	// cloned and appropriate ServerName will be set.
 	TLSConfig *tls.Config
 
+	// ClientCert is the optional callback that will be called during TLS
+	// handshake when server requests a client certificate. It receives the
+	// host name being dialed, which makes it possible to present different
+	// certificates to different hosts without building TLSConfig for each of
+	// them. When set, it is used as GetClientCertificate of the (cloned)
+	// TLSConfig. If TLSClient is not nil, then it is ignored.
+	ClientCert func(host string) (*tls.Certificate, error)
+
 	// WrapConn is the optional callback that will be called when connection is
 	// ready for an i/o. That is, it will be called after successful dial and
 	// TLS initialization (for "wss" schemes). It may be helpful for different
@@ -130,14 +368,66 @@ type Dialer struct {
 	// Note that for debugging purposes of an http handshake (e.g. sent request
 	// and received response), there is an wsutil.DebugDialer struct.
 	WrapConn func(conn net.Conn) net.Conn
+
+	// OnConn is the optional callback that will be called with established
+	// connection right before the handshake request is written. It is called
+	// after TLS initialization and WrapConn, so it receives the same conn
+	// which is returned by Dial(). It is the single place to tune connection
+	// options such as TCP_NODELAY, keep alive or buffer sizes.
+	//
+	// Note that for "wss" scheme conn is a *tls.Conn (unless custom
+	// TLSClient or WrapConn is set), which underlying *net.TCPConn can be
+	// reached with its NetConn() method since Go 1.18.
+	//
+	// If returned error is non-nil then connection is closed and Dial()
+	// returns the error.
+	OnConn func(conn net.Conn) error
+
+	// DisableMasking reports that client is going to send frames to the
+	// server without masking. It must be agreed with the server out of band
+	// (see Upgrader's AllowUnmaskedClient option). If set, returned Handshake
+	// has Unmasked field set to true.
+	//
+	// Note that this is not compliant with RFC6455 and breaks
+	// interoperability with any compliant server, as well as it makes
+	// intermediaries vulnerable to cache poisoning attacks, which is what
+	// masking is designed to prevent. Use it only when both endpoints are
+	// under control, for example, within trusted network or behind TLS.
+	DisableMasking bool
+
+	// AcceptKeyFunc is an optional function that derives expected
+	// "Sec-WebSocket-Accept" value from the "Sec-WebSocket-Key" nonce sent
+	// to the server. It could be used to bind the handshake with a custom
+	// algorithm agreed with the server out of band (see Upgrader's
+	// AcceptKeyFunc option). If it is nil, the algorithm defined by RFC6455
+	// (SHA-1 of nonce concatenated with the GUID) is used.
+	//
+	// WARNING: custom derivation breaks interoperability with every standard
+	// server: it responds with the standard accept value, so Dial() fails
+	// with ErrHandshakeBadSecAccept. Use it only when both endpoints are
+	// under control.
+	AcceptKeyFunc func(nonce string) string
 }
 
 // Dial connects to the url host and upgrades connection to WebSocket.
 //
+// Returned conn is the outermost connection used for the handshake. That is,
+// for "wss" scheme it is a *tls.Conn unless custom TLSClient is set – then
+// connection returned by TLSClient is returned. In both cases it is wrapped
+// with WrapConn if it is set. Use ConnectionState() to inspect negotiated TLS
+// connection state regardless of wrapping.
+//
 // If server has sent frames right after successful handshake then returned
 // buffer will be non-nil. In other cases buffer is always nil. For better
 // memory efficiency received non-nil bufio.Reader should be returned to the
-// inner pool with PutReader() function after use.
+// inner pool with PutReader() function after use (or to the d.BufferPool if
+// it is set).
+//
+// Note that when returned buffer is non-nil it is unsafe to read from conn
+// directly until buffered bytes are consumed: they are already pulled out
+// from conn and would be lost otherwise. Since buffer reads through conn
+// when it becomes empty, it is fine to read all frames from the buffer
+// (until it is returned to the pool).
 //
 // Note that Dialer does not implement IDNA (RFC5895) logic as net/http does.
 // If you want to dial non-ascii host name, take care of its name serialization
@@ -171,6 +461,11 @@ func (d Dialer) Dial(ctx context.Context, urlstr string) (conn net.Conn, br *buf
 			conn.Close()
 		}
 	}()
+	if onConn := d.OnConn; onConn != nil {
+		if err = onConn(conn); err != nil {
+			return conn, nil, hs, err
+		}
+	}
 	if ctx == context.Background() {
 		// No need to start I/O interrupter goroutine which is not zero-cost.
 		conn.SetDeadline(deadline)
@@ -189,13 +484,18 @@ func (d Dialer) Dial(ctx context.Context, urlstr string) (conn net.Conn, br *buf
 	}
 
 	br, hs, err = d.Upgrade(conn, u)
+	if err == nil {
+		if state, ok := ConnectionState(conn); ok {
+			hs.TLS = &state
+		}
+	}
 
 	return conn, br, hs, err
 }
 
 var (
 	// netEmptyDialer is a net.Dialer without options, used in Dialer.dial() if
-	// Dialer.NetDial is not provided.
+	// neither Dialer.NetDial nor Dialer.NetDialer is provided.
 	netEmptyDialer net.Dialer
 	// tlsEmptyConfig is an empty tls.Config used as default one.
 	tlsEmptyConfig tls.Config
@@ -218,16 +518,27 @@ func hostport(host, defaultPort string) (hostname, addr string) {
 
 func (d Dialer) dial(ctx context.Context, u *url.URL) (conn net.Conn, err error) {
 	dial := d.NetDial
+	if dial == nil && d.NetDialer != nil {
+		dial = d.NetDialer.DialContext
+	}
 	if dial == nil {
 		dial = netEmptyDialer.DialContext
 	}
+	network := d.Network
+	switch network {
+	case "":
+		network = "tcp"
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unexpected network: %q", network)
+	}
 	switch u.Scheme {
 	case "ws":
 		_, addr := hostport(u.Host, ":80")
-		conn, err = dial(ctx, "tcp", addr)
+		conn, err = dial(ctx, network, addr)
 	case "wss":
 		hostname, addr := hostport(u.Host, ":443")
-		conn, err = dial(ctx, "tcp", addr)
+		conn, err = dial(ctx, network, addr)
 		if err != nil {
 			return nil, err
 		}
@@ -250,15 +561,47 @@ func (d Dialer) tlsClient(conn net.Conn, hostname string) net.Conn {
 	if config == nil {
 		config = tlsDefaultConfig()
 	}
-	if config.ServerName == "" {
+	if config.ServerName == "" || d.ClientCert != nil {
 		config = tlsCloneConfig(config)
+	}
+	if config.ServerName == "" {
 		config.ServerName = hostname
 	}
+	if cert := d.ClientCert; cert != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert(hostname)
+		}
+	}
 	// Do not make conn.Handshake() here because downstairs we will prepare
 	// i/o on this conn with proper context's timeout handling.
 	return tls.Client(conn, config)
 }
 
+// ConnectionState returns TLS connection state of given connection.
+//
+// It digs through connection wrappers that implement NetConn() net.Conn method
+// (such as *tls.Conn does since Go 1.18) until it meets connection that
+// implements ConnectionState() tls.ConnectionState method. It returns false if
+// no such connection found.
+func ConnectionState(conn net.Conn) (tls.ConnectionState, bool) {
+	for conn != nil {
+		switch c := conn.(type) {
+		case interface{ ConnectionState() tls.ConnectionState }:
+			return c.ConnectionState(), true
+		case interface{ NetConn() net.Conn }:
+			next := c.NetConn()
+			if next == conn {
+				// Prevent infinite loop on misbehaving wrapper.
+				return tls.ConnectionState{}, false
+			}
+			conn = next
+		default:
+			return tls.ConnectionState{}, false
+		}
+	}
+	return tls.ConnectionState{}, false
+}
+
 var (
 	// This variables are set like in net/net.go.
 	// noDeadline is just zero value for readability.
@@ -291,29 +634,55 @@ func (d Dialer) Upgrade(conn io.ReadWriter, u *url.URL) (br *bufio.Reader, hs Ha
 			headerSeenSecAccept
 	)
 
-	br = pbufio.GetReader(conn,
-		nonZero(d.ReadBufferSize, DefaultClientReadBufferSize),
-	)
-	bw := pbufio.GetWriter(conn,
-		nonZero(d.WriteBufferSize, DefaultClientWriteBufferSize),
+	br = d.getReader(conn)
+	var (
+		dst = io.Writer(conn)
+		req *bytes.Buffer
 	)
+	if d.OnWroteRequest != nil {
+		req = new(bytes.Buffer)
+		dst = io.MultiWriter(conn, req)
+	}
+	bw := d.getWriter(dst)
 	defer func() {
-		pbufio.PutWriter(bw)
+		d.putWriter(bw)
 		if br.Buffered() == 0 || err != nil {
 			// Server does not wrote additional bytes to the connection or
 			// error occurred. That is, no reason to return buffer.
-			pbufio.PutReader(br)
+			d.putReader(br)
 			br = nil
 		}
 	}()
 
+	for _, p := range d.Protocols {
+		if !IsValidProtocolToken(p) {
+			return br, hs, ErrHandshakeBadProtocolToken
+		}
+	}
+
+	for _, v := range [...]struct{ key, value string }{
+		{headerOrigin, d.Origin},
+		{headerUserAgent, d.UserAgent},
+	} {
+		if !isValidHeaderValue(v.value) {
+			return br, hs, fmt.Errorf("malformed %s header value: %q", v.key, v.value)
+		}
+	}
+
 	nonce := make([]byte, nonceSize)
 	initNonce(nonce)
 
-	httpWriteUpgradeRequest(bw, u, nonce, d.Protocols, d.Extensions, d.Header)
+	header := d.Header
+	if d.Origin != "" || d.UserAgent != "" {
+		header = HandshakeHeaderMulti(d.fieldsHeader(), d.Header)
+	}
+	httpWriteUpgradeRequest(bw, u, nonce, d.Protocols, d.Extensions, header)
 	if err := bw.Flush(); err != nil {
 		return br, hs, err
 	}
+	if req != nil {
+		d.OnWroteRequest(req.Bytes())
+	}
 
 	// Read HTTP status line like "HTTP/1.1 101 Switching Protocols".
 	sl, err := readLine(br)
@@ -335,14 +704,62 @@ func (d Dialer) Upgrade(conn io.ReadWriter, u *url.URL) (br *bufio.Reader, hs Ha
 	}
 	if resp.status != http.StatusSwitchingProtocols {
 		err = StatusError(resp.status)
+		if !d.ResponseError {
+			if onStatusError := d.OnStatusError; onStatusError != nil {
+				// Invoke callback with multireader of status-line bytes br.
+				onStatusError(resp.status, resp.reason,
+					io.MultiReader(
+						bytes.NewReader(sl),
+						strings.NewReader(crlf),
+						br,
+					),
+				)
+			}
+			return br, hs, err
+		}
+		respErr := &ResponseError{
+			StatusError: StatusError(resp.status),
+			Reason:      string(resp.reason),
+			Header:      make(http.Header),
+		}
+		// Read response headers to expose them in the error. All bytes read
+		// from br are kept in head to pass them to OnStatusError along with
+		// the rest of response.
+		var head bytes.Buffer
+		head.Write(sl)
+		head.WriteString(crlf)
+		max := nonZero(d.MaxHeaderBytes, DefaultClientMaxHeaderBytes)
+		size := head.Len()
+		for {
+			begin := head.Len()
+			bts, e := br.ReadSlice('\n')
+			head.Write(bts)
+			for e == bufio.ErrBufferFull && (max < 0 || head.Len()-size <= max) {
+				bts, e = br.ReadSlice('\n')
+				head.Write(bts)
+			}
+			if e != nil || (max >= 0 && head.Len()-size > max) {
+				// Malformed, truncated or too large headers. Stop parsing
+				// and leave the rest of response as is.
+				break
+			}
+			line := head.Bytes()[begin : head.Len()-1]
+			if n := len(line); n > 0 && line[n-1] == '\r' {
+				line = line[:n-1]
+			}
+			if len(line) == 0 {
+				break
+			}
+			if k, v, ok := httpParseHeaderLine(line); ok {
+				respErr.Header.Add(string(k), string(v))
+			}
+		}
+		err = respErr
 		if onStatusError := d.OnStatusError; onStatusError != nil {
-			// Invoke callback with multireader of status-line bytes br.
+			// Invoke callback with multireader of status-line, headers and
+			// br bytes.
 			onStatusError(resp.status, resp.reason,
-				io.MultiReader(
-					bytes.NewReader(sl),
-					strings.NewReader(crlf),
-					br,
-				),
+				io.MultiReader(&head, br),
 			)
 		}
 		return br, hs, err
@@ -390,8 +807,8 @@ func (d Dialer) Upgrade(conn io.ReadWriter, u *url.URL) (br *bufio.Reader, hs Ha
 
 		case headerSecAcceptCanonical:
 			headerSeen |= headerSeenSecAccept
-			if !checkAcceptFromNonce(v, nonce) {
-				err = ErrHandshakeBadSecAccept
+			if !checkAcceptFromNonceFunc(v, nonce, d.AcceptKeyFunc) {
+				err = newSecAcceptError(v, nonce, d.AcceptKeyFunc)
 				return br, hs, err
 			}
 
@@ -400,18 +817,13 @@ func (d Dialer) Upgrade(conn io.ReadWriter, u *url.URL) (br *bufio.Reader, hs Ha
 			//   "The server selects one or none of the acceptable protocols
 			//   and echoes that value in its handshake to indicate that it has
 			//   selected that protocol."
-			for _, want := range d.Protocols {
-				if string(v) == want {
-					hs.Protocol = want
-					break
-				}
-			}
-			if hs.Protocol == "" {
+			if !d.protocolMatch(d.Protocols, v) {
 				// Server echoed subprotocol that is not present in client
 				// requested protocols.
 				err = ErrHandshakeBadSubProtocol
 				return br, hs, err
 			}
+			hs.Protocol, hs.protocolIndex = selectedProtocol(d.Protocols, v)
 
 		case headerSecExtensionsCanonical:
 			hs.Extensions, err = matchSelectedExtensions(v, d.Extensions, hs.Extensions)
@@ -440,6 +852,10 @@ func (d Dialer) Upgrade(conn io.ReadWriter, u *url.URL) (br *bufio.Reader, hs Ha
 			panic("unknown headers state")
 		}
 	}
+	if err == nil {
+		hs.Compressed = hasExtension(hs.Extensions, extensionDeflate)
+		hs.Unmasked = d.DisableMasking
+	}
 	return br, hs, err
 }
 
@@ -451,6 +867,88 @@ func PutReader(br *bufio.Reader) {
 	pbufio.PutReader(br)
 }
 
+func (d Dialer) getReader(r io.Reader) *bufio.Reader {
+	size := nonZero(d.ReadBufferSize, DefaultClientReadBufferSize)
+	if p := d.BufferPool; p != nil {
+		return p.GetReader(r, size)
+	}
+	return pbufio.GetReader(r, size)
+}
+
+func (d Dialer) putReader(br *bufio.Reader) {
+	if p := d.BufferPool; p != nil {
+		p.PutReader(br)
+		return
+	}
+	pbufio.PutReader(br)
+}
+
+func (d Dialer) getWriter(w io.Writer) *bufio.Writer {
+	size := nonZero(d.WriteBufferSize, DefaultClientWriteBufferSize)
+	if p := d.BufferPool; p != nil {
+		return p.GetWriter(w, size)
+	}
+	return pbufio.GetWriter(w, size)
+}
+
+func (d Dialer) putWriter(bw *bufio.Writer) {
+	if p := d.BufferPool; p != nil {
+		p.PutWriter(bw)
+		return
+	}
+	pbufio.PutWriter(bw)
+}
+
+// fieldsHeader returns HandshakeHeader which writes headers defined by Dialer
+// fields, unless they are provided by d.Header.
+func (d Dialer) fieldsHeader() HandshakeHeader {
+	var buf bytes.Buffer
+	for _, v := range [...]struct{ key, value string }{
+		{headerOrigin, d.Origin},
+		{headerUserAgent, d.UserAgent},
+	} {
+		if v.value == "" {
+			continue
+		}
+		if d.Header != nil && HandshakeHeaderGet(d.Header, v.key) != "" {
+			continue
+		}
+		buf.WriteString(v.key + colonAndSpace + v.value + crlf)
+	}
+	return HandshakeHeaderBytes(buf.Bytes())
+}
+
+func (d Dialer) protocolMatch(offered []string, echoed []byte) bool {
+	if d.ProtocolMatch != nil {
+		return d.ProtocolMatch(offered, string(echoed))
+	}
+	for _, p := range offered {
+		if string(echoed) == p {
+			return true
+		}
+	}
+	return false
+}
+
+// selectedProtocol returns offered protocol which corresponds to echoed one
+// and its index plus one. Exact match is preferred over case-insensitive one.
+// If there is no such protocol, echoed value and zero index are returned.
+func selectedProtocol(offered []string, echoed []byte) (string, int) {
+	i := -1
+	for j, p := range offered {
+		if string(echoed) == p {
+			return p, j + 1
+		}
+		if i == -1 && strings.EqualFold(p, string(echoed)) {
+			i = j
+		}
+	}
+	if i == -1 {
+		return string(echoed), 0
+	}
+	return offered[i], i + 1
+}
+
 // StatusError contains an unexpected status-line code from the server.
 type StatusError int
 
@@ -458,6 +956,82 @@ func (s StatusError) Error() string {
 	return "unexpected HTTP response status: " + strconv.Itoa(int(s))
 }
 
+// ResponseError is returned by Dialer with ResponseError option set when the
+// server responds with status other than 101 Switching Protocols. Along with
+// the status code it contains reason phrase and headers of the response,
+// e.g. to log them or to decide whether to retry on 429 or 503 statuses.
+//
+// It unwraps to StatusError, so errors.Is(err, StatusError(503)) reports
+// true for ResponseError with 503 status code.
+type ResponseError struct {
+	StatusError
+	Reason string
+	Header http.Header
+}
+
+// Code returns status code of the response.
+func (e *ResponseError) Code() int {
+	return int(e.StatusError)
+}
+
+// Error implements error interface.
+func (e *ResponseError) Error() string {
+	return e.StatusError.Error() + " " + e.Reason
+}
+
+// Unwrap returns StatusError of the response.
+func (e *ResponseError) Unwrap() error {
+	return e.StatusError
+}
+
+// IsRetryable reports whether dialing which failed with err could succeed
+// if retried later. It is intended to be used by clients implementing
+// reconnection policy.
+//
+// Retryable errors are:
+//   - StatusError with 408, 425, 429, 500, 502, 503 or 504 status code;
+//   - timeout errors, including DNS lookup timeouts and expired contexts;
+//   - temporary DNS errors and failures to establish connection (e.g.
+//     connection refused or network unreachable);
+//   - connection closed by server in the middle of handshake.
+//
+// All other errors, such as StatusError with 401 or 403 status code or
+// malformed handshake response, are considered permanent. It returns false
+// for nil error and for context.Canceled.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var status StatusError
+	if errors.As(err, &status) {
+		switch status {
+		case
+			http.StatusRequestTimeout,
+			http.StatusTooEarly,
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var dns *net.DNSError
+	if errors.As(err, &dns) {
+		return dns.Timeout() || dns.Temporary()
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	var op *net.OpError
+	if errors.As(err, &op) && op.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
 func isTimeoutError(err error) bool {
 	t, ok := err.(net.Error)
 	return ok && t.Timeout()
@@ -4,14 +4,21 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -107,6 +114,46 @@ func TestDialerRequest(t *testing.T) {
 	}
 }
 
+func TestDialerOnWroteRequest(t *testing.T) {
+	u, err := url.ParseRequestURI("ws://example.org/chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		buf   bytes.Buffer
+		req   []byte
+		calls int
+	)
+	conn := struct {
+		io.Reader
+		io.Writer
+	}{io.LimitReader(&buf, 0), &buf}
+
+	d := Dialer{
+		Protocols: []string{"foo"},
+		OnWroteRequest: func(p []byte) {
+			calls++
+			req = append(req, p...)
+		},
+	}
+	if _, _, err = d.Upgrade(&conn, u); err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("unexpected number of OnWroteRequest calls: %d; want 1", calls)
+	}
+	if act, exp := req, buf.Bytes(); !bytes.Equal(act, exp) {
+		t.Errorf("unexpected request bytes:\nact:\n%s\nexp:\n%s\n", act, exp)
+	}
+	r, err := http.ReadRequest(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("read request error: %s", err)
+	}
+	if r.Header.Get(headerSecKey) == "" {
+		t.Errorf("no nonce in request")
+	}
+}
+
 func makeAccept(nonce []byte) []byte {
 	accept := make([]byte, acceptSize)
 	initAcceptFromNonce(accept, nonce)
@@ -137,7 +184,7 @@ func BenchmarkCheckNonce(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_ = checkAcceptFromNonce(nonce, accept)
+		_ = checkAcceptFromNonce(accept, nonce)
 	}
 }
 
@@ -146,6 +193,7 @@ func TestDialerHandshake(t *testing.T) {
 		acceptNo = iota
 		acceptInvalid
 		acceptValid
+		acceptBadGUID
 	)
 	for _, test := range []struct {
 		name       string
@@ -155,6 +203,7 @@ func TestDialerHandshake(t *testing.T) {
 		accept     int
 		err        error
 		wantBuffer bool
+		compressed bool
 	}{
 		{
 			res: &http.Response{
@@ -447,6 +496,58 @@ func TestDialerHandshake(t *testing.T) {
 			accept: acceptValid,
 			err:    ErrHandshakeBadExtensions,
 		},
+		{
+			name: "bad guid",
+			res: &http.Response{
+				StatusCode: http.StatusSwitchingProtocols,
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header: http.Header{
+					headerConnection: []string{"Upgrade"},
+					headerUpgrade:    []string{"websocket"},
+				},
+			},
+			accept: acceptBadGUID,
+			err:    ErrHandshakeBadSecAccept,
+		},
+		{
+			name: "compressed",
+			dialer: Dialer{
+				Extensions: []httphead.Option{
+					httphead.NewOption("permessage-deflate", nil),
+				},
+			},
+			res: &http.Response{
+				StatusCode: http.StatusSwitchingProtocols,
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header: http.Header{
+					headerConnection:    []string{"Upgrade"},
+					headerUpgrade:       []string{"websocket"},
+					headerSecExtensions: []string{"permessage-deflate"},
+				},
+			},
+			accept:     acceptValid,
+			compressed: true,
+		},
+		{
+			name: "compression declined",
+			dialer: Dialer{
+				Extensions: []httphead.Option{
+					httphead.NewOption("permessage-deflate", nil),
+				},
+			},
+			res: &http.Response{
+				StatusCode: http.StatusSwitchingProtocols,
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header: http.Header{
+					headerConnection: []string{"Upgrade"},
+					headerUpgrade:    []string{"websocket"},
+				},
+			},
+			accept: acceptValid,
+		},
 	} {
 		t.Run(test.name, func(t *testing.T) {
 			client, server := net.Pipe()
@@ -470,6 +571,10 @@ func TestDialerHandshake(t *testing.T) {
 					nonce := req.Header.Get(headerSecKey)
 					accept := makeAccept(strToBytes(nonce))
 					test.res.Header.Set(headerSecAccept, string(accept))
+				case acceptBadGUID:
+					nonce := req.Header.Get(headerSecKey)
+					accept := ComputeAcceptKeyWith(nonce, "258EAFA5-E914-47DA-95CA-000000000000")
+					test.res.Header.Set(headerSecAccept, accept)
 				}
 
 				test.res.Request = req
@@ -518,10 +623,13 @@ func TestDialerHandshake(t *testing.T) {
 				}
 			}
 
-			_, br, _, err := test.dialer.Dial(context.Background(), "ws://gobwas.com")
-			if test.err != err {
+			_, br, hs, err := test.dialer.Dial(context.Background(), "ws://gobwas.com")
+			if test.err != err && !errors.Is(err, test.err) {
 				t.Fatalf("unexpected error: %v;\n\twant %v", err, test.err)
 			}
+			if hs.Compressed != test.compressed {
+				t.Errorf("unexpected compressed flag: %t; want %t", hs.Compressed, test.compressed)
+			}
 
 			if (test.wantBuffer || len(test.frames) > 0) && br == nil {
 				t.Fatalf("Dial() returned empty bufio.Reader")
@@ -551,217 +659,1054 @@ func TestDialerHandshake(t *testing.T) {
 	}
 }
 
-// Used to emulate net.Error behavior, which is usually returned when
-// connection deadline exceeds.
-type errTimeout struct {
-	error
-}
+func TestDialerSecAcceptError(t *testing.T) {
+	// Emulate a proxy which rewrites the Sec-WebSocket-Key header.
+	const rewritten = "dGhlIHNhbXBsZSBub25jZQ=="
 
-func (errTimeout) Timeout() bool   { return true }
-func (errTimeout) Temporary() bool { return false }
+	client, server := net.Pipe()
+	defer client.Close()
 
-func TestDialerCancelation(t *testing.T) {
-	ioErrDeadline := errTimeout{
-		fmt.Errorf("stub: i/o timeout"),
+	nonces := make(chan string, 1)
+	go func() {
+		defer server.Close()
+		req, err := http.ReadRequest(bufio.NewReader(server))
+		if err != nil {
+			return
+		}
+		nonces <- req.Header.Get(headerSecKey)
+		res := &http.Response{
+			StatusCode: http.StatusSwitchingProtocols,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header: http.Header{
+				headerConnection: []string{"Upgrade"},
+				headerUpgrade:    []string{"websocket"},
+				headerSecAccept:  []string{string(makeAccept([]byte(rewritten)))},
+			},
+		}
+		server.Write(dumpResponse(res))
+	}()
+
+	d := Dialer{
+		NetDial: func(context.Context, string, string) (net.Conn, error) {
+			return client, nil
+		},
+	}
+	_, _, _, err := d.Dial(context.Background(), "ws://example.org")
+	if !errors.Is(err, ErrHandshakeBadSecAccept) {
+		t.Fatalf("unexpected error: %v; want %v", err, ErrHandshakeBadSecAccept)
+	}
+	var (
+		nonce    = <-nonces
+		expected = string(makeAccept([]byte(nonce)))
+		received = string(makeAccept([]byte(rewritten)))
+	)
+	msg := err.Error()
+	if !strings.Contains(msg, expected) {
+		t.Errorf("error message %q does not contain expected accept %q", msg, expected)
+	}
+	if !strings.Contains(msg, received) {
+		t.Errorf("error message %q does not contain received accept %q", msg, received)
+	}
+	var acceptErr *SecAcceptError
+	if !errors.As(err, &acceptErr) {
+		t.Fatalf("error is not a *SecAcceptError: %T", err)
+	}
+	if acceptErr.Expected != expected || acceptErr.Received != received {
+		t.Errorf("unexpected error fields: %+v", acceptErr)
 	}
+}
 
-	for _, test := range []struct {
-		name           string
-		dialer         Dialer
-		dialDelay      time.Duration
-		ctxTimeout     time.Duration
-		ctxCancelAfter time.Duration
-		err            error
-	}{
+func TestHandshakeExtensionParams(t *testing.T) {
+	deflate := httphead.NewOption("permessage-deflate", map[string]string{
+		"server_no_context_takeover": "",
+		"client_max_window_bits":     "10",
+	})
+	unknown := httphead.NewOption("x-unknown", map[string]string{
+		"foo": "bar",
+	})
+	exp := []ExtensionParam{
 		{
-			ctxTimeout: time.Millisecond * 100,
-			err:        context.DeadlineExceeded,
+			Name: "permessage-deflate",
+			Params: map[string]string{
+				"server_no_context_takeover": "",
+				"client_max_window_bits":     "10",
+			},
 		},
 		{
-			ctxCancelAfter: time.Millisecond * 100,
-			err:            context.Canceled,
+			Name:   "x-unknown",
+			Params: map[string]string{"foo": "bar"},
 		},
-		{
-			dialer: Dialer{
-				Timeout: time.Millisecond * 100,
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	type result struct {
+		hs  Handshake
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer server.Close()
+		u := Upgrader{
+			Negotiate: func(opt httphead.Option) (httphead.Option, error) {
+				return opt.Clone(), nil
 			},
-			ctxTimeout: time.Millisecond * 150,
-			err:        context.DeadlineExceeded,
-		},
-		{
-			ctxTimeout: time.Millisecond * 100,
-			dialDelay:  time.Millisecond * 200,
-			err:        context.DeadlineExceeded,
+		}
+		hs, err := u.Upgrade(server)
+		done <- result{hs, err}
+	}()
+
+	d := Dialer{
+		Extensions: []httphead.Option{deflate, unknown},
+		NetDial: func(context.Context, string, string) (net.Conn, error) {
+			return client, nil
 		},
+	}
+	_, _, hs, err := d.Dial(context.Background(), "ws://example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	for _, test := range []struct {
+		name string
+		hs   Handshake
+	}{
+		{"dialer", hs},
+		{"upgrader", res.hs},
+	} {
+		if act := test.hs.ExtensionParams(); !reflect.DeepEqual(act, exp) {
+			t.Errorf("unexpected %s extension params:\nact: %+v\nexp: %+v", test.name, act, exp)
+		}
+	}
+	if act := (Handshake{}).ExtensionParams(); act != nil {
+		t.Errorf("unexpected extension params of empty handshake: %+v", act)
+	}
+}
+
+func TestHandshakeSelectedProtocolIndex(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		protocol string
+		index    int
+		err      error
+	}{
+		{name: "first", protocol: "xml", index: 0},
+		{name: "last", protocol: "soap", index: 2},
+		{name: "none", index: -1},
 		{
-			ctxCancelAfter: time.Millisecond * 100,
-			dialDelay:      time.Millisecond * 200,
-			err:            context.Canceled,
+			name:     "unexpected",
+			protocol: "yaml",
+			index:    -1,
+			err:      ErrHandshakeBadSubProtocol,
 		},
 	} {
 		t.Run(test.name, func(t *testing.T) {
-			var timer *time.Timer
-			deadline := make(chan error, 10)
-			conn := &stubConn{
-				setDeadline: func(t time.Time) error {
-					if timer != nil {
-						timer.Stop()
-					}
-					if t.IsZero() {
-						return nil
-					}
-					d := time.Until(t)
-					if d < 0 {
-						deadline <- ioErrDeadline
-					} else {
-						timer = time.AfterFunc(d, func() {
-							deadline <- ioErrDeadline
-						})
-					}
-
-					return nil
-				},
-				read: func(p []byte) (int, error) {
-					if err := <-deadline; err != nil {
-						return 0, err
-					}
-					return len(p), nil
-				},
-				write: func(p []byte) (int, error) {
-					if err := <-deadline; err != nil {
-						return 0, err
-					}
-					return len(p), nil
-				},
-			}
-
-			test.dialer.NetDial = func(ctx context.Context, _, _ string) (net.Conn, error) {
-				if t := test.dialDelay; t != 0 {
-					delay := time.After(t)
-					select {
-					case <-delay:
-					case <-ctx.Done():
-						return nil, ctx.Err()
-					}
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer server.Close()
+				req, err := http.ReadRequest(bufio.NewReader(server))
+				if err != nil {
+					return
 				}
-				return conn, nil
-			}
+				accept := makeAccept(strToBytes(req.Header.Get(headerSecKey)))
+				res := &http.Response{
+					StatusCode: http.StatusSwitchingProtocols,
+					ProtoMajor: 1,
+					ProtoMinor: 1,
+					Header: http.Header{
+						headerConnection: []string{"Upgrade"},
+						headerUpgrade:    []string{"websocket"},
+						headerSecAccept:  []string{string(accept)},
+					},
+				}
+				if test.protocol != "" {
+					res.Header.Set(headerSecProtocol, test.protocol)
+				}
+				server.Write(dumpResponse(res))
+			}()
 
-			ctx := context.Background()
-			if t := test.ctxTimeout; t != 0 {
-				var cancel context.CancelFunc
-				ctx, cancel = context.WithTimeout(ctx, t)
-				defer cancel()
+			u, err := url.ParseRequestURI("ws://example.org")
+			if err != nil {
+				t.Fatal(err)
 			}
-			if t := test.ctxCancelAfter; t != 0 {
-				var cancel context.CancelFunc
-				ctx, cancel = context.WithCancel(ctx)
-				time.AfterFunc(t, cancel)
+			d := Dialer{
+				Protocols: []string{"xml", "json", "soap"},
 			}
-
-			_, _, _, err := test.dialer.Dial(ctx, "ws://gobwas.com")
+			_, hs, err := d.Upgrade(client, u)
 			if err != test.err {
-				t.Fatalf("unexpected error: %q; want %q", err, test.err)
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			if act, exp := hs.SelectedProtocolIndex(), test.index; act != exp {
+				t.Errorf("unexpected selected protocol index: %d; want %d", act, exp)
 			}
 		})
 	}
+	if act := (Handshake{}).SelectedProtocolIndex(); act != -1 {
+		t.Errorf("unexpected selected protocol index of empty handshake: %d", act)
+	}
 }
 
-func BenchmarkDialer(b *testing.B) {
-	for _, test := range []struct {
-		dialer Dialer
-	}{
-		{
-			dialer: DefaultDialer,
-		},
-	} {
-		// We need to "mock" the rand.Read method used to generate nonce random
-		// bytes for Sec-WebSocket-Key header.
-		rand.Seed(0)
-		need := b.N * nonceKeySize
-		nonceBytes := make([]byte, need)
-		n, err := rand.Read(nonceBytes)
+func TestDialerBufferedFrames(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var (
+		first  = NewTextFrame([]byte("hello"))
+		second = NewTextFrame([]byte("world"))
+		done   = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
 		if err != nil {
-			b.Fatal(err)
+			t.Error(err)
+			return
 		}
-		if n != need {
-			b.Fatalf("not enough random nonce bytes: %d; want %d", n, need)
-		}
-		rand.Seed(0)
+		defer conn.Close()
 
-		resp := &http.Response{
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accept := makeAccept(strToBytes(req.Header.Get(headerSecKey)))
+		res := &http.Response{
 			StatusCode: http.StatusSwitchingProtocols,
 			ProtoMajor: 1,
 			ProtoMinor: 1,
 			Header: http.Header{
 				headerConnection: []string{"Upgrade"},
 				headerUpgrade:    []string{"websocket"},
-				headerSecAccept:  []string{"fill it later"},
+				headerSecAccept:  []string{string(accept)},
 			},
 		}
-		rs := make([][]byte, b.N)
-		for i := range rs {
-			nonce := make([]byte, nonceSize)
-			base64.StdEncoding.Encode(
-				nonce,
-				nonceBytes[i*nonceKeySize:i*nonceKeySize+nonceKeySize],
-			)
-			accept := makeAccept(nonce)
-			resp.Header[headerSecAccept] = []string{string(accept)}
-			rs[i] = dumpResponse(resp)
+		// Send response and the first frame within single packet.
+		buf := bytes.NewBuffer(dumpResponse(res))
+		if err := WriteFrame(buf, first); err != nil {
+			t.Error(err)
+			return
 		}
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := WriteFrame(conn, second); err != nil {
+			t.Error(err)
+		}
+	}()
 
-		var i int
-		conn := stubConn{
-			read: func(p []byte) (int, error) {
-				bts := rs[i]
-				if len(p) < len(bts) {
-					b.Fatalf("short buffer")
-				}
-				return copy(p, bts), io.EOF
-			},
-			write: func(p []byte) (int, error) {
-				return len(p), nil
-			},
+	conn, br, _, err := Dial(context.Background(), "ws://"+ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if br == nil {
+		t.Fatalf("Dial() returned empty bufio.Reader")
+	}
+	defer PutReader(br)
+
+	for i, exp := range []Frame{first, second} {
+		act, err := ReadFrame(br)
+		if err != nil {
+			t.Fatalf("can not read %d-th frame: %v", i, err)
 		}
-		var nc net.Conn = conn
-		test.dialer.NetDial = func(_ context.Context, net, addr string) (net.Conn, error) {
-			return nc, nil
+		if !bytes.Equal(act.Payload, exp.Payload) {
+			t.Fatalf(
+				"unexpected %d-th frame payload: %q; want %q",
+				i, act.Payload, exp.Payload,
+			)
 		}
+	}
+	<-done
+}
 
-		b.ResetTimer()
-		for i = 0; i < b.N; i++ {
-			_, _, _, err := test.dialer.Dial(context.Background(), "ws://example.org")
+func TestDialerNetDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
 			if err != nil {
-				b.Fatal(err)
+				return
 			}
+			// Close connection to make handshake fail fast.
+			conn.Close()
 		}
-	}
-}
+	}()
 
-func TestHostPort(t *testing.T) {
 	for _, test := range []struct {
-		name string
-		host string
-		port string
-
-		expHostname string
-		expHostport string
+		name    string
+		netDial bool
+		control bool
 	}{
 		{
-			host:        "foo",
-			port:        ":80",
-			expHostname: "foo",
-			expHostport: "foo:80",
+			name:    "net dialer",
+			control: true,
 		},
 		{
-			host:        "foo:1234",
-			port:        ":80",
-			expHostname: "foo",
-			expHostport: "foo:1234",
+			name:    "net dial precedence",
+			netDial: true,
+			control: false,
 		},
-		{
-			name:        "ipv4",
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				control bool
+				netDial bool
+			)
+			d := Dialer{
+				NetDialer: &net.Dialer{
+					LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+					Control: func(network, address string, c syscall.RawConn) error {
+						control = true
+						return nil
+					},
+				},
+			}
+			if test.netDial {
+				d.NetDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+					netDial = true
+					var nd net.Dialer
+					return nd.DialContext(ctx, network, addr)
+				}
+			}
+			_, _, _, err := d.Dial(context.Background(), "ws://"+ln.Addr().String())
+			if err == nil {
+				t.Fatalf("expected handshake error")
+			}
+			if act, exp := control, test.control; act != exp {
+				t.Errorf("unexpected NetDialer.Control call: %t; want %t", act, exp)
+			}
+			if act, exp := netDial, test.netDial; act != exp {
+				t.Errorf("unexpected NetDial call: %t; want %t", act, exp)
+			}
+		})
+	}
+}
+
+func TestDialerResponseError(t *testing.T) {
+	resp := "" +
+		"HTTP/1.1 503 Service Unavailable\r\n" +
+		"Retry-After: 120\r\n" +
+		"Content-Length: 4\r\n" +
+		"\r\n" +
+		"busy"
+	var out bytes.Buffer
+	conn := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader(resp), &out}
+
+	var (
+		status int
+		reason []byte
+		body   []byte
+	)
+	d := Dialer{
+		ResponseError: true,
+		OnStatusError: func(s int, r []byte, resp io.Reader) {
+			status, reason = s, r
+			res, err := http.ReadResponse(bufio.NewReader(resp), nil)
+			if err != nil {
+				t.Errorf("read response inside OnStatusError error: %v", err)
+				return
+			}
+			body, _ = ioutil.ReadAll(res.Body)
+		},
+	}
+	_, _, err := d.Upgrade(conn, &url.URL{Host: "example.org", Path: "/ws"})
+
+	var re *ResponseError
+	if !errors.As(err, &re) {
+		t.Fatalf("unexpected error: %v; want *ResponseError", err)
+	}
+	if re.Code() != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status code: %d; want %d", re.Code(), http.StatusServiceUnavailable)
+	}
+	if re.Reason != "Service Unavailable" {
+		t.Errorf("unexpected reason: %q", re.Reason)
+	}
+	if v := re.Header.Get("Retry-After"); v != "120" {
+		t.Errorf("unexpected Retry-After header: %q", v)
+	}
+	if !errors.Is(err, StatusError(http.StatusServiceUnavailable)) {
+		t.Errorf("error does not match StatusError with the same code")
+	}
+	if errors.Is(err, StatusError(http.StatusTooManyRequests)) {
+		t.Errorf("error matches StatusError with different code")
+	}
+	if status != re.Code() || string(reason) != re.Reason {
+		t.Errorf("unexpected OnStatusError arguments: %d %q", status, reason)
+	}
+	if string(body) != "busy" {
+		t.Errorf("unexpected response body in OnStatusError: %q", body)
+	}
+}
+
+func TestDialerResponseErrorMaxHeaderBytes(t *testing.T) {
+	const headers = 1000
+
+	var resp bytes.Buffer
+	resp.WriteString("HTTP/1.1 400 Bad Request\r\n")
+	for i := 0; i < headers; i++ {
+		fmt.Fprintf(&resp, "X-Header-%d: value\r\n", i)
+	}
+	// Header line which is longer than read buffer.
+	fmt.Fprintf(&resp, "X-Long: %s\r\n", bytes.Repeat([]byte("x"), 2*DefaultClientReadBufferSize))
+	resp.WriteString("Content-Length: 4\r\n")
+	resp.WriteString("\r\n")
+	resp.WriteString("body")
+
+	for _, test := range []struct {
+		name  string
+		max   int
+		limit bool
+	}{
+		{
+			name: "default",
+		},
+		{
+			name: "no limit",
+			max:  -1,
+		},
+		{
+			name:  "limit",
+			max:   1024,
+			limit: true,
+		},
+		{
+			name:  "limit in long line",
+			max:   headers*20 + DefaultClientReadBufferSize,
+			limit: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn := struct {
+				io.Reader
+				io.Writer
+			}{bytes.NewReader(resp.Bytes()), ioutil.Discard}
+
+			var (
+				raw  []byte
+				body []byte
+			)
+			d := Dialer{
+				ResponseError:  true,
+				MaxHeaderBytes: test.max,
+				OnStatusError: func(_ int, _ []byte, r io.Reader) {
+					// Response must be passed to the callback untouched.
+					raw, _ = ioutil.ReadAll(r)
+					res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+					if err != nil {
+						t.Errorf("read response inside OnStatusError error: %v", err)
+						return
+					}
+					body, _ = ioutil.ReadAll(res.Body)
+				},
+			}
+			_, _, err := d.Upgrade(conn, &url.URL{Host: "example.org", Path: "/ws"})
+
+			var re *ResponseError
+			if !errors.As(err, &re) {
+				t.Fatalf("unexpected error: %v; want *ResponseError", err)
+			}
+			if re.Code() != http.StatusBadRequest {
+				t.Errorf("unexpected status code: %d", re.Code())
+			}
+			if !bytes.Equal(raw, resp.Bytes()) {
+				t.Errorf("response passed to OnStatusError differs from sent one")
+			}
+			if string(body) != "body" {
+				t.Errorf("unexpected response body in OnStatusError: %q", body)
+			}
+			if re.Header.Get("X-Header-0") != "value" {
+				t.Errorf("first header is missing")
+			}
+			n := len(re.Header)
+			if test.limit {
+				if re.Header.Get("Content-Length") != "" {
+					t.Errorf("unexpected header read after the limit")
+				}
+				if test.max < headers*19 && (n == 0 || n > test.max/19) {
+					// Each header line takes at least 19 bytes.
+					t.Errorf("unexpected number of headers: %d", n)
+				}
+				return
+			}
+			if exp := headers + 2; n != exp {
+				t.Errorf("unexpected number of headers: %d; want %d", n, exp)
+			}
+		})
+	}
+}
+
+func TestDialerBadProtocolToken(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		protocols []string
+		err       error
+	}{
+		{
+			name:      "valid",
+			protocols: []string{"chat", "v2.chat"},
+			err:       io.EOF,
+		},
+		{
+			name:      "space",
+			protocols: []string{"chat", "my proto"},
+			err:       ErrHandshakeBadProtocolToken,
+		},
+		{
+			name:      "comma",
+			protocols: []string{"chat,superchat"},
+			err:       ErrHandshakeBadProtocolToken,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			conn := struct {
+				io.Reader
+				io.Writer
+			}{strings.NewReader(""), &out}
+
+			d := Dialer{
+				Protocols: test.protocols,
+			}
+			_, _, err := d.Upgrade(conn, &url.URL{Host: "example.org", Path: "/ws"})
+			if err != test.err {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			if test.err == ErrHandshakeBadProtocolToken && out.Len() != 0 {
+				t.Errorf("unexpected request written: %q", out.Bytes())
+			}
+		})
+	}
+}
+
+func TestDialerNetwork(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// Close connection to make handshake fail fast.
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	for _, test := range []struct {
+		name    string
+		network string
+		exp     string
+		err     bool
+	}{
+		{
+			name: "default",
+			exp:  "tcp4",
+		},
+		{
+			name:    "tcp4",
+			network: "tcp4",
+			exp:     "tcp4",
+		},
+		{
+			name:    "invalid",
+			network: "udp",
+			err:     true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				network string
+				address string
+			)
+			d := Dialer{
+				Network: test.network,
+				NetDialer: &net.Dialer{
+					Control: func(n, a string, _ syscall.RawConn) error {
+						network, address = n, a
+						return nil
+					},
+				},
+			}
+			// Note that NetDialer.Control receives network of the resolved
+			// address, thus "tcp" becomes "tcp4" for IPv4 literal.
+			_, _, _, err := d.Dial(context.Background(), "ws://127.0.0.1:"+port)
+			if err == nil {
+				t.Fatalf("expected error")
+			}
+			if test.err {
+				if network != "" {
+					t.Fatalf("unexpected dial for invalid network")
+				}
+				return
+			}
+			if network != test.exp {
+				t.Errorf("unexpected network: %q; want %q", network, test.exp)
+			}
+			host, _, _ := net.SplitHostPort(address)
+			if ip := net.ParseIP(host); ip == nil || ip.To4() == nil {
+				t.Errorf("unexpected non IPv4 address: %q", address)
+			}
+		})
+	}
+
+	t.Run("localhost", func(t *testing.T) {
+		var addrs []string
+		d := Dialer{
+			Network: "tcp4",
+			NetDialer: &net.Dialer{
+				Control: func(n, a string, _ syscall.RawConn) error {
+					if n != "tcp4" {
+						t.Errorf("unexpected network: %q", n)
+					}
+					addrs = append(addrs, a)
+					return nil
+				},
+			},
+		}
+		_, _, _, _ = d.Dial(context.Background(), "ws://localhost:"+port)
+		for _, a := range addrs {
+			host, _, _ := net.SplitHostPort(a)
+			if ip := net.ParseIP(host); ip == nil || ip.To4() == nil {
+				t.Errorf("dialed non IPv4 address: %q", a)
+			}
+		}
+	})
+}
+
+// Used to emulate net.Error behavior, which is usually returned when
+// connection deadline exceeds.
+type errTimeout struct {
+	error
+}
+
+func (errTimeout) Timeout() bool   { return true }
+func (errTimeout) Temporary() bool { return false }
+
+func TestDialerCancelation(t *testing.T) {
+	ioErrDeadline := errTimeout{
+		fmt.Errorf("stub: i/o timeout"),
+	}
+
+	for _, test := range []struct {
+		name           string
+		dialer         Dialer
+		dialDelay      time.Duration
+		ctxTimeout     time.Duration
+		ctxCancelAfter time.Duration
+		err            error
+	}{
+		{
+			ctxTimeout: time.Millisecond * 100,
+			err:        context.DeadlineExceeded,
+		},
+		{
+			ctxCancelAfter: time.Millisecond * 100,
+			err:            context.Canceled,
+		},
+		{
+			dialer: Dialer{
+				Timeout: time.Millisecond * 100,
+			},
+			ctxTimeout: time.Millisecond * 150,
+			err:        context.DeadlineExceeded,
+		},
+		{
+			ctxTimeout: time.Millisecond * 100,
+			dialDelay:  time.Millisecond * 200,
+			err:        context.DeadlineExceeded,
+		},
+		{
+			ctxCancelAfter: time.Millisecond * 100,
+			dialDelay:      time.Millisecond * 200,
+			err:            context.Canceled,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var timer *time.Timer
+			deadline := make(chan error, 10)
+			conn := &stubConn{
+				setDeadline: func(t time.Time) error {
+					if timer != nil {
+						timer.Stop()
+					}
+					if t.IsZero() {
+						return nil
+					}
+					d := time.Until(t)
+					if d < 0 {
+						deadline <- ioErrDeadline
+					} else {
+						timer = time.AfterFunc(d, func() {
+							deadline <- ioErrDeadline
+						})
+					}
+
+					return nil
+				},
+				read: func(p []byte) (int, error) {
+					if err := <-deadline; err != nil {
+						return 0, err
+					}
+					return len(p), nil
+				},
+				write: func(p []byte) (int, error) {
+					if err := <-deadline; err != nil {
+						return 0, err
+					}
+					return len(p), nil
+				},
+			}
+
+			test.dialer.NetDial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				if t := test.dialDelay; t != 0 {
+					delay := time.After(t)
+					select {
+					case <-delay:
+					case <-ctx.Done():
+						return nil, ctx.Err()
+					}
+				}
+				return conn, nil
+			}
+
+			ctx := context.Background()
+			if t := test.ctxTimeout; t != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, t)
+				defer cancel()
+			}
+			if t := test.ctxCancelAfter; t != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				time.AfterFunc(t, cancel)
+			}
+
+			_, _, _, err := test.dialer.Dial(ctx, "ws://gobwas.com")
+			if err != test.err {
+				t.Fatalf("unexpected error: %q; want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func BenchmarkDialer(b *testing.B) {
+	for _, test := range []struct {
+		name   string
+		dialer Dialer
+	}{
+		{
+			name:   "default",
+			dialer: DefaultDialer,
+		},
+		{
+			name: "large buffers",
+			dialer: Dialer{
+				ReadBufferSize:  64 << 10,
+				WriteBufferSize: 64 << 10,
+			},
+		},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			// We need to "mock" the rand.Read method used to generate nonce random
+			// bytes for Sec-WebSocket-Key header.
+			rand.Seed(0)
+			need := b.N * nonceKeySize
+			nonceBytes := make([]byte, need)
+			n, err := rand.Read(nonceBytes)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if n != need {
+				b.Fatalf("not enough random nonce bytes: %d; want %d", n, need)
+			}
+			rand.Seed(0)
+
+			resp := &http.Response{
+				StatusCode: http.StatusSwitchingProtocols,
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header: http.Header{
+					headerConnection: []string{"Upgrade"},
+					headerUpgrade:    []string{"websocket"},
+					headerSecAccept:  []string{"fill it later"},
+				},
+			}
+			rs := make([][]byte, b.N)
+			for i := range rs {
+				nonce := make([]byte, nonceSize)
+				base64.StdEncoding.Encode(
+					nonce,
+					nonceBytes[i*nonceKeySize:i*nonceKeySize+nonceKeySize],
+				)
+				accept := makeAccept(nonce)
+				resp.Header[headerSecAccept] = []string{string(accept)}
+				rs[i] = dumpResponse(resp)
+			}
+
+			var i int
+			conn := stubConn{
+				read: func(p []byte) (int, error) {
+					bts := rs[i]
+					if len(p) < len(bts) {
+						b.Fatalf("short buffer")
+					}
+					return copy(p, bts), io.EOF
+				},
+				write: func(p []byte) (int, error) {
+					return len(p), nil
+				},
+			}
+			var nc net.Conn = conn
+			test.dialer.NetDial = func(_ context.Context, net, addr string) (net.Conn, error) {
+				return nc, nil
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i = 0; i < b.N; i++ {
+				_, _, _, err := test.dialer.Dial(context.Background(), "ws://example.org")
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// stubBufferPool is a BufferPool implementation which holds at most one
+// reader and one writer and counts calls to its methods.
+type stubBufferPool struct {
+	br *bufio.Reader
+	bw *bufio.Writer
+
+	getReader, putReader int
+	getWriter, putWriter int
+}
+
+func (p *stubBufferPool) GetReader(r io.Reader, size int) *bufio.Reader {
+	p.getReader++
+	if br := p.br; br != nil && br.Size() >= size {
+		p.br = nil
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, size)
+}
+
+func (p *stubBufferPool) PutReader(br *bufio.Reader) {
+	p.putReader++
+	br.Reset(nil)
+	p.br = br
+}
+
+func (p *stubBufferPool) GetWriter(w io.Writer, size int) *bufio.Writer {
+	p.getWriter++
+	if bw := p.bw; bw != nil && bw.Size() >= size {
+		p.bw = nil
+		bw.Reset(w)
+		return bw
+	}
+	return bufio.NewWriterSize(w, size)
+}
+
+func (p *stubBufferPool) PutWriter(bw *bufio.Writer) {
+	p.putWriter++
+	bw.Reset(nil)
+	p.bw = bw
+}
+
+func TestDialerBufferPool(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		extra []byte
+	}{
+		{
+			name: "handshake only",
+		},
+		{
+			name:  "buffered frame",
+			extra: MustCompileFrame(NewTextFrame([]byte("hello"))),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				// Send response and frame (if any) within single write to
+				// make frame buffered by the client during handshake.
+				bw := bufio.NewWriter(server)
+				rw := struct {
+					io.Reader
+					io.Writer
+				}{server, bw}
+				if _, err := Upgrade(rw); err != nil {
+					t.Errorf("Upgrade() error: %v", err)
+					return
+				}
+				bw.Write(test.extra)
+				if err := bw.Flush(); err != nil {
+					t.Errorf("Flush() error: %v", err)
+				}
+			}()
+
+			pool := new(stubBufferPool)
+			d := Dialer{
+				BufferPool: pool,
+			}
+			br, _, err := d.Upgrade(client, &url.URL{
+				Scheme: "ws",
+				Host:   "example.org",
+				Path:   "/",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pool.getReader != 1 || pool.getWriter != 1 {
+				t.Errorf(
+					"unexpected Get() calls: %d readers and %d writers; want 1 and 1",
+					pool.getReader, pool.getWriter,
+				)
+			}
+			if pool.putWriter != 1 {
+				t.Errorf("unexpected PutWriter() calls: %d; want 1", pool.putWriter)
+			}
+			exp := 1
+			if test.extra != nil {
+				exp = 0
+				if br == nil {
+					t.Fatalf("expected non-nil buffered reader")
+				}
+				f, err := ReadFrame(br)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(f.Payload) != "hello" {
+					t.Errorf("unexpected payload: %q", f.Payload)
+				}
+			}
+			if pool.putReader != exp {
+				t.Errorf("unexpected PutReader() calls: %d; want %d", pool.putReader, exp)
+			}
+		})
+	}
+}
+
+func BenchmarkDialerBufferPool(b *testing.B) {
+	// NOTE: each benchmark iteration makes 1000 dials.
+	const dials = 1000
+
+	rand.Seed(0)
+	nonceBytes := make([]byte, dials*nonceKeySize)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		b.Fatal(err)
+	}
+	resp := &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			headerConnection: []string{"Upgrade"},
+			headerUpgrade:    []string{"websocket"},
+		},
+	}
+	rs := make([][]byte, dials)
+	for i := range rs {
+		nonce := make([]byte, nonceSize)
+		base64.StdEncoding.Encode(
+			nonce,
+			nonceBytes[i*nonceKeySize:i*nonceKeySize+nonceKeySize],
+		)
+		resp.Header[headerSecAccept] = []string{string(makeAccept(nonce))}
+		rs[i] = dumpResponse(resp)
+	}
+
+	for _, test := range []struct {
+		name string
+		pool BufferPool
+	}{
+		{
+			name: "inner pool",
+		},
+		{
+			name: "buffer pool",
+			pool: new(stubBufferPool),
+		},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			var j int
+			var nc net.Conn = stubConn{
+				read: func(p []byte) (int, error) {
+					return copy(p, rs[j]), io.EOF
+				},
+				write: func(p []byte) (int, error) {
+					return len(p), nil
+				},
+			}
+			d := Dialer{
+				BufferPool: test.pool,
+				NetDial: func(context.Context, string, string) (net.Conn, error) {
+					return nc, nil
+				},
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rand.Seed(0)
+				for j = 0; j < dials; j++ {
+					_, _, _, err := d.Dial(context.Background(), "ws://example.org")
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestHostPort(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		host string
+		port string
+
+		expHostname string
+		expHostport string
+	}{
+		{
+			host:        "foo",
+			port:        ":80",
+			expHostname: "foo",
+			expHostport: "foo:80",
+		},
+		{
+			host:        "foo:1234",
+			port:        ":80",
+			expHostname: "foo",
+			expHostport: "foo:1234",
+		},
+		{
+			name:        "ipv4",
 			host:        "127.0.0.1",
 			port:        ":80",
 			expHostname: "127.0.0.1",
@@ -807,6 +1752,216 @@ func TestHostPort(t *testing.T) {
 	}
 }
 
+func TestConnectionState(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer srv.Close()
+
+	config := srv.Client().Transport.(*http.Transport).TLSClientConfig
+	for _, test := range []struct {
+		name   string
+		dialer Dialer
+	}{
+		{
+			name: "tls",
+			dialer: Dialer{
+				TLSConfig: config,
+			},
+		},
+		{
+			name: "wrapped",
+			dialer: Dialer{
+				TLSConfig: config,
+				WrapConn: func(conn net.Conn) net.Conn {
+					return wrappedConn{conn}
+				},
+			},
+		},
+		{
+			name: "custom client",
+			dialer: Dialer{
+				TLSClient: func(conn net.Conn, hostname string) net.Conn {
+					c := tlsCloneConfig(config)
+					c.ServerName = hostname
+					return wrappedConn{tls.Client(conn, c)}
+				},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, _, hs, err := test.dialer.Dial(context.Background(), "wss"+srv.URL[len("https"):])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			state, ok := ConnectionState(conn)
+			if !ok {
+				t.Fatalf("no connection state found")
+			}
+			if !state.HandshakeComplete {
+				t.Fatalf("tls handshake is not complete")
+			}
+			if hs.TLS == nil {
+				t.Fatalf("no tls connection state in handshake")
+			}
+			if len(hs.TLS.PeerCertificates) == 0 {
+				t.Fatalf("no peer certificates in handshake tls state")
+			}
+			if !hs.TLS.PeerCertificates[0].Equal(srv.Certificate()) {
+				t.Errorf("unexpected peer certificate")
+			}
+		})
+	}
+
+	plain := httptest.NewServer(srv.Config.Handler)
+	defer plain.Close()
+	conn, _, hs, err := Dial(context.Background(), "ws"+plain.URL[len("http"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if hs.TLS != nil {
+		t.Errorf("unexpected tls connection state for plain connection")
+	}
+
+	if _, ok := ConnectionState(stubConn{}); ok {
+		t.Errorf("unexpected connection state of non-tls connection")
+	}
+	if _, ok := ConnectionState(wrappedConn{stubConn{}}); ok {
+		t.Errorf("unexpected connection state of wrapped non-tls connection")
+	}
+}
+
+func TestDialerOnConn(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	t.Run("ws", func(t *testing.T) {
+		var seen net.Conn
+		d := Dialer{
+			OnConn: func(conn net.Conn) error {
+				seen = conn
+				tcp, ok := conn.(*net.TCPConn)
+				if !ok {
+					t.Errorf("unexpected conn type: %T; want *net.TCPConn", conn)
+					return nil
+				}
+				return tcp.SetNoDelay(true)
+			},
+		}
+		conn, _, _, err := d.Dial(context.Background(), "ws"+plain.URL[len("http"):])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if seen != conn {
+			t.Errorf("OnConn received different conn than returned by Dial()")
+		}
+	})
+	t.Run("wss", func(t *testing.T) {
+		d := Dialer{
+			TLSConfig: secure.Client().Transport.(*http.Transport).TLSClientConfig,
+			OnConn: func(conn net.Conn) error {
+				tc, ok := conn.(*tls.Conn)
+				if !ok {
+					t.Errorf("unexpected conn type: %T; want *tls.Conn", conn)
+					return nil
+				}
+				if tc.ConnectionState().HandshakeComplete {
+					t.Errorf("unexpected complete tls handshake before request write")
+				}
+				return nil
+			},
+		}
+		conn, _, _, err := d.Dial(context.Background(), "wss"+secure.URL[len("https"):])
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	})
+	t.Run("error", func(t *testing.T) {
+		errOnConn := fmt.Errorf("stop")
+		d := Dialer{
+			OnConn: func(net.Conn) error {
+				return errOnConn
+			},
+			OnWroteRequest: func([]byte) {
+				t.Errorf("unexpected request write")
+			},
+		}
+		_, _, _, err := d.Dial(context.Background(), "ws"+plain.URL[len("http"):])
+		if err != errOnConn {
+			t.Errorf("unexpected error: %v; want %v", err, errOnConn)
+		}
+	})
+}
+
+func TestDialerClientCert(t *testing.T) {
+	peers := make(chan int, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peers <- len(r.TLS.PeerCertificates)
+		conn, _, _, err := UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var host string
+	d := Dialer{
+		TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig,
+		ClientCert: func(h string) (*tls.Certificate, error) {
+			host = h
+			// Present server's certificate since server does not verify it.
+			return &srv.TLS.Certificates[0], nil
+		},
+	}
+	conn, _, _, err := d.Dial(context.Background(), "wss://"+u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if exp := u.Hostname(); host != exp {
+		t.Errorf("unexpected host passed to ClientCert: %q; want %q", host, exp)
+	}
+	if n := <-peers; n != 1 {
+		t.Errorf("unexpected number of client certificates presented: %d; want 1", n)
+	}
+	if d.TLSConfig.GetClientCertificate != nil {
+		t.Errorf("TLSConfig was modified")
+	}
+}
+
+type wrappedConn struct {
+	net.Conn
+}
+
+func (w wrappedConn) NetConn() net.Conn { return w.Conn }
+
 type stubConn struct {
 	read             func([]byte) (int, error)
 	write            func([]byte) (int, error)
@@ -847,3 +2002,273 @@ func (s stubConn) SetWriteDeadline(t time.Time) error {
 	}
 	return nil
 }
+
+func TestDialerProtocolMatch(t *testing.T) {
+	caseInsensitive := func(offered []string, echoed string) bool {
+		for _, p := range offered {
+			if strings.EqualFold(p, echoed) {
+				return true
+			}
+		}
+		return false
+	}
+	versioned := func(offered []string, echoed string) bool {
+		for _, p := range offered {
+			if strings.HasPrefix(echoed, p+".") {
+				return true
+			}
+		}
+		return false
+	}
+	protocols := []string{"xml", "json", "JSON"}
+	for _, test := range []struct {
+		name     string
+		match    func([]string, string) bool
+		echoed   string
+		protocol string
+		index    int
+		err      error
+	}{
+		{name: "exact", echoed: "json", protocol: "json", index: 1},
+		{name: "exact case mismatch", echoed: "Json", index: -1, err: ErrHandshakeBadSubProtocol},
+		{name: "custom", match: caseInsensitive, echoed: "Json", protocol: "json", index: 1},
+		{name: "custom exact", match: caseInsensitive, echoed: "JSON", protocol: "JSON", index: 2},
+		{name: "custom mismatch", match: caseInsensitive, echoed: "yaml", index: -1, err: ErrHandshakeBadSubProtocol},
+		{name: "custom not offered", match: versioned, echoed: "json.v2", protocol: "json.v2", index: -1},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer server.Close()
+				req, err := http.ReadRequest(bufio.NewReader(server))
+				if err != nil {
+					return
+				}
+				accept := makeAccept(strToBytes(req.Header.Get(headerSecKey)))
+				res := &http.Response{
+					StatusCode: http.StatusSwitchingProtocols,
+					ProtoMajor: 1,
+					ProtoMinor: 1,
+					Header: http.Header{
+						headerConnection:  []string{"Upgrade"},
+						headerUpgrade:     []string{"websocket"},
+						headerSecAccept:   []string{string(accept)},
+						headerSecProtocol: []string{test.echoed},
+					},
+				}
+				server.Write(dumpResponse(res))
+			}()
+
+			u, err := url.ParseRequestURI("ws://example.org")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var calls int
+			d := Dialer{
+				Protocols: protocols,
+			}
+			if test.match != nil {
+				d.ProtocolMatch = func(offered []string, echoed string) bool {
+					calls++
+					if !reflect.DeepEqual(offered, protocols) {
+						t.Errorf("unexpected offered protocols: %v; want %v", offered, protocols)
+					}
+					return test.match(offered, echoed)
+				}
+			}
+			_, hs, err := d.Upgrade(client, u)
+			if err != test.err {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			if hs.Protocol != test.protocol {
+				t.Errorf("unexpected protocol: %q; want %q", hs.Protocol, test.protocol)
+			}
+			if act := hs.SelectedProtocolIndex(); act != test.index {
+				t.Errorf("unexpected protocol index: %d; want %d", act, test.index)
+			}
+			if test.match != nil && calls != 1 {
+				t.Errorf("unexpected number of ProtocolMatch calls: %d; want 1", calls)
+			}
+		})
+	}
+}
+
+func TestDialerOriginUserAgent(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		origin    string
+		userAgent string
+		header    HandshakeHeader
+		expOrigin []string
+		expAgent  []string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:      "fields",
+			origin:    "https://example.org",
+			userAgent: "test/1.0",
+			expOrigin: []string{"https://example.org"},
+			expAgent:  []string{"test/1.0"},
+		},
+		{
+			name:      "header http",
+			origin:    "https://example.org",
+			userAgent: "test/1.0",
+			header: HandshakeHeaderHTTP(http.Header{
+				"Origin": []string{"https://other.org"},
+			}),
+			expOrigin: []string{"https://other.org"},
+			expAgent:  []string{"test/1.0"},
+		},
+		{
+			name:      "header string",
+			origin:    "https://example.org",
+			header:    HandshakeHeaderString("origin: https://other.org\r\n"),
+			expOrigin: []string{"https://other.org"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			reqs := make(chan *http.Request, 1)
+			go func() {
+				defer server.Close()
+				req, err := http.ReadRequest(bufio.NewReader(server))
+				if err != nil {
+					close(reqs)
+					return
+				}
+				reqs <- req
+			}()
+			d := Dialer{
+				Origin:    test.origin,
+				UserAgent: test.userAgent,
+				Header:    test.header,
+			}
+			u, err := url.ParseRequestURI("ws://example.org")
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.Upgrade(client, u)
+
+			req, ok := <-reqs
+			if !ok {
+				t.Fatalf("can not read request")
+			}
+			if act := req.Header["Origin"]; !reflect.DeepEqual(act, test.expOrigin) {
+				t.Errorf("unexpected Origin headers: %q; want %q", act, test.expOrigin)
+			}
+			if act := req.Header["User-Agent"]; !reflect.DeepEqual(act, test.expAgent) {
+				t.Errorf("unexpected User-Agent headers: %q; want %q", act, test.expAgent)
+			}
+		})
+	}
+}
+
+func TestDialerMalformedOrigin(t *testing.T) {
+	d := Dialer{
+		Origin: "https://example.org\r\nX-Injected: 1",
+	}
+	u, err := url.ParseRequestURI("ws://example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer server.Close()
+	if _, _, err := d.Upgrade(client, u); err == nil {
+		t.Errorf("expected error for malformed Origin value")
+	}
+}
+
+func TestDialerAcceptKeyFunc(t *testing.T) {
+	custom := func(nonce string) string {
+		sum := sha256.Sum256([]byte(nonce + "custom-binding"))
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	for _, test := range []struct {
+		name   string
+		client func(string) string
+		server func(string) string
+		err    error
+	}{
+		{name: "default"},
+		{name: "custom", client: custom, server: custom},
+		{name: "custom server", server: custom, err: ErrHandshakeBadSecAccept},
+		{name: "custom client", client: custom, err: ErrHandshakeBadSecAccept},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer server.Close()
+				u := Upgrader{
+					AcceptKeyFunc: test.server,
+				}
+				u.Upgrade(server)
+			}()
+			d := Dialer{
+				AcceptKeyFunc: test.client,
+			}
+			u, err := url.ParseRequestURI("ws://example.org")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = d.Upgrade(client, u)
+			if !errors.Is(err, test.err) {
+				t.Errorf("unexpected error: %v; want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	_, _, _, refused := Dialer{}.Dial(context.Background(), "ws://"+addr)
+	if refused == nil {
+		t.Fatalf("expected dial error")
+	}
+
+	for _, test := range []struct {
+		name string
+		err  error
+		exp  bool
+	}{
+		{"nil", nil, false},
+		{"service unavailable", StatusError(503), true},
+		{"too many requests", StatusError(429), true},
+		{"wrapped status", fmt.Errorf("dial: %w", StatusError(502)), true},
+		{"response error", &ResponseError{StatusError: 503}, true},
+		{"unauthorized", StatusError(401), false},
+		{"forbidden", StatusError(403), false},
+		{"not found", StatusError(404), false},
+		{"connection refused", refused, true},
+		{"dial error", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{"read error", &net.OpError{Op: "read", Err: syscall.ECONNRESET}, false},
+		{"dns timeout", &net.DNSError{IsTimeout: true}, true},
+		{"dns temporary", &net.DNSError{IsTemporary: true}, true},
+		{"dns not found", &net.DNSError{IsNotFound: true}, false},
+		{"deadline exceeded", context.DeadlineExceeded, true},
+		{"canceled", context.Canceled, false},
+		{"unexpected eof", io.ErrUnexpectedEOF, true},
+		{"bad sec accept", &SecAcceptError{}, false},
+		{"bad subprotocol", ErrHandshakeBadSubProtocol, false},
+		{"bad upgrade", ErrHandshakeBadUpgrade, false},
+		{"other", errors.New("some error"), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if act := IsRetryable(test.err); act != test.exp {
+				t.Errorf("IsRetryable(%v) = %t; want %t", test.err, act, test.exp)
+			}
+		})
+	}
+}
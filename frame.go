@@ -248,6 +248,28 @@ func NewFrame(op OpCode, fin bool, p []byte) Frame {
 	}
 }
 
+// HeaderForPayload creates frame header with given operation code, flag of
+// completeness and payload length. If masked is true, header is marked as
+// masked with random mask (see NewMask()) and it is caller's responsibility
+// to cipher the payload with h.Mask before writing it.
+//
+// It is intended to be used along with WriteHeaderN() when payload is written
+// separately, e.g. spliced directly from a file for zero-copy transfer. Since
+// payload of client frames must be masked and thus could not be sent
+// untouched, such usage is only suitable for unmasked server frames.
+func HeaderForPayload(op OpCode, fin bool, masked bool, length int64) Header {
+	h := Header{
+		Fin:    fin,
+		OpCode: op,
+		Length: length,
+	}
+	if masked {
+		h.Masked = true
+		h.Mask = NewMask()
+	}
+	return h
+}
+
 // NewTextFrame creates text frame with p as payload.
 // Note that p is not copied.
 func NewTextFrame(p []byte) Frame {
@@ -260,6 +282,30 @@ func NewBinaryFrame(p []byte) Frame {
 	return NewFrame(OpBinary, true, p)
 }
 
+// NewFragmentFrame creates first frame of fragmented message with given
+// operation code and payload.
+// Note that p is not copied.
+//
+// Fragmented message must be sent in order as follows: the first frame has
+// data operation code (e.g. OpText or OpBinary) and fin flag set to false;
+// then zero or more frames created by NewContinuationFrame() with fin set to
+// false; then the last frame created by NewContinuationFrame() with fin set to
+// true. If fin is true, then message consists of single frame.
+//
+// See https://tools.ietf.org/html/rfc6455#section-5.4
+func NewFragmentFrame(op OpCode, fin bool, p []byte) Frame {
+	return NewFrame(op, fin, p)
+}
+
+// NewContinuationFrame creates continuation frame of fragmented message with
+// p as payload. The last frame of the message must have fin set to true.
+// Note that p is not copied.
+//
+// See NewFragmentFrame() for the frames order.
+func NewContinuationFrame(fin bool, p []byte) Frame {
+	return NewFrame(OpContinuation, fin, p)
+}
+
 // NewPingFrame creates ping frame with p as payload.
 // Note that p is not copied.
 // Note that p must have length of MaxControlFramePayloadSize bytes or less due
@@ -384,6 +430,10 @@ func NewMask() (ret [4]byte) {
 // CompileFrame returns byte representation of given frame.
 // In terms of memory consumption it is useful to precompile static frames
 // which are often used.
+//
+// Note that CompileFrame does not validate given frame. That is, it will
+// compile, for example, control frame with too long payload. Use
+// CompileFrameStrict() to get an error instead.
 func CompileFrame(f Frame) (bts []byte, err error) {
 	buf := bytes.NewBuffer(make([]byte, 0, 16))
 	err = WriteFrame(buf, f)
@@ -391,6 +441,23 @@ func CompileFrame(f Frame) (bts []byte, err error) {
 	return bts, err
 }
 
+// CompileFrameStrict is like CompileFrame but checks given frame to be valid
+// first. It returns ErrProtocolOpCodeReserved if frame has reserved operation
+// code and ErrProtocolControlPayloadOverflow or ErrProtocolControlFragmented
+// if control frame has too long payload or FIN bit unset respectively.
+func CompileFrameStrict(f Frame) (bts []byte, err error) {
+	h := f.Header
+	switch {
+	case h.OpCode.IsReserved():
+		return nil, ErrProtocolOpCodeReserved
+	case h.OpCode.IsControl() && h.Length > MaxControlFramePayloadSize:
+		return nil, ErrProtocolControlPayloadOverflow
+	case h.OpCode.IsControl() && !h.Fin:
+		return nil, ErrProtocolControlFragmented
+	}
+	return CompileFrame(f)
+}
+
 // MustCompileFrame is like CompileFrame but panics if frame can not be
 // encoded.
 func MustCompileFrame(f Frame) []byte {
@@ -418,3 +485,44 @@ var (
 	closeFrameInternalServerError     = makeCloseFrame(StatusInternalServerError)
 	closeFrameTLSHandshake            = makeCloseFrame(StatusTLSHandshake)
 )
+
+// PrecompiledFrame holds byte representation of an unmasked (server side)
+// frame. It is useful for broadcasting the same frame to many connections:
+// frame is compiled once and then written with WritePrecompiled() to each
+// of them.
+//
+// Zero value is an empty frame which writes nothing.
+type PrecompiledFrame struct {
+	bts []byte
+}
+
+// NewPrecompiledFrame compiles given frame into PrecompiledFrame. It returns
+// ErrProtocolMaskUnexpected if frame is masked, since masked frames are sent
+// by clients only and each of them must have its own mask. It also returns
+// errors from CompileFrameStrict().
+func NewPrecompiledFrame(f Frame) (PrecompiledFrame, error) {
+	if f.Header.Masked {
+		return PrecompiledFrame{}, ErrProtocolMaskUnexpected
+	}
+	bts, err := CompileFrameStrict(f)
+	if err != nil {
+		return PrecompiledFrame{}, err
+	}
+	return PrecompiledFrame{bts}, nil
+}
+
+// MustPrecompileFrame is like NewPrecompiledFrame but panics if frame can not
+// be compiled.
+func MustPrecompileFrame(f Frame) PrecompiledFrame {
+	pf, err := NewPrecompiledFrame(f)
+	if err != nil {
+		panic(err)
+	}
+	return pf
+}
+
+// Bytes returns byte representation of the frame. Returned slice is shared
+// and must not be modified.
+func (pf PrecompiledFrame) Bytes() []byte {
+	return pf.bts
+}
@@ -1,6 +1,7 @@
 package ws
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 )
@@ -24,3 +25,140 @@ func TestOpCodeIsControl(t *testing.T) {
 		})
 	}
 }
+
+func TestOpCodePredicates(t *testing.T) {
+	for _, test := range []struct {
+		code     OpCode
+		control  bool
+		data     bool
+		reserved bool
+	}{
+		{OpContinuation, false, true, false},
+		{OpText, false, true, false},
+		{OpBinary, false, true, false},
+		{0x3, false, true, true},
+		{0x4, false, true, true},
+		{0x5, false, true, true},
+		{0x6, false, true, true},
+		{0x7, false, true, true},
+		{OpClose, true, false, false},
+		{OpPing, true, false, false},
+		{OpPong, true, false, false},
+		{0xb, true, false, true},
+		{0xc, true, false, true},
+		{0xd, true, false, true},
+		{0xe, true, false, true},
+		{0xf, true, false, true},
+	} {
+		t.Run(fmt.Sprintf("0x%02x", test.code), func(t *testing.T) {
+			if act := test.code.IsControl(); act != test.control {
+				t.Errorf("IsControl = %v; want %v", act, test.control)
+			}
+			if act := test.code.IsData(); act != test.data {
+				t.Errorf("IsData = %v; want %v", act, test.data)
+			}
+			if act := test.code.IsReserved(); act != test.reserved {
+				t.Errorf("IsReserved = %v; want %v", act, test.reserved)
+			}
+		})
+	}
+}
+
+func TestFragmentFrames(t *testing.T) {
+	var buf bytes.Buffer
+	for _, f := range []Frame{
+		NewFragmentFrame(OpText, false, []byte("Hello")),
+		NewContinuationFrame(false, []byte(", ")),
+		NewContinuationFrame(true, []byte("World!")),
+	} {
+		if err := WriteFrame(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		op  OpCode
+		msg []byte
+	)
+	for i := 0; ; i++ {
+		f, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := StateClientSide
+		if i > 0 {
+			s = s.Set(StateFragmented)
+		}
+		if err := CheckHeader(f.Header, s); err != nil {
+			t.Fatalf("unexpected #%d frame header error: %v", i, err)
+		}
+		if i == 0 {
+			op = f.Header.OpCode
+		}
+		msg = append(msg, f.Payload...)
+		if f.Header.Fin {
+			if n := i + 1; n != 3 {
+				t.Fatalf("unexpected number of frames: %d; want 3", n)
+			}
+			break
+		}
+	}
+	if op != OpText {
+		t.Errorf("unexpected message opcode: %v; want %v", op, OpText)
+	}
+	if act, exp := string(msg), "Hello, World!"; act != exp {
+		t.Errorf("unexpected message: %q; want %q", act, exp)
+	}
+}
+
+func TestCompileFrameStrict(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		frame Frame
+		err   error
+	}{
+		{
+			name:  "text",
+			frame: NewTextFrame(bytes.Repeat([]byte{'x'}, 200)),
+		},
+		{
+			name:  "ping",
+			frame: NewPingFrame(bytes.Repeat([]byte{'x'}, MaxControlFramePayloadSize)),
+		},
+		{
+			name:  "continuation",
+			frame: NewContinuationFrame(false, []byte("part")),
+		},
+		{
+			name:  "control overflow",
+			frame: NewPingFrame(bytes.Repeat([]byte{'x'}, 200)),
+			err:   ErrProtocolControlPayloadOverflow,
+		},
+		{
+			name:  "control fragmented",
+			frame: NewFrame(OpPong, false, nil),
+			err:   ErrProtocolControlFragmented,
+		},
+		{
+			name:  "reserved opcode",
+			frame: NewFrame(OpCode(0x3), true, nil),
+			err:   ErrProtocolOpCodeReserved,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bts, err := CompileFrameStrict(test.frame)
+			if err != test.err {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			if err != nil {
+				if bts != nil {
+					t.Errorf("unexpected bytes on error")
+				}
+				return
+			}
+			if exp := MustCompileFrame(test.frame); !bytes.Equal(bts, exp) {
+				t.Errorf("unexpected bytes:\nact: %#x\nexp: %#x", bts, exp)
+			}
+		})
+	}
+}
@@ -3,10 +3,13 @@ package ws
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/gobwas/httphead"
 )
@@ -35,6 +38,9 @@ var (
 	textTailErrHandshakeBadSecKey     = errorText(ErrHandshakeBadSecKey)
 	textTailErrHandshakeBadSecVersion = errorText(ErrHandshakeBadSecVersion)
 	textTailErrUpgradeRequired        = errorText(ErrHandshakeUpgradeRequired)
+	textTailErrProtocolRequired       = errorText(ErrHandshakeProtocolRequired)
+	textTailErrHeaderTooLarge         = errorText(ErrHandshakeHeaderTooLarge)
+	textTailErrBadProtocolToken       = errorText(ErrHandshakeBadProtocolToken)
 )
 
 const (
@@ -47,6 +53,9 @@ const (
 	headerSecExtensions = "Sec-WebSocket-Extensions"
 	headerSecKey        = "Sec-WebSocket-Key"
 	headerSecAccept     = "Sec-WebSocket-Accept"
+	headerForwardedFor  = "X-Forwarded-For"
+	headerOrigin        = "Origin"
+	headerUserAgent     = "User-Agent"
 
 	headerHostCanonical          = headerHost
 	headerUpgradeCanonical       = headerUpgrade
@@ -56,6 +65,9 @@ const (
 	headerSecExtensionsCanonical = "Sec-Websocket-Extensions"
 	headerSecKeyCanonical        = "Sec-Websocket-Key"
 	headerSecAcceptCanonical     = "Sec-Websocket-Accept"
+	headerForwardedForCanonical  = headerForwardedFor
+	headerOriginCanonical        = headerOrigin
+	headerUserAgentCanonical     = headerUserAgent
 )
 
 var (
@@ -65,6 +77,10 @@ var (
 	specHeaderValueSecVersion      = []byte("13")
 )
 
+// extensionDeflate is the name of compression extension defined by RFC7692.
+// Note that it is duplicated here to not import wsflate package.
+const extensionDeflate = "permessage-deflate"
+
 var (
 	httpVersion1_0    = []byte("HTTP/1.0")
 	httpVersion1_1    = []byte("HTTP/1.1")
@@ -214,6 +230,73 @@ func btsSelectProtocol(h []byte, check func([]byte) bool) (ret string, ok bool)
 	return ret, ok
 }
 
+// btsSelectProtocolQ is like btsSelectProtocol but selects the acceptable
+// subprotocol with the highest "q" parameter value. Returned q is the weight
+// of selected subprotocol in thousandths.
+func btsSelectProtocolQ(h []byte, check func([]byte) bool) (ret string, q int, ok bool) {
+	var (
+		index    = -1
+		name     []byte
+		weight   int
+		valid    = true
+		selected []byte
+	)
+	choose := func() {
+		if name != nil && weight > q && check(name) {
+			selected, q = name, weight
+		}
+	}
+	ok = httphead.ScanOptions(h, func(i int, option, attribute, value []byte) httphead.Control {
+		if i != index {
+			choose()
+			index, name, weight = i, option, 1000
+		}
+		if len(attribute) == 1 && (attribute[0] == 'q' || attribute[0] == 'Q') {
+			if weight, valid = parseQValue(value); !valid {
+				return httphead.ControlBreak
+			}
+		}
+		return httphead.ControlContinue
+	})
+	if !ok || !valid {
+		return "", 0, false
+	}
+	choose()
+	if selected != nil {
+		ret = string(selected)
+	}
+	return ret, q, true
+}
+
+// parseQValue parses weight as defined by RFC7231 section 5.3.1 and returns
+// it in thousandths:
+//
+//	qvalue = ( "0" [ "." 0*3DIGIT ] ) / ( "1" [ "." 0*3("0") ] )
+func parseQValue(v []byte) (q int, ok bool) {
+	if len(v) == 0 || len(v) > 5 || (v[0] != '0' && v[0] != '1') {
+		return 0, false
+	}
+	q = int(v[0]-'0') * 1000
+	if len(v) == 1 {
+		return q, true
+	}
+	if v[1] != '.' {
+		return 0, false
+	}
+	m := 100
+	for _, c := range v[2:] {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		q += int(c-'0') * m
+		m /= 10
+	}
+	if q > 1000 {
+		return 0, false
+	}
+	return q, true
+}
+
 func btsSelectExtensions(h []byte, selected []httphead.Option, check func(httphead.Option) bool) ([]httphead.Option, bool) {
 	s := httphead.OptionSelector{
 		Flags: httphead.SelectCopy,
@@ -222,6 +305,15 @@ func btsSelectExtensions(h []byte, selected []httphead.Option, check func(httphe
 	return s.Select(h, selected)
 }
 
+func hasExtension(opts []httphead.Option, name string) bool {
+	for _, opt := range opts {
+		if btsToString(opt.Name) == name {
+			return true
+		}
+	}
+	return false
+}
+
 func negotiateMaybe(in httphead.Option, dest []httphead.Option, f func(httphead.Option) (httphead.Option, error)) ([]httphead.Option, error) {
 	if in.Size() == 0 {
 		return dest, nil
@@ -327,11 +419,17 @@ func httpWriteUpgradeRequest(
 	bw.WriteString(crlf)
 }
 
-func httpWriteResponseUpgrade(bw *bufio.Writer, nonce []byte, hs Handshake, header HandshakeHeaderFunc) {
+// httpWriteResponseUpgrade writes upgrade response. If accept is empty, the
+// Sec-WebSocket-Accept value is computed from nonce as defined by RFC6455.
+func httpWriteResponseUpgrade(bw *bufio.Writer, nonce []byte, hs Handshake, header HandshakeHeaderFunc, accept string) {
 	bw.WriteString(textHeadUpgrade)
 
 	httpWriteHeaderKey(bw, headerSecAccept)
-	writeAccept(bw, nonce)
+	if accept != "" {
+		bw.WriteString(accept)
+	} else {
+		writeAccept(bw, nonce)
+	}
 	bw.WriteString(crlf)
 
 	if hs.Protocol != "" {
@@ -385,6 +483,12 @@ func httpWriteResponseError(bw *bufio.Writer, err error, code int, header Handsh
 		bw.WriteString(textTailErrHandshakeBadSecVersion)
 	case ErrHandshakeUpgradeRequired:
 		bw.WriteString(textTailErrUpgradeRequired)
+	case ErrHandshakeProtocolRequired:
+		bw.WriteString(textTailErrProtocolRequired)
+	case ErrHandshakeHeaderTooLarge:
+		bw.WriteString(textTailErrHeaderTooLarge)
+	case ErrHandshakeBadProtocolToken:
+		bw.WriteString(textTailErrBadProtocolToken)
 	case nil:
 		bw.WriteString(crlf)
 	default:
@@ -485,6 +589,181 @@ func (h HandshakeHeaderHTTP) WriteTo(w io.Writer) (int64, error) {
 	return wr.n, err
 }
 
+// HandshakeHeaderMulti returns HandshakeHeader that writes each of given
+// headers in order. It is useful when headers come from different places,
+// like authentication, tracing and application-specific ones.
+//
+// Returned value also has Get(key string) string method, which returns the
+// first value associated with the given key among all of the headers. See
+// HandshakeHeaderGet().
+func HandshakeHeaderMulti(hs ...HandshakeHeader) HandshakeHeader {
+	return handshakeHeaderMulti(hs)
+}
+
+type handshakeHeaderMulti []HandshakeHeader
+
+// WriteTo implements HandshakeHeader (and io.WriterTo) interface.
+func (m handshakeHeaderMulti) WriteTo(w io.Writer) (n int64, err error) {
+	for _, h := range m {
+		if h == nil {
+			continue
+		}
+		var x int64
+		x, err = h.WriteTo(w)
+		n += x
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Get returns the first value associated with the given key among all of
+// the headers.
+func (m handshakeHeaderMulti) Get(key string) string {
+	v, _ := handshakeHeaderLookup(m, key)
+	return v
+}
+
+// Get returns the first value associated with the given key.
+func (h HandshakeHeaderHTTP) Get(key string) string {
+	return http.Header(h).Get(key)
+}
+
+// HandshakeHeaderGet returns the first value associated with the given key in
+// h. If h has Get(key string) string method (as HandshakeHeaderHTTP and
+// HandshakeHeader returned by HandshakeHeaderMulti() have) it is used.
+// Otherwise h is written into a temporary buffer and parsed. Key is case
+// insensitive.
+func HandshakeHeaderGet(h HandshakeHeader, key string) string {
+	v, _ := handshakeHeaderLookup(h, key)
+	return v
+}
+
+func handshakeHeaderLookup(h HandshakeHeader, key string) (string, bool) {
+	switch x := h.(type) {
+	case HandshakeHeaderHTTP:
+		vs, ok := http.Header(x)[textproto.CanonicalMIMEHeaderKey(key)]
+		if !ok || len(vs) == 0 {
+			return "", false
+		}
+		return vs[0], true
+	case handshakeHeaderMulti:
+		for _, h := range x {
+			if h == nil {
+				continue
+			}
+			if v, ok := handshakeHeaderLookup(h, key); ok {
+				return v, true
+			}
+		}
+		return "", false
+	case interface{ Get(string) string }:
+		v := x.Get(key)
+		return v, v != ""
+	}
+	var buf bytes.Buffer
+	if _, err := h.WriteTo(&buf); err != nil {
+		return "", false
+	}
+	for _, line := range bytes.Split(buf.Bytes(), []byte(crlf)) {
+		k, v, ok := httpParseHeaderLine(line)
+		if ok && strings.EqualFold(string(k), key) {
+			return string(v), true
+		}
+	}
+	return "", false
+}
+
+// HeaderResumeToken is the name of the header used by HandshakeHeaderResume()
+// and ResumeToken() to carry an application-defined resumption token.
+const HeaderResumeToken = "X-Websocket-Resume-Token"
+
+// ErrMalformedResumeToken is returned by the HandshakeHeader created with
+// HandshakeHeaderResume() when token contains characters that are not
+// allowed in the header value.
+var ErrMalformedResumeToken = fmt.Errorf("malformed resume token")
+
+// isValidHeaderValue reports whether s could be written as a header value
+// without breaking the request.
+func isValidHeaderValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// HandshakeHeaderResume returns HandshakeHeader that writes given resumption
+// token as HeaderResumeToken header. It is intended to be used as
+// Dialer.Header when client re-establishes connection after, for example,
+// switching networks.
+//
+// Note that this is transport plumbing only: the library does not issue,
+// store or validate tokens; that is up to the application.
+func HandshakeHeaderResume(token string) HandshakeHeader {
+	return HandshakeHeaderFunc(func(w io.Writer) (int64, error) {
+		if !isValidHeaderValue(token) {
+			return 0, ErrMalformedResumeToken
+		}
+		n, err := io.WriteString(w, HeaderResumeToken+colonAndSpace+token+crlf)
+		return int64(n), err
+	})
+}
+
+// ResumeToken returns resumption token if given header key is
+// HeaderResumeToken. It is intended to be used inside Upgrader.OnHeader
+// callback:
+//
+//	u := ws.Upgrader{
+//		OnHeader: func(key, value []byte) error {
+//			if token, ok := ws.ResumeToken(key, value); ok {
+//				// Look up session by token.
+//			}
+//			return nil
+//		},
+//	}
+//
+// For the HTTPUpgrader the token is available as
+// r.Header.Get(ws.HeaderResumeToken).
+func ResumeToken(key, value []byte) (token string, ok bool) {
+	if !strings.EqualFold(string(key), HeaderResumeToken) {
+		return "", false
+	}
+	return string(value), true
+}
+
+// ParseRequestURI parses request URI received by Upgrader.OnRequest callback
+// and returns its unescaped path and query parameters. It is useful for
+// browser clients, which are not able to set custom headers and pass things
+// like auth tokens as query parameters instead:
+//
+//	u := ws.Upgrader{
+//		OnRequest: func(uri []byte) error {
+//			_, query, err := ws.ParseRequestURI(uri)
+//			if err != nil {
+//				return err
+//			}
+//			token := query.Get("token")
+//			// Check token.
+//			return nil
+//		},
+//	}
+//
+// Note that uri could be in absolute form, as RFC7230 allows it.
+func ParseRequestURI(uri []byte) (path string, query url.Values, err error) {
+	u, err := url.ParseRequestURI(string(uri))
+	if err != nil {
+		return "", nil, err
+	}
+	query, err = url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return "", nil, err
+	}
+	return u.Path, query, nil
+}
+
 type writer struct {
 	n int64
 	w io.Writer
@@ -2,9 +2,14 @@ package ws
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"net/textproto"
 	"net/url"
+	"reflect"
 	"testing"
 
 	"github.com/gobwas/httphead"
@@ -70,10 +75,22 @@ func TestHeaderNames(t *testing.T) {
 			have: headerSecKey,
 			want: headerSecKeyCanonical,
 		},
+		{
+			have: headerForwardedFor,
+			want: headerForwardedForCanonical,
+		},
 		{
 			have: headerSecAccept,
 			want: headerSecAcceptCanonical,
 		},
+		{
+			have: headerOrigin,
+			want: headerOriginCanonical,
+		},
+		{
+			have: headerUserAgent,
+			want: headerUserAgentCanonical,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -135,3 +152,180 @@ func makeURL(s string) *url.URL {
 	}
 	return ret
 }
+
+func TestHandshakeHeaderResume(t *testing.T) {
+	const token = "c2Vzc2lvbi0xMjM="
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	tokens := make(chan string, 1)
+	go func() {
+		defer server.Close()
+		u := Upgrader{
+			OnHeader: func(key, value []byte) error {
+				if token, ok := ResumeToken(key, value); ok {
+					tokens <- token
+				}
+				return nil
+			},
+		}
+		u.Upgrade(server)
+	}()
+
+	d := Dialer{
+		Header: HandshakeHeaderResume(token),
+		NetDial: func(context.Context, string, string) (net.Conn, error) {
+			return client, nil
+		},
+	}
+	if _, _, _, err := d.Dial(context.Background(), "ws://example.org"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case act := <-tokens:
+		if act != token {
+			t.Errorf("unexpected token: %q; want %q", act, token)
+		}
+	default:
+		t.Errorf("no resume token received")
+	}
+}
+
+func TestHandshakeHeaderResumeMalformed(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := HandshakeHeaderResume("token\r\nX-Injected: 1").WriteTo(&buf)
+	if err != ErrMalformedResumeToken {
+		t.Errorf("unexpected error: %v; want %v", err, ErrMalformedResumeToken)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("unexpected bytes written: %q", buf.Bytes())
+	}
+}
+
+func TestResumeToken(t *testing.T) {
+	for _, test := range []struct {
+		key   string
+		value string
+		ok    bool
+	}{
+		{HeaderResumeToken, "abc", true},
+		{"x-websocket-resume-token", "abc", true},
+		{"X-Websocket-Resume", "abc", false},
+		{"Cookie", "abc", false},
+	} {
+		token, ok := ResumeToken([]byte(test.key), []byte(test.value))
+		if ok != test.ok {
+			t.Errorf("ResumeToken(%q) ok = %v; want %v", test.key, ok, test.ok)
+		}
+		if ok && token != test.value {
+			t.Errorf("ResumeToken(%q) = %q; want %q", test.key, token, test.value)
+		}
+	}
+}
+
+func TestParseRequestURI(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		uri   string
+		path  string
+		query url.Values
+		err   bool
+	}{
+		{
+			name:  "plain",
+			uri:   "/ws",
+			path:  "/ws",
+			query: url.Values{},
+		},
+		{
+			name: "encoded",
+			uri:  "/chat%20room/ws?token=a%2Bb%3D&room=1&room=2",
+			path: "/chat room/ws",
+			query: url.Values{
+				"token": {"a+b="},
+				"room":  {"1", "2"},
+			},
+		},
+		{
+			name: "absolute",
+			uri:  "ws://example.org/ws?token=xyz",
+			path: "/ws",
+			query: url.Values{
+				"token": {"xyz"},
+			},
+		},
+		{
+			name: "malformed uri",
+			uri:  "ws?token=xyz",
+			err:  true,
+		},
+		{
+			name: "malformed query",
+			uri:  "/ws?token=%zz",
+			err:  true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path, query, err := ParseRequestURI([]byte(test.uri))
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if path != test.path {
+				t.Errorf("unexpected path: %q; want %q", path, test.path)
+			}
+			if !reflect.DeepEqual(query, test.query) {
+				t.Errorf("unexpected query: %v; want %v", query, test.query)
+			}
+		})
+	}
+}
+
+func TestHandshakeHeaderMulti(t *testing.T) {
+	h := HandshakeHeaderMulti(
+		HandshakeHeaderString("Authorization: Bearer token\r\n"),
+		HandshakeHeaderHTTP(http.Header{
+			"X-Trace-Id": []string{"abc"},
+		}),
+		HandshakeHeaderBytes("X-App: app\r\n"),
+	)
+	getter, ok := h.(interface{ Get(string) string })
+	if !ok {
+		t.Fatalf("HandshakeHeaderMulti() result has no Get() method")
+	}
+	for _, test := range []struct {
+		key string
+		exp string
+	}{
+		{"Authorization", "Bearer token"},
+		{"x-trace-id", "abc"},
+		{"X-App", "app"},
+		{"X-Missing", ""},
+	} {
+		if act := getter.Get(test.key); act != test.exp {
+			t.Errorf("Get(%q) = %q; want %q", test.key, act, test.exp)
+		}
+		if act := HandshakeHeaderGet(h, test.key); act != test.exp {
+			t.Errorf("HandshakeHeaderGet(%q) = %q; want %q", test.key, act, test.exp)
+		}
+	}
+
+	var buf bytes.Buffer
+	n, err := h.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(n) != buf.Len() {
+		t.Errorf("WriteTo() returned %d; %d bytes written", n, buf.Len())
+	}
+	exp := "Authorization: Bearer token\r\nX-Trace-Id: abc\r\nX-App: app\r\n"
+	if act := buf.String(); act != exp {
+		t.Errorf("unexpected written headers:\n%q\nwant:\n%q", act, exp)
+	}
+}
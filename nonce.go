@@ -2,8 +2,8 @@ package ws
 
 import (
 	"bufio"
-	"bytes"
 	"crypto/sha1"
+	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
 	"math/rand"
@@ -23,8 +23,42 @@ const (
 	// concatenated value to obtain a 20-byte value and base64- encoding (see
 	// Section 4 of [RFC4648]) this 20-byte hash.
 	acceptSize = 28 // base64.StdEncoding.EncodedLen(sha1.Size)
+
+	// acceptGUID is the globally unique identifier defined by RFC6455 which
+	// is used to compute Sec-WebSocket-Accept header value.
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 )
 
+// ComputeAcceptKeyWith returns Sec-WebSocket-Accept header value computed
+// from given Sec-WebSocket-Key nonce and GUID string.
+//
+// It is intended for interoperability testing against nonstandard servers
+// (for example, to prove that server using wrong GUID is rejected). Library
+// itself always uses the GUID defined by RFC6455.
+func ComputeAcceptKeyWith(nonce, guid string) string {
+	h := sha1.New()
+	h.Write([]byte(nonce))
+	h.Write([]byte(guid))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// computeAcceptKeyFunc returns Sec-WebSocket-Accept header value computed by
+// fn from given Sec-WebSocket-Key nonce. It returns ErrHandshakeBadAcceptKey if
+// computed value is empty or could not be written as a header value (e.g.
+// contains CR or LF).
+func computeAcceptKeyFunc(fn func(string) string, nonce []byte) (string, error) {
+	accept := fn(string(nonce))
+	if accept == "" {
+		return "", ErrHandshakeBadAcceptKey
+	}
+	for i := 0; i < len(accept); i++ {
+		if c := accept[i]; c < ' ' || c == 0x7f {
+			return "", ErrHandshakeBadAcceptKey
+		}
+	}
+	return accept, nil
+}
+
 // initNonce fills given slice with random base64-encoded nonce bytes.
 func initNonce(dst []byte) {
 	// NOTE: bts does not escape.
@@ -36,7 +70,8 @@ func initNonce(dst []byte) {
 }
 
 // checkAcceptFromNonce reports whether given accept bytes are valid for given
-// nonce bytes.
+// nonce bytes. Comparison is made in constant time to not leak the expected
+// value through timing.
 func checkAcceptFromNonce(accept, nonce []byte) bool {
 	if len(accept) != acceptSize {
 		return false
@@ -44,14 +79,21 @@ func checkAcceptFromNonce(accept, nonce []byte) bool {
 	// NOTE: expect does not escape.
 	expect := make([]byte, acceptSize)
 	initAcceptFromNonce(expect, nonce)
-	return bytes.Equal(expect, accept)
+	return subtle.ConstantTimeCompare(expect, accept) == 1
+}
+
+// checkAcceptFromNonceFunc is like checkAcceptFromNonce, but uses given
+// function to compute expected accept value if it is non-nil.
+func checkAcceptFromNonceFunc(accept, nonce []byte, fn func(string) string) bool {
+	if fn == nil {
+		return checkAcceptFromNonce(accept, nonce)
+	}
+	return subtle.ConstantTimeCompare([]byte(fn(string(nonce))), accept) == 1
 }
 
 // initAcceptFromNonce fills given slice with accept bytes generated from given
 // nonce bytes. Given buffer should be exactly acceptSize bytes.
 func initAcceptFromNonce(accept, nonce []byte) {
-	const magic = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
-
 	if len(accept) != acceptSize {
 		panic("accept buffer is invalid")
 	}
@@ -59,9 +101,9 @@ func initAcceptFromNonce(accept, nonce []byte) {
 		panic("nonce is invalid")
 	}
 
-	p := make([]byte, nonceSize+len(magic))
+	p := make([]byte, nonceSize+len(acceptGUID))
 	copy(p[:nonceSize], nonce)
-	copy(p[nonceSize:], magic)
+	copy(p[nonceSize:], acceptGUID)
 
 	sum := sha1.Sum(p)
 	base64.StdEncoding.Encode(accept, sum[:])
@@ -2,6 +2,52 @@ package ws
 
 import "testing"
 
+func TestComputeAcceptKeyWith(t *testing.T) {
+	// Example from RFC6455 section 1.3.
+	const (
+		nonce  = "dGhlIHNhbXBsZSBub25jZQ=="
+		accept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	)
+	if act := ComputeAcceptKeyWith(nonce, acceptGUID); act != accept {
+		t.Errorf("unexpected accept key: %q; want %q", act, accept)
+	}
+	if act := ComputeAcceptKeyWith(nonce, "bad-guid"); act == accept {
+		t.Errorf("unexpected accept key computed with wrong guid")
+	}
+
+	exp := make([]byte, acceptSize)
+	initAcceptFromNonce(exp, []byte(nonce))
+	if act := ComputeAcceptKeyWith(nonce, acceptGUID); act != string(exp) {
+		t.Errorf("unexpected accept key: %q; want %q", act, exp)
+	}
+}
+
+func TestCheckAcceptFromNonce(t *testing.T) {
+	nonce := mustMakeNonce()
+	accept := makeAccept(nonce)
+
+	bad := append([]byte(nil), accept...)
+	bad[len(bad)-2] ^= 1
+
+	for _, test := range []struct {
+		name   string
+		accept []byte
+		exp    bool
+	}{
+		{"valid", accept, true},
+		{"mismatch", bad, false},
+		{"short", accept[:acceptSize-1], false},
+		{"long", append(append([]byte(nil), accept...), '='), false},
+		{"empty", nil, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if act := checkAcceptFromNonce(test.accept, nonce); act != test.exp {
+				t.Errorf("checkAcceptFromNonce() = %t; want %t", act, test.exp)
+			}
+		})
+	}
+}
+
 func BenchmarkInitAcceptFromNonce(b *testing.B) {
 	dst := make([]byte, acceptSize)
 	nonce := mustMakeNonce()
@@ -19,7 +19,7 @@ func ReadHeader(r io.Reader) (h Header, err error) {
 	// The maximum header size is 14, but due to the 2 hop reads,
 	// after first hop that reads first 2 constant bytes, we could reuse 2 bytes.
 	// So 14 - 2 = 12.
-	bts := make([]byte, 2, MaxHeaderSize-2)
+	bts := make([]byte, MinHeaderSize, MaxHeaderSize-MinHeaderSize)
 
 	// Prepare to hold first 2 bytes to choose size of next read.
 	_, err = io.ReadFull(r, bts)
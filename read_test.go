@@ -1,9 +1,11 @@
 package ws
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"reflect"
 	"testing"
 )
@@ -57,3 +59,54 @@ func BenchmarkReadHeader(b *testing.B) {
 		})
 	}
 }
+
+// countingReader counts Read() calls as a rough estimate of syscalls made
+// while reading from the underlying connection.
+type countingReader struct {
+	r     io.Reader
+	calls int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	c.calls++
+	return c.r.Read(p)
+}
+
+func BenchmarkReadBufferSize(b *testing.B) {
+	frame := MustCompileFrame(NewBinaryFrame(make([]byte, 1024)))
+	stream := bytes.Repeat(frame, 256)
+
+	for _, size := range []int{4 << 10, 64 << 10} {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			var (
+				src   = bytes.NewReader(stream)
+				cr    = &countingReader{r: src}
+				br    = bufio.NewReaderSize(cr, size)
+				calls int
+			)
+			b.SetBytes(int64(len(stream)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				src.Reset(stream)
+				br.Reset(cr)
+				cr.calls = 0
+				for {
+					h, err := ReadHeader(br)
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := io.CopyN(ioutil.Discard, br, h.Length); err != nil {
+						b.Fatal(err)
+					}
+				}
+				calls += cr.calls
+			}
+			b.ReportMetric(float64(calls)/float64(b.N), "reads/op")
+		})
+	}
+}
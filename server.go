@@ -3,6 +3,7 @@ package ws
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -18,6 +19,7 @@ import (
 const (
 	DefaultServerReadBufferSize  = 4096
 	DefaultServerWriteBufferSize = 512
+	DefaultServerMaxHeaderBytes  = 64 << 10
 )
 
 // Errors used by both client and server when preparing WebSocket handshake.
@@ -81,6 +83,38 @@ var ErrHandshakeUpgradeRequired = RejectConnectionError(
 	RejectionReason(fmt.Sprintf("handshake error: bad %q header", headerSecVersion)),
 )
 
+// ErrHandshakeProtocolRequired is returned by Upgrader to indicate that
+// connection is rejected because none of subprotocols requested by client
+// was selected while RequireProtocol option is set.
+var ErrHandshakeProtocolRequired = RejectConnectionError(
+	RejectionStatus(http.StatusBadRequest),
+	RejectionReason(fmt.Sprintf("handshake error: no acceptable %q", headerSecProtocol)),
+)
+
+// ErrHandshakeBadAcceptKey is returned by Upgrader and HTTPUpgrader to
+// indicate that connection is rejected because AcceptKeyFunc returned value
+// which could not be sent as "Sec-WebSocket-Accept" header.
+var ErrHandshakeBadAcceptKey = RejectConnectionError(
+	RejectionStatus(http.StatusInternalServerError),
+	RejectionReason(fmt.Sprintf("handshake error: bad %q value computed", headerSecAccept)),
+)
+
+// ErrHandshakeHeaderTooLarge is returned by Upgrader to indicate that
+// connection is rejected because handshake request is larger than
+// Upgrader.MaxHeaderBytes.
+var ErrHandshakeHeaderTooLarge = RejectConnectionError(
+	RejectionStatus(http.StatusRequestHeaderFieldsTooLarge),
+	RejectionReason("handshake error: request headers too large"),
+)
+
+// ErrHandshakeBadProtocolToken is returned by Dialer and Upgrader to indicate
+// that subprotocol name is not a valid HTTP token and thus could not be sent
+// in "Sec-WebSocket-Protocol" header. See IsValidProtocolToken().
+var ErrHandshakeBadProtocolToken = RejectConnectionError(
+	RejectionStatus(http.StatusInternalServerError),
+	RejectionReason(fmt.Sprintf("handshake error: bad token in %q header", headerSecProtocol)),
+)
+
 // ErrNotHijacker is an error returned when http.ResponseWriter does not
 // implement http.Hijacker interface.
 var ErrNotHijacker = RejectConnectionError(
@@ -97,6 +131,51 @@ func UpgradeHTTP(r *http.Request, w http.ResponseWriter) (net.Conn, *bufio.ReadW
 	return DefaultHTTPUpgrader.Upgrade(r, w)
 }
 
+// Handler returns http.Handler that upgrades received requests with given
+// HTTPUpgrader and calls fn with upgraded connection and handshake info, like
+// so:
+//
+//	http.Handle("/ws", ws.Handler(ws.HTTPUpgrader{}, func(conn net.Conn, hs ws.Handshake) {
+//		defer conn.Close()
+//		// Read and write frames.
+//	}))
+//
+// When handshake fails, rejection response is written (see
+// HTTPUpgrader.Upgrade()) and connection is closed without calling fn. If
+// http.ResponseWriter does not support hijacking, the response with 500
+// status code is written.
+//
+// Connection is hijacked from the HTTP server, so fn is responsible for
+// closing it. Note that bytes buffered by the HTTP server after the
+// handshake request are read from the connection passed to fn before the
+// network ones.
+func Handler(u HTTPUpgrader, fn func(conn net.Conn, hs Handshake)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, hs, err := u.Upgrade(r, w)
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if rw != nil && rw.Reader.Buffered() > 0 {
+			conn = bufferedConn{conn, rw.Reader}
+		}
+		fn(conn, hs)
+	})
+}
+
+// bufferedConn is a net.Conn which reads from its reader (buffering bytes of
+// the underlying connection) instead of connection itself.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
 // DefaultUpgrader is an Upgrader that holds no options and is used by Upgrade
 // function.
 var DefaultUpgrader Upgrader
@@ -106,6 +185,158 @@ func Upgrade(conn io.ReadWriter) (Handshake, error) {
 	return DefaultUpgrader.Upgrade(conn)
 }
 
+// CheckUpgrade checks whether r is a well-formed WebSocket upgrade request.
+// It returns nil if so, and one of the ErrHandshake* errors otherwise. Note
+// that returned errors are created by RejectConnectionError() and thus hold
+// an appropriate HTTP response status code.
+//
+// CheckUpgrade does not hijack or write anything to the connection. It could
+// be helpful for checking requests in middleware before deciding to upgrade.
+// Note that it does not check subprotocols and extensions.
+func CheckUpgrade(r *http.Request) error {
+	// See https://tools.ietf.org/html/rfc6455#section-4.1
+	// The method of the request MUST be GET, and the HTTP version MUST be at least 1.1.
+	switch {
+	case r.Method != http.MethodGet:
+		return ErrHandshakeBadMethod
+	case r.ProtoMajor < 1 || (r.ProtoMajor == 1 && r.ProtoMinor < 1):
+		return ErrHandshakeBadProtocol
+	case r.Host == "":
+		return ErrHandshakeBadHost
+	}
+	if u := httpGetHeader(r.Header, headerUpgradeCanonical); u != "websocket" && !strings.EqualFold(u, "websocket") {
+		return ErrHandshakeBadUpgrade
+	}
+	if c := httpGetHeader(r.Header, headerConnectionCanonical); c != "Upgrade" && !strHasToken(c, "upgrade") {
+		return ErrHandshakeBadConnection
+	}
+	if nonce := httpGetHeader(r.Header, headerSecKeyCanonical); len(nonce) != nonceSize {
+		return ErrHandshakeBadSecKey
+	}
+	if v := httpGetHeader(r.Header, headerSecVersionCanonical); v != "13" {
+		// According to RFC6455:
+		//
+		// If this version does not match a version understood by the server,
+		// the server MUST abort the WebSocket handshake described in this
+		// section and instead send an appropriate HTTP error code (such as 426
+		// Upgrade Required) and a |Sec-WebSocket-Version| header field
+		// indicating the version(s) the server is capable of understanding.
+		//
+		// So we branching here cause empty or not present version does not
+		// meet the ABNF rules of RFC6455:
+		//
+		// version = DIGIT | (NZDIGIT DIGIT) |
+		// ("1" DIGIT DIGIT) | ("2" DIGIT DIGIT)
+		// ; Limited to 0-255 range, with no leading zeros
+		//
+		// That is, if version is really invalid – we sent 426 status, if it
+		// not present or empty – it is 400.
+		if v != "" {
+			return ErrHandshakeUpgradeRequired
+		}
+		return ErrHandshakeBadSecVersion
+	}
+	return nil
+}
+
+// tlsRecordHandshake is the content type of TLS record carrying ClientHello.
+const tlsRecordHandshake = 0x16
+
+// SniffTLS reports whether the next bytes from r look like the beginning of a
+// TLS handshake (ClientHello) rather than a plain HTTP request. It peeks the
+// first byte without consuming it, so it could be used to serve both "ws" and
+// "wss" schemes on a single listener.
+//
+// Note that since bytes are buffered by r, caller must read further bytes
+// (either for TLS termination or for Upgrade()) through r, not directly from
+// the connection.
+func SniffTLS(r *bufio.Reader) (isTLS bool, err error) {
+	p, err := r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	return p[0] == tlsRecordHandshake, nil
+}
+
+// RealIP returns the client IP address from the X-Forwarded-For header chain.
+// It walks the chain from the right (the hop closest to the server) and
+// returns the first address which is not listed in trustedProxies. If all of
+// hops are trusted, the leftmost one is returned. It returns nil if header has
+// no forwarded chain or it contains malformed address before an untrusted one
+// is found.
+//
+// Each of trustedProxies items is either an IP address or a CIDR notation
+// network (e.g. "10.0.0.0/8"). Malformed items are ignored.
+//
+// Note that RealIP assumes that the header was received from a trusted proxy.
+// That is, it is caller's responsibility to check the address of the
+// immediate peer (e.g. conn.RemoteAddr()) before relying on the result.
+//
+// Upgrader's OnHeader callback could be used to collect headers before the
+// upgrade decision is made in OnBeforeUpgrade:
+//
+//	header := make(http.Header)
+//	u := ws.Upgrader{
+//		OnHeader: func(key, value []byte) error {
+//			header.Add(string(key), string(value))
+//			return nil
+//		},
+//		OnBeforeUpgrade: func() (ws.HandshakeHeader, error) {
+//			ip := ws.RealIP(header, trusted)
+//			...
+//		},
+//	}
+func RealIP(header http.Header, trustedProxies []string) net.IP {
+	var chain []string
+	for _, v := range header[headerForwardedForCanonical] {
+		chain = append(chain, strings.Split(v, ",")...)
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+	trusted := parseTrustedProxies(trustedProxies)
+	var ip net.IP
+	for i := len(chain) - 1; i >= 0; i-- {
+		if ip = net.ParseIP(strings.TrimSpace(chain[i])); ip == nil {
+			return nil
+		}
+		if !trusted(ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+func parseTrustedProxies(proxies []string) func(net.IP) bool {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if strings.IndexByte(p, '/') != -1 {
+			if _, n, err := net.ParseCIDR(p); err == nil {
+				nets = append(nets, n)
+			}
+			continue
+		}
+		if ip := net.ParseIP(p); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(bits, bits),
+			})
+		}
+	}
+	return func(ip net.IP) bool {
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 // HTTPUpgrader contains options for upgrading connection to websocket from
 // net/http Handler arguments.
 type HTTPUpgrader struct {
@@ -126,6 +357,28 @@ type HTTPUpgrader struct {
 	// protocol is sent to a client as negotiated.
 	Protocol func(string) bool
 
+	// RequireProtocol makes Upgrade() reject connection with
+	// ErrHandshakeProtocolRequired when no subprotocol was selected from the
+	// list requested by client (or when client did not request any).
+	RequireProtocol bool
+
+	// AllowUnmaskedClient makes server accept client frames without masking.
+	// It must be agreed with the client out of band (see Dialer's
+	// DisableMasking option). If set, returned Handshake has Unmasked field
+	// set to true.
+	//
+	// Note that this is not compliant with RFC6455 and breaks
+	// interoperability with any compliant client. Use it only when both
+	// endpoints are under control, for example, within trusted network or
+	// behind TLS.
+	AllowUnmaskedClient bool
+
+	// AcceptKeyFunc is an optional function that derives
+	// "Sec-WebSocket-Accept" response value from the "Sec-WebSocket-Key"
+	// nonce. It has the same meaning as Upgrader's AcceptKeyFunc option and
+	// breaks interoperability with standard clients the same way.
+	AcceptKeyFunc func(nonce string) string
+
 	// Extension is the select function that is used to select extensions from
 	// list requested by client. If this field is set, then the all matched
 	// extensions are sent to a client as negotiated.
@@ -138,6 +391,12 @@ type HTTPUpgrader struct {
 	// extensions are sent to the client as accepted extensions in the
 	// response.
 	//
+	// Negotiate is called for every option offered by the client in
+	// the order they appear in the request (even across multiple
+	// Sec-WebSocket-Extensions headers). Note that the same extension could
+	// be offered multiple times with different parameters to express
+	// fallbacks; the first acceptable offer is the most preferable one.
+	//
 	// The argument is only valid until the Negotiate callback returns.
 	//
 	// If returned error is non-nil then connection is rejected and response is
@@ -161,44 +420,9 @@ func (u HTTPUpgrader) Upgrade(r *http.Request, w http.ResponseWriter) (conn net.
 		return conn, rw, hs, err
 	}
 
-	// See https://tools.ietf.org/html/rfc6455#section-4.1
-	// The method of the request MUST be GET, and the HTTP version MUST be at least 1.1.
 	var nonce string
-	if r.Method != http.MethodGet {
-		err = ErrHandshakeBadMethod
-	} else if r.ProtoMajor < 1 || (r.ProtoMajor == 1 && r.ProtoMinor < 1) {
-		err = ErrHandshakeBadProtocol
-	} else if r.Host == "" {
-		err = ErrHandshakeBadHost
-	} else if u := httpGetHeader(r.Header, headerUpgradeCanonical); u != "websocket" && !strings.EqualFold(u, "websocket") {
-		err = ErrHandshakeBadUpgrade
-	} else if c := httpGetHeader(r.Header, headerConnectionCanonical); c != "Upgrade" && !strHasToken(c, "upgrade") {
-		err = ErrHandshakeBadConnection
-	} else if nonce = httpGetHeader(r.Header, headerSecKeyCanonical); len(nonce) != nonceSize {
-		err = ErrHandshakeBadSecKey
-	} else if v := httpGetHeader(r.Header, headerSecVersionCanonical); v != "13" {
-		// According to RFC6455:
-		//
-		// If this version does not match a version understood by the server,
-		// the server MUST abort the WebSocket handshake described in this
-		// section and instead send an appropriate HTTP error code (such as 426
-		// Upgrade Required) and a |Sec-WebSocket-Version| header field
-		// indicating the version(s) the server is capable of understanding.
-		//
-		// So we branching here cause empty or not present version does not
-		// meet the ABNF rules of RFC6455:
-		//
-		// version = DIGIT | (NZDIGIT DIGIT) |
-		// ("1" DIGIT DIGIT) | ("2" DIGIT DIGIT)
-		// ; Limited to 0-255 range, with no leading zeros
-		//
-		// That is, if version is really invalid – we sent 426 status, if it
-		// not present or empty – it is 400.
-		if v != "" {
-			err = ErrHandshakeUpgradeRequired
-		} else {
-			err = ErrHandshakeBadSecVersion
-		}
+	if err = CheckUpgrade(r); err == nil {
+		nonce = httpGetHeader(r.Header, headerSecKeyCanonical)
 	}
 	if check := u.Protocol; err == nil && check != nil {
 		ps := r.Header[headerSecProtocolCanonical]
@@ -210,6 +434,9 @@ func (u HTTPUpgrader) Upgrade(r *http.Request, w http.ResponseWriter) (conn net.
 			}
 		}
 	}
+	if err == nil && u.RequireProtocol && hs.Protocol == "" {
+		err = ErrHandshakeProtocolRequired
+	}
 	if f := u.Negotiate; err == nil && f != nil {
 		for _, h := range r.Header[headerSecExtensionsCanonical] {
 			hs.Extensions, err = negotiateExtensions(strToBytes(h), hs.Extensions, f)
@@ -230,6 +457,11 @@ func (u HTTPUpgrader) Upgrade(r *http.Request, w http.ResponseWriter) (conn net.
 		}
 	}
 
+	var accept string
+	if f := u.AcceptKeyFunc; err == nil && f != nil {
+		accept, err = computeAcceptKeyFunc(f, strToBytes(nonce))
+	}
+
 	// Clear deadlines set by server.
 	conn.SetDeadline(noDeadline)
 	if t := u.Timeout; t != 0 {
@@ -242,7 +474,9 @@ func (u HTTPUpgrader) Upgrade(r *http.Request, w http.ResponseWriter) (conn net.
 		header[0] = HandshakeHeaderHTTP(h)
 	}
 	if err == nil {
-		httpWriteResponseUpgrade(rw.Writer, strToBytes(nonce), hs, header.WriteTo)
+		hs.Compressed = hasExtension(hs.Extensions, extensionDeflate)
+		hs.Unmasked = u.AllowUnmaskedClient
+		httpWriteResponseUpgrade(rw.Writer, strToBytes(nonce), hs, header.WriteTo, accept)
 		err = rw.Writer.Flush()
 	} else {
 		var code int
@@ -272,8 +506,22 @@ type Upgrader struct {
 	// size because incoming request could contain long header values, such as
 	// Cookie. Response, in other way, could be big only if user write multiple
 	// custom headers. Usually response takes less than 256 bytes.
+	//
+	// Defaults are DefaultServerReadBufferSize and
+	// DefaultServerWriteBufferSize. Larger buffers trade memory for fewer
+	// syscalls while reading the request; the buffers are released once the
+	// handshake is done and are not used for the session.
 	ReadBufferSize, WriteBufferSize int
 
+	// MaxHeaderBytes is the maximum number of bytes Upgrade() reads while
+	// parsing the request line and headers of the handshake request. When
+	// it is exceeded, ErrHandshakeHeaderTooLarge is returned. If it happens
+	// while reading headers, 431 response is also written to the connection.
+	//
+	// If it is zero then DefaultServerMaxHeaderBytes is used. If it is
+	// negative then no limit is applied.
+	MaxHeaderBytes int
+
 	// Protocol is a select function that is used to select subprotocol
 	// from list requested by client. If this field is set, then the first matched
 	// protocol is sent to a client as negotiated.
@@ -284,8 +532,72 @@ type Upgrader struct {
 	// ProtocolCustrom allow user to parse Sec-WebSocket-Protocol header manually.
 	// Note that returned bytes must be valid until Upgrade returns.
 	// If ProtocolCustom is set, it used instead of Protocol function.
+	// Returned protocol must be a valid HTTP token, otherwise connection is
+	// rejected with ErrHandshakeBadProtocolToken.
 	ProtocolCustom func([]byte) (string, bool)
 
+	// ProtocolQValues makes Upgrade() treat requested subprotocols as
+	// weighted with "q" parameter, like in Accept header:
+	//
+	//	Sec-WebSocket-Protocol: chat;q=0.5, superchat;q=0.9, json
+	//
+	// If set, the acceptable (by Protocol function) subprotocol with highest
+	// weight is selected. Subprotocols without weight have weight of 1;
+	// subprotocols with weight of 0 are never selected. For the equal weights
+	// the order of request is preserved. Malformed weight leads to
+	// ErrMalformedRequest.
+	//
+	// Note that weights are not a part of RFC6455, thus this option must be
+	// agreed with the clients out of band. It has no effect if ProtocolCustom
+	// is set.
+	ProtocolQValues bool
+
+	// RequireProtocol makes Upgrade() reject connection with
+	// ErrHandshakeProtocolRequired when no subprotocol was selected from the
+	// list requested by client (or when client did not request any).
+	RequireProtocol bool
+
+	// AllowUnmaskedClient makes server accept client frames without masking.
+	// It must be agreed with the client out of band (see Dialer's
+	// DisableMasking option). If set, returned Handshake has Unmasked field
+	// set to true.
+	//
+	// Note that this is not compliant with RFC6455 and breaks
+	// interoperability with any compliant client. Use it only when both
+	// endpoints are under control, for example, within trusted network or
+	// behind TLS.
+	AllowUnmaskedClient bool
+
+	// AcceptKeyFunc is an optional function that derives
+	// "Sec-WebSocket-Accept" response value from the "Sec-WebSocket-Key"
+	// nonce received from the client. It could be used to bind the handshake
+	// with a custom algorithm agreed with the client out of band (see
+	// Dialer's AcceptKeyFunc option). If it is nil, the algorithm defined by
+	// RFC6455 (SHA-1 of nonce concatenated with the GUID) is used.
+	//
+	// WARNING: custom derivation breaks interoperability with every standard
+	// client (including browsers), which fails the handshake after
+	// receiving non-standard accept value. Use it only when both endpoints
+	// are under control.
+	//
+	// Returned value must be a valid header value. If it is empty or
+	// contains control characters (such as CR or LF), the handshake fails
+	// with ErrHandshakeBadAcceptKey.
+	AcceptKeyFunc func(nonce string) string
+
+	// Lenient makes Upgrader tolerate some deviations from the spec made by
+	// non-compliant clients. Each of the following leniencies is applied only
+	// when Lenient is true:
+	//
+	// 	- Leading and trailing whitespace of the request line is trimmed
+	// 	instead of rejecting the request with ErrMalformedRequest;
+	// 	- Header lines without colon are ignored instead of rejecting the
+	// 	request with ErrMalformedRequest.
+	//
+	// Note that whitespace around header values is trimmed regardless of
+	// Lenient.
+	Lenient bool
+
 	// Extension is a select function that is used to select extensions
 	// from list requested by client. If this field is set, then the all matched
 	// extensions are sent to a client as negotiated.
@@ -329,6 +641,12 @@ type Upgrader struct {
 	// extensions are sent to the client as accepted extensions in the
 	// response.
 	//
+	// Negotiate is called for every option offered by the client in
+	// the order they appear in the request (even across multiple
+	// Sec-WebSocket-Extensions headers). Note that the same extension could
+	// be offered multiple times with different parameters to express
+	// fallbacks; the first acceptable offer is the most preferable one.
+	//
 	// The argument is only valid until the Negotiate callback returns.
 	//
 	// If returned error is non-nil then connection is rejected and response is
@@ -399,6 +717,29 @@ type Upgrader struct {
 	//
 	// RejectConnectionError could be used to get more control on response.
 	OnBeforeUpgrade func() (header HandshakeHeader, err error)
+
+	// OnConn is a callback that will be called with the connection passed to
+	// Upgrade() before any handshake i/o is made, if it implements net.Conn.
+	// It is the single place to tune connection options such as
+	// TCP_NODELAY or keep alive (e.g. by asserting conn to *net.TCPConn).
+	//
+	// If returned error is non-nil then Upgrade() returns it without reading
+	// request or writing any response.
+	OnConn func(conn net.Conn) error
+
+	// OnRequestContext, OnHostContext, OnHeaderContext, NegotiateContext and
+	// OnBeforeUpgradeContext are the same as callbacks without the Context
+	// suffix, except that they receive context passed to UpgradeContext()
+	// (or context.Background() if Upgrade() is called). It makes possible to
+	// share one Upgrader across listeners (e.g. virtual hosts) and still
+	// access request-scoped values set by the accept loop.
+	//
+	// If both variants of a callback are set, the context-aware one is used.
+	OnRequestContext       func(ctx context.Context, uri []byte) error
+	OnHostContext          func(ctx context.Context, host []byte) error
+	OnHeaderContext        func(ctx context.Context, key, value []byte) error
+	NegotiateContext       func(ctx context.Context, opt httphead.Option) (httphead.Option, error)
+	OnBeforeUpgradeContext func(ctx context.Context) (header HandshakeHeader, err error)
 }
 
 // Upgrade zero-copy upgrades connection to WebSocket. It interprets given conn
@@ -406,11 +747,49 @@ type Upgrader struct {
 //
 // It is a caller responsibility to manage i/o timeouts on conn.
 //
+// Upgrade does not rely on any transport specifics, thus conn may be any
+// stream-oriented connection such as *net.TCPConn or *net.UnixConn. Note that
+// "Host" header is still required by HTTP/1.1, even if it has no meaning for
+// the underlying transport.
+//
 // Non-nil error means that request for the WebSocket upgrade is invalid or
 // malformed and usually connection should be closed.
 // Even when error is non-nil Upgrade will write appropriate response into
 // connection in compliance with RFC.
 func (u Upgrader) Upgrade(conn io.ReadWriter) (hs Handshake, err error) {
+	return u.UpgradeContext(context.Background(), conn)
+}
+
+// UpgradeContext is like Upgrade() but passes given context to the
+// context-aware callbacks such as OnRequestContext.
+//
+// Note that ctx is not used to cancel i/o on conn.
+func (u Upgrader) UpgradeContext(ctx context.Context, conn io.ReadWriter) (hs Handshake, err error) {
+	if f := u.OnRequestContext; f != nil {
+		u.OnRequest = func(uri []byte) error {
+			return f(ctx, uri)
+		}
+	}
+	if f := u.OnHostContext; f != nil {
+		u.OnHost = func(host []byte) error {
+			return f(ctx, host)
+		}
+	}
+	if f := u.OnHeaderContext; f != nil {
+		u.OnHeader = func(key, value []byte) error {
+			return f(ctx, key, value)
+		}
+	}
+	if f := u.NegotiateContext; f != nil {
+		u.Negotiate = func(opt httphead.Option) (httphead.Option, error) {
+			return f(ctx, opt)
+		}
+	}
+	if f := u.OnBeforeUpgradeContext; f != nil {
+		u.OnBeforeUpgrade = func() (HandshakeHeader, error) {
+			return f(ctx)
+		}
+	}
 	// headerSeen constants helps to report whether or not some header was seen
 	// during reading request bytes.
 	const (
@@ -430,8 +809,15 @@ func (u Upgrader) Upgrade(conn io.ReadWriter) (hs Handshake, err error) {
 			headerSeenSecKey
 	)
 
+	if onConn := u.OnConn; onConn != nil {
+		if c, ok := conn.(net.Conn); ok {
+			if err = onConn(c); err != nil {
+				return hs, err
+			}
+		}
+	}
+
 	// Prepare I/O buffers.
-	// TODO(gobwas): make it configurable.
 	br := pbufio.GetReader(conn,
 		nonZero(u.ReadBufferSize, DefaultServerReadBufferSize),
 	)
@@ -443,11 +829,27 @@ func (u Upgrader) Upgrade(conn io.ReadWriter) (hs Handshake, err error) {
 		pbufio.PutWriter(bw)
 	}()
 
+	// Limit the number of bytes read while parsing the request. Negative
+	// value means no limit.
+	max := nonZero(u.MaxHeaderBytes, DefaultServerMaxHeaderBytes)
+	if max < 0 {
+		max = -1
+	}
+
 	// Read HTTP request line like "GET /ws HTTP/1.1".
-	rl, err := readLine(br)
+	rl, n, err := readLineLimit(br, max)
+	if err == errLineTooLong {
+		err = ErrHandshakeHeaderTooLarge
+	}
 	if err != nil {
 		return hs, err
 	}
+	if max > 0 {
+		max -= n
+	}
+	if u.Lenient {
+		rl = btrim(rl)
+	}
 	// Parse request line data like HTTP version, uri and method.
 	req, err := httpParseRequestLine(rl)
 	if err != nil {
@@ -496,19 +898,33 @@ func (u Upgrader) Upgrade(conn io.ReadWriter) (hs Handshake, err error) {
 		// bit on.
 		headerSeen byte
 
+		// protocolQ holds weight of the selected subprotocol when
+		// ProtocolQValues option is set.
+		protocolQ int
+
 		nonce = make([]byte, nonceSize)
 	)
 	for err == nil {
-		line, e := readLine(br)
+		line, n, e := readLineLimit(br, max)
+		if e == errLineTooLong {
+			err = ErrHandshakeHeaderTooLarge
+			break
+		}
 		if e != nil {
 			return hs, e
 		}
+		if max > 0 {
+			max -= n
+		}
 		if len(line) == 0 {
 			// Blank line, no more lines to read.
 			break
 		}
 
 		k, v, ok := httpParseHeaderLine(line)
+		if !ok && u.Lenient {
+			continue
+		}
 		if !ok {
 			err = ErrMalformedRequest
 			break
@@ -548,7 +964,14 @@ func (u Upgrader) Upgrade(conn io.ReadWriter) (hs Handshake, err error) {
 			}
 
 		case headerSecProtocolCanonical:
-			if custom, check := u.ProtocolCustom, u.Protocol; hs.Protocol == "" && (custom != nil || check != nil) {
+			if check := u.Protocol; u.ProtocolQValues && u.ProtocolCustom == nil && check != nil {
+				p, q, ok := btsSelectProtocolQ(v, check)
+				if !ok {
+					err = ErrMalformedRequest
+				} else if q > protocolQ {
+					hs.Protocol, protocolQ = p, q
+				}
+			} else if custom, check := u.ProtocolCustom, u.Protocol; hs.Protocol == "" && (custom != nil || check != nil) {
 				var ok bool
 				if custom != nil {
 					hs.Protocol, ok = custom(v)
@@ -620,9 +1043,19 @@ func (u Upgrader) Upgrade(conn io.ReadWriter) (hs Handshake, err error) {
 			panic("unknown headers state")
 		}
 
+	case err == nil && hs.Protocol != "" && !IsValidProtocolToken(hs.Protocol):
+		err = ErrHandshakeBadProtocolToken
+
+	case err == nil && u.RequireProtocol && hs.Protocol == "":
+		err = ErrHandshakeProtocolRequired
+
 	case err == nil && u.OnBeforeUpgrade != nil:
 		header[1], err = u.OnBeforeUpgrade()
 	}
+	var accept string
+	if f := u.AcceptKeyFunc; err == nil && f != nil {
+		accept, err = computeAcceptKeyFunc(f, nonce)
+	}
 	if err != nil {
 		var code int
 		if rej, ok := err.(*ConnectionRejectedError); ok {
@@ -638,7 +1071,9 @@ func (u Upgrader) Upgrade(conn io.ReadWriter) (hs Handshake, err error) {
 		return hs, err
 	}
 
-	httpWriteResponseUpgrade(bw, nonce, hs, header.WriteTo)
+	hs.Compressed = hasExtension(hs.Extensions, extensionDeflate)
+	hs.Unmasked = u.AllowUnmaskedClient
+	httpWriteResponseUpgrade(bw, nonce, hs, header.WriteTo, accept)
 	err = bw.Flush()
 
 	return hs, err
@@ -3,6 +3,8 @@ package ws
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,12 +13,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gobwas/httphead"
 	"github.com/gobwas/pool/pbufio"
@@ -27,11 +32,12 @@ import (
 type upgradeCase struct {
 	label string
 
-	protocol  func(string) bool
-	negotiate func(httphead.Option) (httphead.Option, error)
-	onRequest func(u []byte) error
-	onHost    func(h []byte) error
-	onHeader  func(k, v []byte) error
+	protocol        func(string) bool
+	requireProtocol bool
+	negotiate       func(httphead.Option) (httphead.Option, error)
+	onRequest       func(u []byte) error
+	onHost          func(h []byte) error
+	onHeader        func(k, v []byte) error
 
 	nonce        []byte
 	removeSecKey bool
@@ -86,6 +92,19 @@ var upgradeCases = []upgradeCase{
 			headerConnection: []string{"Upgrade"},
 		}),
 	},
+	{
+		label: "mixedcase_upgrade",
+		nonce: mustMakeNonce(),
+		req: mustMakeRequest("GET", "ws://example.org", http.Header{
+			headerUpgrade:    []string{"WebSocket"},
+			headerConnection: []string{"Upgrade"},
+			headerSecVersion: []string{"13"},
+		}),
+		res: mustMakeResponse(101, http.Header{
+			headerUpgrade:    []string{"websocket"},
+			headerConnection: []string{"Upgrade"},
+		}),
+	},
 	{
 		label:    "uppercase",
 		protocol: func(sub string) bool { return true },
@@ -117,6 +136,51 @@ var upgradeCases = []upgradeCase{
 		}),
 		hs: Handshake{Protocol: "b"},
 	},
+	{
+		label:           "subproto_required",
+		protocol:        SelectFromSlice([]string{"b", "d"}),
+		requireProtocol: true,
+		nonce:           mustMakeNonce(),
+		req: mustMakeRequest("GET", "ws://example.org", http.Header{
+			headerUpgrade:     []string{"websocket"},
+			headerConnection:  []string{"Upgrade"},
+			headerSecVersion:  []string{"13"},
+			headerSecProtocol: []string{"a", "b"},
+		}),
+		res: mustMakeResponse(101, http.Header{
+			headerUpgrade:     []string{"websocket"},
+			headerConnection:  []string{"Upgrade"},
+			headerSecProtocol: []string{"b"},
+		}),
+		hs: Handshake{Protocol: "b"},
+	},
+	{
+		label:           "subproto_required_no_match",
+		protocol:        SelectFromSlice([]string{"b", "d"}),
+		requireProtocol: true,
+		nonce:           mustMakeNonce(),
+		req: mustMakeRequest("GET", "ws://example.org", http.Header{
+			headerUpgrade:     []string{"websocket"},
+			headerConnection:  []string{"Upgrade"},
+			headerSecVersion:  []string{"13"},
+			headerSecProtocol: []string{"a", "c"},
+		}),
+		res: mustMakeErrResponse(400, ErrHandshakeProtocolRequired, nil),
+		err: ErrHandshakeProtocolRequired,
+	},
+	{
+		label:           "subproto_required_not_offered",
+		protocol:        SelectFromSlice([]string{"b", "d"}),
+		requireProtocol: true,
+		nonce:           mustMakeNonce(),
+		req: mustMakeRequest("GET", "ws://example.org", http.Header{
+			headerUpgrade:    []string{"websocket"},
+			headerConnection: []string{"Upgrade"},
+			headerSecVersion: []string{"13"},
+		}),
+		res: mustMakeErrResponse(400, ErrHandshakeProtocolRequired, nil),
+		err: ErrHandshakeProtocolRequired,
+	},
 	{
 		label:        "subproto_lowercase_headers",
 		protocol:     SelectFromSlice([]string{"b", "d"}),
@@ -188,6 +252,50 @@ var upgradeCases = []upgradeCase{
 	// Error cases.
 	// ------------
 
+	{
+		label: "deflate",
+		negotiate: func(opt httphead.Option) (ret httphead.Option, err error) {
+			if string(opt.Name) == "permessage-deflate" {
+				return httphead.NewOption("permessage-deflate", nil), nil
+			}
+			return ret, nil
+		},
+		nonce: mustMakeNonce(),
+		req: mustMakeRequest("GET", "ws://example.org", http.Header{
+			headerUpgrade:       []string{"websocket"},
+			headerConnection:    []string{"Upgrade"},
+			headerSecVersion:    []string{"13"},
+			headerSecExtensions: []string{"permessage-deflate;client_max_window_bits"},
+		}),
+		res: mustMakeResponse(101, http.Header{
+			headerUpgrade:       []string{"websocket"},
+			headerConnection:    []string{"Upgrade"},
+			headerSecExtensions: []string{"permessage-deflate"},
+		}),
+		hs: Handshake{
+			Extensions: []httphead.Option{
+				httphead.NewOption("permessage-deflate", nil),
+			},
+			Compressed: true,
+		},
+	},
+	{
+		label: "deflate_declined",
+		negotiate: func(opt httphead.Option) (ret httphead.Option, err error) {
+			return ret, nil
+		},
+		nonce: mustMakeNonce(),
+		req: mustMakeRequest("GET", "ws://example.org", http.Header{
+			headerUpgrade:       []string{"websocket"},
+			headerConnection:    []string{"Upgrade"},
+			headerSecVersion:    []string{"13"},
+			headerSecExtensions: []string{"permessage-deflate"},
+		}),
+		res: mustMakeResponse(101, http.Header{
+			headerUpgrade:    []string{"websocket"},
+			headerConnection: []string{"Upgrade"},
+		}),
+	},
 	{
 		label: "bad_http_method",
 		nonce: mustMakeNonce(),
@@ -222,7 +330,7 @@ var upgradeCases = []upgradeCase{
 		err: ErrHandshakeBadHost,
 	},
 	{
-		label: "bad_upgrade",
+		label: "bad_upgrade_missing",
 		nonce: mustMakeNonce(),
 		req: mustMakeRequest("GET", "ws://example.org", http.Header{
 			headerConnection: []string{"Upgrade"},
@@ -232,7 +340,7 @@ var upgradeCases = []upgradeCase{
 		err: ErrHandshakeBadUpgrade,
 	},
 	{
-		label: "bad_upgrade",
+		label: "bad_upgrade_missing_custom_header",
 		nonce: mustMakeNonce(),
 		req: mustMakeRequest("GET", "ws://example.org", http.Header{
 			"X-Custom-Header": []string{"value"},
@@ -248,7 +356,7 @@ var upgradeCases = []upgradeCase{
 		err: ErrHandshakeBadUpgrade,
 	},
 	{
-		label: "bad_upgrade",
+		label: "bad_upgrade_not_websocket",
 		nonce: mustMakeNonce(),
 		req: mustMakeRequest("GET", "ws://example.org", http.Header{
 			headerUpgrade:    []string{"not-websocket"},
@@ -259,7 +367,29 @@ var upgradeCases = []upgradeCase{
 		err: ErrHandshakeBadUpgrade,
 	},
 	{
-		label: "bad_connection",
+		label: "bad_upgrade_suffix",
+		nonce: mustMakeNonce(),
+		req: mustMakeRequest("GET", "ws://example.org", http.Header{
+			headerUpgrade:    []string{"websocket-extra"},
+			headerConnection: []string{"Upgrade"},
+			headerSecVersion: []string{"13"},
+		}),
+		res: mustMakeErrResponse(400, ErrHandshakeBadUpgrade, nil),
+		err: ErrHandshakeBadUpgrade,
+	},
+	{
+		label: "bad_upgrade_version_suffix",
+		nonce: mustMakeNonce(),
+		req: mustMakeRequest("GET", "ws://example.org", http.Header{
+			headerUpgrade:    []string{"WebSocket2"},
+			headerConnection: []string{"Upgrade"},
+			headerSecVersion: []string{"13"},
+		}),
+		res: mustMakeErrResponse(400, ErrHandshakeBadUpgrade, nil),
+		err: ErrHandshakeBadUpgrade,
+	},
+	{
+		label: "bad_connection_missing",
 		nonce: mustMakeNonce(),
 		req: mustMakeRequest("GET", "ws://example.org", http.Header{
 			headerUpgrade:    []string{"websocket"},
@@ -269,7 +399,7 @@ var upgradeCases = []upgradeCase{
 		err: ErrHandshakeBadConnection,
 	},
 	{
-		label: "bad_connection",
+		label: "bad_connection_not_upgrade",
 		nonce: mustMakeNonce(),
 		req: mustMakeRequest("GET", "ws://example.org", http.Header{
 			headerUpgrade:    []string{"websocket"},
@@ -303,7 +433,7 @@ var upgradeCases = []upgradeCase{
 		err: ErrHandshakeUpgradeRequired,
 	},
 	{
-		label:        "bad_sec_key",
+		label:        "bad_sec_key_missing",
 		nonce:        mustMakeNonce(),
 		removeSecKey: true,
 		req: mustMakeRequest("GET", "ws://example.org", http.Header{
@@ -315,7 +445,7 @@ var upgradeCases = []upgradeCase{
 		err: ErrHandshakeBadSecKey,
 	},
 	{
-		label:     "bad_sec_key",
+		label:     "bad_sec_key_invalid",
 		nonce:     mustMakeNonce(),
 		badSecKey: true,
 		req: mustMakeRequest("GET", "ws://example.org", http.Header{
@@ -389,8 +519,9 @@ func TestHTTPUpgrader(t *testing.T) {
 			res := newRecorder()
 
 			u := HTTPUpgrader{
-				Protocol:  test.protocol,
-				Negotiate: test.negotiate,
+				Protocol:        test.protocol,
+				RequireProtocol: test.requireProtocol,
+				Negotiate:       test.negotiate,
 			}
 			_, _, hs, err := u.Upgrade(req, res)
 			if test.err != err {
@@ -412,6 +543,9 @@ func TestHTTPUpgrader(t *testing.T) {
 			if act, exp := hs.Protocol, test.hs.Protocol; act != exp {
 				t.Errorf("handshake protocol is %q want %q", act, exp)
 			}
+			if act, exp := hs.Compressed, test.hs.Compressed; act != exp {
+				t.Errorf("handshake compressed is %t want %t", act, exp)
+			}
 			if act, exp := len(hs.Extensions), len(test.hs.Extensions); act != exp {
 				t.Errorf("handshake got %d extensions; want %d", act, exp)
 			} else {
@@ -443,9 +577,10 @@ func TestUpgrader(t *testing.T) {
 				Protocol: func(p []byte) bool {
 					return test.protocol(string(p))
 				},
-				Negotiate: test.negotiate,
-				OnHeader:  test.onHeader,
-				OnRequest: test.onRequest,
+				RequireProtocol: test.requireProtocol,
+				Negotiate:       test.negotiate,
+				OnHeader:        test.onHeader,
+				OnRequest:       test.onRequest,
 			}
 
 			// We use dumpRequest here because test.req.Write is always send
@@ -471,6 +606,9 @@ func TestUpgrader(t *testing.T) {
 			if act, exp := hs.Protocol, test.hs.Protocol; act != exp {
 				t.Errorf("handshake protocol is %q want %q", act, exp)
 			}
+			if act, exp := hs.Compressed, test.hs.Compressed; act != exp {
+				t.Errorf("handshake compressed is %t want %t", act, exp)
+			}
 			if act, exp := len(hs.Extensions), len(test.hs.Extensions); act != exp {
 				t.Errorf("handshake got %d extensions; want %d", act, exp)
 			} else {
@@ -484,6 +622,854 @@ func TestUpgrader(t *testing.T) {
 	}
 }
 
+func TestUpgraderAcceptKeyFunc(t *testing.T) {
+	const req = "" +
+		"GET / HTTP/1.1\r\n" +
+		"Host: example.org\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"\r\n"
+
+	for _, test := range []struct {
+		name   string
+		accept string
+		err    error
+	}{
+		{
+			name:   "custom",
+			accept: "custom-accept",
+		},
+		{
+			name:   "crlf",
+			accept: "x\r\nX-Injected: 1",
+			err:    ErrHandshakeBadAcceptKey,
+		},
+		{
+			name:   "lf",
+			accept: "x\nX-Injected: 1",
+			err:    ErrHandshakeBadAcceptKey,
+		},
+		{
+			name: "empty",
+			err:  ErrHandshakeBadAcceptKey,
+		},
+	} {
+		test := test
+		accept := func(string) string {
+			return test.accept
+		}
+		check := func(t *testing.T, err error, raw []byte) {
+			if err != test.err {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Header.Get("X-Injected") != "" {
+				t.Errorf("header is injected:\n%s", raw)
+			}
+			exp := http.StatusSwitchingProtocols
+			if test.err != nil {
+				exp = http.StatusInternalServerError
+			}
+			if act := resp.StatusCode; act != exp {
+				t.Fatalf("unexpected response status: %d; want %d", act, exp)
+			}
+			if test.err != nil {
+				return
+			}
+			if act := resp.Header.Get(headerSecAccept); act != test.accept {
+				t.Errorf("unexpected %s header: %q; want %q", headerSecAccept, act, test.accept)
+			}
+		}
+		t.Run(test.name+"/upgrader", func(t *testing.T) {
+			var out bytes.Buffer
+			rw := struct {
+				io.Reader
+				io.Writer
+			}{strings.NewReader(req), &out}
+			u := Upgrader{
+				AcceptKeyFunc: accept,
+			}
+			_, err := u.Upgrade(rw)
+			check(t, err, out.Bytes())
+		})
+		t.Run(test.name+"/http", func(t *testing.T) {
+			r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(req)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := newRecorder()
+			u := HTTPUpgrader{
+				AcceptKeyFunc: accept,
+			}
+			_, _, _, err = u.Upgrade(r, res)
+			check(t, err, res.Bytes())
+		})
+	}
+}
+
+func TestUpgraderNoHost(t *testing.T) {
+	req := "" +
+		"GET /ws HTTP/1.1\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: " + string(mustMakeNonce()) + "\r\n" +
+		"\r\n"
+
+	conn := bytes.NewBufferString(req)
+	_, err := Upgrade(conn)
+	if err != ErrHandshakeBadHost {
+		t.Fatalf("unexpected error: %v; want %v", err, ErrHandshakeBadHost)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected response status: %d; want %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestUpgradeProtocolHeader(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		offer    string
+		accept   string
+		protocol string
+	}{
+		{
+			name:     "selected",
+			offer:    "a, b",
+			accept:   "b",
+			protocol: "b",
+		},
+		{
+			name:   "not selected",
+			offer:  "a, b",
+			accept: "c",
+		},
+		{
+			name:   "not offered",
+			accept: "c",
+		},
+	} {
+		check := func(p string) bool {
+			return p == test.accept
+		}
+		req := mustMakeRequest("GET", "ws://example.org", http.Header{})
+		req.Header.Set(headerUpgrade, "websocket")
+		req.Header.Set(headerConnection, "Upgrade")
+		req.Header.Set(headerSecVersion, "13")
+		req.Header.Set(headerSecKey, string(mustMakeNonce()))
+		if test.offer != "" {
+			req.Header.Set(headerSecProtocol, test.offer)
+		}
+		assert := func(t *testing.T, hs Handshake, raw []byte) {
+			if hs.Protocol != test.protocol {
+				t.Errorf("unexpected protocol: %q; want %q", hs.Protocol, test.protocol)
+			}
+			res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			act, has := res.Header[headerSecProtocolCanonical]
+			if test.protocol == "" {
+				if has || bytes.Contains(raw, []byte(headerSecProtocol)) {
+					t.Errorf("unexpected %q header: %q", headerSecProtocol, act)
+				}
+				return
+			}
+			if len(act) != 1 || act[0] != test.protocol {
+				t.Errorf("unexpected %q header: %q; want %q", headerSecProtocol, act, test.protocol)
+			}
+		}
+		t.Run(test.name+"/Upgrader", func(t *testing.T) {
+			var out bytes.Buffer
+			conn := struct {
+				io.Reader
+				io.Writer
+			}{bytes.NewReader(dumpRequest(req)), &out}
+			hs, err := Upgrader{
+				Protocol: func(p []byte) bool {
+					return check(string(p))
+				},
+			}.Upgrade(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert(t, hs, out.Bytes())
+		})
+		t.Run(test.name+"/HTTPUpgrader", func(t *testing.T) {
+			res := newRecorder()
+			_, _, hs, err := HTTPUpgrader{
+				Protocol: check,
+			}.Upgrade(req, res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert(t, hs, res.Bytes())
+		})
+	}
+}
+
+func TestCheckUpgrade(t *testing.T) {
+	valid := func() http.Header {
+		h := http.Header{}
+		h.Set(headerUpgrade, "websocket")
+		h.Set(headerConnection, "Upgrade")
+		h.Set(headerSecVersion, "13")
+		h.Set(headerSecKey, string(mustMakeNonce()))
+		return h
+	}
+	for _, test := range []struct {
+		name   string
+		method string
+		modify func(http.Header)
+		err    error
+		status int
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name:   "bad method",
+			method: http.MethodPost,
+			err:    ErrHandshakeBadMethod,
+			status: http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "no upgrade",
+			modify: func(h http.Header) { h.Del(headerUpgrade) },
+			err:    ErrHandshakeBadUpgrade,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "no connection",
+			modify: func(h http.Header) { h.Del(headerConnection) },
+			err:    ErrHandshakeBadConnection,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "wrong version",
+			modify: func(h http.Header) { h.Set(headerSecVersion, "8") },
+			err:    ErrHandshakeUpgradeRequired,
+			status: http.StatusUpgradeRequired,
+		},
+		{
+			name:   "no version",
+			modify: func(h http.Header) { h.Del(headerSecVersion) },
+			err:    ErrHandshakeBadSecVersion,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "no key",
+			modify: func(h http.Header) { h.Del(headerSecKey) },
+			err:    ErrHandshakeBadSecKey,
+			status: http.StatusBadRequest,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			h := valid()
+			if test.modify != nil {
+				test.modify(h)
+			}
+			req := mustMakeRequest(method, "ws://example.org", h)
+
+			err := CheckUpgrade(req)
+			if err != test.err {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			if err == nil {
+				return
+			}
+			if act := err.(*ConnectionRejectedError).StatusCode(); act != test.status {
+				t.Errorf("unexpected status code: %d; want %d", act, test.status)
+			}
+		})
+	}
+}
+
+func TestUpgraderMaxHeaderBytes(t *testing.T) {
+	request := func(cookie int) string {
+		return "" +
+			"GET /ws HTTP/1.1\r\n" +
+			"Host: example.org\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Cookie: " + strings.Repeat("x", cookie) + "\r\n" +
+			"Sec-WebSocket-Version: 13\r\n" +
+			"Sec-WebSocket-Key: " + string(mustMakeNonce()) + "\r\n" +
+			"\r\n"
+	}
+	for _, test := range []struct {
+		name   string
+		max    int
+		req    string
+		err    error
+		status int
+	}{
+		{
+			name:   "default",
+			req:    request(DefaultServerMaxHeaderBytes),
+			err:    ErrHandshakeHeaderTooLarge,
+			status: http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			name:   "custom",
+			max:    256,
+			req:    request(256),
+			err:    ErrHandshakeHeaderTooLarge,
+			status: http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			name:   "total",
+			max:    len(request(10)) - 1,
+			req:    request(10),
+			err:    ErrHandshakeHeaderTooLarge,
+			status: http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			name:   "exact",
+			max:    len(request(10)),
+			req:    request(10),
+			status: http.StatusSwitchingProtocols,
+		},
+		{
+			name:   "no limit",
+			max:    -1,
+			req:    request(DefaultServerMaxHeaderBytes),
+			status: http.StatusSwitchingProtocols,
+		},
+		{
+			name: "request line",
+			max:  64,
+			req:  "GET /" + strings.Repeat("x", 64) + " HTTP/1.1\r\n" + request(0),
+			err:  ErrHandshakeHeaderTooLarge,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			conn := struct {
+				io.Reader
+				io.Writer
+			}{strings.NewReader(test.req), &out}
+
+			u := Upgrader{
+				MaxHeaderBytes: test.max,
+			}
+			_, err := u.Upgrade(conn)
+			if err != test.err {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			if test.status == 0 {
+				return
+			}
+			res, err := http.ReadResponse(bufio.NewReader(&out), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != test.status {
+				t.Errorf("unexpected response status: %d; want %d", res.StatusCode, test.status)
+			}
+		})
+	}
+}
+
+func TestUpgraderBadProtocolToken(t *testing.T) {
+	req := "" +
+		"GET /ws HTTP/1.1\r\n" +
+		"Host: example.org\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: " + string(mustMakeNonce()) + "\r\n" +
+		"Sec-WebSocket-Protocol: chat\r\n" +
+		"\r\n"
+	for _, test := range []struct {
+		name     string
+		protocol string
+		err      error
+		status   int
+	}{
+		{
+			name:     "valid",
+			protocol: "chat",
+			status:   http.StatusSwitchingProtocols,
+		},
+		{
+			name:     "space",
+			protocol: "my proto",
+			err:      ErrHandshakeBadProtocolToken,
+			status:   http.StatusInternalServerError,
+		},
+		{
+			name:     "comma",
+			protocol: "chat,superchat",
+			err:      ErrHandshakeBadProtocolToken,
+			status:   http.StatusInternalServerError,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			conn := struct {
+				io.Reader
+				io.Writer
+			}{strings.NewReader(req), &out}
+
+			u := Upgrader{
+				ProtocolCustom: func([]byte) (string, bool) {
+					return test.protocol, true
+				},
+			}
+			_, err := u.Upgrade(conn)
+			if err != test.err {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			res, err := http.ReadResponse(bufio.NewReader(&out), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != test.status {
+				t.Errorf("unexpected response status: %d; want %d", res.StatusCode, test.status)
+			}
+			if res.Header.Get(headerSecProtocol) != "" && test.err != nil {
+				t.Errorf("unexpected %q header in response", headerSecProtocol)
+			}
+		})
+	}
+}
+
+func TestUpgraderProtocolQValues(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		protocols []string
+		qvalues   bool
+		exp       string
+		err       error
+	}{
+		{
+			name:      "weighted",
+			protocols: []string{"chat;q=0.5, superchat;q=0.9, json;q=0.7"},
+			qvalues:   true,
+			exp:       "superchat",
+		},
+		{
+			name:      "unweighted",
+			protocols: []string{"chat, superchat"},
+			qvalues:   true,
+			exp:       "chat",
+		},
+		{
+			name:      "implicit weight",
+			protocols: []string{"chat;q=0.999, superchat"},
+			qvalues:   true,
+			exp:       "superchat",
+		},
+		{
+			name:      "unacceptable",
+			protocols: []string{"unknown;q=1, chat;q=0.1"},
+			qvalues:   true,
+			exp:       "chat",
+		},
+		{
+			name:      "zero weight",
+			protocols: []string{"chat;q=0"},
+			qvalues:   true,
+		},
+		{
+			name:      "multiple headers",
+			protocols: []string{"chat;q=0.5", "superchat;q=0.8", "json;q=0.8"},
+			qvalues:   true,
+			exp:       "superchat",
+		},
+		{
+			name:      "malformed weight",
+			protocols: []string{"chat;q=2"},
+			qvalues:   true,
+			err:       ErrMalformedRequest,
+		},
+		{
+			name:      "disabled",
+			protocols: []string{"chat;q=0.5, superchat;q=0.9"},
+			exp:       "chat",
+		},
+		{
+			name:      "disabled multiple headers",
+			protocols: []string{"chat;q=0.5", "superchat;q=0.9"},
+			exp:       "chat",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := "" +
+				"GET /ws HTTP/1.1\r\n" +
+				"Host: example.org\r\n" +
+				"Upgrade: websocket\r\n" +
+				"Connection: Upgrade\r\n" +
+				"Sec-WebSocket-Version: 13\r\n" +
+				"Sec-WebSocket-Key: " + string(mustMakeNonce()) + "\r\n"
+			for _, p := range test.protocols {
+				req += "Sec-WebSocket-Protocol: " + p + "\r\n"
+			}
+			req += "\r\n"
+
+			var out bytes.Buffer
+			conn := struct {
+				io.Reader
+				io.Writer
+			}{strings.NewReader(req), &out}
+
+			u := Upgrader{
+				Protocol: func(p []byte) bool {
+					return string(p) != "unknown"
+				},
+				ProtocolQValues: test.qvalues,
+			}
+			hs, err := u.Upgrade(conn)
+			if err != test.err {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			if act, exp := hs.Protocol, test.exp; act != exp {
+				t.Errorf("unexpected protocol: %q; want %q", act, exp)
+			}
+		})
+	}
+}
+
+func TestUpgraderContext(t *testing.T) {
+	type vhostKey struct{}
+	req := "" +
+		"GET /ws HTTP/1.1\r\n" +
+		"Host: example.org\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: " + string(mustMakeNonce()) + "\r\n" +
+		"Sec-WebSocket-Extensions: foo\r\n" +
+		"X-Custom: 1\r\n" +
+		"\r\n"
+
+	var seen []string
+	record := func(name string, ctx context.Context) {
+		vhost, _ := ctx.Value(vhostKey{}).(string)
+		seen = append(seen, name+"="+vhost)
+	}
+	u := Upgrader{
+		OnRequestContext: func(ctx context.Context, _ []byte) error {
+			record("request", ctx)
+			return nil
+		},
+		OnHostContext: func(ctx context.Context, _ []byte) error {
+			record("host", ctx)
+			return nil
+		},
+		OnHeaderContext: func(ctx context.Context, _, _ []byte) error {
+			record("header", ctx)
+			return nil
+		},
+		NegotiateContext: func(ctx context.Context, opt httphead.Option) (httphead.Option, error) {
+			record("negotiate", ctx)
+			return opt, nil
+		},
+		OnBeforeUpgradeContext: func(ctx context.Context) (HandshakeHeader, error) {
+			record("before", ctx)
+			return nil, nil
+		},
+	}
+	for _, test := range []struct {
+		name  string
+		vhost string
+	}{
+		{name: "context", vhost: "a.example.org"},
+		{name: "background"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			seen = seen[:0]
+			conn := struct {
+				io.Reader
+				io.Writer
+			}{strings.NewReader(req), ioutil.Discard}
+
+			var (
+				hs  Handshake
+				err error
+			)
+			if test.vhost != "" {
+				ctx := context.WithValue(context.Background(), vhostKey{}, test.vhost)
+				hs, err = u.UpgradeContext(ctx, conn)
+			} else {
+				hs, err = u.Upgrade(conn)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hs.Extensions) != 1 {
+				t.Errorf("unexpected extensions: %v", hs.Extensions)
+			}
+			exp := []string{
+				"request=" + test.vhost,
+				"host=" + test.vhost,
+				"negotiate=" + test.vhost,
+				"header=" + test.vhost,
+				"before=" + test.vhost,
+			}
+			if !reflect.DeepEqual(seen, exp) {
+				t.Errorf("unexpected callbacks:\nact: %v\nexp: %v", seen, exp)
+			}
+		})
+	}
+}
+
+func TestUpgraderLenient(t *testing.T) {
+	headers := func(extra string) string {
+		return "" +
+			"Host: example.org\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			extra +
+			"Sec-WebSocket-Version: 13\r\n" +
+			"Sec-WebSocket-Key: " + string(mustMakeNonce()) + "\r\n" +
+			"\r\n"
+	}
+	for _, test := range []struct {
+		name string
+		req  string
+	}{
+		{
+			name: "request line whitespace",
+			req:  "GET /ws HTTP/1.1 \t\r\n" + headers(""),
+		},
+		{
+			name: "header without colon",
+			req:  "GET /ws HTTP/1.1\r\n" + headers("X-Broken-Header\r\n"),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, lenient := range []bool{false, true} {
+				u := Upgrader{
+					Lenient: lenient,
+				}
+				conn := bytes.NewBufferString(test.req)
+				_, err := u.Upgrade(conn)
+				if lenient && err != nil {
+					t.Errorf("unexpected error in lenient mode: %v", err)
+				}
+				if !lenient && err != ErrMalformedRequest {
+					t.Errorf("unexpected error in strict mode: %v; want %v", err, ErrMalformedRequest)
+				}
+			}
+		})
+	}
+}
+
+func TestUpgraderOnConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	errOnConn := fmt.Errorf("stop")
+	done := make(chan error, 1)
+	go func() {
+		for _, reject := range []bool{false, true} {
+			conn, err := ln.Accept()
+			if err != nil {
+				done <- err
+				return
+			}
+			u := Upgrader{
+				OnConn: func(conn net.Conn) error {
+					tcp, ok := conn.(*net.TCPConn)
+					if !ok {
+						return fmt.Errorf("unexpected conn type: %T", conn)
+					}
+					if reject {
+						return errOnConn
+					}
+					return tcp.SetNoDelay(true)
+				},
+			}
+			_, err = u.Upgrade(conn)
+			conn.Close()
+			if reject && err == errOnConn {
+				err = nil
+			}
+			done <- err
+		}
+	}()
+
+	conn, _, _, err := Dial(context.Background(), "ws://"+ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := Dial(context.Background(), "ws://"+ln.Addr().String()); err == nil {
+		t.Errorf("expected handshake error")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// OnConn must not be called for connections which are not net.Conn.
+	u := Upgrader{
+		OnConn: func(net.Conn) error {
+			t.Errorf("unexpected OnConn() call")
+			return nil
+		},
+	}
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader("GET / HTTP/1.1\r\n\r\n"), ioutil.Discard}
+	u.Upgrade(rw)
+}
+
+func listenUnix(t *testing.T) (ln net.Listener, cleanup func()) {
+	dir, err := ioutil.TempDir("", "ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err = net.Listen("unix", filepath.Join(dir, "ws.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Skipf("unix sockets are not supported: %v", err)
+	}
+	return ln, func() {
+		ln.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUpgraderUnixSocket(t *testing.T) {
+	ln, cleanup := listenUnix(t)
+	defer cleanup()
+
+	exp := NewTextFrame([]byte("hello, unix"))
+	done := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		if _, ok := conn.(*net.UnixConn); !ok {
+			done <- fmt.Errorf("unexpected conn type: %T", conn)
+			return
+		}
+		if _, err = Upgrade(conn); err != nil {
+			done <- err
+			return
+		}
+		f, err := ReadFrame(conn)
+		if err == nil {
+			f = UnmaskFrameInPlace(f)
+			err = WriteFrame(conn, f)
+		}
+		done <- err
+	}()
+
+	d := Dialer{
+		NetDial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var nd net.Dialer
+			return nd.DialContext(ctx, "unix", ln.Addr().String())
+		},
+	}
+	conn, br, _, err := d.Dial(context.Background(), "ws://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if br != nil {
+		PutReader(br)
+	}
+	if err := WriteFrame(conn, MaskFrame(exp)); err != nil {
+		t.Fatal(err)
+	}
+	act, err := ReadFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(act.Payload, exp.Payload) {
+		t.Errorf("unexpected echo payload: %q; want %q", act.Payload, exp.Payload)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgraderUnixSocketTimeout(t *testing.T) {
+	ln, cleanup := listenUnix(t)
+	defer cleanup()
+
+	client, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Client sends nothing, so Upgrade() must be interrupted by deadline.
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = Upgrade(conn)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("unexpected Upgrade() error: %v; want timeout error", err)
+	}
+}
+
+func TestHTTPUpgraderUnixSocket(t *testing.T) {
+	ln, cleanup := listenUnix(t)
+	defer cleanup()
+
+	done := make(chan error, 1)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, _, _, err := HTTPUpgrader{
+				Timeout: time.Second,
+			}.Upgrade(r, w)
+			if err == nil {
+				conn.Close()
+			}
+			done <- err
+		}),
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	d := Dialer{
+		NetDial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var nd net.Dialer
+			return nd.DialContext(ctx, "unix", ln.Addr().String())
+		},
+	}
+	conn, _, _, err := d.Dial(context.Background(), "ws://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
 func BenchmarkHTTPUpgrader(b *testing.B) {
 	for _, bench := range upgradeCases {
 		bench.req.Header.Set(headerSecKey, string(bench.nonce[:]))
@@ -820,3 +1806,183 @@ func mustMakeNonce() (ret []byte) {
 	initNonce(ret)
 	return ret
 }
+
+func TestSniffTLS(t *testing.T) {
+	t.Run("client hello", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer server.Close()
+		go func() {
+			defer client.Close()
+			tls.Client(client, &tls.Config{ServerName: "example.org"}).Handshake()
+		}()
+		br := bufio.NewReader(server)
+		isTLS, err := SniffTLS(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isTLS {
+			t.Errorf("expected TLS to be detected")
+		}
+		if br.Buffered() == 0 {
+			t.Errorf("sniffed bytes were consumed")
+		}
+	})
+	t.Run("http", func(t *testing.T) {
+		br := bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n"))
+		isTLS, err := SniffTLS(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isTLS {
+			t.Errorf("unexpected TLS detection")
+		}
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != "GET / HTTP/1.1\r\n" {
+			t.Errorf("unexpected bytes after sniff: %q", line)
+		}
+	})
+	t.Run("eof", func(t *testing.T) {
+		br := bufio.NewReader(strings.NewReader(""))
+		if _, err := SniffTLS(br); err != io.EOF {
+			t.Errorf("unexpected error: %v; want %v", err, io.EOF)
+		}
+	})
+}
+
+func TestRealIP(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "192.168.1.1", "malformed"}
+	for _, test := range []struct {
+		name  string
+		chain []string
+		exp   string
+	}{
+		{
+			name: "no header",
+		},
+		{
+			name:  "direct client",
+			chain: []string{"5.6.7.8"},
+			exp:   "5.6.7.8",
+		},
+		{
+			// Client sent spoofed header which trusted proxy extended with
+			// real client address.
+			name:  "spoofed",
+			chain: []string{"1.2.3.4, 5.6.7.8"},
+			exp:   "5.6.7.8",
+		},
+		{
+			name:  "trusted hops",
+			chain: []string{"1.2.3.4, 5.6.7.8, 10.1.2.3", "192.168.1.1"},
+			exp:   "5.6.7.8",
+		},
+		{
+			// Address added by an untrusted proxy can not be relied on.
+			name:  "untrusted proxy",
+			chain: []string{"5.6.7.8, 9.9.9.9, 10.0.0.1"},
+			exp:   "9.9.9.9",
+		},
+		{
+			name:  "all trusted",
+			chain: []string{"10.0.0.2, 10.0.0.1"},
+			exp:   "10.0.0.2",
+		},
+		{
+			name:  "malformed",
+			chain: []string{"5.6.7.8, unknown, 10.0.0.1"},
+		},
+		{
+			name:  "ipv6",
+			chain: []string{"2001:db8::1, 10.0.0.1"},
+			exp:   "2001:db8::1",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h := make(http.Header)
+			for _, v := range test.chain {
+				h.Add("X-Forwarded-For", v)
+			}
+			act := RealIP(h, trusted)
+			if test.exp == "" {
+				if act != nil {
+					t.Errorf("unexpected ip: %s; want nil", act)
+				}
+				return
+			}
+			if exp := net.ParseIP(test.exp); !act.Equal(exp) {
+				t.Errorf("unexpected ip: %s; want %s", act, exp)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	handler := Handler(HTTPUpgrader{
+		Protocol: func(p string) bool { return p == "echo" },
+	}, func(conn net.Conn, hs Handshake) {
+		defer conn.Close()
+		if hs.Protocol != "echo" {
+			t.Errorf("unexpected protocol: %q", hs.Protocol)
+		}
+		f, err := ReadFrame(conn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		f = UnmaskFrameInPlace(f)
+		if err := WriteFrame(conn, NewTextFrame(f.Payload)); err != nil {
+			t.Error(err)
+		}
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	d := Dialer{
+		Protocols: []string{"echo"},
+	}
+	conn, br, _, err := d.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if br != nil {
+		t.Fatalf("unexpected buffered data after handshake")
+	}
+	if err := WriteFrame(conn, MaskFrame(NewTextFrame([]byte("hello")))); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ReadFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(f.Payload) != "hello" {
+		t.Errorf("unexpected echo: %q", f.Payload)
+	}
+
+	// Rejected handshake must not call fn.
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status code for non-upgrade request: %d", res.StatusCode)
+	}
+}
+
+func TestHandlerNotHijacker(t *testing.T) {
+	handler := Handler(HTTPUpgrader{}, func(net.Conn, Handshake) {
+		t.Errorf("unexpected handler call")
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("unexpected status code: %d; want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
@@ -1,10 +1,16 @@
 package tests
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
 	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -112,9 +118,811 @@ func TestFlateClientServer(t *testing.T) {
 	}
 }
 
+func TestFlateNegotiateFallback(t *testing.T) {
+	e := wsflate.Extension{
+		Parameters: wsflate.Parameters{
+			ServerMaxWindowBits: 12,
+		},
+	}
+	// Client offers deflate twice: the first offer is not acceptable because
+	// requested server window is larger than server supports.
+	req := "" +
+		"GET /ws HTTP/1.1\r\n" +
+		"Host: example.org\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Extensions: permessage-deflate;server_max_window_bits=15, " +
+		"permessage-deflate;server_max_window_bits=12\r\n" +
+		"\r\n"
+
+	var offers []string
+	u := ws.Upgrader{
+		Negotiate: func(opt httphead.Option) (httphead.Option, error) {
+			offers = append(offers, opt.String())
+			return e.Negotiate(opt)
+		},
+	}
+	conn := bytes.NewBufferString(req)
+	hs, err := u.Upgrade(conn)
+	if err != nil {
+		t.Fatalf("unexpected Upgrade() error: %v", err)
+	}
+	if n := len(offers); n != 2 {
+		t.Fatalf("unexpected number of negotiated offers: %d; want 2", n)
+	}
+	if n := len(hs.Extensions); n != 1 {
+		t.Fatalf("unexpected number of accepted extensions: %d; want 1", n)
+	}
+	if act, exp := hs.Extensions[0], e.Parameters.Option(); !act.Equal(exp) {
+		t.Errorf("unexpected accepted extension: %s; want %s", act, exp)
+	}
+	params, accepted := e.Accepted()
+	if !accepted {
+		t.Fatalf("extension is not accepted")
+	}
+	if params.ServerMaxWindowBits != 12 {
+		t.Errorf(
+			"unexpected accepted offer server window bits: %d; want 12",
+			params.ServerMaxWindowBits,
+		)
+	}
+
+	res := conn.String()
+	if exp := "Sec-WebSocket-Extensions: permessage-deflate;server_max_window_bits=12\r\n"; !strings.Contains(res, exp) {
+		t.Errorf("unexpected response:\n%s\nwant it to contain %q", res, exp)
+	}
+}
+
 func reverse(buf []byte) []byte {
 	for i, j := 0, len(buf)-1; i < j; i, j = i+1, j-1 {
 		buf[i], buf[j] = buf[j], buf[i]
 	}
 	return buf
 }
+
+// rsv2Extension is a no-op extension which marks each message with RSV2 bit.
+type rsv2Extension struct{}
+
+func (rsv2Extension) SetBits(h ws.Header) (ws.Header, error) {
+	if h.OpCode.IsData() && h.OpCode != ws.OpContinuation {
+		h.Rsv |= ws.Rsv(false, true, false)
+	}
+	return h, nil
+}
+
+func (rsv2Extension) UnsetBits(h ws.Header) (ws.Header, error) {
+	_, r2, _ := ws.RsvBits(h.Rsv)
+	first := h.OpCode.IsData() && h.OpCode != ws.OpContinuation
+	if r2 != first {
+		return h, fmt.Errorf("unexpected rsv2 bit %t for %v frame", r2, h.OpCode)
+	}
+	r1, _, r3 := ws.RsvBits(h.Rsv)
+	h.Rsv = ws.Rsv(r1, false, r3)
+	return h, nil
+}
+
+func TestFlateExtensionChain(t *testing.T) {
+	var (
+		buf   bytes.Buffer
+		order []string
+		rsv2  rsv2Extension
+		exp   = make([]byte, 4096)
+		state = ws.StateExtended
+	)
+	// Use random payload to make compressed message fragmented.
+	rand.New(rand.NewSource(42)).Read(exp)
+	var send wsflate.MessageState
+	send.SetCompressed(true)
+	w := wsutil.NewWriterSize(&buf, state|ws.StateClientSide, ws.OpText, 64)
+	w.SetExtensions(&send, rsv2)
+	fw := wsflate.NewWriter(w, func(w io.Writer) wsflate.Compressor {
+		fw, _ := flate.NewWriter(w, 9)
+		return fw
+	})
+	if _, err := fw.Write(exp); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var recv wsflate.MessageState
+	r := wsutil.Reader{
+		Source: &buf,
+		State:  state | ws.StateServerSide,
+		Extensions: []wsutil.RecvExtension{
+			wsutil.RecvExtensionFunc(func(h ws.Header) (ws.Header, error) {
+				order = append(order, "deflate")
+				return recv.UnsetBits(h)
+			}),
+			wsutil.RecvExtensionFunc(func(h ws.Header) (ws.Header, error) {
+				order = append(order, "rsv2")
+				return rsv2.UnsetBits(h)
+			}),
+		},
+	}
+	h, err := r.NextFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Rsv != 0 {
+		t.Errorf("unexpected rsv bits left: %#x", h.Rsv)
+	}
+	if h.Fin {
+		t.Fatalf("expected message to be fragmented")
+	}
+	if !recv.IsCompressed() {
+		t.Fatalf("expected message to be compressed")
+	}
+	if len(order) != 2 || order[0] != "rsv2" || order[1] != "deflate" {
+		t.Errorf("unexpected extensions order: %v; want [rsv2 deflate]", order)
+	}
+	fr := wsflate.NewReader(&r, func(r io.Reader) wsflate.Decompressor {
+		return flate.NewReader(r)
+	})
+	act, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(act, exp) {
+		t.Errorf("unexpected message after round trip")
+	}
+}
+
+func TestFlateMultiFrameFlush(t *testing.T) {
+	var (
+		buf   bytes.Buffer
+		exp   = make([]byte, 2048)
+		state = ws.StateExtended
+		tail  = []byte{0, 0, 0xff, 0xff}
+	)
+	rand.New(rand.NewSource(42)).Read(exp)
+
+	var send wsflate.MessageState
+	send.SetCompressed(true)
+	w := wsutil.NewWriterSize(&buf, state|ws.StateServerSide, ws.OpBinary, 64)
+	w.SetExtensions(&send)
+	fw := wsflate.NewWriter(w, func(w io.Writer) wsflate.Compressor {
+		fw, _ := flate.NewWriter(w, 9)
+		return fw
+	})
+	// Flush compressor in the middle of the message to make it emit sync
+	// flush trailer which must not end up at the end of the message.
+	half := len(exp) / 2
+	for _, p := range [][]byte{exp[:half], exp[half:]} {
+		if _, err := fw.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := fw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		frames  []ws.Frame
+		payload []byte
+	)
+	for buf.Len() > 0 {
+		f, err := ws.ReadFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, f)
+		payload = append(payload, f.Payload...)
+	}
+	if len(frames) < 2 {
+		t.Fatalf("expected message to be fragmented")
+	}
+	for i, f := range frames {
+		last := i == len(frames)-1
+		if f.Header.Fin != last {
+			t.Errorf("unexpected fin bit of #%d frame: %t", i, f.Header.Fin)
+		}
+		if rsv1, _, _ := ws.RsvBits(f.Header.Rsv); rsv1 != (i == 0) {
+			t.Errorf("unexpected rsv1 bit of #%d frame: %t", i, rsv1)
+		}
+		if bytes.HasSuffix(f.Payload, tail) {
+			t.Errorf("unexpected compression trailer at the end of #%d frame", i)
+		}
+	}
+
+	// Restore trimmed trailer and terminate the stream with final empty
+	// block to read it back with standard inflater.
+	payload = append(payload, tail...)
+	payload = append(payload, 1, 0, 0, 0xff, 0xff)
+	act, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(act, exp) {
+		t.Errorf("unexpected message after inflate")
+	}
+}
+
+func TestFlateReaderOnRsv(t *testing.T) {
+	var (
+		buf   bytes.Buffer
+		state = ws.StateExtended
+	)
+	var send wsflate.MessageState
+	w := wsutil.NewWriter(&buf, state|ws.StateServerSide, ws.OpText)
+	w.SetExtensions(&send)
+	fw := wsflate.NewWriter(w, func(w io.Writer) wsflate.Compressor {
+		fw, _ := flate.NewWriter(w, 9)
+		return fw
+	})
+	for _, compressed := range []bool{true, false} {
+		send.SetCompressed(compressed)
+		p := []byte("hello, rsv")
+		if compressed {
+			fw.Reset(w)
+			if _, err := fw.Write(p); err != nil {
+				t.Fatal(err)
+			}
+			if err := fw.Close(); err != nil {
+				t.Fatal(err)
+			}
+		} else if _, err := w.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		recv wsflate.MessageState
+		rsv  []byte
+	)
+	r := wsutil.Reader{
+		Source:     &buf,
+		State:      state | ws.StateClientSide,
+		Extensions: []wsutil.RecvExtension{&recv},
+		OnRsv: func(bits byte) {
+			rsv = append(rsv, bits)
+		},
+	}
+	for i := 0; i < 2; i++ {
+		h, err := r.NextFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Rsv != 0 {
+			t.Errorf("unexpected rsv bits left by extension: %#x", h.Rsv)
+		}
+		if err := r.Discard(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if exp := []byte{ws.Rsv(true, false, false), 0}; !bytes.Equal(rsv, exp) {
+		t.Errorf("unexpected rsv bits reported: %v; want %v", rsv, exp)
+	}
+}
+
+func TestFlateReaderOnMessage(t *testing.T) {
+	var (
+		buf   bytes.Buffer
+		state = ws.StateExtended
+	)
+	var send wsflate.MessageState
+	send.SetCompressed(true)
+	w := wsutil.NewWriter(&buf, state|ws.StateServerSide, ws.OpText)
+	w.SetExtensions(&send)
+	fw := wsflate.NewWriter(w, func(w io.Writer) wsflate.Compressor {
+		fw, _ := flate.NewWriter(w, 9)
+		return fw
+	})
+	msg := bytes.Repeat([]byte("hello, compressed message "), 100)
+	// Write message in fragments.
+	for i := 0; i < len(msg); i += 500 {
+		j := i + 500
+		if j > len(msg) {
+			j = len(msg)
+		}
+		if _, err := fw.Write(msg[i:j]); err != nil {
+			t.Fatal(err)
+		}
+		if err := fw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.FlushFragment(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		recv wsflate.MessageState
+		size int64
+	)
+	r := wsutil.Reader{
+		Source:     &buf,
+		State:      state | ws.StateClientSide,
+		Extensions: []wsutil.RecvExtension{&recv},
+		Transform: func(_ ws.OpCode, p []byte) ([]byte, error) {
+			if !recv.IsCompressed() {
+				return p, nil
+			}
+			return wsflate.DefaultHelper.Decompress(p)
+		},
+		OnMessage: func(op ws.OpCode, n int64) {
+			if op != ws.OpText {
+				t.Errorf("unexpected message op code: %v", op)
+			}
+			size = n
+		},
+	}
+	h, err := r.NextFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Fin {
+		t.Errorf("transformed message is not final")
+	}
+	act, err := ioutil.ReadAll(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(act, msg) {
+		t.Fatalf("unexpected message")
+	}
+	if size != int64(len(msg)) {
+		t.Errorf("unexpected reported size: %d; want %d", size, len(msg))
+	}
+}
+
+func TestFlateWriterNextCompressed(t *testing.T) {
+	var (
+		buf   bytes.Buffer
+		state = ws.StateExtended
+	)
+	var send wsflate.MessageState
+	send.SetCompressed(true)
+	w := wsutil.NewWriter(&buf, state|ws.StateServerSide, ws.OpText)
+	w.SetExtensions(&send)
+	fw := wsflate.NewWriter(w, func(w io.Writer) wsflate.Compressor {
+		fw, _ := flate.NewWriter(w, 9)
+		return fw
+	})
+	messages := []struct {
+		text       string
+		compressed bool
+	}{
+		{"compressed by default", true},
+		{"explicitly uncompressed", false},
+		{"compressed again", true},
+		{"uncompressed again", false},
+		{"explicitly compressed", true},
+	}
+	for i, m := range messages {
+		switch {
+		case !m.compressed:
+			w.SetNextCompressed(false)
+		case i == len(messages)-1:
+			// Override extension state which is off now.
+			send.SetCompressed(false)
+			w.SetNextCompressed(true)
+		}
+		if m.compressed {
+			fw.Reset(w)
+			if _, err := fw.Write([]byte(m.text)); err != nil {
+				t.Fatal(err)
+			}
+			if err := fw.Close(); err != nil {
+				t.Fatal(err)
+			}
+		} else if _, err := w.Write([]byte(m.text)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var recv wsflate.MessageState
+	r := wsutil.Reader{
+		Source:     &buf,
+		State:      state | ws.StateClientSide,
+		Extensions: []wsutil.RecvExtension{&recv},
+	}
+	fr := wsflate.NewReader(&r, func(r io.Reader) wsflate.Decompressor {
+		return flate.NewReader(r)
+	})
+	for i, m := range messages {
+		if _, err := r.NextFrame(); err != nil {
+			t.Fatal(err)
+		}
+		if act := recv.IsCompressed(); act != m.compressed {
+			t.Errorf("#%d: unexpected compressed flag: %t; want %t", i, act, m.compressed)
+		}
+		var src io.Reader = &r
+		if recv.IsCompressed() {
+			fr.Reset(&r)
+			src = fr
+		}
+		p, err := ioutil.ReadAll(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(p) != m.text {
+			t.Errorf("#%d: unexpected message: %q; want %q", i, p, m.text)
+		}
+	}
+}
+
+func TestFlateWriterAutoFlush(t *testing.T) {
+	var (
+		buf   bytes.Buffer
+		conn  = bufio.NewWriter(&buf)
+		state = ws.StateExtended
+	)
+	var send wsflate.MessageState
+	send.SetCompressed(true)
+	w := wsutil.NewWriter(conn, state|ws.StateServerSide, ws.OpText)
+	w.AutoFlush = true
+	w.SetExtensions(&send)
+	fw := wsflate.NewWriter(w, func(w io.Writer) wsflate.Compressor {
+		fw, _ := flate.NewWriter(w, 9)
+		return fw
+	})
+	exp := []string{"hello, ", "auto ", "flush!"}
+	for _, p := range exp {
+		if _, err := fw.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected bytes on the wire before message end")
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	frame, err := ws.ReadFrame(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected bytes after the first frame: %d", buf.Len())
+	}
+	if !frame.Header.Fin {
+		t.Errorf("message is fragmented")
+	}
+	frame, err = wsflate.DecompressFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act, exp := string(frame.Payload), strings.Join(exp, ""); act != exp {
+		t.Errorf("unexpected message: %q; want %q", act, exp)
+	}
+}
+
+func TestFlateReaderOnMessageDecompressed(t *testing.T) {
+	var (
+		buf   bytes.Buffer
+		state = ws.StateExtended
+	)
+	var send wsflate.MessageState
+	send.SetCompressed(true)
+	w := wsutil.NewWriter(&buf, state|ws.StateServerSide, ws.OpBinary)
+	w.SetExtensions(&send)
+	fw := wsflate.NewWriter(w, func(w io.Writer) wsflate.Compressor {
+		fw, _ := flate.NewWriter(w, 9)
+		return fw
+	})
+	msg := bytes.Repeat([]byte("hello, compressed message "), 100)
+	for i := 0; i < len(msg); i += 500 {
+		j := i + 500
+		if j > len(msg) {
+			j = len(msg)
+		}
+		if _, err := fw.Write(msg[i:j]); err != nil {
+			t.Fatal(err)
+		}
+		if err := fw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.FlushFragment(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		recv wsflate.MessageState
+		wire int64
+		size int64
+		n    int
+	)
+	r := wsutil.Reader{
+		Source:     &buf,
+		State:      state | ws.StateClientSide,
+		Extensions: []wsutil.RecvExtension{&recv},
+		OnMessage: func(_ ws.OpCode, n int64) {
+			wire = n
+		},
+	}
+	fr := wsflate.NewReader(&r, func(r io.Reader) wsflate.Decompressor {
+		return flate.NewReader(r)
+	})
+	fr.OnMessage = func(n int64) {
+		size += n
+	}
+	if _, err := r.NextFrame(); err != nil {
+		t.Fatal(err)
+	}
+	if !recv.IsCompressed() {
+		t.Fatalf("message is not compressed")
+	}
+	// Read message by small chunks to make sure callback is called once.
+	p := make([]byte, 100)
+	for {
+		m, err := fr.Read(p)
+		n += m
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fr.Read(p); err != io.EOF {
+		t.Fatalf("unexpected error after message end: %v", err)
+	}
+	if n != len(msg) {
+		t.Fatalf("unexpected number of bytes read: %d; want %d", n, len(msg))
+	}
+	if size != int64(len(msg)) {
+		t.Errorf("unexpected decompressed size: %d; want %d", size, len(msg))
+	}
+	if wire == 0 || wire >= size {
+		t.Errorf("unexpected wire size: %d", wire)
+	}
+}
+
+func TestFlateTransformOrder(t *testing.T) {
+	const key = 0x5a
+	xor := func(_ ws.OpCode, p []byte) ([]byte, error) {
+		for i := range p {
+			p[i] ^= key
+		}
+		return p, nil
+	}
+	var (
+		buf   bytes.Buffer
+		state = ws.StateExtended
+	)
+	var send wsflate.MessageState
+	send.SetCompressed(true)
+	w := wsutil.NewWriter(&buf, state|ws.StateServerSide, ws.OpText)
+	w.SetExtensions(&send)
+	w.SetTransform(xor)
+	fw := wsflate.NewWriter(w, func(w io.Writer) wsflate.Compressor {
+		fw, _ := flate.NewWriter(w, 9)
+		return fw
+	})
+	msg := bytes.Repeat([]byte("hello, transformed message "), 100)
+	if _, err := fw.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Transform runs outside of compression on write: the wire payload must
+	// become a valid compressed message once transform is reverted.
+	wire := append([]byte(nil), buf.Bytes()...)
+	f, err := ws.ReadFrame(bytes.NewReader(wire))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Header.Fin || f.Header.Rsv != ws.Rsv(true, false, false) {
+		t.Fatalf("unexpected frame header: %+v", f.Header)
+	}
+	if len(f.Payload) >= len(msg) {
+		t.Fatalf("message is not compressed: %d bytes on the wire", len(f.Payload))
+	}
+	if _, err := wsflate.DecompressFrame(f); err == nil {
+		t.Fatalf("wire payload is decompressible without reverting transform")
+	}
+	xor(ws.OpText, f.Payload)
+	f, err = wsflate.DecompressFrame(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.Payload, msg) {
+		t.Fatalf("unexpected decompressed payload")
+	}
+
+	// Transform runs inside of decompression on read.
+	var recv wsflate.MessageState
+	r := wsutil.Reader{
+		Source:     bytes.NewReader(wire),
+		State:      state | ws.StateClientSide,
+		Extensions: []wsutil.RecvExtension{&recv},
+		Transform:  xor,
+	}
+	fr := wsflate.NewReader(&r, func(r io.Reader) wsflate.Decompressor {
+		return flate.NewReader(r)
+	})
+	h, err := r.NextFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.OpCode != ws.OpText {
+		t.Fatalf("unexpected header: %+v", h)
+	}
+	if !recv.IsCompressed() {
+		t.Fatalf("message is not compressed")
+	}
+	act, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(act, msg) {
+		t.Fatalf("unexpected message read")
+	}
+}
+
+func TestCopyMessageDecompress(t *testing.T) {
+	var (
+		buf   bytes.Buffer
+		state = ws.StateExtended
+	)
+	var send wsflate.MessageState
+	w := wsutil.NewWriter(&buf, state|ws.StateServerSide, ws.OpText)
+	w.SetExtensions(&send)
+	fw := wsflate.NewWriter(w, func(w io.Writer) wsflate.Compressor {
+		fw, _ := flate.NewWriter(w, 9)
+		return fw
+	})
+
+	// Compressed text message split into fragments with ping in between.
+	text := bytes.Repeat([]byte("hello, compressed message "), 100)
+	send.SetCompressed(true)
+	if _, err := fw.Write(text[:1000]); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.FlushFragment(); err != nil {
+		t.Fatal(err)
+	}
+	ws.MustWriteFrame(&buf, ws.NewPingFrame([]byte("ping")))
+	if _, err := fw.Write(text[1000:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Uncompressed binary message.
+	binary := []byte("uncompressed")
+	send.SetCompressed(false)
+	w.ResetOp(ws.OpBinary)
+	if _, err := w.Write(binary); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{&buf, &out}
+
+	fr := wsflate.NewReader(nil, func(r io.Reader) wsflate.Decompressor {
+		return flate.NewReader(r)
+	})
+	decompress := func(r io.Reader) io.Reader {
+		fr.Reset(r)
+		return fr
+	}
+	for _, exp := range []wsutil.Message{
+		{OpCode: ws.OpText, Payload: text},
+		{OpCode: ws.OpBinary, Payload: binary},
+	} {
+		var dst bytes.Buffer
+		op, n, err := wsutil.CopyMessageDecompress(&dst, rw, state|ws.StateClientSide, decompress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != exp.OpCode {
+			t.Errorf("unexpected op code: %v; want %v", op, exp.OpCode)
+		}
+		if n != int64(len(exp.Payload)) {
+			t.Errorf("unexpected number of bytes copied: %d; want %d", n, len(exp.Payload))
+		}
+		if !bytes.Equal(dst.Bytes(), exp.Payload) {
+			t.Errorf("unexpected payload of %v message", exp.OpCode)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("unexpected unread bytes: %d", buf.Len())
+	}
+	if f, err := ws.ReadFrame(&out); err != nil || f.Header.OpCode != ws.OpPong {
+		t.Errorf("ping was not responded: %v %v", f.Header.OpCode, err)
+	}
+}
+
+func TestFlateEmptyMessage(t *testing.T) {
+	var (
+		buf   bytes.Buffer
+		state = ws.StateExtended
+	)
+	var send wsflate.MessageState
+	send.SetCompressed(true)
+	w := wsutil.NewWriter(&buf, state|ws.StateServerSide, ws.OpText)
+	w.SetExtensions(&send)
+	fw := wsflate.NewWriter(w, func(w io.Writer) wsflate.Compressor {
+		fw, _ := flate.NewWriter(w, 9)
+		return fw
+	})
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Some peers send empty compressed message without any payload.
+	f := ws.NewTextFrame(nil)
+	f.Header.Rsv = ws.Rsv(true, false, false)
+	ws.MustWriteFrame(&buf, f)
+
+	var recv wsflate.MessageState
+	r := wsutil.Reader{
+		Source:     &buf,
+		State:      state | ws.StateClientSide,
+		Extensions: []wsutil.RecvExtension{&recv},
+	}
+	fr := wsflate.NewReader(nil, func(r io.Reader) wsflate.Decompressor {
+		return flate.NewReader(r)
+	})
+	for i := 0; i < 2; i++ {
+		h, err := r.NextFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.OpCode != ws.OpText || !recv.IsCompressed() {
+			t.Fatalf("unexpected #%d message: %v compressed=%t", i, h.OpCode, recv.IsCompressed())
+		}
+		fr.Reset(&r)
+		p, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatalf("unexpected error reading #%d message: %v", i, err)
+		}
+		if len(p) != 0 {
+			t.Errorf("unexpected payload of #%d message: %q", i, p)
+		}
+	}
+}
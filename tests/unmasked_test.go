@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+func TestUnmaskedClientServer(t *testing.T) {
+	client, server := net.Pipe()
+
+	serverDone := make(chan error, 1)
+	go func() {
+		defer close(serverDone)
+		u := ws.Upgrader{
+			AllowUnmaskedClient: true,
+		}
+		hs, err := u.Upgrade(server)
+		if err != nil {
+			serverDone <- err
+			return
+		}
+		if !hs.Unmasked {
+			t.Errorf("server handshake is not unmasked")
+		}
+		state := ws.StateServerSide | ws.StateUnmasked
+
+		// Read raw header to ensure that frame is really not masked.
+		h, err := ws.ReadHeader(server)
+		if err != nil {
+			serverDone <- err
+			return
+		}
+		if h.Masked {
+			t.Errorf("unexpected masked frame from client")
+		}
+		if err := ws.CheckHeader(h, state); err != nil {
+			serverDone <- err
+			return
+		}
+		if err := ws.CheckHeader(h, ws.StateServerSide); err != ws.ErrProtocolMaskRequired {
+			t.Errorf("unexpected CheckHeader() error: %v; want %v", err, ws.ErrProtocolMaskRequired)
+		}
+		p := make([]byte, h.Length)
+		if _, err := io.ReadFull(server, p); err != nil {
+			serverDone <- err
+			return
+		}
+		if err := wsutil.WriteMessage(server, state, ws.OpText, p); err != nil {
+			serverDone <- err
+			return
+		}
+
+		// Then read through the wsutil helpers.
+		p, _, err = wsutil.ReadData(server, state)
+		if err != nil {
+			serverDone <- err
+			return
+		}
+		serverDone <- wsutil.WriteMessage(server, state, ws.OpText, p)
+	}()
+
+	d := ws.Dialer{
+		DisableMasking: true,
+		NetDial: func(_ context.Context, network, addr string) (net.Conn, error) {
+			return client, nil
+		},
+	}
+	conn, _, hs, err := d.Dial(context.Background(), "ws://stubbed")
+	if err != nil {
+		t.Fatalf("unexpected Dial() error: %v", err)
+	}
+	defer conn.Close()
+	if !hs.Unmasked {
+		t.Fatalf("client handshake is not unmasked")
+	}
+	state := ws.StateClientSide | ws.StateUnmasked
+
+	for _, msg := range [][]byte{
+		[]byte("hello"),
+		bytes.Repeat([]byte("unmasked"), 1024),
+	} {
+		w := wsutil.NewWriter(conn, state, ws.OpText)
+		if _, err := w.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		echo, _, err := wsutil.ReadData(conn, state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(echo, msg) {
+			t.Fatalf("unexpected echo message")
+		}
+	}
+	if err := <-serverDone; err != nil {
+		t.Fatalf("unexpected server error: %v", err)
+	}
+}
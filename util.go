@@ -39,6 +39,23 @@ func SelectEqual(v string) func(string) bool {
 	}
 }
 
+// IsValidProtocolToken reports whether s could be used as a subprotocol name.
+// That is, s must be a non-empty HTTP token, without spaces, commas or other
+// separators.
+//
+// See https://tools.ietf.org/html/rfc6455#section-4.1
+func IsValidProtocolToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !httphead.OctetTypes[s[i]].IsToken() {
+			return false
+		}
+	}
+	return true
+}
+
 // asciiToInt converts bytes to int.
 func asciiToInt(bts []byte) (ret int, err error) {
 	// ASCII numbers all start with the high-order bits 0011.
@@ -149,9 +166,24 @@ func canonicalizeHeaderKey(k []byte) {
 // NOTE: it may return copied flag to notify that returned buffer is safe to
 // use.
 func readLine(br *bufio.Reader) ([]byte, error) {
+	line, _, err := readLineLimit(br, -1)
+	return line, err
+}
+
+// errLineTooLong is returned by readLineLimit() when line exceeds the limit.
+var errLineTooLong = fmt.Errorf("line is too long")
+
+// readLineLimit is the same as readLine() except the thing that it returns
+// errLineTooLong if line (including line feed) is longer than max bytes.
+// Negative max means no limit. It also returns number of bytes consumed from
+// br.
+func readLineLimit(br *bufio.Reader, max int) ([]byte, int, error) {
 	var line []byte
 	for {
 		bts, err := br.ReadSlice('\n')
+		if max >= 0 && len(line)+len(bts) > max {
+			return nil, len(line) + len(bts), errLineTooLong
+		}
 		if err == bufio.ErrBufferFull {
 			// Copy bytes because next read will discard them.
 			line = append(line, bts...)
@@ -166,7 +198,7 @@ func readLine(br *bufio.Reader) ([]byte, error) {
 		}
 
 		if err != nil {
-			return line, err
+			return line, len(line), err
 		}
 
 		// Size of line is at least 1.
@@ -180,7 +212,7 @@ func readLine(br *bufio.Reader) ([]byte, error) {
 			line = line[:n-1]
 		}
 
-		return line, nil
+		return line, n, nil
 	}
 }
 
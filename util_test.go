@@ -319,6 +319,28 @@ func TestHasToken(t *testing.T) {
 	}
 }
 
+func TestIsValidProtocolToken(t *testing.T) {
+	for _, test := range []struct {
+		in  string
+		exp bool
+	}{
+		{"chat", true},
+		{"v2.bin.example.com", true},
+		{"graphql-ws", true},
+		{"", false},
+		{"my proto", false},
+		{"chat,superchat", false},
+		{"chat\r\n", false},
+		{"\"chat\"", false},
+	} {
+		t.Run(test.in, func(t *testing.T) {
+			if act := IsValidProtocolToken(test.in); act != test.exp {
+				t.Errorf("IsValidProtocolToken(%q) = %t; want %t", test.in, act, test.exp)
+			}
+		})
+	}
+}
+
 func BenchmarkHasToken(b *testing.B) {
 	for i, bench := range []struct {
 		header string
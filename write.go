@@ -5,7 +5,8 @@ import (
 	"io"
 )
 
-// Header size length bounds in bytes.
+// Header size length bounds in bytes. Buffers which are supposed to hold any
+// frame header should be at least MaxHeaderSize bytes long.
 const (
 	MaxHeaderSize = 14
 	MinHeaderSize = 2
@@ -31,11 +32,11 @@ const (
 func HeaderSize(h Header) (n int) {
 	switch {
 	case h.Length < 126:
-		n = 2
+		n = MinHeaderSize
 	case h.Length <= len16:
-		n = 4
+		n = MinHeaderSize + 2
 	case h.Length <= len64:
-		n = 10
+		n = MinHeaderSize + 8
 	default:
 		return -1
 	}
@@ -47,6 +48,15 @@ func HeaderSize(h Header) (n int) {
 
 // WriteHeader writes header binary representation into w.
 func WriteHeader(w io.Writer, h Header) error {
+	_, err := WriteHeaderN(w, h)
+	return err
+}
+
+// WriteHeaderN writes header binary representation into w and returns the
+// number of bytes written. Only header bytes are written, thus h.Length bytes
+// of payload are expected to be written to w by the caller right after.
+// See HeaderForPayload() for notes on such usage.
+func WriteHeaderN(w io.Writer, h Header) (int, error) {
 	// Make slice of bytes with capacity 14 that could hold any header.
 	bts := make([]byte, MaxHeaderSize)
 
@@ -60,20 +70,20 @@ func WriteHeader(w io.Writer, h Header) error {
 	switch {
 	case h.Length <= len7:
 		bts[1] = byte(h.Length)
-		n = 2
+		n = MinHeaderSize
 
 	case h.Length <= len16:
 		bts[1] = 126
 		binary.BigEndian.PutUint16(bts[2:4], uint16(h.Length))
-		n = 4
+		n = MinHeaderSize + 2
 
 	case h.Length <= len64:
 		bts[1] = 127
 		binary.BigEndian.PutUint64(bts[2:10], uint64(h.Length))
-		n = 10
+		n = MinHeaderSize + 8
 
 	default:
-		return ErrHeaderLengthUnexpected
+		return 0, ErrHeaderLengthUnexpected
 	}
 
 	if h.Masked {
@@ -81,12 +91,13 @@ func WriteHeader(w io.Writer, h Header) error {
 		n += copy(bts[n:], h.Mask[:])
 	}
 
-	_, err := w.Write(bts[:n])
-
-	return err
+	return w.Write(bts[:n])
 }
 
 // WriteFrame writes frame binary representation into w.
+//
+// WriteFrame does not retain f.Payload after return, so its bytes could be
+// reused or returned to a pool right after the call.
 func WriteFrame(w io.Writer, f Frame) error {
 	err := WriteHeader(w, f.Header)
 	if err != nil {
@@ -96,9 +107,41 @@ func WriteFrame(w io.Writer, f Frame) error {
 	return err
 }
 
+// WriteFrameMasked writes binary representation of frame f masked with given
+// mask into w. Unlike MaskFrameWith, it does not modify or copy f.Payload:
+// payload is masked by chunks while writing.
+//
+// It is intended for tooling such as traffic replayers, which need the
+// written bytes to match previously captured frames exactly. Client
+// connections should use random masks (see NewMask()) instead.
+func WriteFrameMasked(w io.Writer, f Frame, mask [4]byte) error {
+	f.Header.Masked = true
+	f.Header.Mask = mask
+	if err := WriteHeader(w, f.Header); err != nil {
+		return err
+	}
+	var buf [512]byte
+	for i := 0; i < len(f.Payload); {
+		n := copy(buf[:], f.Payload[i:])
+		Cipher(buf[:n], mask, i)
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		i += n
+	}
+	return nil
+}
+
 // MustWriteFrame is like WriteFrame but panics if frame can not be read.
 func MustWriteFrame(w io.Writer, f Frame) {
 	if err := WriteFrame(w, f); err != nil {
 		panic(err)
 	}
 }
+
+// WritePrecompiled writes precompiled frame to w. It does not do any
+// allocations or copying, thus it is the fastest way to send the same frame
+// to many connections.
+func WritePrecompiled(w io.Writer, pf PrecompiledFrame) (int, error) {
+	return w.Write(pf.bts)
+}
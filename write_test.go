@@ -7,6 +7,34 @@ import (
 	"testing"
 )
 
+// Compile time assertions of header size bounds.
+var (
+	_ [MaxHeaderSize - 14]struct{}
+	_ [14 - MaxHeaderSize]struct{}
+	_ [MinHeaderSize - 2]struct{}
+	_ [2 - MinHeaderSize]struct{}
+)
+
+func TestHeaderSizeBounds(t *testing.T) {
+	if n := HeaderSize(Header{}); n != MinHeaderSize {
+		t.Errorf("unexpected min header size: %d; want %d", n, MinHeaderSize)
+	}
+	max := Header{
+		Length: len64,
+		Masked: true,
+	}
+	if n := HeaderSize(max); n != MaxHeaderSize {
+		t.Errorf("unexpected max header size: %d; want %d", n, MaxHeaderSize)
+	}
+	var buf bytes.Buffer
+	if err := WriteHeader(&buf, max); err != nil {
+		t.Fatal(err)
+	}
+	if n := buf.Len(); n != MaxHeaderSize {
+		t.Errorf("unexpected written max header size: %d; want %d", n, MaxHeaderSize)
+	}
+}
+
 func TestWriteHeader(t *testing.T) {
 	for i, test := range RWTestCases {
 		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
@@ -28,6 +56,56 @@ func TestWriteHeader(t *testing.T) {
 	}
 }
 
+func TestWriteHeaderN(t *testing.T) {
+	for _, test := range []struct {
+		length int64
+		data   []byte
+	}{
+		{0, []byte{0x82, 0}},
+		{125, []byte{0x82, 125}},
+		{126, []byte{0x82, 126, 0, 126}},
+		{65535, []byte{0x82, 126, 0xff, 0xff}},
+		{65536, []byte{0x82, 127, 0, 0, 0, 0, 0, 1, 0, 0}},
+		{1 << 40, []byte{0x82, 127, 0, 0, 1, 0, 0, 0, 0, 0}},
+	} {
+		t.Run(fmt.Sprintf("%d", test.length), func(t *testing.T) {
+			h := HeaderForPayload(OpBinary, true, false, test.length)
+			var buf bytes.Buffer
+			n, err := WriteHeaderN(&buf, h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(test.data) || n != HeaderSize(h) {
+				t.Errorf("unexpected number of bytes written: %d; want %d", n, len(test.data))
+			}
+			if bts := buf.Bytes(); !bytes.Equal(bts, test.data) {
+				t.Errorf("WriteHeaderN()\nwrote:\n\t%08b\nwant:\n\t%08b", bts, test.data)
+			}
+		})
+	}
+	t.Run("masked", func(t *testing.T) {
+		h := HeaderForPayload(OpText, false, true, 5)
+		if !h.Masked {
+			t.Fatalf("expected masked header")
+		}
+		var buf bytes.Buffer
+		n, err := WriteHeaderN(&buf, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != MinHeaderSize+4 {
+			t.Errorf("unexpected number of bytes written: %d", n)
+		}
+		act, err := ReadHeader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act != h {
+			t.Errorf("unexpected header read back: %+v; want %+v", act, h)
+		}
+	})
+}
+
 func BenchmarkWriteHeader(b *testing.B) {
 	for _, bench := range RWBenchCases {
 		b.Run(bench.label, func(b *testing.B) {
@@ -39,3 +117,93 @@ func BenchmarkWriteHeader(b *testing.B) {
 		})
 	}
 }
+
+func TestWriteFrameMasked(t *testing.T) {
+	// Masked "Hello" text frame from RFC6455 section 5.7.
+	captured := []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}
+	mask := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+	payload := []byte("Hello")
+	var buf bytes.Buffer
+	if err := WriteFrameMasked(&buf, NewTextFrame(payload), mask); err != nil {
+		t.Fatal(err)
+	}
+	if act := buf.Bytes(); !bytes.Equal(act, captured) {
+		t.Errorf("unexpected frame bytes:\nact: %#x\nexp: %#x", act, captured)
+	}
+	if string(payload) != "Hello" {
+		t.Errorf("payload was modified: %q", payload)
+	}
+}
+
+func TestWriteFrameMaskedLarge(t *testing.T) {
+	// Payload larger than internal chunk buffer must be masked with the
+	// correct mask offset across chunks.
+	payload := bytes.Repeat([]byte("abcdefg"), 1000)
+	mask := [4]byte{1, 2, 3, 4}
+
+	var act, exp bytes.Buffer
+	if err := WriteFrameMasked(&act, NewBinaryFrame(payload), mask); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFrame(&exp, MaskFrameWith(NewBinaryFrame(payload), mask)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(act.Bytes(), exp.Bytes()) {
+		t.Errorf("unexpected frame bytes")
+	}
+}
+
+func TestPrecompiledFrame(t *testing.T) {
+	f := NewTextFrame([]byte("hello, world"))
+	pf, err := NewPrecompiledFrame(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	n, err := WritePrecompiled(&buf, pf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := MustCompileFrame(f)
+	if n != len(exp) {
+		t.Errorf("unexpected written bytes: %d; want %d", n, len(exp))
+	}
+	if act := buf.Bytes(); !bytes.Equal(act, exp) {
+		t.Errorf("unexpected written frame:\nact:\n%x\nexp:\n%x\n", act, exp)
+	}
+
+	if _, err := NewPrecompiledFrame(MaskFrame(f)); err != ErrProtocolMaskUnexpected {
+		t.Errorf("unexpected error for masked frame: %v; want %v", err, ErrProtocolMaskUnexpected)
+	}
+	if _, err := NewPrecompiledFrame(NewFrame(OpPing, false, nil)); err != ErrProtocolControlFragmented {
+		t.Errorf("unexpected error for invalid frame: %v; want %v", err, ErrProtocolControlFragmented)
+	}
+}
+
+func BenchmarkWritePrecompiled(b *testing.B) {
+	f := NewTextFrame(bytes.Repeat([]byte("x"), 128))
+	b.Run("precompiled", func(b *testing.B) {
+		pf := MustPrecompileFrame(f)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := WritePrecompiled(ioutil.Discard, pf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("compile", func(b *testing.B) {
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			bts, err := CompileFrame(f)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := ioutil.Discard.Write(bts); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
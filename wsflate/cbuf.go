@@ -11,6 +11,9 @@ type cbuf struct {
 	n   int
 	dst io.Writer
 	err error
+
+	// discard makes cbuf to drop written bytes, leaving held ones untouched.
+	discard bool
 }
 
 // Write implements io.Writer interface.
@@ -18,6 +21,9 @@ func (c *cbuf) Write(p []byte) (int, error) {
 	if c.err != nil {
 		return 0, c.err
 	}
+	if c.discard {
+		return len(p), nil
+	}
 	head, tail := c.split(p)
 	n := c.n + len(tail)
 	if n > len(c.buf) {
@@ -53,6 +59,7 @@ func (c *cbuf) split(p []byte) (head, tail []byte) {
 func (c *cbuf) reset(dst io.Writer) {
 	c.n = 0
 	c.err = nil
+	c.discard = false
 	c.buf = [4]byte{0, 0, 0, 0}
 	c.dst = dst
 }
@@ -61,6 +68,7 @@ type suffixedReader struct {
 	r      io.Reader
 	pos    int // position in the suffix.
 	suffix [9]byte
+	data   bool // whether any bytes were read from r.
 
 	rx struct{ io.Reader }
 }
@@ -86,18 +94,33 @@ func (r *suffixedReader) iface() io.Reader {
 func (r *suffixedReader) Read(p []byte) (n int, err error) {
 	if r.r != nil {
 		n, err = r.r.Read(p)
+		if n > 0 {
+			r.data = true
+		}
 		if err == io.EOF {
 			err = nil
-			r.r = nil
+			r.eof()
 		}
 		return n, err
 	}
+	if r.pos < 0 {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		p[0] = 0
+		p = p[1:]
+		r.pos = 0
+		n = 1
+	}
 	if r.pos >= len(r.suffix) {
+		if n > 0 {
+			return n, nil
+		}
 		return 0, io.EOF
 	}
-	n = copy(p, r.suffix[r.pos:])
-	r.pos += n
-	return n, nil
+	m := copy(p, r.suffix[r.pos:])
+	r.pos += m
+	return n + m, nil
 }
 
 func (r *suffixedReader) ReadByte() (b byte, err error) {
@@ -107,11 +130,17 @@ func (r *suffixedReader) ReadByte() (b byte, err error) {
 			panic("wsflate: internal error: incorrect use of suffixedReader")
 		}
 		b, err = br.ReadByte()
-		if err == io.EOF {
-			err = nil
-			r.r = nil
+		if err != io.EOF {
+			if err == nil {
+				r.data = true
+			}
+			return b, err
 		}
-		return b, err
+		r.eof()
+	}
+	if r.pos < 0 {
+		r.pos = 0
+		return 0, nil
 	}
 	if r.pos >= len(r.suffix) {
 		return 0, io.EOF
@@ -121,9 +150,22 @@ func (r *suffixedReader) ReadByte() (b byte, err error) {
 	return b, nil
 }
 
+// eof is called when r is fully read. Compressed payload of empty message is
+// expected to be at least a single byte: header of empty DEFLATE block with
+// no compression, which is followed by the stripped tail. Some peers send
+// empty payload instead, so we prepend the suffix with the missing header
+// byte (by setting pos to -1) to keep the stream valid.
+func (r *suffixedReader) eof() {
+	r.r = nil
+	if !r.data {
+		r.pos = -1
+	}
+}
+
 func (r *suffixedReader) reset(src io.Reader) {
 	r.r = src
 	r.pos = 0
+	r.data = false
 }
 
 func min(a, b int) int {
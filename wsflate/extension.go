@@ -11,13 +11,58 @@ import (
 // made during HTTP WebSocket handshake.
 // It might be reused between different upgrades (but not concurrently) with
 // Reset() being called after each.
+//
+// With context takeover each connection keeps its compression and
+// decompression state between messages. For zlib-like implementations
+// compressor keeps about 2^(bits+2) bytes (window and hash chains) plus hash
+// table of fixed size (128KB for default memory level), and decompressor
+// keeps 2^bits bytes of window, where bits is the LZ77 window bits of the
+// corresponding side. With maximum window of 15 bits that is up to ~300KB
+// per connection, which is 30GB for 100k connections.
+//
+// To cap the memory server could:
+//
+//   - Require no context takeover, so that compressors and decompressors
+//     could be pooled and shared between connections and messages;
+//   - Force smaller window by setting Parameters.ServerMaxWindowBits (which
+//     limits server compressor and client decompressor) and
+//     Parameters.ClientMaxWindowBits (which limits client compressor and
+//     server decompressor);
+//   - Set MaxMemoryPerConn to let Negotiate() choose the parameters above.
+//
+// Negotiated window bits are reported by WindowBits() and could be used to
+// compute total memory; MemoryPerConn() reports the estimation used by
+// MaxMemoryPerConn. Note that Compressor returned by Writer constructor must
+// honor negotiated server window. For example, standard library's
+// compress/flate always uses 15 bits window, so it should be used with
+// flate.HuffmanOnly level (which never references previous data) when
+// smaller window is negotiated. Smaller window trades compression ratio for
+// memory: each bit less halves the memory of the window, but also the
+// distance at which repeated sequences could be found and replaced.
 type Extension struct {
 	// Parameters is specification of extension parameters server is going to
 	// accept.
 	Parameters Parameters
 
+	// MaxMemoryPerConn is the maximum number of bytes of compression
+	// contexts server is going to keep per connection between messages. If
+	// it is non-zero, Negotiate() lowers window bits given by Parameters
+	// (and, if it is not enough, disables context takeover of the client
+	// and then of the server) until the estimated memory fits the limit.
+	//
+	// Memory is estimated as 2^(bits+2) bytes for server compressor and
+	// 2^bits bytes for server decompressor when corresponding context is
+	// taken over; contexts without takeover are considered to be pooled and
+	// are not counted. Fixed size tables of compressor are not counted
+	// either, since they do not depend on negotiated parameters.
+	//
+	// Note that client window could be limited only if client has offered
+	// "client_max_window_bits" parameter.
+	MaxMemoryPerConn int
+
 	accepted bool
 	params   Parameters
+	resp     Parameters
 }
 
 // Negotiate parses given HTTP header option and returns (if any) header option
@@ -43,6 +88,9 @@ func (n *Extension) Negotiate(opt httphead.Option) (accept httphead.Option, err
 		return accept, err
 	}
 	{
+		// A server MAY include "server_max_window_bits" in response even
+		// if the offer lacks it, which makes possible to force smaller
+		// window.
 		offer := n.params.ServerMaxWindowBits
 		want := want.ServerMaxWindowBits
 		if offer > want {
@@ -57,8 +105,14 @@ func (n *Extension) Negotiate(opt httphead.Option) (accept httphead.Option, err
 		// "client_max_window_bits" extension parameter, the server MAY
 		// include the "client_max_window_bits" extension parameter in the
 		// corresponding extension negotiation response to the offer.
+		//
+		// Parameter without value in offer means that client supports
+		// any window, so server may choose any value.
 		offer := n.params.ClientMaxWindowBits
 		want := want.ClientMaxWindowBits
+		if offer == windowBitsBare {
+			offer = maxWindowBits
+		}
 		if want > offer {
 			return accept, nil
 		}
@@ -71,7 +125,12 @@ func (n *Extension) Negotiate(opt httphead.Option) (accept httphead.Option, err
 		}
 	}
 
+	if max := n.MaxMemoryPerConn; max > 0 {
+		want = capMemory(want, n.params.ClientMaxWindowBits, max)
+	}
+
 	n.accepted = true
+	n.resp = want
 
 	return want.Option(), nil
 }
@@ -82,10 +141,101 @@ func (n *Extension) Accepted() (_ Parameters, accepted bool) {
 	return n.params, n.accepted
 }
 
+// WindowBits returns LZ77 window bits of server and client compression
+// contexts agreed during last negotiation. Window which size was not limited
+// during negotiation is reported as 15 bits (see MaxLZ77WindowSize). It
+// returns false if extension was not accepted.
+func (n *Extension) WindowBits() (server, client WindowBits, ok bool) {
+	if !n.accepted {
+		return 0, 0, false
+	}
+	server, client = windows(n.resp)
+	return server, client, true
+}
+
+// MemoryPerConn returns estimated number of bytes of compression contexts
+// server keeps per connection between messages with parameters agreed
+// during last negotiation. See MaxMemoryPerConn for details of estimation.
+// It returns false if extension was not accepted.
+func (n *Extension) MemoryPerConn() (int, bool) {
+	if !n.accepted {
+		return 0, false
+	}
+	server, client := windows(n.resp)
+	return memoryPerConn(n.resp, server, client), true
+}
+
+// windows returns window bits of server and client contexts limited by
+// response parameters p.
+func windows(p Parameters) (server, client WindowBits) {
+	server, client = maxWindowBits, maxWindowBits
+	if b := p.ServerMaxWindowBits; b.Defined() {
+		server = b
+	}
+	if b := p.ClientMaxWindowBits; b != windowBitsBare && b.Defined() {
+		client = b
+	}
+	return server, client
+}
+
+func memoryPerConn(p Parameters, server, client WindowBits) (n int) {
+	if !p.ServerNoContextTakeover {
+		n += 4 * server.Bytes()
+	}
+	if !p.ClientNoContextTakeover {
+		n += client.Bytes()
+	}
+	return n
+}
+
+// capMemory returns copy of response parameters p changed such that server
+// memory estimated by memoryPerConn() does not exceed max. Context takeover
+// is disabled only when reducing windows is not enough; after that the larger
+// of windows is reduced first. Client window is changed only if client has
+// offered bits, and never exceeds the offered value.
+func capMemory(p Parameters, offer WindowBits, max int) Parameters {
+	server, client := windows(p)
+	if offer != windowBitsBare && offer.Defined() && offer < client {
+		client = offer
+	}
+	limitClient := offer.Defined()
+	min := client
+	if limitClient {
+		min = minWindowBits
+	}
+	// Drop context takeover only if limit is not reachable by reducing the
+	// window sizes.
+	if memoryPerConn(p, minWindowBits, min) > max {
+		p.ClientNoContextTakeover = true
+	}
+	if memoryPerConn(p, minWindowBits, min) > max {
+		p.ServerNoContextTakeover = true
+	}
+	for memoryPerConn(p, server, client) > max {
+		var (
+			reduceServer = !p.ServerNoContextTakeover && server > minWindowBits
+			reduceClient = !p.ClientNoContextTakeover && client > min
+		)
+		if reduceServer && (!reduceClient || 4*server.Bytes() >= client.Bytes()) {
+			server--
+		} else {
+			client--
+		}
+	}
+	if server < maxWindowBits {
+		p.ServerMaxWindowBits = server
+	}
+	if limitClient && client < maxWindowBits {
+		p.ClientMaxWindowBits = client
+	}
+	return p
+}
+
 // Reset resets extension for further reuse.
 func (n *Extension) Reset() {
 	n.accepted = false
 	n.params = Parameters{}
+	n.resp = Parameters{}
 }
 
 var ErrUnexpectedCompressionBit = ws.ProtocolError(
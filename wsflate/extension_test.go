@@ -0,0 +1,539 @@
+package wsflate
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestExtensionWindowBits(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		params Parameters
+		offer  Parameters
+		accept bool
+		server WindowBits
+		client WindowBits
+	}{
+		{
+			name:   "default",
+			accept: true,
+			server: 15,
+			client: 15,
+		},
+		{
+			name: "force small server window",
+			params: Parameters{
+				ServerMaxWindowBits: 10,
+			},
+			accept: true,
+			server: 10,
+			client: 15,
+		},
+		{
+			name: "offered same window",
+			params: Parameters{
+				ServerMaxWindowBits: 10,
+			},
+			offer: Parameters{
+				ServerMaxWindowBits: 10,
+			},
+			accept: true,
+			server: 10,
+			client: 15,
+		},
+		{
+			name: "offered larger window",
+			params: Parameters{
+				ServerMaxWindowBits: 10,
+			},
+			offer: Parameters{
+				ServerMaxWindowBits: 12,
+			},
+		},
+		{
+			name: "small client window",
+			params: Parameters{
+				ServerMaxWindowBits: 9,
+				ClientMaxWindowBits: 9,
+			},
+			offer: Parameters{
+				ClientMaxWindowBits: 12,
+			},
+			accept: true,
+			server: 9,
+			client: 9,
+		},
+		{
+			name: "bare client window offer",
+			params: Parameters{
+				ClientMaxWindowBits: 10,
+			},
+			offer: Parameters{
+				ClientMaxWindowBits: 1,
+			},
+			accept: true,
+			server: 15,
+			client: 10,
+		},
+		{
+			name: "bare client window offer without limit",
+			offer: Parameters{
+				ClientMaxWindowBits: 1,
+			},
+			accept: true,
+			server: 15,
+			client: 15,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			e := Extension{
+				Parameters: test.params,
+			}
+			opt, err := e.Negotiate(test.offer.Option())
+			if err != nil {
+				t.Fatal(err)
+			}
+			server, client, ok := e.WindowBits()
+			if ok != test.accept {
+				t.Fatalf("unexpected accept: %t; want %t", ok, test.accept)
+			}
+			if !ok {
+				if opt.Size() != 0 {
+					t.Errorf("unexpected response option: %s", opt.String())
+				}
+				return
+			}
+			if server != test.server || client != test.client {
+				t.Errorf(
+					"unexpected window bits: server=%d client=%d; want server=%d client=%d",
+					server, client, test.server, test.client,
+				)
+			}
+			// Client must see the same limit of server window in response.
+			var resp Parameters
+			if err := resp.Parse(opt); err != nil {
+				t.Fatal(err)
+			}
+			if b := resp.ServerMaxWindowBits; b.Defined() && b != server {
+				t.Errorf("unexpected server_max_window_bits in response: %d; want %d", b, server)
+			}
+			if b := resp.ClientMaxWindowBits; b.Defined() && b != client {
+				t.Errorf("unexpected client_max_window_bits in response: %d; want %d", b, client)
+			}
+		})
+	}
+}
+
+func TestExtensionMaxMemoryPerConn(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		params Parameters
+		offer  Parameters
+		max    int
+		exp    Parameters
+	}{
+		{
+			name: "fits",
+			max:  1 << 20,
+			exp:  Parameters{},
+		},
+		{
+			name: "server window",
+			max:  4*1024 + 32*1024,
+			exp: Parameters{
+				ServerMaxWindowBits: 10,
+			},
+		},
+		{
+			name: "both windows",
+			offer: Parameters{
+				ClientMaxWindowBits: windowBitsBare,
+			},
+			max: 4*256 + 1024,
+			exp: Parameters{
+				ServerMaxWindowBits: 8,
+				ClientMaxWindowBits: 10,
+			},
+		},
+		{
+			name: "client window is not offered",
+			max:  4 * 1024,
+			exp: Parameters{
+				ServerMaxWindowBits:     10,
+				ClientNoContextTakeover: true,
+			},
+		},
+		{
+			name: "no context takeover",
+			offer: Parameters{
+				ClientMaxWindowBits: windowBitsBare,
+			},
+			max: 512,
+			exp: Parameters{
+				ServerNoContextTakeover: true,
+				ClientNoContextTakeover: true,
+			},
+		},
+		{
+			name: "offered client window",
+			offer: Parameters{
+				ClientMaxWindowBits: 12,
+			},
+			max: 4*1024 + 4*1024,
+			exp: Parameters{
+				ServerMaxWindowBits: 10,
+				ClientMaxWindowBits: 12,
+			},
+		},
+		{
+			name: "configured parameters",
+			params: Parameters{
+				ServerNoContextTakeover: true,
+			},
+			offer: Parameters{
+				ClientMaxWindowBits: 12,
+			},
+			max: 1024,
+			exp: Parameters{
+				ServerNoContextTakeover: true,
+				ClientMaxWindowBits:     10,
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			e := Extension{
+				Parameters:       test.params,
+				MaxMemoryPerConn: test.max,
+			}
+			opt, err := e.Negotiate(test.offer.Option())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resp Parameters
+			if err := resp.Parse(opt); err != nil {
+				t.Fatal(err)
+			}
+			if resp != test.exp {
+				t.Errorf("unexpected response: %+v; want %+v", resp, test.exp)
+			}
+			n, ok := e.MemoryPerConn()
+			if !ok {
+				t.Fatalf("extension is not accepted")
+			}
+			if n > test.max {
+				t.Errorf("estimated memory exceeds the limit: %d > %d", n, test.max)
+			}
+		})
+	}
+}
+
+func TestExtensionSmallWindowHonored(t *testing.T) {
+	const max = 1024
+	e := Extension{
+		MaxMemoryPerConn: max,
+	}
+	if _, err := e.Negotiate((Parameters{}).Option()); err != nil {
+		t.Fatal(err)
+	}
+	server, _, ok := e.WindowBits()
+	if !ok || server != minWindowBits {
+		t.Fatalf("unexpected server window bits: %d (accepted %t)", server, ok)
+	}
+
+	// Make message with sequences repeated at the distance larger than the
+	// negotiated window.
+	seq := make([]byte, 4*server.Bytes())
+	rand.New(rand.NewSource(42)).Read(seq)
+	exp := bytes.Repeat(seq, 8)
+
+	for _, test := range []struct {
+		name  string
+		level int
+		ok    bool
+	}{
+		{
+			// The default compressor uses 32KB window and exceeds the
+			// negotiated one.
+			name:  "best compression",
+			level: flate.BestCompression,
+			ok:    false,
+		},
+		{
+			// Huffman only compression never references previous data and
+			// thus honors any negotiated window.
+			name:  "huffman only",
+			level: flate.HuffmanOnly,
+			ok:    true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			fw := NewWriter(&buf, func(w io.Writer) Compressor {
+				fw, _ := flate.NewWriter(w, test.level)
+				return fw
+			})
+			if _, err := fw.Write(exp); err != nil {
+				t.Fatal(err)
+			}
+			if err := fw.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			compressed := append([]byte(nil), buf.Bytes()...)
+
+			fr := NewReader(&buf, func(r io.Reader) Decompressor {
+				return flate.NewReader(r)
+			})
+			act, err := ioutil.ReadAll(fr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(act, exp) {
+				t.Fatalf("unexpected message after round trip")
+			}
+
+			// Restore stripped tail and terminate the stream to decode it.
+			compressed = append(compressed, compressionReadTail[:]...)
+			dist, err := maxDistance(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok := dist <= server.Bytes(); ok != test.ok {
+				t.Errorf(
+					"unexpected window honoring: %t; want %t (max distance is %d)",
+					ok, test.ok, dist,
+				)
+			}
+		})
+	}
+}
+
+// maxDistance decodes DEFLATE stream p and returns the maximum distance of
+// LZ77 back-references found in it. That is, the minimal window size needed
+// to decompress the stream.
+func maxDistance(p []byte) (max int, err error) {
+	br := bitReader{p: p}
+	for {
+		final, err := br.bits(1)
+		if err != nil {
+			return 0, err
+		}
+		typ, err := br.bits(2)
+		if err != nil {
+			return 0, err
+		}
+		var lit, dist huffman
+		switch typ {
+		case 0:
+			br.align()
+			n, err := br.bits(16)
+			if err != nil {
+				return 0, err
+			}
+			if _, err = br.bits(16); err != nil {
+				return 0, err
+			}
+			if br.pos += 8 * n; br.pos > 8*len(br.p) {
+				return 0, io.ErrUnexpectedEOF
+			}
+		case 1:
+			lit, dist = fixedHuffman()
+		case 2:
+			if lit, dist, err = br.dynamicHuffman(); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("unexpected block type: %d", typ)
+		}
+		for lit != nil {
+			sym, err := lit.decode(&br)
+			if err != nil {
+				return 0, err
+			}
+			if sym < 256 {
+				continue
+			}
+			if sym == 256 {
+				break
+			}
+			sym -= 257
+			if _, err = br.bits(lengthExtra[sym]); err != nil {
+				return 0, err
+			}
+			if sym, err = dist.decode(&br); err != nil {
+				return 0, err
+			}
+			extra, err := br.bits(distExtra[sym])
+			if err != nil {
+				return 0, err
+			}
+			if d := distBase[sym] + extra; d > max {
+				max = d
+			}
+		}
+		if final == 1 {
+			return max, nil
+		}
+	}
+}
+
+var (
+	lengthExtra = [29]int{
+		0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2,
+		2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0,
+	}
+	distBase = [30]int{
+		1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129,
+		193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097,
+		6145, 8193, 12289, 16385, 24577,
+	}
+	distExtra = [30]int{
+		0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6,
+		6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13,
+	}
+	codeLengthOrder = [19]int{
+		16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15,
+	}
+)
+
+type bitReader struct {
+	p   []byte
+	pos int // Position in bits.
+}
+
+func (b *bitReader) bits(n int) (v int, err error) {
+	for i := 0; i < n; i++ {
+		if b.pos>>3 >= len(b.p) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		v |= int(b.p[b.pos>>3]>>uint(b.pos&7)&1) << uint(i)
+		b.pos++
+	}
+	return v, nil
+}
+
+func (b *bitReader) align() {
+	b.pos = (b.pos + 7) &^ 7
+}
+
+func (b *bitReader) dynamicHuffman() (lit, dist huffman, err error) {
+	var hlit, hdist, hclen int
+	for _, x := range []struct {
+		v    *int
+		bits int
+		base int
+	}{
+		{&hlit, 5, 257},
+		{&hdist, 5, 1},
+		{&hclen, 4, 4},
+	} {
+		if *x.v, err = b.bits(x.bits); err != nil {
+			return nil, nil, err
+		}
+		*x.v += x.base
+	}
+	var cl [19]int
+	for i := 0; i < hclen; i++ {
+		if cl[codeLengthOrder[i]], err = b.bits(3); err != nil {
+			return nil, nil, err
+		}
+	}
+	ch := newHuffman(cl[:])
+	lengths := make([]int, 0, hlit+hdist)
+	for len(lengths) < hlit+hdist {
+		sym, err := ch.decode(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		var (
+			v, n  int
+			extra int
+		)
+		switch sym {
+		case 16:
+			if len(lengths) == 0 {
+				return nil, nil, fmt.Errorf("repeat of no code length")
+			}
+			v, n, extra = lengths[len(lengths)-1], 3, 2
+		case 17:
+			n, extra = 3, 3
+		case 18:
+			n, extra = 11, 7
+		default:
+			lengths = append(lengths, sym)
+			continue
+		}
+		x, err := b.bits(extra)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := 0; i < n+x; i++ {
+			lengths = append(lengths, v)
+		}
+	}
+	return newHuffman(lengths[:hlit]), newHuffman(lengths[hlit:]), nil
+}
+
+// huffman maps code length and code (as length<<16|code) to symbol.
+type huffman map[int]int
+
+func newHuffman(lengths []int) huffman {
+	var count, next [16]int
+	for _, n := range lengths {
+		count[n]++
+	}
+	count[0] = 0
+	var code int
+	for n := 1; n < 16; n++ {
+		code = (code + count[n-1]) << 1
+		next[n] = code
+	}
+	h := make(huffman)
+	for sym, n := range lengths {
+		if n > 0 {
+			h[n<<16|next[n]] = sym
+			next[n]++
+		}
+	}
+	return h
+}
+
+func fixedHuffman() (lit, dist huffman) {
+	lengths := make([]int, 288)
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	d := make([]int, 30)
+	for i := range d {
+		d[i] = 5
+	}
+	return newHuffman(lengths), newHuffman(d)
+}
+
+func (h huffman) decode(b *bitReader) (int, error) {
+	var code int
+	for n := 1; n < 16; n++ {
+		bit, err := b.bits(1)
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | bit
+		if sym, ok := h[n<<16|code]; ok {
+			return sym, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid huffman code")
+}
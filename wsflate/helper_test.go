@@ -25,3 +25,42 @@ func TestHelperWriteAndRead(t *testing.T) {
 		t.Fatalf("original and decompressed payload are not equal")
 	}
 }
+
+func TestHelperEmptyMessage(t *testing.T) {
+	f := ws.NewTextFrame(nil)
+	c, err := CompressFrame(f)
+	if err != nil {
+		t.Fatalf("can't compress frame: %v", err)
+	}
+	if ok, err := IsCompressed(c.Header); err != nil || !ok {
+		t.Fatalf("compressed frame has no compression bit set")
+	}
+	if len(c.Payload) == 0 {
+		t.Fatalf("compressed frame has empty payload")
+	}
+	for _, test := range []struct {
+		name    string
+		payload []byte
+	}{
+		{"compressed", c.Payload},
+		{"sync flush", []byte{0}},
+		{"no payload", nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			in := c
+			in.Payload = test.payload
+			in.Header.Length = int64(len(test.payload))
+
+			d, err := DecompressFrame(in)
+			if err != nil {
+				t.Fatalf("can't decompress frame: %v", err)
+			}
+			if f.Header != d.Header {
+				t.Errorf("unexpected decompressed header: %+v; want %+v", d.Header, f.Header)
+			}
+			if len(d.Payload) != 0 {
+				t.Errorf("unexpected decompressed payload: %q", d.Payload)
+			}
+		})
+	}
+}
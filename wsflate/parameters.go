@@ -1,10 +1,12 @@
 package wsflate
 
 import (
+	"bytes"
 	"fmt"
 	"strconv"
 
 	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
 )
 
 const (
@@ -34,6 +36,10 @@ func init() {
 }
 
 // Parameters contains compression extension options.
+//
+// ClientMaxWindowBits could be set to 1 to represent the parameter without
+// a value. Client uses it in offer to signal that it supports the parameter
+// and lets the server choose the window size.
 type Parameters struct {
 	ServerNoContextTakeover bool
 	ClientNoContextTakeover bool
@@ -41,6 +47,9 @@ type Parameters struct {
 	ClientMaxWindowBits     WindowBits
 }
 
+// windowBitsBare represents "client_max_window_bits" parameter without value.
+const windowBitsBare WindowBits = 1
+
 // WindowBits specifies window size accordingly to RFC.
 // Use its Bytes() method to obtain actual size of window in bytes.
 type WindowBits byte
@@ -59,6 +68,12 @@ const (
 	MaxLZ77WindowSize = 32768 // 2^15
 )
 
+// maxWindowBits is the window bits of MaxLZ77WindowSize.
+const maxWindowBits WindowBits = 15
+
+// minWindowBits is the minimum window bits allowed by RFC.
+const minWindowBits WindowBits = 8
+
 // Parse reads parameters from given HTTP header option accordingly to RFC.
 //
 // It returns non-nil error at least in these cases:
@@ -83,15 +98,15 @@ func (p *Parameters) Parse(opt httphead.Option) (err error) {
 	opt.Parameters.ForEach(func(key, val []byte) (ok bool) {
 		switch string(key) {
 		case clientMaxWindowBits:
-			if len(val) == 0 {
-				p.ClientMaxWindowBits = 1
-				return true
-			}
 			if seen&clientMaxWindowBitsSeen != 0 {
 				err = paramError("duplicate", key, val)
 				return false
 			}
 			seen |= clientMaxWindowBitsSeen
+			if len(val) == 0 {
+				p.ClientMaxWindowBits = windowBitsBare
+				return true
+			}
 			if p.ClientMaxWindowBits, ok = bitsFromASCII(val); !ok {
 				err = paramError("invalid", key, val)
 				return false
@@ -157,6 +172,25 @@ func (p Parameters) Option() httphead.Option {
 	return opt
 }
 
+// ReaderParameters returns compression parameters agreed during the given
+// handshake. It returns false if compression extension was not accepted or
+// its parameters could not be parsed.
+//
+// It is useful to configure both reading and writing sides of the
+// connection from the same negotiated options.
+func ReaderParameters(hs ws.Handshake) (p Parameters, ok bool) {
+	for _, opt := range hs.Extensions {
+		if !bytes.Equal(opt.Name, ExtensionNameBytes) {
+			continue
+		}
+		if err := p.Parse(opt); err != nil {
+			return Parameters{}, false
+		}
+		return p, true
+	}
+	return p, false
+}
+
 func isValidBits(x int) bool {
 	return 8 <= x && x <= 15
 }
@@ -173,7 +207,7 @@ func setBits(opt *httphead.Option, name []byte, bits WindowBits) {
 	if bits == 0 {
 		return
 	}
-	if bits == 1 {
+	if bits == windowBitsBare {
 		opt.Parameters.Set(name, nil)
 		return
 	}
@@ -1 +1,144 @@
 package wsflate
+
+import (
+	"testing"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+)
+
+func TestParametersParse(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opt  httphead.Option
+		exp  Parameters
+		err  bool
+	}{
+		{
+			name: "bare client window",
+			opt:  Parameters{ClientMaxWindowBits: 1}.Option(),
+			exp:  Parameters{ClientMaxWindowBits: 1},
+		},
+		{
+			name: "valued client window",
+			opt:  Parameters{ClientMaxWindowBits: 10}.Option(),
+			exp:  Parameters{ClientMaxWindowBits: 10},
+		},
+		{
+			name: "bare server window",
+			opt: httphead.NewOption(ExtensionName, map[string]string{
+				serverMaxWindowBits: "",
+			}),
+			err: true,
+		},
+		{
+			name: "duplicate bare client window",
+			opt: func() httphead.Option {
+				opt := Parameters{ClientMaxWindowBits: 1}.Option()
+				opt.Parameters.Set(clientMaxWindowBitsBytes, nil)
+				return opt
+			}(),
+			err: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var act Parameters
+			err := act.Parse(test.opt)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if act != test.exp {
+				t.Errorf("unexpected parameters: %+v; want %+v", act, test.exp)
+			}
+		})
+	}
+}
+
+func TestParametersBareClientWindowOption(t *testing.T) {
+	opt := Parameters{ClientMaxWindowBits: 1}.Option()
+	if v, ok := opt.Parameters.Get(clientMaxWindowBits); !ok || len(v) != 0 {
+		t.Errorf("unexpected %s parameter: %q (present %t); want bare", clientMaxWindowBits, v, ok)
+	}
+}
+
+func TestReaderParameters(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		exts []httphead.Option
+		exp  Parameters
+		ok   bool
+	}{
+		{
+			name: "no extensions",
+		},
+		{
+			name: "other extension",
+			exts: []httphead.Option{
+				httphead.NewOption("foo", nil),
+			},
+		},
+		{
+			name: "defaults",
+			exts: []httphead.Option{
+				Parameters{}.Option(),
+			},
+			ok: true,
+		},
+		{
+			name: "no context takeover",
+			exts: []httphead.Option{
+				httphead.NewOption("foo", nil),
+				Parameters{
+					ServerNoContextTakeover: true,
+					ClientNoContextTakeover: true,
+				}.Option(),
+			},
+			exp: Parameters{
+				ServerNoContextTakeover: true,
+				ClientNoContextTakeover: true,
+			},
+			ok: true,
+		},
+		{
+			name: "window bits",
+			exts: []httphead.Option{
+				Parameters{
+					ServerMaxWindowBits: 10,
+					ClientMaxWindowBits: 12,
+				}.Option(),
+			},
+			exp: Parameters{
+				ServerMaxWindowBits: 10,
+				ClientMaxWindowBits: 12,
+			},
+			ok: true,
+		},
+		{
+			name: "invalid parameters",
+			exts: []httphead.Option{
+				httphead.NewOption(ExtensionName, map[string]string{
+					"foo": "bar",
+				}),
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			hs := ws.Handshake{
+				Extensions: test.exts,
+			}
+			act, ok := ReaderParameters(hs)
+			if ok != test.ok {
+				t.Fatalf("unexpected ok: %t; want %t", ok, test.ok)
+			}
+			if act != test.exp {
+				t.Errorf("unexpected parameters: %+v; want %+v", act, test.exp)
+			}
+		})
+	}
+}
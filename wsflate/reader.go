@@ -1,9 +1,15 @@
 package wsflate
 
 import (
+	"errors"
 	"io"
 )
 
+// ErrMessageTooLarge is returned by Reader when decompressed message size
+// exceeds Reader.MaxMessageSize. Application should close the connection with
+// ws.StatusMessageTooBig status code when receiving this error.
+var ErrMessageTooLarge = errors.New("wsflate: decompressed message too large")
+
 // Decompressor is an interface holding deflate decompression implementation.
 type Decompressor interface {
 	io.Reader
@@ -25,11 +31,32 @@ type ReadResetter interface {
 // Reader might be reused for different io.Reader objects after its Reset()
 // method has been called.
 type Reader struct {
+	// MaxMessageSize is the maximum number of decompressed bytes Reader is
+	// allowed to produce until next Reset() call. It protects from highly
+	// compressed messages (so called decompression bombs), which are small on
+	// the wire but expand into a huge payload. If it is zero then no limit is
+	// applied.
+	//
+	// Once the limit is exceeded, Read() returns ErrMessageTooLarge without
+	// inflating the rest of the source.
+	MaxMessageSize int64
+
+	// OnMessage is an optional callback that will be called once the whole
+	// message is decompressed, that is, when Read() returns io.EOF. It
+	// receives the logical (decompressed) size of the message in bytes.
+	//
+	// It complements wsutil.Reader's OnMessage, which reports the wire
+	// (compressed) size of the same message and its operation code. That
+	// is, the ratio of the two is the compression ratio of the message.
+	OnMessage func(size int64)
+
 	src  io.Reader
 	ctor func(io.Reader) Decompressor
 	d    Decompressor
 	sr   suffixedReader
+	n    int64
 	err  error
+	done bool
 }
 
 // NewReader returns a new Reader.
@@ -49,6 +76,8 @@ func NewReader(r io.Reader, ctor func(io.Reader) Decompressor) *Reader {
 func (r *Reader) Reset(src io.Reader) {
 	r.err = nil
 	r.src = src
+	r.n = 0
+	r.done = false
 	r.sr.reset(src)
 
 	if x, ok := r.d.(ReadResetter); ok {
@@ -63,7 +92,29 @@ func (r *Reader) Read(p []byte) (n int, err error) {
 	if r.err != nil {
 		return 0, r.err
 	}
-	return r.d.Read(p)
+	max := r.MaxMessageSize
+	if max > 0 {
+		// Let the decompressor produce at most one byte above the limit to
+		// be able to tell that the limit was exceeded.
+		if rem := max - r.n + 1; int64(len(p)) > rem {
+			p = p[:rem]
+		}
+	}
+	n, err = r.d.Read(p)
+	r.n += int64(n)
+	if max > 0 && r.n > max {
+		n -= int(r.n - max)
+		r.n = max
+		r.err = ErrMessageTooLarge
+		err = r.err
+	}
+	if err == io.EOF && !r.done {
+		r.done = true
+		if cb := r.OnMessage; cb != nil {
+			cb(r.n)
+		}
+	}
+	return n, err
 }
 
 // Close closes Reader and a Decompressor instance used under the hood (if it
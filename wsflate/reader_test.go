@@ -2,8 +2,10 @@ package wsflate
 
 import (
 	"bytes"
+	"compress/flate"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"testing"
 )
 
@@ -35,3 +37,104 @@ func TestSuffixedReaderIface(t *testing.T) {
 		})
 	}
 }
+
+func TestReaderMaxMessageSize(t *testing.T) {
+	const (
+		limit = 1 << 20
+		size  = 64 << 20
+	)
+	var buf bytes.Buffer
+	w := NewWriter(&buf, func(w io.Writer) Compressor {
+		fw, _ := flate.NewWriter(w, 9)
+		return fw
+	})
+	if _, err := w.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := buf.Len(); n >= limit {
+		t.Fatalf("compressed payload is too large for the test: %d", n)
+	}
+	compressed := buf.Bytes()
+
+	for _, test := range []struct {
+		name  string
+		limit int64
+		err   error
+		n     int64
+	}{
+		{
+			name:  "bomb",
+			limit: limit,
+			err:   ErrMessageTooLarge,
+			n:     limit,
+		},
+		{
+			name:  "exact",
+			limit: size,
+			n:     size,
+		},
+		{
+			name: "no limit",
+			n:    size,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			src := bytes.NewReader(compressed)
+			r := NewReader(src, func(r io.Reader) Decompressor {
+				return flate.NewReader(r)
+			})
+			r.MaxMessageSize = test.limit
+
+			n, err := io.Copy(ioutil.Discard, r)
+			if err != test.err {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			if n != test.n {
+				t.Fatalf("unexpected number of decompressed bytes: %d; want %d", n, test.n)
+			}
+			if test.err != nil && src.Len() == 0 {
+				t.Errorf("source was consumed entirely")
+			}
+
+			// Reset must reset the limit counter.
+			r.Reset(bytes.NewReader(compressed))
+			if _, err := io.CopyN(ioutil.Discard, r, 10); err != nil {
+				t.Fatalf("unexpected error after Reset(): %v", err)
+			}
+		})
+	}
+}
+
+func TestReaderEmptyMessage(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		payload []byte
+	}{
+		{"no payload", nil},
+		{"empty block", []byte{0}},
+	} {
+		for _, src := range []struct {
+			name string
+			wrap func(io.Reader) io.Reader
+		}{
+			{"byte reader", func(r io.Reader) io.Reader { return r }},
+			{"reader", func(r io.Reader) io.Reader { return io.TeeReader(r, ioutil.Discard) }},
+		} {
+			t.Run(test.name+"/"+src.name, func(t *testing.T) {
+				r := NewReader(src.wrap(bytes.NewReader(test.payload)), func(r io.Reader) Decompressor {
+					return flate.NewReader(r)
+				})
+				act, err := ioutil.ReadAll(r)
+				if err != nil {
+					t.Fatalf("unexpected Reader error: %v", err)
+				}
+				if len(act) != 0 {
+					t.Fatalf("unexpected bytes: %#q; want none", act)
+				}
+			})
+		}
+	}
+}
@@ -3,6 +3,8 @@ package wsflate
 import (
 	"fmt"
 	"io"
+
+	"github.com/gobwas/ws"
 )
 
 var (
@@ -16,6 +18,22 @@ var (
 	}
 )
 
+// MaxCompressedSize returns the worst-case size of a frame holding message of
+// n bytes compressed by Writer (with single Flush() call), including frame
+// header overhead. Deflate could slightly expand incompressible data, thus
+// returned value is greater than n. It could be used to preallocate buffers
+// for compressed frames.
+//
+// The bound is the one used by zlib's compressBound(): deflate emits stored
+// block with 5 bytes of overhead per each 16KB of input at worst. Its extra
+// constant bytes cover the empty block written on Flush() and bits left from
+// the previous block.
+//
+// Note that each additional Flush() call may produce up to 5 more bytes.
+func MaxCompressedSize(n int) int {
+	return n + n>>12 + n>>14 + n>>25 + 13 + ws.MaxHeaderSize
+}
+
 // Compressor is an interface holding deflate compression implementation.
 type Compressor interface {
 	io.Writer
@@ -55,6 +73,9 @@ type Writer struct {
 	c    Compressor
 	cbuf cbuf
 	err  error
+
+	// flushed reports whether there were no writes since last Flush() call.
+	flushed bool
 }
 
 // NewWriter returns a new Writer.
@@ -74,6 +95,7 @@ func NewWriter(w io.Writer, ctor func(io.Writer) Compressor) *Writer {
 // Any not flushed data will be lost.
 func (w *Writer) Reset(dest io.Writer) {
 	w.err = nil
+	w.flushed = false
 	w.cbuf.reset(dest)
 	if x, ok := w.c.(WriteResetter); ok {
 		x.Reset(&w.cbuf)
@@ -87,30 +109,51 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	if w.err != nil {
 		return 0, w.err
 	}
+	if len(p) > 0 {
+		w.flushed = false
+	}
 	n, w.err = w.c.Write(p)
 	return n, w.err
 }
 
 // Flush writes any pending data into w.Dest.
+//
+// The 0x00 0x00 0xff 0xff trailer emitted by compressor's sync flush is held
+// back and is written only if more data follows. Thus intermediate flushes
+// keep the stream valid, while the message never ends with the trailer, even
+// when it is split into multiple frames by the underlying writer.
 func (w *Writer) Flush() error {
 	if w.err != nil {
 		return w.err
 	}
 	w.err = w.c.Flush()
+	w.flushed = true
 	w.checkTail()
 	return w.err
 }
 
-// Close closes Writer and a Compressor instance used under the hood (if it
-// implements io.Closer interface).
+// Close flushes data written after the last Flush() call (if any) and closes
+// a Compressor instance used under the hood (if it implements io.Closer
+// interface). Empty message (when nothing was written since Reset()) is
+// flushed as well, resulting in a minimal valid compressed payload.
+//
+// Bytes written by Compressor on close (such as the final DEFLATE block) are
+// discarded: RFC 7692 section 7.2.1 requires the message to end with the
+// sync flush, which tail is already held back.
 func (w *Writer) Close() error {
 	if w.err != nil {
 		return w.err
 	}
+	if !w.flushed {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
 	if c, ok := w.c.(io.Closer); ok {
+		w.cbuf.discard = true
 		w.err = c.Close()
+		w.cbuf.discard = false
 	}
-	w.checkTail()
 	return w.err
 }
 
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/url"
 	"testing"
@@ -44,6 +45,62 @@ func TestWriter(t *testing.T) {
 	}
 }
 
+func TestWriterEmptyMessage(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, func(w io.Writer) Compressor {
+		fw, _ := flate.NewWriter(w, 9)
+		return fw
+	})
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected Close() error: %v", err)
+	}
+	// Sync flush of empty stream is an empty block with no compression,
+	// which is the header byte followed by the stripped tail.
+	if act, exp := buf.Bytes(), []byte{0}; !bytes.Equal(act, exp) {
+		t.Fatalf("unexpected compressed bytes: %#x; want %#x", act, exp)
+	}
+}
+
+type stubCompressor struct {
+	w    io.Writer
+	tail []byte
+}
+
+func (c stubCompressor) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c stubCompressor) Flush() error {
+	_, err := c.w.Write(c.tail)
+	return err
+}
+
+func TestWriterBadCompressor(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		tail []byte
+		ok   bool
+	}{
+		{"sync flush", []byte{0, 0, 0, 0xff, 0xff}, true},
+		{"no flush", nil, false},
+		{"final block", []byte{0x03, 0x00}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := NewWriter(ioutil.Discard, func(w io.Writer) Compressor {
+				return stubCompressor{w, test.tail}
+			})
+			w.Write([]byte("data"))
+			err := w.Close()
+			if test.ok && err != nil {
+				t.Fatalf("unexpected Close() error: %v", err)
+			}
+			if !test.ok && err == nil {
+				t.Fatalf("expected bad compressor error")
+			}
+		})
+	}
+}
+
 func TestExtensionNegotiation(t *testing.T) {
 	client, server := net.Pipe()
 
@@ -119,3 +176,49 @@ func TestExtensionNegotiation(t *testing.T) {
 		t.Fatalf("server Upgrade() error: %v", err)
 	}
 }
+
+func TestMaxCompressedSize(t *testing.T) {
+	random := func(n int) []byte {
+		p := make([]byte, n)
+		rand.Read(p)
+		return p
+	}
+	structured := func(n int) []byte {
+		return bytes.Repeat([]byte(`{"id":42,"name":"gobwas"}`), n/25+1)[:n]
+	}
+	for _, level := range []int{
+		flate.HuffmanOnly,
+		flate.BestSpeed,
+		flate.DefaultCompression,
+		flate.BestCompression,
+	} {
+		for _, n := range []int{0, 1, 125, 126, 1 << 10, 1<<14 + 1, 1 << 16, 1<<18 + 7} {
+			for name, gen := range map[string]func(int) []byte{
+				"random":     random,
+				"structured": structured,
+			} {
+				var buf bytes.Buffer
+				w := NewWriter(&buf, func(w io.Writer) Compressor {
+					fw, _ := flate.NewWriter(w, level)
+					return fw
+				})
+				if _, err := w.Write(gen(n)); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Flush(); err != nil {
+					t.Fatal(err)
+				}
+				size := buf.Len() + ws.HeaderSize(ws.Header{
+					Length: int64(buf.Len()),
+					Masked: true,
+				})
+				if max := MaxCompressedSize(n); size > max {
+					t.Errorf(
+						"level %d, %s data of %d bytes: compressed frame size %d exceeds bound %d",
+						level, name, n, size, max,
+					)
+				}
+			}
+		}
+	}
+}
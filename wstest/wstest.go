@@ -0,0 +1,65 @@
+/*
+Package wstest provides utilities for negative testing of WebSocket frame
+readers. It helps to feed readers with malformed frames, which could not be
+produced by ws.WriteFrame() or wsutil.Writer.
+
+It is intended for test suites only and is not a part of the production API.
+
+Frame with payload corrupted after masking (mask key is present, but payload
+does not correspond to the original data):
+
+	f := ws.MaskFrame(ws.NewTextFrame([]byte("hello")))
+	raw := wstest.CompileFrame(f.Header, f.Payload)
+	raw[len(raw)-1] ^= 0xff
+	wstest.InjectFrame(conn, raw)
+
+Frame which declares more payload bytes than sent (truncated frame):
+
+	h := ws.Header{Fin: true, OpCode: ws.OpBinary, Length: 10}
+	wstest.InjectFrame(conn, wstest.CompileFrame(h, []byte("short")))
+
+Masked frame which payload is sent unmasked:
+
+	h := ws.Header{Fin: true, OpCode: ws.OpText, Masked: true, Mask: ws.NewMask()}
+	wstest.InjectFrame(conn, wstest.CompileFrame(h, []byte("plain")))
+
+Header with arbitrary bytes, e.g. with reserved operation code:
+
+	wstest.InjectFrame(conn, []byte{0x83, 0x00})
+*/
+package wstest
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/gobwas/ws"
+)
+
+// InjectFrame writes raw bytes to w as is. It does not do any checks or
+// masking, thus raw could be any sequence of bytes, including malformed or
+// partial frames.
+func InjectFrame(w io.Writer, raw []byte) error {
+	for len(raw) > 0 {
+		n, err := w.Write(raw)
+		if err != nil {
+			return err
+		}
+		raw = raw[n:]
+	}
+	return nil
+}
+
+// CompileFrame returns bytes of the frame with given header and payload.
+// Unlike ws.CompileFrame() it does not mask payload and does not check that
+// h.Length equals to the payload length, thus it could be used to build
+// frames with mismatching header and payload. It panics if header could not
+// be encoded.
+func CompileFrame(h ws.Header, payload []byte) []byte {
+	var buf bytes.Buffer
+	if err := ws.WriteHeader(&buf, h); err != nil {
+		panic(err)
+	}
+	buf.Write(payload)
+	return buf.Bytes()
+}
@@ -0,0 +1,80 @@
+package wstest
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+func TestInjectFrame(t *testing.T) {
+	corrupted := func() []byte {
+		f := ws.MaskFrame(ws.NewTextFrame([]byte("hello")))
+		raw := CompileFrame(f.Header, f.Payload)
+		raw[len(raw)-1] ^= 0xff
+		return raw
+	}
+	for _, test := range []struct {
+		name string
+		raw  []byte
+		err  error
+	}{
+		{
+			name: "valid",
+			raw: func() []byte {
+				f := ws.MaskFrame(ws.NewTextFrame([]byte("hello")))
+				return CompileFrame(f.Header, f.Payload)
+			}(),
+		},
+		{
+			name: "corrupted payload",
+			raw:  corrupted(),
+			err:  wsutil.ErrInvalidUTF8,
+		},
+		{
+			name: "truncated",
+			raw: CompileFrame(ws.Header{
+				Fin:    true,
+				OpCode: ws.OpBinary,
+				Length: 10,
+				Masked: true,
+			}, []byte("short")),
+			err: io.ErrUnexpectedEOF,
+		},
+		{
+			name: "unmasked",
+			raw:  CompileFrame(ws.Header{Fin: true, OpCode: ws.OpText, Length: 5}, []byte("plain")),
+			err:  ws.ErrProtocolMaskRequired,
+		},
+		{
+			name: "reserved opcode",
+			raw:  []byte{0x83, 0x80, 0, 0, 0, 0},
+			err:  ws.ErrProtocolOpCodeReserved,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := InjectFrame(&buf, test.raw); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), test.raw) {
+				t.Fatalf("injected bytes differ")
+			}
+			r := wsutil.Reader{
+				Source:    &buf,
+				State:     ws.StateServerSide,
+				CheckUTF8: true,
+			}
+			_, err := r.NextFrame()
+			if err == nil {
+				_, err = ioutil.ReadAll(&r)
+			}
+			if err != test.err {
+				t.Errorf("unexpected error: %v; want %v", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package wsutil
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/gobwas/ws"
+)
+
+// Conn is a WebSocket connection which tracks the closing handshake. It makes
+// Close() idempotent: close frame is sent at most once, either by Close() or
+// in response to the peer's close frame received by ReadData(), and Close()
+// reports which side initiated the closing handshake.
+//
+// Note that only c.ReadData() tracks received close frames. Reading c with
+// other helpers (such as ReadClientData()) leaves c unaware of the peer's
+// close frame, so c.Close() would send another one.
+type Conn struct {
+	net.Conn
+	State ws.State
+
+	mu     sync.Mutex // Serializes control frames writes.
+	sent   bool       // Close frame is sent.
+	peer   bool       // Close frame is sent in response to the peer's one.
+	closed bool       // Underlying connection is closed.
+}
+
+// NewConn creates new Conn which uses conn as the underlying connection and
+// given state to mask frames and check received ones.
+func NewConn(conn net.Conn, s ws.State) *Conn {
+	return &Conn{
+		Conn:  conn,
+		State: s,
+	}
+}
+
+// ReadData reads next data message from c the same way as ReadData() does.
+// When peer sends close frame, ClosedError is returned. Close frame is sent
+// in response only if c has not sent one before; otherwise received frame is
+// the response to the close frame sent by c.Close().
+func (c *Conn) ReadData() ([]byte, ws.OpCode, error) {
+	return readDataWith(c.Conn, c.State, ws.OpText|ws.OpBinary, c.handleControl)
+}
+
+// Close sends close frame with given code and reason unless close frame was
+// already sent, and then closes the underlying connection. It reports whether
+// the peer initiated the closing handshake, that is, whether its close frame
+// was received by c.ReadData() before c sent one.
+//
+// It is safe to call Close() multiple times and concurrently with ReadData().
+// Subsequent calls do nothing and return nil error. Note that Close() does not
+// wait for the peer's response to the close frame.
+func (c *Conn) Close(code ws.StatusCode, reason string) (peer bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return c.peer, nil
+	}
+	c.closed = true
+	if !c.sent {
+		c.sent = true
+		err = writeFrame(c.Conn, c.State, ws.OpClose, true, ws.NewCloseFrameBody(code, reason))
+	}
+	if e := c.Conn.Close(); err == nil {
+		err = e
+	}
+	return c.peer, err
+}
+
+func (c *Conn) handleControl(h ws.Header, r io.Reader) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var w io.Writer = c.Conn
+	if h.OpCode == ws.OpClose {
+		if c.sent {
+			// Peer responds to our close frame.
+			w = ioutil.Discard
+		} else {
+			c.sent = true
+			c.peer = true
+		}
+	}
+	return ControlFrameHandler(w, c.State)(h, r)
+}
@@ -0,0 +1,89 @@
+package wsutil
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/gobwas/ws"
+)
+
+func TestConnCloseLocal(t *testing.T) {
+	client, server := net.Pipe()
+	frames := readAllFrames(client)
+
+	c := NewConn(server, ws.StateServerSide)
+	peer, err := c.Close(ws.StatusGoingAway, "bye")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer {
+		t.Errorf("close is reported as initiated by peer")
+	}
+	exp := []ws.Frame{
+		ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusGoingAway, "bye")),
+	}
+	if act := <-frames; !reflect.DeepEqual(act, exp) {
+		t.Errorf("unexpected frames sent: %v; want %v", act, exp)
+	}
+}
+
+func TestConnClosePeer(t *testing.T) {
+	client, server := net.Pipe()
+	frames := readAllFrames(client)
+	go ws.WriteFrame(client, ws.MaskFrameInPlace(
+		ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "done")),
+	))
+	c := NewConn(server, ws.StateServerSide)
+	_, _, err := c.ReadData()
+	if exp := (ClosedError{Code: ws.StatusNormalClosure, Reason: "done"}); err != exp {
+		t.Fatalf("unexpected error: %v; want %v", err, exp)
+	}
+	peer, err := c.Close(ws.StatusGoingAway, "bye")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !peer {
+		t.Errorf("close is reported as initiated locally")
+	}
+	// Only the echo of peer's close frame must be sent.
+	exp := []ws.Frame{
+		ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "")),
+	}
+	if act := <-frames; !reflect.DeepEqual(act, exp) {
+		t.Errorf("unexpected frames sent: %v; want %v", act, exp)
+	}
+}
+
+func TestConnCloseTwice(t *testing.T) {
+	client, server := net.Pipe()
+	frames := readAllFrames(client)
+
+	c := NewConn(server, ws.StateServerSide)
+	for i := 0; i < 2; i++ {
+		if _, err := c.Close(ws.StatusNormalClosure, ""); err != nil {
+			t.Fatalf("#%d Close() error: %v", i, err)
+		}
+	}
+	if act := <-frames; len(act) != 1 {
+		t.Errorf("unexpected number of close frames sent: %d; want 1", len(act))
+	}
+}
+
+// readAllFrames reads frames from conn until error and sends them to the
+// returned channel.
+func readAllFrames(conn net.Conn) <-chan []ws.Frame {
+	ch := make(chan []ws.Frame, 1)
+	go func() {
+		var fs []ws.Frame
+		for {
+			f, err := ws.ReadFrame(conn)
+			if err != nil {
+				break
+			}
+			fs = append(fs, f)
+		}
+		ch <- fs
+	}()
+	return ch
+}
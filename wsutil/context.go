@@ -0,0 +1,89 @@
+package wsutil
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrWriteInterrupted is returned by connection created with
+// NewContextConn() after a write made by WriteMessageContext() or
+// WriteCloseContext() was interrupted. Since it is unknown how many bytes of
+// the frame were written, the stream is considered corrupted.
+var ErrWriteInterrupted = errors.New("write interrupted")
+
+// NewContextConn returns a wrapper around conn which keeps state of writes
+// made by WriteMessageContext() and WriteCloseContext(). It is recommended
+// to wrap connections used with these functions:
+//
+//   - Once such write fails, connection is marked as failed: every next
+//     Write() call and context-aware write returns ErrWriteInterrupted,
+//     regardless of deadlines set afterwards.
+//   - Write deadline set by user is respected along with the context
+//     deadline and is restored after a successful write.
+//
+// Without the wrapper, those functions could only make write deadline of
+// conn expired to prevent further writes, and have to clear write deadline
+// after a successful write.
+func NewContextConn(conn net.Conn) net.Conn {
+	return &contextConn{Conn: conn}
+}
+
+type contextConn struct {
+	net.Conn
+
+	mu        sync.Mutex
+	wdeadline time.Time // Write deadline set by user.
+	err       error
+}
+
+// Write implements io.Writer.
+func (c *contextConn) Write(p []byte) (int, error) {
+	if err := c.failure(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+// SetDeadline implements net.Conn.
+func (c *contextConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wdeadline = t
+	if c.err != nil {
+		// Keep write deadline expired.
+		return c.Conn.SetReadDeadline(t)
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn.
+func (c *contextConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wdeadline = t
+	if c.err != nil {
+		return nil
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *contextConn) failure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *contextConn) writeDeadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.wdeadline
+}
+
+func (c *contextConn) fail() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = ErrWriteInterrupted
+	c.Conn.SetWriteDeadline(aLongTimeAgo)
+}
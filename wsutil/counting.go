@@ -0,0 +1,93 @@
+package wsutil
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Counters holds number of bytes transferred through CountingConn. It is
+// safe to use its methods concurrently with connection reads and writes.
+type Counters struct {
+	// Fields are accessed atomically and placed first to be 64-bit aligned
+	// on 32-bit platforms.
+	read    int64
+	written int64
+}
+
+// BytesRead returns number of bytes read from the connection.
+func (c *Counters) BytesRead() int64 {
+	return atomic.LoadInt64(&c.read)
+}
+
+// BytesWritten returns number of bytes written to the connection.
+func (c *Counters) BytesWritten() int64 {
+	return atomic.LoadInt64(&c.written)
+}
+
+// CountingConn is a wrapper around net.Conn that counts bytes read from and
+// written to it. It works at the transport level: handshake bytes, frame
+// headers, masks and control frames are all counted. Bytes are passed
+// through as is, thus it does not affect framing.
+//
+// It is intended to wrap the raw connection, e.g. the one returned by
+// net.Dial() or net.Listener.Accept(), before handshake is made.
+type CountingConn struct {
+	net.Conn
+
+	// Dump is an optional writer which receives copy of all raw bytes read
+	// from and written to the connection, in order they were transferred.
+	// Each Read() and Write() call result is written to Dump with a single
+	// Write() call. Dump errors are ignored.
+	//
+	// Dump must be set before the connection is used.
+	Dump io.Writer
+
+	counters *Counters
+	dmu      sync.Mutex
+}
+
+// NewCountingConn creates CountingConn wrapping conn. It returns counters of
+// the created connection along with it for convenience.
+func NewCountingConn(conn net.Conn) (*CountingConn, *Counters) {
+	c := &CountingConn{
+		Conn:     conn,
+		counters: new(Counters),
+	}
+	return c, c.counters
+}
+
+// Counters returns counters of the connection.
+func (c *CountingConn) Counters() *Counters {
+	return c.counters
+}
+
+// Read implements io.Reader.
+func (c *CountingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&c.counters.read, int64(n))
+		c.dump(p[:n])
+	}
+	return n, err
+}
+
+// Write implements io.Writer.
+func (c *CountingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		atomic.AddInt64(&c.counters.written, int64(n))
+		c.dump(p[:n])
+	}
+	return n, err
+}
+
+func (c *CountingConn) dump(p []byte) {
+	if c.Dump == nil {
+		return
+	}
+	c.dmu.Lock()
+	_, _ = c.Dump.Write(p)
+	c.dmu.Unlock()
+}
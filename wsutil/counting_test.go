@@ -0,0 +1,58 @@
+package wsutil
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestCountingConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		p, err := ReadClientText(server)
+		if err == nil {
+			err = WriteServerText(server, p[:2])
+		}
+		done <- err
+	}()
+
+	var dump bytes.Buffer
+	conn, counters := NewCountingConn(client)
+	conn.Dump = &dump
+
+	if err := WriteClientText(conn, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ReadServerText(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != "he" {
+		t.Fatalf("unexpected response: %q", p)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Masked client frame: 2 bytes of header, 4 bytes of mask and 5 bytes of
+	// payload. Server frame: 2 bytes of header and 2 bytes of payload.
+	if act, exp := counters.BytesWritten(), int64(11); act != exp {
+		t.Errorf("unexpected bytes written: %d; want %d", act, exp)
+	}
+	if act, exp := counters.BytesRead(), int64(4); act != exp {
+		t.Errorf("unexpected bytes read: %d; want %d", act, exp)
+	}
+	if conn.Counters() != counters {
+		t.Errorf("Counters() returned different counters")
+	}
+	if act, exp := dump.Len(), 15; act != exp {
+		t.Errorf("unexpected dump length: %d; want %d", act, exp)
+	}
+	if act, exp := dump.Bytes()[11:], []byte{0x81, 0x02, 'h', 'e'}; !bytes.Equal(act, exp) {
+		t.Errorf("unexpected dumped response: %#x; want %#x", act, exp)
+	}
+}
@@ -29,3 +29,30 @@ type SendExtensionFunc func(ws.Header) (ws.Header, error)
 func (fn SendExtensionFunc) SetBits(h ws.Header) (ws.Header, error) {
 	return fn(h)
 }
+
+// setBits applies send extensions xs to header h in declared order. Each
+// extension is expected to set its own RSV bits only, thus bits set by
+// previous extensions are preserved (OR-combined) even if next extension
+// does not keep them.
+func setBits(h ws.Header, xs []SendExtension) (_ ws.Header, err error) {
+	for _, x := range xs {
+		rsv := h.Rsv
+		if h, err = x.SetBits(h); err != nil {
+			return h, err
+		}
+		h.Rsv |= rsv
+	}
+	return h, nil
+}
+
+// unsetBits applies receive extensions xs to header h in reverse order. That
+// is, when both sides list extensions in the same order, the last extension
+// applied on write is the first one applied on read.
+func unsetBits(h ws.Header, xs []RecvExtension) (_ ws.Header, err error) {
+	for i := len(xs) - 1; i >= 0; i-- {
+		if h, err = xs[i].UnsetBits(h); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
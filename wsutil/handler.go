@@ -1,6 +1,7 @@
 package wsutil
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -43,6 +44,31 @@ type ControlHandler struct {
 	// pulled and ciphered out from the connection (and introduced by
 	// bytes.Reader, for example).
 	DisableSrcCiphering bool
+
+	// OnPong is an optional callback that will be called by HandlePong() with
+	// received pong payload. Since pong must echo the payload of a ping it
+	// responds to, it could be used along with PingPayload() and MatchPong()
+	// to measure round trip time.
+	//
+	// The argument is only valid until the callback returns.
+	OnPong func(payload []byte)
+
+	// ExpectPong is an optional payload of the ping sent before, for which
+	// pong response is expected. Pong that does not match it is considered
+	// unsolicited. Note that nil ExpectPong means that no ping is pending,
+	// while empty non-nil slice means ping with empty payload.
+	ExpectPong []byte
+
+	// OnUnsolicitedPong is an optional callback that will be called by
+	// HandlePong() with received pong payload if it does not match
+	// ExpectPong. Unsolicited pongs are legal and serve as unidirectional
+	// heartbeat, thus it could be used to update peer liveness timers.
+	// If it is nil, unsolicited pongs are silently accepted.
+	//
+	// Note that OnPong is called for every pong regardless of this field.
+	//
+	// The argument is only valid until the callback returns.
+	OnUnsolicitedPong func(payload []byte)
 }
 
 // ErrNotControlFrame is returned by ControlHandler to indicate that given
@@ -76,14 +102,14 @@ func (c ControlHandler) HandlePing(h ws.Header) error {
 		return ws.WriteHeader(c.Dst, ws.Header{
 			Fin:    true,
 			OpCode: ws.OpPong,
-			Masked: c.State.ClientSide(),
+			Masked: masked(c.State),
 		})
 	}
 
 	// In other way reply with Pong frame with copied payload.
 	p := pbytes.GetLen(int(h.Length) + ws.HeaderSize(ws.Header{
 		Length: h.Length,
-		Masked: c.State.ClientSide(),
+		Masked: masked(c.State),
 	}))
 	defer pbytes.Put(p)
 
@@ -110,15 +136,30 @@ func (c ControlHandler) HandlePing(h ws.Header) error {
 	return err
 }
 
-// HandlePong handles pong frame by discarding it.
+// HandlePong handles pong frame by discarding it. If c.OnPong or
+// c.OnUnsolicitedPong is set, it is called with pong payload before
+// discarding.
 func (c ControlHandler) HandlePong(h ws.Header) error {
 	if h.Length == 0 {
+		c.onPong(nil)
 		return nil
 	}
 
 	buf := pbytes.GetLen(int(h.Length))
 	defer pbytes.Put(buf)
 
+	if c.OnPong != nil || c.OnUnsolicitedPong != nil {
+		r := c.Src
+		if c.State.ServerSide() && !c.DisableSrcCiphering {
+			r = NewCipherReader(r, h.Mask)
+		}
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		c.onPong(buf)
+		return nil
+	}
+
 	// Discard pong message according to the RFC6455:
 	// A Pong frame MAY be sent unsolicited. This serves as a
 	// unidirectional heartbeat. A response to an unsolicited Pong frame
@@ -128,6 +169,34 @@ func (c ControlHandler) HandlePong(h ws.Header) error {
 	return err
 }
 
+// PingPayload returns ping frame with a copy of given data as its payload.
+// Data could be any application-defined value (e.g. a timestamp) to be
+// matched against pong payload with MatchPong().
+//
+// Note that data must be at most ws.MaxControlFramePayloadSize bytes long.
+func PingPayload(data []byte) ws.Frame {
+	p := make([]byte, len(data))
+	copy(p, data)
+	return ws.NewPingFrame(p)
+}
+
+// MatchPong reports whether pong payload got echoes the expected payload of
+// a ping sent before.
+func MatchPong(expected, got []byte) bool {
+	return bytes.Equal(expected, got)
+}
+
+func (c ControlHandler) onPong(p []byte) {
+	if cb := c.OnPong; cb != nil {
+		cb(p)
+	}
+	if cb := c.OnUnsolicitedPong; cb != nil {
+		if c.ExpectPong == nil || !MatchPong(c.ExpectPong, p) {
+			cb(p)
+		}
+	}
+}
+
 // HandleClose handles close frame, makes protocol validity checks and writes
 // specification compatible response to the c.Dst.
 func (c ControlHandler) HandleClose(h ws.Header) error {
@@ -135,7 +204,7 @@ func (c ControlHandler) HandleClose(h ws.Header) error {
 		err := ws.WriteHeader(c.Dst, ws.Header{
 			Fin:    true,
 			OpCode: ws.OpClose,
-			Masked: c.State.ClientSide(),
+			Masked: masked(c.State),
 		})
 		if err != nil {
 			return err
@@ -155,7 +224,7 @@ func (c ControlHandler) HandleClose(h ws.Header) error {
 	// Prepare bytes both for reading reason and sending response.
 	p := pbytes.GetLen(int(h.Length) + ws.HeaderSize(ws.Header{
 		Length: h.Length,
-		Masked: c.State.ClientSide(),
+		Masked: masked(c.State),
 	}))
 	defer pbytes.Put(p)
 
@@ -208,11 +277,43 @@ func (c ControlHandler) HandleClose(h ws.Header) error {
 	}
 }
 
+// CloseResponse returns close frame that should be sent in response to the
+// received close frame with given payload.
+//
+// It echoes the status code received. If received payload is empty or
+// contains status code that must not be sent over the wire (such as
+// ws.StatusNoStatusRcvd or ws.StatusAbnormalClosure), it responds with
+// ws.StatusNormalClosure. If received payload is malformed, it responds with
+// ws.StatusProtocolError.
+//
+// Returned frame is not masked; client side must mask it before sending.
+func CloseResponse(received []byte) ws.Frame {
+	if len(received) == 0 {
+		return ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, ""))
+	}
+	if len(received) < 2 {
+		// Status code is truncated.
+		return ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusProtocolError, ""))
+	}
+	code, reason := ws.ParseCloseFrameDataUnsafe(received)
+	switch code {
+	case ws.StatusNoStatusRcvd, ws.StatusAbnormalClosure:
+		code = ws.StatusNormalClosure
+	default:
+		if err := ws.CheckCloseFrameData(code, reason); err != nil {
+			return ws.NewCloseFrame(ws.NewCloseFrameBody(
+				ws.StatusProtocolError, err.Error(),
+			))
+		}
+	}
+	return ws.NewCloseFrame(ws.NewCloseFrameBody(code, ""))
+}
+
 func (c ControlHandler) closeWithProtocolError(reason error) error {
 	f := ws.NewCloseFrame(ws.NewCloseFrameBody(
 		ws.StatusProtocolError, reason.Error(),
 	))
-	if c.State.ClientSide() {
+	if masked(c.State) {
 		ws.MaskFrameInPlace(f)
 	}
 	return ws.WriteFrame(c.Dst, f)
@@ -2,8 +2,11 @@ package wsutil
 
 import (
 	"bytes"
+	"encoding/binary"
+	"io/ioutil"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/gobwas/ws"
 )
@@ -159,3 +162,204 @@ func TestControlHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestCloseResponse(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		in   []byte
+		code ws.StatusCode
+	}{
+		{
+			name: "normal",
+			in:   ws.NewCloseFrameBody(ws.StatusNormalClosure, "bye"),
+			code: ws.StatusNormalClosure,
+		},
+		{
+			name: "echo",
+			in:   ws.NewCloseFrameBody(ws.StatusGoingAway, "restart"),
+			code: ws.StatusGoingAway,
+		},
+		{
+			name: "empty",
+			code: ws.StatusNormalClosure,
+		},
+		{
+			name: "no status",
+			in:   ws.NewCloseFrameBody(ws.StatusNoStatusRcvd, ""),
+			code: ws.StatusNormalClosure,
+		},
+		{
+			name: "abnormal",
+			in:   ws.NewCloseFrameBody(ws.StatusAbnormalClosure, ""),
+			code: ws.StatusNormalClosure,
+		},
+		{
+			name: "invalid code",
+			in:   ws.NewCloseFrameBody(999, ""),
+			code: ws.StatusProtocolError,
+		},
+		{
+			name: "invalid reason",
+			in:   ws.NewCloseFrameBody(ws.StatusNormalClosure, "\xff"),
+			code: ws.StatusProtocolError,
+		},
+		{
+			name: "truncated",
+			in:   []byte{0x03},
+			code: ws.StatusProtocolError,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			f := CloseResponse(test.in)
+			if f.Header.OpCode != ws.OpClose || !f.Header.Fin || f.Header.Masked {
+				t.Fatalf("unexpected frame header: %+v", f.Header)
+			}
+			if code, _ := ws.ParseCloseFrameData(f.Payload); code != test.code {
+				t.Errorf("unexpected close code: %v; want %v", code, test.code)
+			}
+		})
+	}
+}
+
+func TestControlHandlerOnPong(t *testing.T) {
+	// Client sends ping with a timestamp payload.
+	var stamp [8]byte
+	binary.BigEndian.PutUint64(stamp[:], uint64(time.Now().UnixNano()))
+	ping := PingPayload(stamp[:])
+
+	var c2s, s2c bytes.Buffer
+	if err := ws.WriteFrame(&c2s, ws.MaskFrame(ping)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Server responds with pong echoing the payload.
+	sr := NewServerSideReader(&c2s)
+	h, err := sr.NextFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ControlHandler{
+		Src:                 sr,
+		Dst:                 &s2c,
+		State:               ws.StateServerSide,
+		DisableSrcCiphering: true,
+	}.Handle(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Client receives pong and matches it to the ping.
+	var (
+		called  bool
+		matched bool
+		rtt     time.Duration
+	)
+	cr := NewClientSideReader(&s2c)
+	if h, err = cr.NextFrame(); err != nil {
+		t.Fatal(err)
+	}
+	err = ControlHandler{
+		Src:                 cr,
+		Dst:                 &c2s,
+		State:               ws.StateClientSide,
+		DisableSrcCiphering: true,
+		OnPong: func(p []byte) {
+			called = true
+			if matched = MatchPong(ping.Payload, p); matched {
+				sent := int64(binary.BigEndian.Uint64(p))
+				rtt = time.Duration(time.Now().UnixNano() - sent)
+			}
+		},
+	}.Handle(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Fatalf("OnPong was not called")
+	}
+	if !matched {
+		t.Fatalf("pong payload does not match ping payload")
+	}
+	if rtt < 0 {
+		t.Errorf("unexpected negative rtt: %s", rtt)
+	}
+	if MatchPong(ping.Payload, []byte("other")) {
+		t.Errorf("unexpected match of different payload")
+	}
+}
+
+func TestControlHandlerOnUnsolicitedPong(t *testing.T) {
+	ping := PingPayload([]byte("ping"))
+	for _, test := range []struct {
+		name   string
+		expect []byte
+		pong   []byte
+		called bool
+	}{
+		{
+			name:   "solicited",
+			expect: ping.Payload,
+			pong:   ping.Payload,
+		},
+		{
+			name:   "unsolicited",
+			pong:   []byte("heartbeat"),
+			called: true,
+		},
+		{
+			name:   "unsolicited empty",
+			pong:   nil,
+			called: true,
+		},
+		{
+			name:   "mismatch",
+			expect: ping.Payload,
+			pong:   []byte("other"),
+			called: true,
+		},
+		{
+			name:   "solicited empty",
+			expect: []byte{},
+			pong:   nil,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := ws.WriteFrame(&buf, ws.NewPongFrame(test.pong)); err != nil {
+				t.Fatal(err)
+			}
+			h, err := ws.ReadHeader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var (
+				pong   bool
+				called bool
+			)
+			err = ControlHandler{
+				Src:        &buf,
+				Dst:        ioutil.Discard,
+				State:      ws.StateClientSide,
+				ExpectPong: test.expect,
+				OnPong: func([]byte) {
+					pong = true
+				},
+				OnUnsolicitedPong: func(p []byte) {
+					called = true
+					if !bytes.Equal(p, test.pong) {
+						t.Errorf("unexpected payload: %q; want %q", p, test.pong)
+					}
+				},
+			}.Handle(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !pong {
+				t.Errorf("OnPong was not called")
+			}
+			if called != test.called {
+				t.Errorf("OnUnsolicitedPong called: %t; want %t", called, test.called)
+			}
+		})
+	}
+}
@@ -2,8 +2,15 @@ package wsutil
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/gobwas/ws"
 )
@@ -62,6 +69,184 @@ func ReadMessage(r io.Reader, s ws.State, m []Message) ([]Message, error) {
 	return append(m, Message{h.OpCode, p}), nil
 }
 
+// CopyMessage reads next data message from src and copies its payload to dst
+// without buffering the whole message. It returns operation code of the
+// message and number of bytes written to dst.
+//
+// Control frames received before or in between of message fragments are
+// handled. If src implements io.Writer, responses to them are written back to
+// src. Otherwise responses are dropped. On close frame receipt ClosedError is
+// returned.
+//
+// Note that CopyMessage does not interpret RSV bits. To copy messages
+// compressed by permessage-deflate extension use CopyMessageDecompress().
+func CopyMessage(dst io.Writer, src io.Reader, s ws.State) (op ws.OpCode, n int64, err error) {
+	return copyMessage(dst, src, s, nil)
+}
+
+// CopyMessageDecompress is like CopyMessage but also handles messages
+// compressed by permessage-deflate extension. That is, it treats RSV1 bit as
+// the Per-Message Compressed bit and streams payload of compressed messages
+// through the reader returned by decompress. Returned n is the number of
+// decompressed bytes written to dst.
+//
+// Decompress receives reader of the compressed message payload and must
+// return reader of decompressed data, which ends with io.EOF when the
+// message ends. For example:
+//
+//	fr := wsflate.NewReader(nil, func(r io.Reader) wsflate.Decompressor {
+//		return flate.NewReader(r)
+//	})
+//	decompress := func(r io.Reader) io.Reader {
+//		fr.Reset(r)
+//		return fr
+//	}
+//
+// It must be used only if compression extension was negotiated.
+func CopyMessageDecompress(dst io.Writer, src io.Reader, s ws.State, decompress func(io.Reader) io.Reader) (op ws.OpCode, n int64, err error) {
+	return copyMessage(dst, src, s, decompress)
+}
+
+func copyMessage(dst io.Writer, src io.Reader, s ws.State, decompress func(io.Reader) io.Reader) (op ws.OpCode, n int64, err error) {
+	w, ok := src.(io.Writer)
+	if !ok {
+		w = ioutil.Discard
+	}
+	controlHandler := ControlFrameHandler(w, s)
+	rd := Reader{
+		Source:         src,
+		State:          s,
+		CheckUTF8:      true,
+		OnIntermediate: controlHandler,
+	}
+	var compressed bool
+	if decompress != nil {
+		rd.State |= ws.StateExtended
+		rd.Extensions = []RecvExtension{RecvExtensionFunc(func(h ws.Header) (ws.Header, error) {
+			r1, r2, r3 := ws.RsvBits(h.Rsv)
+			if !h.OpCode.IsData() || h.OpCode == ws.OpContinuation {
+				if r1 {
+					// Only the first frame of a data message could have
+					// compression bit set.
+					return h, ws.ErrProtocolNonZeroRsv
+				}
+				return h, nil
+			}
+			compressed = r1
+			// Compressed payload could not be checked for UTF-8; it is
+			// checked after decompression instead.
+			rd.CheckUTF8 = !compressed
+			h.Rsv = ws.Rsv(false, r2, r3)
+			return h, nil
+		})}
+	}
+	for {
+		hdr, err := rd.NextFrame()
+		if err != nil {
+			return 0, 0, err
+		}
+		if hdr.OpCode.IsControl() {
+			if err := controlHandler(hdr, &rd); err != nil {
+				return 0, 0, err
+			}
+			continue
+		}
+		if !compressed {
+			n, err = io.Copy(dst, &rd)
+			return hdr.OpCode, n, err
+		}
+		r := decompress(&rd)
+		if hdr.OpCode == ws.OpText {
+			u := UTF8Reader{Source: r}
+			if n, err = io.Copy(dst, &u); err == nil && !u.Valid() {
+				err = ErrInvalidUTF8
+			}
+		} else {
+			n, err = io.Copy(dst, r)
+		}
+		if err == nil {
+			// Make sure that the rest of compressed payload (if any) is not
+			// left unread.
+			err = rd.Discard()
+		}
+		return hdr.OpCode, n, err
+	}
+}
+
+// ReadTextInto reads next data message from r and appends its payload to sb
+// without intermediate []byte buffer. It returns ErrUnexpectedOpCode if
+// received message is not a text message; such message is discarded and sb
+// is left untouched. Payload is validated to be UTF-8 encoded; on error sb may
+// contain bytes of the partially read message.
+//
+// Message size is not bounded; use ReadTextIntoLimit() to bound it. Note that
+// wrapping r (e.g. by io.LimitReader()) does not work for that: it limits
+// bytes of frames instead of message payload and hides r's io.Writer, which
+// is needed to respond to pings.
+//
+// Control frames are handled the same way as CopyMessage() does.
+func ReadTextInto(r io.Reader, s ws.State, sb *strings.Builder) error {
+	return ReadTextIntoLimit(r, s, sb, 0)
+}
+
+// ReadTextIntoLimit is like ReadTextInto() but returns ErrMessageTooLarge if
+// received text message is longer than max bytes. In that case sb may contain
+// up to max first bytes of the message and the rest of the message is left
+// unread. Non-positive max means there is no limit.
+func ReadTextIntoLimit(r io.Reader, s ws.State, sb *strings.Builder, max int) error {
+	w, ok := r.(io.Writer)
+	if !ok {
+		w = ioutil.Discard
+	}
+	controlHandler := ControlFrameHandler(w, s)
+	rd := Reader{
+		Source:         r,
+		State:          s,
+		CheckUTF8:      true,
+		OnIntermediate: controlHandler,
+	}
+	for {
+		hdr, err := rd.NextFrame()
+		if err != nil {
+			return err
+		}
+		if hdr.OpCode.IsControl() {
+			if err := controlHandler(hdr, &rd); err != nil {
+				return err
+			}
+			continue
+		}
+		if hdr.OpCode != ws.OpText {
+			if err := rd.Discard(); err != nil {
+				return err
+			}
+			return ErrUnexpectedOpCode
+		}
+		if max > 0 && hdr.Length > int64(max) {
+			return ErrMessageTooLarge
+		}
+		var (
+			buf [512]byte
+			n   int
+		)
+		for {
+			m, err := rd.Read(buf[:])
+			if max > 0 && n+m > max {
+				sb.Write(buf[:max-n])
+				return ErrMessageTooLarge
+			}
+			sb.Write(buf[:m])
+			n += m
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
 // ReadClientMessage reads next message from r, considering that caller
 // represents server side.
 // It is a shortcut for ReadMessage(r, ws.StateServerSide, m).
@@ -161,6 +346,42 @@ func WriteMessage(w io.Writer, s ws.State, op ws.OpCode, p []byte) error {
 	return writeFrame(w, s, op, true, p)
 }
 
+// WriteMessageBuffer is like WriteMessage but takes message payload from buf,
+// which is usually taken from a pool.
+//
+// Ownership of buf is passed to WriteMessageBuffer for the duration of the
+// call: if cipher must be made, buf bytes are masked in place to avoid copy.
+// Before return buf is fully consumed and reset (even if error occurred) and
+// no references to it are retained, thus caller could reuse buf or return it
+// to the pool right after the call.
+func WriteMessageBuffer(w io.Writer, s ws.State, op ws.OpCode, buf *bytes.Buffer) error {
+	defer buf.Reset()
+	frame := ws.NewFrame(op, true, buf.Bytes())
+	if masked(s) {
+		frame = ws.MaskFrameInPlace(frame)
+	}
+	return ws.WriteFrame(w, frame)
+}
+
+// WriteMessageContext is like WriteMessage but writes message to conn with
+// respect of given context. Context deadline (if any) is applied as a conn
+// write deadline; context cancelation interrupts the write as well. When
+// context is done before message is fully written, ctx.Err() is returned.
+//
+// Note that when write is interrupted partway through a frame, conn is left
+// in inconsistent state and must not be used for writing anymore. If conn is
+// created by NewContextConn(), it is marked as failed and all subsequent
+// writes return ErrWriteInterrupted; its write deadline set by user is
+// restored after successful write. Otherwise WriteMessageContext only leaves
+// conn write deadline in the past, so that subsequent writes fail fast
+// unless the deadline is changed, and clears write deadline after successful
+// write if context has a deadline.
+func WriteMessageContext(ctx context.Context, conn net.Conn, s ws.State, op ws.OpCode, p []byte) error {
+	return writeContext(ctx, conn, func() error {
+		return WriteMessage(conn, s, op, p)
+	})
+}
+
 // WriteServerMessage writes message to w, considering that caller
 // represents server side.
 func WriteServerMessage(w io.Writer, op ws.OpCode, p []byte) error {
@@ -197,6 +418,217 @@ func WriteClientBinary(w io.Writer, p []byte) error {
 	return WriteClientMessage(w, ws.OpBinary, p)
 }
 
+// CloseWrite writes close frame with given code and reason to conn and then
+// shuts down the writing side of the underlying connection, if conn
+// implements CloseWrite() error method (such as *net.TCPConn does). Reading
+// side of conn is left untouched, so caller is still able to receive the
+// close frame sent by peer in response.
+//
+// If conn does not implement CloseWrite() method, then only close frame is
+// written.
+func CloseWrite(conn net.Conn, s ws.State, code ws.StatusCode, reason string) error {
+	err := writeFrame(conn, s, ws.OpClose, true, ws.NewCloseFrameBody(code, reason))
+	if err != nil {
+		return err
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// WriteCloseContext writes close frame with given code and reason to conn,
+// bounding the write by ctx. The context deadline is applied as conn write
+// deadline; if ctx is done before frame is fully written, ctx.Err() is
+// returned. In that case caller should proceed to close conn without waiting
+// for the closing handshake to complete.
+//
+// See WriteMessageContext() for notes on conn write deadline.
+func WriteCloseContext(ctx context.Context, conn net.Conn, s ws.State, code ws.StatusCode, reason string) error {
+	return writeContext(ctx, conn, func() error {
+		return writeFrame(conn, s, ws.OpClose, true, ws.NewCloseFrameBody(code, reason))
+	})
+}
+
+// Probe checks that conn is a live WebSocket connection by sending a ping
+// frame with random payload and waiting for the matching pong within given
+// timeout. Pings received meanwhile are answered and other pongs are
+// ignored. It returns nil if connection is healthy.
+//
+// Probe is intended to be used by connection pools on the client side of an
+// idle connection: conn must not be read or written concurrently and must
+// not contain buffered data elsewhere. If data frame is received,
+// ErrUnexpectedOpCode is returned; ClosedError is returned if peer closes the
+// connection.
+//
+// Probe resets conn deadline before return.
+func Probe(conn net.Conn, timeout time.Duration) (err error) {
+	var payload [8]byte
+	if _, err = rand.Read(payload[:]); err != nil {
+		return err
+	}
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	defer func() {
+		if e := conn.SetDeadline(time.Time{}); err == nil {
+			err = e
+		}
+	}()
+
+	s := ws.StateClientSide
+	if err = writeFrame(conn, s, ws.OpPing, true, payload[:]); err != nil {
+		return err
+	}
+
+	var matched bool
+	control := ControlHandler{
+		Dst:   conn,
+		State: s,
+		OnPong: func(p []byte) {
+			matched = MatchPong(payload[:], p)
+		},
+	}
+	for !matched {
+		h, err := ws.ReadHeader(conn)
+		if err != nil {
+			return err
+		}
+		if err = ws.CheckHeader(h, s); err != nil {
+			return err
+		}
+		if !h.OpCode.IsControl() {
+			return ErrUnexpectedOpCode
+		}
+		control.Src = io.LimitReader(conn, h.Length)
+		if err = control.Handle(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrUnexpectedOpCode is returned by value reading helpers when received
+// message has unexpected operation code.
+var ErrUnexpectedOpCode = errors.New("unexpected message operation code")
+
+// ErrMessageTooLarge is returned by value reading helpers when received
+// message is longer than given limit. The rest of the message is left unread,
+// so the connection should be closed; RFC 6455 suggests ws.StatusMessageTooBig
+// (1009) close code for that.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// WriteBinaryValue marshals v with given marshal function and writes result
+// to w as a single binary message. It uses given state to prepare
+// side-dependent things, like cipher payload bytes from client to server.
+//
+// Value is marshaled completely before anything is written, thus marshal
+// failure never leads to partially written frames.
+func WriteBinaryValue(w io.Writer, s ws.State, v interface{}, marshal func(interface{}) ([]byte, error)) error {
+	p, err := marshal(v)
+	if err != nil {
+		return err
+	}
+	return WriteMessage(w, s, ws.OpBinary, p)
+}
+
+// ReadBinaryValue reads next data message from rw and unmarshals its
+// payload into v with given unmarshal function. It returns
+// ErrUnexpectedOpCode if received message is not a binary message.
+//
+// Note this may handle and write control frames into the writer part of a
+// given io.ReadWriter.
+func ReadBinaryValue(rw io.ReadWriter, s ws.State, v interface{}, unmarshal func([]byte, interface{}) error) error {
+	p, op, err := ReadData(rw, s)
+	if err != nil {
+		return err
+	}
+	if op != ws.OpBinary {
+		return ErrUnexpectedOpCode
+	}
+	return unmarshal(p, v)
+}
+
+// WriteJSON marshals v as JSON and writes result to w as a single text
+// message. It uses given state to prepare side-dependent things, like cipher
+// payload bytes from client to server.
+//
+// Value is marshaled completely before anything is written, thus marshal
+// failure never leads to partially written frames.
+func WriteJSON(w io.Writer, s ws.State, v interface{}) error {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return WriteMessage(w, s, ws.OpText, p)
+}
+
+// ReadJSON reads next data message from r and unmarshals its JSON payload
+// into v. It returns ErrUnexpectedOpCode if received message is not a text
+// message.
+//
+// Control frames are handled the same way as CopyMessage() does.
+func ReadJSON(r io.Reader, s ws.State, v interface{}) error {
+	var buf bytes.Buffer
+	op, _, err := CopyMessage(&buf, r, s)
+	if err != nil {
+		return err
+	}
+	if op != ws.OpText {
+		return ErrUnexpectedOpCode
+	}
+	return json.Unmarshal(buf.Bytes(), v)
+}
+
+// ErrStop could be returned by ForEachMessage() callback to stop iteration
+// without an error.
+var ErrStop = errors.New("stop")
+
+// ForEachMessage reads data messages from rw until io.EOF or an error and
+// calls fn for every complete message. Fragmented messages are reassembled;
+// control frames are handled and responded to the write part of rw.
+//
+// If fn returns non-nil error, iteration stops and that error is returned.
+// If fn returns ErrStop, iteration stops and nil is returned. Nil error is
+// also returned when io.EOF is received at message boundary.
+//
+// Note that data argument is only valid until fn returns.
+func ForEachMessage(rw io.ReadWriter, s ws.State, fn func(op ws.OpCode, data []byte) error) error {
+	controlHandler := ControlFrameHandler(rw, s)
+	rd := Reader{
+		Source:         rw,
+		State:          s,
+		CheckUTF8:      true,
+		OnIntermediate: controlHandler,
+	}
+	var buf bytes.Buffer
+	for {
+		hdr, err := rd.NextFrame()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.OpCode.IsControl() {
+			if err := controlHandler(hdr, &rd); err != nil {
+				return err
+			}
+			continue
+		}
+		buf.Reset()
+		if _, err := buf.ReadFrom(&rd); err != nil {
+			return err
+		}
+		if err := fn(hdr.OpCode, buf.Bytes()); err != nil {
+			if err == ErrStop {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
 // HandleClientControlMessage handles control frame from conn and writes
 // response when needed.
 //
@@ -245,10 +677,85 @@ func ControlFrameHandler(w io.Writer, state ws.State) FrameHandlerFunc {
 	}
 }
 
+// aLongTimeAgo is a non-zero time, far in the past, used for immediate
+// cancelation of i/o operations.
+var aLongTimeAgo = time.Unix(1, 0)
+
+func writeContext(ctx context.Context, conn net.Conn, write func() error) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	var (
+		raw  = conn
+		user time.Time // Write deadline to restore after successful write.
+	)
+	cc, tracked := conn.(*contextConn)
+	if tracked {
+		if err = cc.failure(); err != nil {
+			return err
+		}
+		raw = cc.Conn
+		user = cc.writeDeadline()
+	}
+	t, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		if !user.IsZero() && user.Before(t) {
+			t = user
+		}
+		raw.SetWriteDeadline(t)
+	}
+	var (
+		quit      = make(chan struct{})
+		interrupt = make(chan error, 1)
+	)
+	go func() {
+		select {
+		case <-quit:
+			interrupt <- nil
+		case <-ctx.Done():
+			raw.SetWriteDeadline(aLongTimeAgo)
+			interrupt <- ctx.Err()
+		}
+	}()
+	err = write()
+	close(quit)
+	ctxErr := <-interrupt
+	if err == nil {
+		// Message was written completely regardless of context expiration.
+		// Restore write deadline if it was changed.
+		if tracked || hasDeadline || ctxErr != nil {
+			raw.SetWriteDeadline(user)
+		}
+		return nil
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if t, ok := ctx.Deadline(); ctxErr == nil && ok && !time.Now().Before(t) {
+			// Conn deadline could be exceeded slightly before the context's
+			// one.
+			ctxErr = context.DeadlineExceeded
+		}
+		if ctxErr != nil {
+			err = ctxErr
+		}
+	}
+	// Poison the conn since we don't know how many bytes were written.
+	if tracked {
+		cc.fail()
+	} else {
+		raw.SetWriteDeadline(aLongTimeAgo)
+	}
+	return err
+}
+
 func readData(rw io.ReadWriter, s ws.State, want ws.OpCode) ([]byte, ws.OpCode, error) {
-	controlHandler := ControlFrameHandler(rw, s)
+	return readDataWith(rw, s, want, ControlFrameHandler(rw, s))
+}
+
+// readDataWith is like readData() but handles control frames with given
+// controlHandler.
+func readDataWith(r io.Reader, s ws.State, want ws.OpCode, controlHandler FrameHandlerFunc) ([]byte, ws.OpCode, error) {
 	rd := Reader{
-		Source:          rw,
+		Source:          r,
 		State:           s,
 		CheckUTF8:       true,
 		SkipHeaderCheck: false,
@@ -277,3 +784,67 @@ func readData(rw io.ReadWriter, s ws.State, want ws.OpCode) ([]byte, ws.OpCode,
 		return bts, hdr.OpCode, err
 	}
 }
+
+// DrainStats is a summary of frames read by Drain().
+type DrainStats struct {
+	// Frames is the number of frames read, including control frames.
+	Frames int
+	// Bytes is the total payload length of the frames read.
+	Bytes int64
+	// OpCodes holds number of frames read per operation code.
+	OpCodes map[ws.OpCode]int
+	// Clean reports whether connection was closed by peer with
+	// ws.StatusNormalClosure code.
+	Clean bool
+	// CloseCode is the status code of the close frame received. It is zero
+	// if connection ended without close frame.
+	CloseCode ws.StatusCode
+}
+
+// Drain reads all frames from the client side connection conn until close
+// frame or EOF is received and returns summary of them. Pings are answered
+// and close frame is replied according to the protocol. It is intended to be
+// used by testing and benchmarking tools to verify results of load tests.
+//
+// It returns nil error if connection was closed by peer (cleanly or not) or
+// ended with EOF; stats.Clean reports whether closure was clean.
+func Drain(conn net.Conn) (stats DrainStats, err error) {
+	s := ws.StateClientSide
+	stats.OpCodes = make(map[ws.OpCode]int)
+	control := ControlHandler{
+		Dst:   conn,
+		State: s,
+	}
+	for {
+		h, err := ws.ReadHeader(conn)
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+		if err = ws.CheckHeader(h, s); err != nil {
+			return stats, err
+		}
+		stats.Frames++
+		stats.Bytes += h.Length
+		stats.OpCodes[h.OpCode]++
+
+		if !h.OpCode.IsControl() {
+			if _, err = io.CopyN(ioutil.Discard, conn, h.Length); err != nil {
+				return stats, err
+			}
+			continue
+		}
+		control.Src = io.LimitReader(conn, h.Length)
+		err = control.Handle(h)
+		if ce, ok := err.(ClosedError); ok {
+			stats.CloseCode = ce.Code
+			stats.Clean = ce.Code == ws.StatusNormalClosure
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+	}
+}
@@ -2,8 +2,16 @@ package wsutil
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gobwas/ws"
 )
@@ -80,3 +88,832 @@ func TestReadMessageEOF(t *testing.T) {
 		})
 	}
 }
+
+func TestCloseWrite(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		pair func(t *testing.T) (net.Conn, net.Conn)
+		eof  bool
+	}{
+		{
+			name: "tcp",
+			pair: tcpPair,
+			eof:  true,
+		},
+		{
+			name: "pipe",
+			pair: func(*testing.T) (net.Conn, net.Conn) {
+				return net.Pipe()
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := test.pair(t)
+			defer client.Close()
+			defer server.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- CloseWrite(server, ws.StateServerSide, ws.StatusGoingAway, "bye")
+			}()
+
+			frame, err := ws.ReadFrame(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-done; err != nil {
+				t.Fatalf("unexpected CloseWrite() error: %v", err)
+			}
+			code, reason := ws.ParseCloseFrameData(frame.Payload)
+			if frame.Header.OpCode != ws.OpClose || code != ws.StatusGoingAway || reason != "bye" {
+				t.Fatalf(
+					"unexpected frame: %v %v %q",
+					frame.Header.OpCode, code, reason,
+				)
+			}
+			if !test.eof {
+				return
+			}
+			if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+				t.Fatalf("unexpected read error: %v; want %v", err, io.EOF)
+			}
+
+			// Reading side of server must be still usable.
+			go func() {
+				done <- WriteClientMessage(client, ws.OpClose, nil)
+			}()
+			if _, err := ws.ReadFrame(server); err != nil {
+				t.Fatalf("unexpected error reading after CloseWrite(): %v", err)
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, <-accepted
+}
+
+func TestWriteMessageBuffer(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		state ws.State
+	}{
+		{"client", ws.StateClientSide},
+		{"server", ws.StateServerSide},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				out bytes.Buffer
+				buf bytes.Buffer
+			)
+			buf.WriteString("hello, buffer")
+			if err := WriteMessageBuffer(&out, test.state, ws.OpText, &buf); err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len() != 0 {
+				t.Fatalf("buffer is not consumed: %d bytes left", buf.Len())
+			}
+			// Buffer is reused right after the call; already written bytes
+			// must not be affected.
+			buf.WriteString("something else")
+
+			f, err := ws.ReadFrame(&out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Header.Masked != test.state.ClientSide() {
+				t.Errorf("unexpected masked flag: %t", f.Header.Masked)
+			}
+			f = ws.UnmaskFrameInPlace(f)
+			if string(f.Payload) != "hello, buffer" {
+				t.Errorf("unexpected payload: %q", f.Payload)
+			}
+		})
+	}
+	t.Run("error", func(t *testing.T) {
+		conn, _ := net.Pipe()
+		conn.Close()
+
+		var buf bytes.Buffer
+		buf.WriteString("hello")
+		err := WriteMessageBuffer(conn, ws.StateServerSide, ws.OpText, &buf)
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("buffer is not reset after error")
+		}
+	})
+}
+
+func TestWriteMessageContext(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+		err  error
+	}{
+		{
+			name: "deadline",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 50*time.Millisecond)
+			},
+			err: context.DeadlineExceeded,
+		},
+		{
+			name: "cancel",
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(50*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+			err: context.Canceled,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Nobody reads from the client side, thus writes are blocked.
+			client, raw := net.Pipe()
+			defer client.Close()
+			defer raw.Close()
+			server := NewContextConn(raw)
+
+			ctx, cancel := test.ctx()
+			defer cancel()
+
+			err := WriteMessageContext(ctx, server, ws.StateServerSide, ws.OpText, []byte("hello"))
+			if err != test.err {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+
+			// Subsequent context-aware writes must fail immediately even if
+			// they set new deadline.
+			ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			start := time.Now()
+			err = WriteMessageContext(ctx, server, ws.StateServerSide, ws.OpText, []byte("world"))
+			if err != ErrWriteInterrupted {
+				t.Fatalf("unexpected error of the next write: %v; want %v", err, ErrWriteInterrupted)
+			}
+			if d := time.Since(start); d > 100*time.Millisecond {
+				t.Fatalf("next write failed too late: %s", d)
+			}
+
+			// Deadline reset must not make conn writable again.
+			server.SetWriteDeadline(time.Time{})
+
+			// Subsequent writes must fail fast.
+			done := make(chan error, 1)
+			go func() {
+				done <- WriteServerText(server, []byte("world"))
+			}()
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Fatalf("unexpected write success after interrupted write")
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("write after interrupted write is blocked")
+			}
+		})
+	}
+}
+
+func TestWriteMessageContextSuccess(t *testing.T) {
+	client, raw := net.Pipe()
+	defer client.Close()
+	defer raw.Close()
+	server := NewContextConn(raw)
+
+	go ws.ReadFrame(client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := WriteMessageContext(ctx, server, ws.StateServerSide, ws.OpText, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write deadline set by user must be respected and restored after
+	// successful write.
+	server.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	go ws.ReadFrame(client)
+	if err := WriteMessageContext(ctx, server, ws.StateServerSide, ws.OpText, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err := WriteServerText(server, []byte("blocked"))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("unexpected error: %v; want timeout", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("user write deadline was not restored: write blocked for %s", d)
+	}
+}
+
+func TestWriteCloseContext(t *testing.T) {
+	t.Run("blocked", func(t *testing.T) {
+		// Nobody reads from the client side, thus writes are blocked.
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- WriteCloseContext(ctx, server, ws.StateServerSide, ws.StatusGoingAway, "shutdown")
+		}()
+		select {
+		case err := <-done:
+			if err != context.DeadlineExceeded {
+				t.Fatalf("unexpected error: %v; want %v", err, context.DeadlineExceeded)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("close write is blocked")
+		}
+	})
+	t.Run("success", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		frames := make(chan ws.Frame, 1)
+		go func() {
+			f, _ := ws.ReadFrame(server)
+			frames <- f
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := WriteCloseContext(ctx, client, ws.StateClientSide, ws.StatusGoingAway, "bye"); err != nil {
+			t.Fatal(err)
+		}
+		f := ws.UnmaskFrameInPlace(<-frames)
+		if f.Header.OpCode != ws.OpClose {
+			t.Fatalf("unexpected op code: %v", f.Header.OpCode)
+		}
+		code, reason := ws.ParseCloseFrameData(f.Payload)
+		if code != ws.StatusGoingAway || reason != "bye" {
+			t.Errorf("unexpected close frame data: %d %q", code, reason)
+		}
+	})
+}
+
+func TestProbe(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		peer func(conn net.Conn, ping ws.Frame) error
+		err  func(error) bool
+	}{
+		{
+			name: "healthy",
+			peer: func(conn net.Conn, ping ws.Frame) error {
+				// Interleave stale pong and ping before the response.
+				if err := ws.WriteFrame(conn, ws.NewPongFrame([]byte("stale"))); err != nil {
+					return err
+				}
+				if err := ws.WriteFrame(conn, ws.NewPingFrame([]byte("ping"))); err != nil {
+					return err
+				}
+				pong, err := ws.ReadFrame(conn)
+				if err != nil {
+					return err
+				}
+				if pong = ws.UnmaskFrameInPlace(pong); string(pong.Payload) != "ping" {
+					return errors.New("unexpected pong payload")
+				}
+				return ws.WriteFrame(conn, ws.NewPongFrame(ping.Payload))
+			},
+			err: func(err error) bool {
+				return err == nil
+			},
+		},
+		{
+			name: "timeout",
+			peer: func(net.Conn, ws.Frame) error {
+				return nil
+			},
+			err: func(err error) bool {
+				ne, ok := err.(net.Error)
+				return ok && ne.Timeout()
+			},
+		},
+		{
+			name: "data",
+			peer: func(conn net.Conn, _ ws.Frame) error {
+				return ws.WriteFrame(conn, ws.NewTextFrame([]byte("hello")))
+			},
+			err: func(err error) bool {
+				return err == ErrUnexpectedOpCode
+			},
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			go func() {
+				ping, err := ws.ReadFrame(server)
+				if err != nil {
+					return
+				}
+				_ = test.peer(server, ws.UnmaskFrameInPlace(ping))
+			}()
+
+			err := Probe(client, 100*time.Millisecond)
+			if !test.err(err) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestBinaryValue(t *testing.T) {
+	type value struct {
+		Name  string
+		Count int
+	}
+	var buf bytes.Buffer
+	exp := value{"gopher", 42}
+	if err := WriteBinaryValue(&buf, ws.StateClientSide, exp, json.Marshal); err != nil {
+		t.Fatal(err)
+	}
+	var act value
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{&buf, ioutil.Discard}
+	if err := ReadBinaryValue(rw, ws.StateServerSide, &act, json.Unmarshal); err != nil {
+		t.Fatal(err)
+	}
+	if act != exp {
+		t.Errorf("unexpected value: %+v; want %+v", act, exp)
+	}
+}
+
+func TestBinaryValueErrors(t *testing.T) {
+	var buf bytes.Buffer
+	errMarshal := errors.New("marshal error")
+	err := WriteBinaryValue(&buf, ws.StateServerSide, nil, func(interface{}) ([]byte, error) {
+		return []byte("partial"), errMarshal
+	})
+	if err != errMarshal {
+		t.Fatalf("unexpected error: %v; want %v", err, errMarshal)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected bytes written on marshal failure")
+	}
+
+	if err := WriteServerText(&buf, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{&buf, ioutil.Discard}
+	var v interface{}
+	if err := ReadBinaryValue(rw, ws.StateClientSide, &v, json.Unmarshal); err != ErrUnexpectedOpCode {
+		t.Fatalf("unexpected error: %v; want %v", err, ErrUnexpectedOpCode)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	type value struct {
+		Name  string
+		Count int
+	}
+	var buf bytes.Buffer
+	exp := value{"gopher", 42}
+	if err := WriteJSON(&buf, ws.StateClientSide, exp); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := ws.ReadFrame(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Header.OpCode != ws.OpText {
+		t.Errorf("unexpected op code: %v; want %v", frame.Header.OpCode, ws.OpText)
+	}
+	var act value
+	if err := ReadJSON(&buf, ws.StateServerSide, &act); err != nil {
+		t.Fatal(err)
+	}
+	if act != exp {
+		t.Errorf("unexpected value: %+v; want %+v", act, exp)
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteJSON(&buf, ws.StateServerSide, func() {}); err == nil {
+		t.Fatalf("expected marshal error")
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected bytes written on marshal failure")
+	}
+
+	for _, test := range []struct {
+		name  string
+		frame ws.Frame
+		err   error
+	}{
+		{
+			name:  "binary",
+			frame: ws.NewBinaryFrame([]byte("{}")),
+			err:   ErrUnexpectedOpCode,
+		},
+		{
+			name:  "malformed",
+			frame: ws.NewTextFrame([]byte("{")),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			ws.MustWriteFrame(&buf, test.frame)
+			var v interface{}
+			err := ReadJSON(&buf, ws.StateClientSide, &v)
+			if test.err != nil && err != test.err {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			if err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
+
+func TestForEachMessage(t *testing.T) {
+	var buf bytes.Buffer
+	for _, f := range []ws.Frame{
+		ws.NewTextFrame([]byte("first")),
+		ws.NewFrame(ws.OpBinary, false, []byte("sec")),
+		ws.NewPingFrame([]byte("ping")),
+		ws.NewFrame(ws.OpContinuation, true, []byte("ond")),
+		ws.NewTextFrame([]byte("third")),
+	} {
+		if err := ws.WriteFrame(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src := buf.Bytes()
+
+	for _, test := range []struct {
+		name  string
+		stop  int
+		err   error
+		exp   []Message
+		cbErr error
+	}{
+		{
+			name: "all",
+			stop: -1,
+			exp: []Message{
+				{ws.OpText, []byte("first")},
+				{ws.OpBinary, []byte("second")},
+				{ws.OpText, []byte("third")},
+			},
+		},
+		{
+			name:  "stop",
+			stop:  1,
+			cbErr: ErrStop,
+			exp: []Message{
+				{ws.OpText, []byte("first")},
+				{ws.OpBinary, []byte("second")},
+			},
+		},
+		{
+			name:  "error",
+			stop:  0,
+			cbErr: io.ErrClosedPipe,
+			err:   io.ErrClosedPipe,
+			exp: []Message{
+				{ws.OpText, []byte("first")},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			rw := struct {
+				io.Reader
+				io.Writer
+			}{bytes.NewReader(src), &out}
+
+			var act []Message
+			err := ForEachMessage(rw, ws.StateClientSide, func(op ws.OpCode, p []byte) error {
+				act = append(act, Message{op, append([]byte(nil), p...)})
+				if len(act)-1 == test.stop {
+					return test.cbErr
+				}
+				return nil
+			})
+			if err != test.err {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			if len(act) != len(test.exp) {
+				t.Fatalf("unexpected number of messages: %d; want %d", len(act), len(test.exp))
+			}
+			for i, exp := range test.exp {
+				if act[i].OpCode != exp.OpCode || !bytes.Equal(act[i].Payload, exp.Payload) {
+					t.Errorf("unexpected #%d message: %v %q", i, act[i].OpCode, act[i].Payload)
+				}
+			}
+			if test.stop < 0 {
+				pong, err := ws.ReadFrame(&out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if pong.Header.OpCode != ws.OpPong {
+					t.Errorf("unexpected response to ping: %v", pong.Header.OpCode)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyMessage(t *testing.T) {
+	var buf bytes.Buffer
+	for _, f := range []ws.Frame{
+		ws.NewPingFrame([]byte("before")),
+		ws.NewFrame(ws.OpBinary, false, []byte("hello, ")),
+		ws.NewPingFrame([]byte("between")),
+		ws.NewFrame(ws.OpContinuation, true, []byte("world")),
+		ws.NewTextFrame([]byte("next")),
+	} {
+		if err := ws.WriteFrame(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var (
+		out bytes.Buffer
+		dst bytes.Buffer
+	)
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{&buf, &out}
+
+	for _, exp := range []Message{
+		{ws.OpBinary, []byte("hello, world")},
+		{ws.OpText, []byte("next")},
+	} {
+		dst.Reset()
+		op, n, err := CopyMessage(&dst, rw, ws.StateClientSide)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != exp.OpCode {
+			t.Errorf("unexpected op code: %v; want %v", op, exp.OpCode)
+		}
+		if n != int64(len(exp.Payload)) {
+			t.Errorf("unexpected number of bytes copied: %d; want %d", n, len(exp.Payload))
+		}
+		if !bytes.Equal(dst.Bytes(), exp.Payload) {
+			t.Errorf("unexpected payload: %q; want %q", dst.Bytes(), exp.Payload)
+		}
+	}
+
+	// Check that both pings were responded.
+	for _, exp := range []string{"before", "between"} {
+		f, err := ws.ReadFrame(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f = ws.UnmaskFrameInPlace(f)
+		if f.Header.OpCode != ws.OpPong || string(f.Payload) != exp {
+			t.Errorf("unexpected response frame: %v %q", f.Header.OpCode, f.Payload)
+		}
+	}
+
+	// Check that close frame is handled even if src is not a writer.
+	buf.Reset()
+	ws.MustWriteFrame(&buf, ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "")))
+	_, _, err := CopyMessage(&dst, &buf, ws.StateClientSide)
+	if _, ok := err.(ClosedError); !ok {
+		t.Errorf("unexpected error: %v; want ClosedError", err)
+	}
+}
+
+func TestReadTextInto(t *testing.T) {
+	var buf bytes.Buffer
+	for _, f := range []ws.Frame{
+		ws.NewFrame(ws.OpText, false, []byte("hello, ")),
+		ws.NewPingFrame([]byte("between")),
+		ws.NewFrame(ws.OpContinuation, false, []byte("wor")),
+		ws.NewFrame(ws.OpContinuation, true, []byte("ld")),
+		ws.NewBinaryFrame([]byte("binary")),
+		ws.NewTextFrame([]byte{0xff, 0xfe}),
+	} {
+		ws.MustWriteFrame(&buf, f)
+	}
+	var out bytes.Buffer
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{&buf, &out}
+
+	var sb strings.Builder
+	if err := ReadTextInto(rw, ws.StateClientSide, &sb); err != nil {
+		t.Fatal(err)
+	}
+	if act, exp := sb.String(), "hello, world"; act != exp {
+		t.Errorf("unexpected text: %q; want %q", act, exp)
+	}
+	if f, err := ws.ReadFrame(&out); err != nil || f.Header.OpCode != ws.OpPong {
+		t.Errorf("ping was not responded: %v %v", f.Header.OpCode, err)
+	}
+
+	sb.Reset()
+	if err := ReadTextInto(rw, ws.StateClientSide, &sb); err != ErrUnexpectedOpCode {
+		t.Errorf("unexpected error: %v; want %v", err, ErrUnexpectedOpCode)
+	}
+	if sb.Len() != 0 {
+		t.Errorf("unexpected text after binary message: %q", sb.String())
+	}
+	if err := ReadTextInto(rw, ws.StateClientSide, &sb); err != ErrInvalidUTF8 {
+		t.Errorf("unexpected error: %v; want %v", err, ErrInvalidUTF8)
+	}
+}
+
+func TestReadTextIntoLimit(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		frames []ws.Frame
+		max    int
+		exp    string
+		err    error
+	}{
+		{
+			name: "fits",
+			frames: []ws.Frame{
+				ws.NewFrame(ws.OpText, false, []byte("hello, ")),
+				ws.NewPingFrame(nil),
+				ws.NewFrame(ws.OpContinuation, true, []byte("world")),
+			},
+			max: 12,
+			exp: "hello, world",
+		},
+		{
+			name: "fragments",
+			frames: []ws.Frame{
+				ws.NewFrame(ws.OpText, false, []byte("hello, ")),
+				ws.NewPingFrame(nil),
+				ws.NewFrame(ws.OpContinuation, true, []byte("world")),
+			},
+			max: 10,
+			exp: "hello, wor",
+			err: ErrMessageTooLarge,
+		},
+		{
+			name: "frame",
+			frames: []ws.Frame{
+				ws.NewTextFrame([]byte("hello, world")),
+			},
+			max: 10,
+			err: ErrMessageTooLarge,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			for _, f := range test.frames {
+				ws.MustWriteFrame(&buf, f)
+			}
+			var out bytes.Buffer
+			rw := struct {
+				io.Reader
+				io.Writer
+			}{&buf, &out}
+
+			var sb strings.Builder
+			err := ReadTextIntoLimit(rw, ws.StateClientSide, &sb, test.max)
+			if err != test.err {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			if act := sb.String(); act != test.exp {
+				t.Errorf("unexpected text: %q; want %q", act, test.exp)
+			}
+			if len(test.frames) > 1 {
+				if f, err := ws.ReadFrame(&out); err != nil || f.Header.OpCode != ws.OpPong {
+					t.Errorf("ping was not responded: %v %v", f.Header.OpCode, err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCopyMessage(b *testing.B) {
+	const (
+		size      = 16 << 20
+		fragments = 16
+	)
+	var buf bytes.Buffer
+	chunk := make([]byte, size/fragments)
+	for i := 0; i < fragments; i++ {
+		op := ws.OpContinuation
+		if i == 0 {
+			op = ws.OpBinary
+		}
+		ws.MustWriteFrame(&buf, ws.NewFrame(op, i == fragments-1, chunk))
+	}
+	src := buf.Bytes()
+
+	b.Run("CopyMessage", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			_, _, err := CopyMessage(ioutil.Discard, bytes.NewReader(src), ws.StateClientSide)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ReadMessage", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			_, err := ReadMessage(bytes.NewReader(src), ws.StateClientSide, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestDrain(t *testing.T) {
+	const n = 10
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		// Read out client responses until client closes the connection.
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ioutil.ReadAll(server)
+		}()
+		defer func() {
+			<-done
+			server.Close()
+		}()
+		for i := 0; i < n; i++ {
+			if err := WriteServerText(server, []byte("hello")); err != nil {
+				return
+			}
+		}
+		if err := WriteServerMessage(server, ws.OpPing, []byte("ping")); err != nil {
+			return
+		}
+		if err := WriteServerBinary(server, []byte("bin")); err != nil {
+			return
+		}
+		body := ws.NewCloseFrameBody(ws.StatusNormalClosure, "")
+		if err := WriteServerMessage(server, ws.OpClose, body); err != nil {
+			return
+		}
+	}()
+
+	stats, err := Drain(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Frames != n+3 {
+		t.Errorf("unexpected frames count: %d; want %d", stats.Frames, n+3)
+	}
+	if exp := int64(n*5 + 4 + 3 + 2); stats.Bytes != exp {
+		t.Errorf("unexpected bytes count: %d; want %d", stats.Bytes, exp)
+	}
+	exp := map[ws.OpCode]int{
+		ws.OpText:   n,
+		ws.OpBinary: 1,
+		ws.OpPing:   1,
+		ws.OpClose:  1,
+	}
+	if !reflect.DeepEqual(stats.OpCodes, exp) {
+		t.Errorf("unexpected opcodes histogram: %v; want %v", stats.OpCodes, exp)
+	}
+	if !stats.Clean || stats.CloseCode != ws.StatusNormalClosure {
+		t.Errorf("unexpected close: clean=%v code=%v", stats.Clean, stats.CloseCode)
+	}
+}
@@ -0,0 +1,160 @@
+package wsutil
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// ErrProbeTimeout is returned by IdleConn when peer did not respond to the
+// probe ping within configured timeout. It usually means that connection is
+// half-open: peer is gone, but local writes still succeed (e.g. after NAT
+// mapping expiration).
+var ErrProbeTimeout = errors.New("connection probe timeout")
+
+// IdleConn is a wrapper around net.Conn that actively verifies peer
+// liveness during idle periods. When nothing is read from the connection
+// for the idle duration, it sends a ping frame and then requires any bytes
+// (usually the pong) to be received within the probe timeout. Otherwise
+// underlying connection is closed and Read() returns ErrProbeTimeout.
+//
+// This is different from the passive read timeout, which treats silent but
+// healthy peer as dead.
+//
+// IdleConn sends pings with constant payload returned by ProbePayload(). To
+// consume probe pongs with ControlHandler, set its ExpectPong field to that
+// payload, so they are not reported as unsolicited:
+//
+//	conn := wsutil.NewIdleConn(conn, ws.StateServerSide, time.Minute, 10*time.Second)
+//	control := wsutil.ControlHandler{
+//		Src:        conn,
+//		Dst:        conn,
+//		State:      ws.StateServerSide,
+//		ExpectPong: conn.ProbePayload(),
+//	}
+//
+// Note that probe ping is written by Read() between Write() calls. That is,
+// each frame must be written to IdleConn with a single Write() call (e.g. by
+// wsutil.Writer or ws.WriteFrame() to a bufio.Writer flushed once),
+// otherwise ping could be interleaved with a partially written frame.
+type IdleConn struct {
+	net.Conn
+
+	state        ws.State
+	idle         time.Duration
+	probeTimeout time.Duration
+	payload      [8]byte
+
+	wmu sync.Mutex // Serializes writes.
+
+	mu        sync.Mutex
+	rdeadline time.Time // Read deadline set by user.
+	wdeadline time.Time // Write deadline set by user.
+}
+
+// NewIdleConn creates IdleConn which probes conn after idle duration without
+// reads. It uses given state to prepare side-dependent things, like masking
+// of the ping frame.
+func NewIdleConn(conn net.Conn, s ws.State, idle, probeTimeout time.Duration) *IdleConn {
+	c := &IdleConn{
+		Conn:         conn,
+		state:        s,
+		idle:         idle,
+		probeTimeout: probeTimeout,
+	}
+	// Random payload is not critical here; it only helps to distinguish
+	// probe pongs from others.
+	_, _ = rand.Read(c.payload[:])
+	return c
+}
+
+// ProbePayload returns payload of the probe ping frames. Returned slice must
+// not be modified.
+func (c *IdleConn) ProbePayload() []byte {
+	return c.payload[:]
+}
+
+// Read implements io.Reader.
+func (c *IdleConn) Read(p []byte) (int, error) {
+	var probing bool
+	for {
+		timeout := c.idle
+		if probing {
+			timeout = c.probeTimeout
+		}
+		deadline := time.Now().Add(timeout)
+		c.mu.Lock()
+		user := c.rdeadline
+		c.mu.Unlock()
+		if !user.IsZero() && user.Before(deadline) {
+			deadline = user
+		}
+		if err := c.Conn.SetReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+		n, err := c.Conn.Read(p)
+		if ne, ok := err.(net.Error); n > 0 || err == nil || !(ok && ne.Timeout()) {
+			return n, err
+		}
+		if !user.IsZero() && !time.Now().Before(user) {
+			// User deadline exceeded.
+			return n, err
+		}
+		if probing {
+			c.Conn.Close()
+			return 0, ErrProbeTimeout
+		}
+		if err := c.ping(); err != nil {
+			c.Conn.Close()
+			return 0, ErrProbeTimeout
+		}
+		probing = true
+	}
+}
+
+// Write implements io.Writer.
+func (c *IdleConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.Conn.Write(p)
+}
+
+// SetDeadline implements net.Conn.
+func (c *IdleConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rdeadline, c.wdeadline = t, t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *IdleConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rdeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn.
+func (c *IdleConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.wdeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *IdleConn) ping() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	// Peer that is gone could also stop reading, so limit the write.
+	c.mu.Lock()
+	user := c.wdeadline
+	c.mu.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(c.probeTimeout))
+	defer c.Conn.SetWriteDeadline(user)
+	return writeFrame(c.Conn, c.state, ws.OpPing, true, c.payload[:])
+}
@@ -0,0 +1,110 @@
+package wsutil
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+func TestIdleConnProbeTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Peer which keeps socket open but does not respond anymore.
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(time.Second)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := NewIdleConn(conn, ws.StateClientSide, 20*time.Millisecond, 50*time.Millisecond)
+	start := time.Now()
+	if _, err := c.Read(make([]byte, 1)); err != ErrProbeTimeout {
+		t.Fatalf("unexpected error: %v; want %v", err, ErrProbeTimeout)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("half-open connection detected too late: %s", d)
+	}
+}
+
+func TestIdleConnProbe(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	// Peer which responds to pings and sends a message after a few of idle
+	// periods.
+	go func() {
+		defer server.Close()
+		control := ControlHandler{
+			Dst:   server,
+			State: ws.StateServerSide,
+		}
+		deadline := time.Now().Add(100 * time.Millisecond)
+		for time.Now().Before(deadline) {
+			h, err := ws.ReadHeader(server)
+			if err != nil {
+				return
+			}
+			control.Src = io.LimitReader(server, h.Length)
+			if err := control.Handle(h); err != nil {
+				return
+			}
+		}
+		WriteServerText(server, []byte("hello"))
+	}()
+
+	c := NewIdleConn(client, ws.StateClientSide, 10*time.Millisecond, 50*time.Millisecond)
+	var pongs, unsolicited int
+	control := ControlHandler{
+		Dst:        c,
+		State:      ws.StateClientSide,
+		ExpectPong: c.ProbePayload(),
+		OnPong: func([]byte) {
+			pongs++
+		},
+		OnUnsolicitedPong: func([]byte) {
+			unsolicited++
+		},
+	}
+	for {
+		h, err := ws.ReadHeader(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !h.OpCode.IsControl() {
+			p := make([]byte, h.Length)
+			if _, err := io.ReadFull(c, p); err != nil {
+				t.Fatal(err)
+			}
+			if string(p) != "hello" {
+				t.Fatalf("unexpected message: %q", p)
+			}
+			break
+		}
+		control.Src = io.LimitReader(c, h.Length)
+		if err := control.Handle(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pongs == 0 {
+		t.Errorf("no probe pongs received")
+	}
+	if unsolicited != 0 {
+		t.Errorf("probe pongs reported as unsolicited: %d", unsolicited)
+	}
+}
@@ -0,0 +1,131 @@
+package wsutil
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// ErrLifetimeExceeded is returned by connection created with NewLifetimeConn()
+// when its maximum lifetime is exceeded.
+var ErrLifetimeExceeded = errors.New("connection lifetime exceeded")
+
+// lifetimeCloseTimeout is the maximum amount of time spent on writing close
+// frame when connection lifetime is exceeded.
+const lifetimeCloseTimeout = time.Second
+
+// NewLifetimeConn returns a wrapper around conn that limits its total
+// lifetime to max regardless of activity. Once lifetime is exceeded every
+// Read() and Write() call returns ErrLifetimeExceeded. At that moment close
+// frame with ws.StatusPolicyViolation code is written to conn and then conn
+// is closed.
+//
+// Returned connection acts as the server side, that is, close frame is
+// written unmasked. Lifetime limit is mostly a server policy; clients should
+// use NewClientSideLifetimeConn() instead.
+//
+// Deadlines set on returned connection are capped by the lifetime deadline,
+// so blocked Read() and Write() calls are interrupted when it is exceeded.
+//
+// Note that close frame may be interleaved with a frame written partially
+// by a Write() call interrupted by the lifetime deadline. Since connection is
+// closed right after that, it is not treated as an issue.
+func NewLifetimeConn(conn net.Conn, max time.Duration) net.Conn {
+	return newLifetimeConn(conn, ws.StateServerSide, max)
+}
+
+// NewClientSideLifetimeConn is a helper function that calls
+// NewLifetimeConn() for the client side of a connection, that is, close frame
+// is written masked.
+func NewClientSideLifetimeConn(conn net.Conn, max time.Duration) net.Conn {
+	return newLifetimeConn(conn, ws.StateClientSide, max)
+}
+
+func newLifetimeConn(conn net.Conn, s ws.State, max time.Duration) net.Conn {
+	c := &lifetimeConn{
+		Conn:     conn,
+		state:    s,
+		deadline: time.Now().Add(max),
+	}
+	c.Conn.SetDeadline(c.deadline)
+	return c
+}
+
+type lifetimeConn struct {
+	net.Conn
+	state    ws.State
+	deadline time.Time
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Read implements io.Reader.
+func (c *lifetimeConn) Read(p []byte) (int, error) {
+	if c.expired() {
+		return 0, c.expire()
+	}
+	n, err := c.Conn.Read(p)
+	if err != nil && c.expired() {
+		err = c.expire()
+	}
+	return n, err
+}
+
+// Write implements io.Writer.
+func (c *lifetimeConn) Write(p []byte) (int, error) {
+	if c.expired() {
+		return 0, c.expire()
+	}
+	n, err := c.Conn.Write(p)
+	if err != nil && c.expired() {
+		err = c.expire()
+	}
+	return n, err
+}
+
+// SetDeadline implements net.Conn.
+func (c *lifetimeConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetDeadline(c.capDeadline(t))
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *lifetimeConn) SetReadDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(c.capDeadline(t))
+}
+
+// SetWriteDeadline implements net.Conn.
+func (c *lifetimeConn) SetWriteDeadline(t time.Time) error {
+	return c.Conn.SetWriteDeadline(c.capDeadline(t))
+}
+
+func (c *lifetimeConn) capDeadline(t time.Time) time.Time {
+	if t.IsZero() || t.After(c.deadline) {
+		return c.deadline
+	}
+	return t
+}
+
+func (c *lifetimeConn) expired() bool {
+	return !time.Now().Before(c.deadline)
+}
+
+// expire writes close frame and closes underlying connection once. It
+// always returns ErrLifetimeExceeded.
+func (c *lifetimeConn) expire() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrLifetimeExceeded
+	}
+	c.closed = true
+	c.Conn.SetWriteDeadline(time.Now().Add(lifetimeCloseTimeout))
+	_ = writeFrame(c.Conn, c.state, ws.OpClose, true, ws.NewCloseFrameBody(
+		ws.StatusPolicyViolation, ErrLifetimeExceeded.Error(),
+	))
+	c.Conn.Close()
+	return ErrLifetimeExceeded
+}
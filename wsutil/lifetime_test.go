@@ -0,0 +1,93 @@
+package wsutil
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+func TestLifetimeConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	frames := make(chan ws.Frame, 1)
+	go func() {
+		for {
+			f, err := ws.ReadFrame(client)
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- ws.UnmaskFrameInPlace(f)
+		}
+	}()
+
+	conn := NewLifetimeConn(server, 50*time.Millisecond)
+	if err := WriteServerText(conn, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if f := <-frames; string(f.Payload) != "hello" {
+		t.Fatalf("unexpected frame payload: %q", f.Payload)
+	}
+
+	// Deadline set on conn must not extend its lifetime.
+	if err := conn.SetReadDeadline(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err != ErrLifetimeExceeded {
+		t.Fatalf("unexpected Read() error: %v; want %v", err, ErrLifetimeExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Read() is not interrupted in time: %s", d)
+	}
+
+	f, ok := <-frames
+	if !ok {
+		t.Fatalf("close frame was not written")
+	}
+	if f.Header.OpCode != ws.OpClose {
+		t.Fatalf("unexpected op code: %v; want %v", f.Header.OpCode, ws.OpClose)
+	}
+	if code, _ := ws.ParseCloseFrameData(f.Payload); code != ws.StatusPolicyViolation {
+		t.Errorf("unexpected close code: %v; want %v", code, ws.StatusPolicyViolation)
+	}
+	if _, err := conn.Write([]byte("x")); err != ErrLifetimeExceeded {
+		t.Errorf("unexpected Write() error: %v; want %v", err, ErrLifetimeExceeded)
+	}
+	if _, ok := <-frames; ok {
+		t.Errorf("unexpected frame after close")
+	}
+}
+
+func TestClientSideLifetimeConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	frames := make(chan ws.Frame, 1)
+	go func() {
+		defer close(frames)
+		f, err := ws.ReadFrame(server)
+		if err == nil {
+			frames <- f
+		}
+	}()
+
+	conn := NewClientSideLifetimeConn(client, 10*time.Millisecond)
+	if _, err := conn.Read(make([]byte, 1)); err != ErrLifetimeExceeded {
+		t.Fatalf("unexpected Read() error: %v; want %v", err, ErrLifetimeExceeded)
+	}
+	f, ok := <-frames
+	if !ok {
+		t.Fatalf("close frame was not written")
+	}
+	if f.Header.OpCode != ws.OpClose || !f.Header.Masked {
+		t.Fatalf("unexpected close frame header: %+v", f.Header)
+	}
+	f = ws.UnmaskFrameInPlace(f)
+	if code, _ := ws.ParseCloseFrameData(f.Payload); code != ws.StatusPolicyViolation {
+		t.Errorf("unexpected close code: %v; want %v", code, ws.StatusPolicyViolation)
+	}
+}
@@ -0,0 +1,88 @@
+package wsutil
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrWouldBlock is returned by non-blocking RateLimitedWriter when write
+// exceeds current rate limit budget.
+var ErrWouldBlock = errors.New("write would block")
+
+// RateLimitedWriter is an io.Writer that limits the rate of bytes written to
+// the destination writer using token bucket algorithm.
+//
+// It never splits bytes passed to a single Write() call. That is, it is safe
+// to wrap a connection with it and write whole frames (e.g. by Writer with
+// explicit Flush() or ws.WriteFrame()): rate is limited between Write() calls
+// and stream could not be corrupted by partial writes.
+//
+// RateLimitedWriter is not safe for concurrent use.
+type RateLimitedWriter struct {
+	// NonBlocking makes Write() return ErrWouldBlock instead of waiting when
+	// there is not enough budget to write given bytes. In that case no bytes
+	// are written.
+	NonBlocking bool
+
+	dest   io.Writer
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimitedWriter creates new RateLimitedWriter that writes to w at most
+// bytesPerSec bytes per second on average, allowing bursts up to burst bytes.
+//
+// Writes of more than burst bytes are permitted when the bucket is full, but
+// then following writes are delayed until the bucket is refilled.
+func NewRateLimitedWriter(w io.Writer, bytesPerSec, burst int) *RateLimitedWriter {
+	if bytesPerSec <= 0 {
+		panic("wsutil: rate limit must be positive")
+	}
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	return &RateLimitedWriter{
+		dest:   w,
+		rate:   float64(bytesPerSec),
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// Write implements io.Writer.
+func (w *RateLimitedWriter) Write(p []byte) (int, error) {
+	n := float64(len(p))
+	// Writes larger than burst could never get enough tokens, so wait only
+	// for the full bucket.
+	need := n
+	if need > w.burst {
+		need = w.burst
+	}
+	now := w.refill(time.Now())
+	if w.tokens < need {
+		if w.NonBlocking {
+			return 0, ErrWouldBlock
+		}
+		wait := time.Duration((need - w.tokens) / w.rate * float64(time.Second))
+		time.Sleep(wait)
+		w.refill(now.Add(wait))
+	}
+	w.tokens -= n
+	return w.dest.Write(p)
+}
+
+func (w *RateLimitedWriter) refill(now time.Time) time.Time {
+	if !w.last.IsZero() {
+		if d := now.Sub(w.last); d > 0 {
+			w.tokens += d.Seconds() * w.rate
+		}
+	}
+	if w.tokens > w.burst {
+		w.tokens = w.burst
+	}
+	w.last = now
+	return now
+}
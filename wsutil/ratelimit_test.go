@@ -0,0 +1,64 @@
+package wsutil
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+func TestRateLimitedWriter(t *testing.T) {
+	const (
+		rate  = 100 << 10
+		burst = 10 << 10
+		total = 30 << 10
+		chunk = 1 << 10
+	)
+	var buf bytes.Buffer
+	w := NewRateLimitedWriter(&buf, rate, burst)
+
+	p := bytes.Repeat([]byte{'x'}, chunk-2)
+	start := time.Now()
+	for buf.Len() < total {
+		if err := WriteServerBinary(w, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+
+	// First burst bytes are written immediately, rest of them must be
+	// limited by the rate.
+	min := time.Duration(float64(buf.Len()-burst) / rate * float64(time.Second))
+	if elapsed < min*9/10 {
+		t.Errorf("written %d bytes in %s; want at least %s", buf.Len(), elapsed, min)
+	}
+
+	// Frames must be left untouched.
+	for buf.Len() > 0 {
+		frame, err := ws.ReadFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(frame.Payload, p) {
+			t.Fatalf("unexpected frame payload")
+		}
+	}
+}
+
+func TestRateLimitedWriterNonBlocking(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewRateLimitedWriter(&buf, 10, 10)
+	w.NonBlocking = true
+
+	if _, err := w.Write(make([]byte, 10)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	n, err := w.Write(make([]byte, 10))
+	if err != ErrWouldBlock {
+		t.Fatalf("unexpected error: %v; want %v", err, ErrWouldBlock)
+	}
+	if n != 0 || buf.Len() != 10 {
+		t.Fatalf("unexpected bytes written on blocked write")
+	}
+}
@@ -1,10 +1,14 @@
 package wsutil
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
 	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/gobwas/ws"
 )
@@ -17,12 +21,49 @@ var ErrNoFrameAdvance = errors.New("no frame advance")
 // MaxFrameSize was being read.
 var ErrFrameTooLarge = errors.New("frame too large")
 
+// ErrTooManyFragments indicates that a message consisting of more than
+// MaxFragments frames was being read. The rest of the message is left unread,
+// so the message could not be consumed anymore; RFC 6455 suggests
+// ws.StatusMessageTooBig (1009) close code for messages which are too big to
+// process.
+var ErrTooManyFragments = errors.New("too many fragments")
+
+// ErrUnsupportedOpCode indicates that a message with operation code not listed
+// in Reader's AllowedOpcodes was being read. Reader sends close frame with
+// ws.StatusUnsupportedData code to its Dst before returning this error, thus
+// application only needs to close the connection (after the closing
+// handshake, if it wants to wait for it). If Reader's Dst is nil, sending
+// that close frame is left to the application.
+var ErrUnsupportedOpCode = errors.New("unsupported message operation code")
+
+// ErrMessageTimeout indicates that a message was not received completely
+// within Reader's MessageTimeout. Part of the message could be already read
+// from the Source, so Reader is out of sync with the stream after this error.
+// Peer trickling the message is considered violating the policy, which is
+// what ws.StatusPolicyViolation (1008) close code is intended for.
+var ErrMessageTimeout = errors.New("message timeout")
+
+// ErrFirstByteTimeout indicates that first byte of the next frame was not
+// received within Reader's FirstByteTimeout. Nothing of the next frame is
+// read at that moment, so it is up to the application to treat the peer as
+// stalled and close the connection, or to probe it (e.g. with a ping) first.
+var ErrFirstByteTimeout = errors.New("first byte timeout")
+
+// ErrReadCanceled is returned by Reader's methods when reading is canceled
+// by Cancel() call.
+var ErrReadCanceled = errors.New("read canceled")
+
 // FrameHandlerFunc handles parsed frame header and its body represented by
 // io.Reader.
 //
 // Note that reader represents already unmasked body.
 type FrameHandlerFunc func(ws.Header, io.Reader) error
 
+// TransformFunc transforms payload of a whole message with given operation
+// code. It could be used to apply application-level encoding (such as
+// encryption) to messages without negotiating any WebSocket extension.
+type TransformFunc func(op ws.OpCode, payload []byte) ([]byte, error)
+
 // Reader is a wrapper around source io.Reader which represents WebSocket
 // connection. It contains options for reading messages from source.
 //
@@ -30,7 +71,11 @@ type FrameHandlerFunc func(ws.Header, io.Reader) error
 // WebSocket frames. It also takes care on fragmented frames and possibly
 // intermediate control frames between them.
 //
-// Note that Reader's methods are not goroutine safe.
+// Masked payload is unmasked in place within the buffer passed to Read(), so
+// no intermediate copy of payload is made. Mask offset is tracked across
+// Read() calls, thus payload might be consumed by chunks of any size.
+//
+// Note that Reader's methods are not goroutine safe, except Cancel().
 type Reader struct {
 	Source io.Reader
 	State  ws.State
@@ -45,6 +90,10 @@ type Reader struct {
 	// Extensions is a list of negotiated extensions for reader Source.
 	// It is used to meet the specs and clear appropriate bits in fragment
 	// header RSV segment.
+	//
+	// Extensions are applied in reverse order. That is, it should be listed
+	// in the same order as it is passed to the Writer's SetExtensions() on
+	// the sending side.
 	Extensions []RecvExtension
 
 	// MaxFrameSize controls the maximum frame size in bytes
@@ -54,6 +103,115 @@ type Reader struct {
 	// Not setting this field means there is no limit.
 	MaxFrameSize int64
 
+	// MaxFragments controls the maximum number of frames a single message
+	// could consist of. A message exceeding that number will return a
+	// ErrTooManyFragments to the application. Intermediate control frames are
+	// not counted.
+	//
+	// Not setting this field means there is no limit.
+	MaxFragments int
+
+	// AllowedOpcodes controls which data messages could be read. When it is
+	// non-empty, receipt of a message with operation code not listed in it
+	// makes Reader to send close frame with ws.StatusUnsupportedData (1003)
+	// code to Dst and return ErrUnsupportedOpCode to the application. For
+	// example, it could be set to []ws.OpCode{ws.OpBinary} for binary only
+	// channels. Control frames are not affected.
+	//
+	// Not setting this field means that all data messages are allowed.
+	AllowedOpcodes []ws.OpCode
+
+	// Dst is an optional writer to the peer, which Reader uses to send close
+	// frame when it rejects a message (see AllowedOpcodes). The frame is
+	// masked according to State. If it is nil, no frame is sent and it is
+	// up to the application to close the connection with appropriate code.
+	Dst io.Writer
+
+	// MessageTimeout controls the maximum amount of time the whole message
+	// could be received in after its first frame header is read. This helps
+	// to defend against peers trickling message fragments. Intermediate
+	// control frames do not reset the timer. When timeout is exceeded
+	// ErrMessageTimeout is returned.
+	//
+	// If Source implements SetReadDeadline(time.Time) error method, it is
+	// used to interrupt blocked reads. Note that in that case Reader
+	// overrides read deadline of Source while the message is read. Use
+	// Reader's SetReadDeadline() instead of Source's one to make it restored
+	// at the end of every message.
+	//
+	// Not setting this field means there is no timeout.
+	MessageTimeout time.Duration
+
+	// FirstByteTimeout controls the maximum amount of time NextFrame() waits
+	// for the first byte of the next message. It is applied only when there
+	// is no fragmented message in progress and cleared right after the
+	// first byte is received; the rest of the message is then bounded by
+	// MessageTimeout, if any. When timeout is exceeded ErrFirstByteTimeout
+	// is returned.
+	//
+	// It has effect only if Source implements SetReadDeadline(time.Time)
+	// error method. Note that in that case Reader overrides read deadline of
+	// Source until the first byte is received. Use Reader's
+	// SetReadDeadline() instead of Source's one to make it restored after
+	// that.
+	//
+	// Not setting this field means there is no timeout.
+	FirstByteTimeout time.Duration
+
+	// Lenient makes Reader tolerate some deviations from the spec made by
+	// non-compliant peers. Each of the following leniencies is applied only
+	// when Lenient is true:
+	//
+	// 	- Close frame with malformed body (e.g. with 1-byte payload, invalid
+	// 	status code or non UTF-8 reason) is returned as close frame with
+	// 	empty body, which means ws.StatusNoStatusRcvd (1005) code, instead
+	// 	of being handled as protocol error by ControlHandler.
+	Lenient bool
+
+	// StrictClose makes Reader treat any frame (either data or control)
+	// received after a close frame as protocol error. When it is true,
+	// NextFrame() returns ws.ErrProtocolFrameAfterClose in that case instead
+	// of returning the frame.
+	//
+	// It is mostly useful in test suites to catch non-compliant peers.
+	StrictClose bool
+
+	// Transform is an optional function which is applied to each received
+	// data message. When it is set, NextFrame() reads the whole message
+	// (including all of its fragments) into an internal buffer, applies
+	// Transform to it and returns header of the transformed message as it
+	// was a single frame. Intermediate control frames are handled as usual.
+	//
+	// Transform runs inside of decompression: it is applied to the unmasked
+	// payload as it was received, so wrappers such as wsflate.Reader
+	// decompress the result of Transform. That is, it reverts the Writer's
+	// transform set by SetTransform(), which runs outside of compression.
+	//
+	// Note that MaxFrameSize still applies to each received frame, not to the
+	// whole message.
+	Transform TransformFunc
+
+	// OnRsv is an optional callback that will be called for each received
+	// frame with its raw RSV bits, before any of Extensions clear them. It is
+	// intended for diagnostic purposes and does not affect extensions
+	// processing.
+	OnRsv func(rsv byte)
+
+	// OnMessage is an optional callback that will be called once the whole
+	// data message is read (or discarded) with its operation code and total
+	// size in bytes. It fires at the FIN boundary regardless of how message
+	// is consumed, thus it is useful for metrics.
+	//
+	// Size is the wire size of the message payload: the number of bytes
+	// returned by Read() (or skipped by Discard()) after unmasking and
+	// Transform. Reader does not decompress messages, so for messages
+	// compressed with permessage-deflate it is the compressed size. The
+	// logical (decompressed) size of such messages is reported by
+	// wsflate.Reader's OnMessage, which should be used along with this one
+	// when compression is negotiated: this callback still provides the
+	// operation code and fires for uncompressed messages as well.
+	OnMessage func(op ws.OpCode, size int64)
+
 	OnContinuation FrameHandlerFunc
 	OnIntermediate FrameHandlerFunc
 
@@ -63,6 +221,25 @@ type Reader struct {
 	utf8   UTF8Reader                 // Used to check UTF8 sequences if CheckUTF8 is true.
 	tmp    [ws.MaxHeaderSize - 2]byte // Used for reading headers.
 	cr     *CipherReader              // Used by NextFrame() to unmask frame payload.
+	tbuf   bytes.Buffer               // Used to collect message for Transform.
+	tr     bytes.Reader               // Used to read transformed message.
+
+	ctl [ws.MaxControlFramePayloadSize]byte // Used to check close frame if Lenient is true.
+
+	size      int64     // Used to report message size to OnMessage.
+	deadline  time.Time // Used to check MessageTimeout.
+	udeadline time.Time // Read deadline set by SetReadDeadline().
+	rdeadline time.Time // Read deadline set by Reader itself.
+	firstByte bool      // Used to check FirstByteTimeout.
+	fragments int       // Used to check MaxFragments.
+	closed    bool      // Used to check StrictClose.
+
+	peeked  []byte // Used to hold bytes returned by PeekMessage() but not read yet.
+	peekErr error  // Used to hold error got by PeekMessage() until peeked bytes are read.
+	pbuf    []byte // Used as PeekMessage() buffer.
+
+	// canceled is set to 1 by Cancel(). It is accessed atomically.
+	canceled int32
 }
 
 // NewReader creates new frame reader that reads from r keeping given state to
@@ -86,6 +263,69 @@ func NewServerSideReader(r io.Reader) *Reader {
 	return NewReader(r, ws.StateServerSide)
 }
 
+// Cancel cancels current and further reads made by r: blocked Read(),
+// NextFrame() or Discard() call returns ErrReadCanceled as soon as possible.
+// Unlike other methods, it is safe to call Cancel() from another goroutine.
+// The underlying connection is not closed. Call Reset() to reuse r after
+// cancelation.
+//
+// Blocked reads are interrupted by setting read deadline in the past, thus
+// Source must implement SetReadDeadline(time.Time) error method (e.g. be a
+// net.Conn). Otherwise only the reads started after Cancel() call are
+// canceled.
+//
+// Note that bytes of the message which was being read are lost, so the next
+// message read after Reset() may start in the middle of a frame. That is,
+// Cancel() is mostly useful to abort waiting for the next message, for
+// example, on graceful shutdown.
+func (r *Reader) Cancel() {
+	atomic.StoreInt32(&r.canceled, 1)
+	if d, ok := r.Source.(readDeadliner); ok {
+		d.SetReadDeadline(aLongTimeAgo)
+	}
+}
+
+// SetReadDeadline sets read deadline of Source, if it implements
+// SetReadDeadline(time.Time) error method, and makes r keep it. That is, r
+// uses the earliest of t and deadlines of MessageTimeout and FirstByteTimeout
+// while reading, and restores t when its own deadlines are cleared. A zero
+// value for t means no deadline.
+//
+// Unlike Cancel(), it is not safe to call SetReadDeadline() concurrently with
+// other methods.
+func (r *Reader) SetReadDeadline(t time.Time) error {
+	r.udeadline = t
+	if d, ok := r.Source.(readDeadliner); ok {
+		return r.setReadDeadline(d, r.rdeadline)
+	}
+	return nil
+}
+
+// Reset resets r to read from src as it was not used before. Options set on
+// r are left untouched. Read deadline set by SetReadDeadline() is forgotten.
+//
+// If r was canceled by Cancel(), read deadline of src is cleared to undo the
+// cancelation. Note that it also clears any read deadline previously set on
+// src by the caller, so such deadline must be set again after Reset().
+func (r *Reader) Reset(src io.Reader) {
+	canceled := atomic.SwapInt32(&r.canceled, 0) == 1
+	r.reset()
+	r.Source = src
+	r.State = r.State.Clear(ws.StateFragmented)
+	r.size = 0
+	r.firstByte = false
+	r.fragments = 0
+	r.closed = false
+	r.udeadline = time.Time{}
+	r.rdeadline = time.Time{}
+	r.resetPeek()
+	if canceled {
+		if d, ok := src.(readDeadliner); ok {
+			d.SetReadDeadline(time.Time{})
+		}
+	}
+}
+
 // Read implements io.Reader. It reads the next message payload into p.
 // It takes care on fragmented messages.
 //
@@ -95,14 +335,73 @@ func NewServerSideReader(r io.Reader) *Reader {
 //
 // The error is ErrNoFrameAdvance if no NextFrame() call was made before
 // reading next message bytes.
+//
+// Bytes returned by PeekMessage() are read first.
 func (r *Reader) Read(p []byte) (n int, err error) {
+	if len(r.peeked) > 0 || r.peekErr != nil {
+		n = copy(p, r.peeked)
+		r.peeked = r.peeked[n:]
+		if len(r.peeked) == 0 {
+			err = r.peekErr
+			r.resetPeek()
+		}
+		return n, err
+	}
+	return r.read(p)
+}
+
+// PeekMessage returns up to n next bytes of the current message without
+// consuming them. That is, returned bytes are returned by subsequent Read()
+// calls as well. It reads fragments of the message if needed; intermediate
+// control frames are handled as usual. It is useful to sniff message content
+// (e.g. by its magic bytes) before deciding to read or discard it.
+//
+// Less than n bytes are returned with nil error if message is shorter. Error
+// is returned along with already peeked bytes if message could not be read.
+//
+// Returned slice is valid only until the next call to r's methods. Peeked
+// bytes which were not read are dropped by NextFrame().
+//
+// The error is ErrNoFrameAdvance if no NextFrame() call was made before.
+func (r *Reader) PeekMessage(n int) ([]byte, error) {
+	if r.frame == nil && !r.fragmented() && len(r.peeked) == 0 && r.peekErr == nil {
+		return nil, ErrNoFrameAdvance
+	}
+	if len(r.peeked) < n && r.peekErr == nil {
+		if cap(r.pbuf) < n {
+			buf := make([]byte, len(r.peeked), n)
+			copy(buf, r.peeked)
+			r.pbuf = buf
+		} else {
+			r.pbuf = r.pbuf[:copy(r.pbuf[:cap(r.pbuf)], r.peeked)]
+		}
+		for len(r.pbuf) < n {
+			m, err := r.read(r.pbuf[len(r.pbuf):n])
+			r.pbuf = r.pbuf[:len(r.pbuf)+m]
+			if err != nil {
+				r.peekErr = err
+				break
+			}
+		}
+		r.peeked = r.pbuf
+	}
+	if len(r.peeked) >= n {
+		return r.peeked[:n], nil
+	}
+	if err := r.peekErr; err != io.EOF {
+		return r.peeked, err
+	}
+	return r.peeked, nil
+}
+
+func (r *Reader) read(p []byte) (n int, err error) {
 	if r.frame == nil {
 		if !r.fragmented() {
 			// Every new Read() must be preceded by NextFrame() call.
 			return 0, ErrNoFrameAdvance
 		}
 		// Read next continuation or intermediate control frame.
-		_, err := r.NextFrame()
+		_, err := r.nextFrame()
 		if err != nil {
 			return 0, err
 		}
@@ -113,8 +412,9 @@ func (r *Reader) Read(p []byte) (n int, err error) {
 	}
 
 	n, err = r.frame.Read(p)
+	r.size += int64(n)
 	if err != nil && err != io.EOF {
-		return n, err
+		return n, r.checkCanceled(r.checkDeadline(err))
 	}
 	if err == nil && r.raw.N != 0 {
 		return n, nil
@@ -136,6 +436,7 @@ func (r *Reader) Read(p []byte) (n int, err error) {
 		err = ErrInvalidUTF8
 
 	default:
+		r.messageDone()
 		r.reset()
 		err = io.EOF
 	}
@@ -144,17 +445,34 @@ func (r *Reader) Read(p []byte) (n int, err error) {
 }
 
 // Discard discards current message unread bytes.
-// It discards all frames of fragmented message.
+// It discards all frames of fragmented message without buffering their
+// payload. Control frames received in between of fragments are passed to
+// OnIntermediate as usual.
 func (r *Reader) Discard() (err error) {
+	if len(r.peeked) > 0 || r.peekErr != nil {
+		err = r.peekErr
+		r.resetPeek()
+		if err == io.EOF {
+			// Message is already read completely.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 	for {
-		_, err = io.Copy(ioutil.Discard, &r.raw)
+		var n int64
+		n, err = io.Copy(ioutil.Discard, &r.raw)
+		r.size += n
 		if err != nil {
+			err = r.checkCanceled(err)
 			break
 		}
 		if !r.fragmented() {
+			r.messageDone()
 			break
 		}
-		if _, err = r.NextFrame(); err != nil {
+		if _, err = r.nextFrame(); err != nil {
 			break
 		}
 	}
@@ -166,9 +484,29 @@ func (r *Reader) Discard() (err error) {
 // and non-nil error on failure.
 //
 // Note that next NextFrame() call must be done after receiving or discarding
-// all current message bytes.
+// all current message bytes. Bytes returned by PeekMessage() but not read yet
+// are dropped.
 func (r *Reader) NextFrame() (hdr ws.Header, err error) {
+	r.resetPeek()
+	return r.nextFrame()
+}
+
+// nextFrame is the same as NextFrame() but keeps peeked bytes. It is used to
+// read continuation frames of the current message.
+func (r *Reader) nextFrame() (hdr ws.Header, err error) {
+	if r.isCanceled() {
+		return hdr, ErrReadCanceled
+	}
+	if err = r.checkDeadline(nil); err != nil {
+		return hdr, err
+	}
+	if !r.fragmented() && r.deadline.IsZero() {
+		r.startFirstByteDeadline()
+	}
 	hdr, err = r.readHeader(r.Source)
+	if err != nil {
+		err = r.checkCanceled(r.checkDeadline(err))
+	}
 	if err == io.EOF && r.fragmented() {
 		// If we are in fragmented state EOF means that is was totally
 		// unexpected.
@@ -185,10 +523,29 @@ func (r *Reader) NextFrame() (hdr ws.Header, err error) {
 	if err != nil {
 		return hdr, err
 	}
+	if r.StrictClose {
+		if r.closed {
+			return hdr, ws.ErrProtocolFrameAfterClose
+		}
+		r.closed = hdr.OpCode == ws.OpClose
+	}
 
 	if n := r.MaxFrameSize; n > 0 && hdr.Length > n {
 		return hdr, ErrFrameTooLarge
 	}
+	if xs := r.AllowedOpcodes; len(xs) > 0 && hdr.OpCode.IsData() && hdr.OpCode != ws.OpContinuation {
+		if !opCodeAllowed(hdr.OpCode, xs) {
+			return hdr, r.reject(ws.StatusUnsupportedData, ErrUnsupportedOpCode)
+		}
+	}
+	if n := r.MaxFragments; n > 0 && !hdr.OpCode.IsControl() {
+		if !r.fragmented() {
+			r.fragments = 0
+		}
+		if r.fragments++; r.fragments > n {
+			return hdr, ErrTooManyFragments
+		}
+	}
 
 	// Save raw reader to use it on discarding frame without ciphering and
 	// other streaming checks.
@@ -207,13 +564,24 @@ func (r *Reader) NextFrame() (hdr ws.Header, err error) {
 		frame = r.cr
 	}
 
-	for _, x := range r.Extensions {
-		hdr, err = x.UnsetBits(hdr)
-		if err != nil {
+	if cb := r.OnRsv; cb != nil {
+		cb(hdr.Rsv)
+	}
+	if hdr, err = unsetBits(hdr, r.Extensions); err != nil {
+		return hdr, err
+	}
+
+	if r.Lenient && hdr.OpCode == ws.OpClose && hdr.Length <= int64(len(r.ctl)) {
+		if hdr, err = r.lenientClose(hdr, frame); err != nil {
 			return hdr, err
 		}
+		frame = &r.raw
 	}
 
+	// Transform must be applied only once the first frame of a data message
+	// is received.
+	transform := r.Transform != nil && !r.fragmented() && hdr.OpCode.IsData()
+
 	if r.fragmented() {
 		if hdr.OpCode.IsControl() {
 			if cb := r.OnIntermediate; cb != nil {
@@ -227,8 +595,12 @@ func (r *Reader) NextFrame() (hdr ws.Header, err error) {
 		}
 	} else {
 		r.opCode = hdr.OpCode
+		r.size = 0
+		if hdr.OpCode.IsData() {
+			r.startDeadline()
+		}
 	}
-	if r.CheckUTF8 && (hdr.OpCode == ws.OpText || (r.fragmented() && r.opCode == ws.OpText)) {
+	if r.CheckUTF8 && r.Transform == nil && (hdr.OpCode == ws.OpText || (r.fragmented() && r.opCode == ws.OpText)) {
 		r.utf8.Source = frame
 		frame = &r.utf8
 	}
@@ -247,10 +619,92 @@ func (r *Reader) NextFrame() (hdr ws.Header, err error) {
 	} else {
 		r.State = r.State.Set(ws.StateFragmented)
 	}
+	if err == nil && transform {
+		hdr, err = r.transformMessage(hdr)
+	}
 
 	return hdr, err
 }
 
+// lenientClose reads close frame payload from frame and checks it. If payload
+// is malformed, it is replaced with an empty one. r.raw is prepared to read
+// the result.
+func (r *Reader) lenientClose(hdr ws.Header, frame io.Reader) (ws.Header, error) {
+	p := r.ctl[:hdr.Length]
+	if _, err := io.ReadFull(frame, p); err != nil {
+		return hdr, r.checkDeadline(err)
+	}
+	if len(p) > 0 {
+		code, reason := ws.ParseCloseFrameData(p)
+		if len(p) == 1 || ws.CheckCloseFrameData(code, reason) != nil {
+			p = p[:0]
+		}
+	}
+	r.tr.Reset(p)
+	r.raw = io.LimitedReader{
+		R: &r.tr,
+		N: int64(len(p)),
+	}
+	hdr.Length = int64(len(p))
+	hdr.Masked = false
+	hdr.Mask = [4]byte{}
+	return hdr, nil
+}
+
+// transformMessage reads the rest of the message started by the frame with
+// given header, applies r.Transform to it and prepares r to read the result.
+func (r *Reader) transformMessage(hdr ws.Header) (_ ws.Header, err error) {
+	r.tbuf.Reset()
+	for {
+		if r.frame != nil {
+			if _, err = r.tbuf.ReadFrom(r.frame); err != nil {
+				return hdr, r.checkDeadline(err)
+			}
+			if r.raw.N != 0 {
+				return hdr, io.ErrUnexpectedEOF
+			}
+		}
+		if !r.fragmented() {
+			break
+		}
+		r.resetFragment()
+		if _, err = r.nextFrame(); err != nil {
+			return hdr, err
+		}
+	}
+	p, err := r.Transform(r.opCode, r.tbuf.Bytes())
+	if err != nil {
+		return hdr, err
+	}
+	r.tr.Reset(p)
+	r.raw = io.LimitedReader{
+		R: &r.tr,
+		N: int64(len(p)),
+	}
+	r.frame = &r.raw
+	if r.CheckUTF8 && r.opCode == ws.OpText {
+		r.utf8 = UTF8Reader{Source: r.frame}
+		r.frame = &r.utf8
+	}
+
+	hdr.Fin = true
+	hdr.Length = int64(len(p))
+
+	return hdr, nil
+}
+
+// messageDone calls OnMessage if current message is a data message.
+func (r *Reader) messageDone() {
+	if cb := r.OnMessage; cb != nil && r.opCode.IsData() && r.opCode != ws.OpContinuation {
+		cb(r.opCode, r.size)
+	}
+}
+
+func (r *Reader) resetPeek() {
+	r.peeked = nil
+	r.peekErr = nil
+}
+
 func (r *Reader) fragmented() bool {
 	return r.State.Fragmented()
 }
@@ -267,6 +721,105 @@ func (r *Reader) reset() {
 	r.frame = nil
 	r.utf8 = UTF8Reader{}
 	r.opCode = 0
+	r.stopDeadline()
+}
+
+type readDeadliner interface {
+	SetReadDeadline(time.Time) error
+}
+
+func (r *Reader) startDeadline() {
+	if r.MessageTimeout <= 0 {
+		return
+	}
+	r.deadline = time.Now().Add(r.MessageTimeout)
+	if d, ok := r.Source.(readDeadliner); ok {
+		r.setReadDeadline(d, r.deadline)
+	}
+}
+
+func (r *Reader) stopDeadline() {
+	if r.deadline.IsZero() {
+		return
+	}
+	r.deadline = time.Time{}
+	if d, ok := r.Source.(readDeadliner); ok {
+		r.setReadDeadline(d, time.Time{})
+	}
+}
+
+func (r *Reader) startFirstByteDeadline() {
+	if r.FirstByteTimeout <= 0 {
+		return
+	}
+	d, ok := r.Source.(readDeadliner)
+	if !ok {
+		return
+	}
+	r.firstByte = true
+	r.setReadDeadline(d, time.Now().Add(r.FirstByteTimeout))
+}
+
+// stopFirstByteDeadline clears read deadline set by startFirstByteDeadline()
+// and returns ErrFirstByteTimeout if given err is a timeout error.
+// Otherwise it returns given err.
+func (r *Reader) stopFirstByteDeadline(err error) error {
+	r.firstByte = false
+	deadline := r.rdeadline
+	if d, ok := r.Source.(readDeadliner); ok {
+		r.setReadDeadline(d, time.Time{})
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && !time.Now().Before(deadline) {
+		// Read deadline set by SetReadDeadline() could be exceeded instead.
+		return ErrFirstByteTimeout
+	}
+	return err
+}
+
+// setReadDeadline sets read deadline of d to t or to deadline set by
+// SetReadDeadline() if it is earlier. Zero t clears own deadline of r. If r is
+// canceled, deadline is kept in the past. All read deadlines of Reader must be
+// set through it.
+func (r *Reader) setReadDeadline(d readDeadliner, t time.Time) error {
+	r.rdeadline = t
+	if u := r.udeadline; !u.IsZero() && (t.IsZero() || u.Before(t)) {
+		t = u
+	}
+	err := d.SetReadDeadline(t)
+	if r.isCanceled() {
+		// Cancel() could be called concurrently, so make sure its deadline
+		// is not lost.
+		d.SetReadDeadline(aLongTimeAgo)
+	}
+	return err
+}
+
+func (r *Reader) isCanceled() bool {
+	return atomic.LoadInt32(&r.canceled) == 1
+}
+
+// checkCanceled returns ErrReadCanceled if err is not nil and r is canceled.
+// Otherwise it returns given err.
+func (r *Reader) checkCanceled(err error) error {
+	if err != nil && err != io.EOF && r.isCanceled() {
+		return ErrReadCanceled
+	}
+	return err
+}
+
+// checkDeadline returns ErrMessageTimeout if message deadline is exceeded.
+// Otherwise it returns given err.
+func (r *Reader) checkDeadline(err error) error {
+	if r.deadline.IsZero() {
+		return err
+	}
+	if time.Now().Before(r.deadline) {
+		return err
+	}
+	if ne, ok := err.(net.Error); err == nil || (ok && ne.Timeout()) {
+		return ErrMessageTimeout
+	}
+	return err
 }
 
 // readHeader reads a frame header from in.
@@ -276,10 +829,18 @@ func (r *Reader) readHeader(in io.Reader) (h ws.Header, err error) {
 	// The maximum header size is 14, but due to the 2 hop reads,
 	// after first hop that reads first 2 constant bytes, we could reuse 2 bytes.
 	// So 14 - 2 = 12.
-	bts := r.tmp[:2]
+	bts := r.tmp[:ws.MinHeaderSize]
 
 	// Prepare to hold first 2 bytes to choose size of next read.
-	_, err = io.ReadFull(in, bts)
+	if r.firstByte {
+		_, err = io.ReadFull(in, bts[:1])
+		if err = r.stopFirstByteDeadline(err); err != nil {
+			return h, err
+		}
+		_, err = io.ReadFull(in, bts[1:])
+	} else {
+		_, err = io.ReadFull(in, bts)
+	}
 	if err != nil {
 		return h, err
 	}
@@ -295,6 +856,16 @@ func (r *Reader) readHeader(in io.Reader) (h ws.Header, err error) {
 		h.Masked = true
 		extra += 4
 	}
+	if !r.SkipHeaderCheck {
+		// Check mask bit against the side right away to not interpret
+		// payload bytes as the rest of the header.
+		switch {
+		case r.State.ServerSide() && !h.Masked && !r.State.Unmasked():
+			return h, ws.ErrProtocolMaskRequired
+		case r.State.ClientSide() && h.Masked:
+			return h, ws.ErrProtocolMaskUnexpected
+		}
+	}
 
 	length := bts[1] & 0x7f
 	switch {
@@ -371,3 +942,23 @@ func NextReader(r io.Reader, s ws.State) (ws.Header, io.Reader, error) {
 	}
 	return header, rd, nil
 }
+
+// reject sends close frame with given code to r.Dst (if any) and returns
+// err. Sending is made on best effort basis: since connection is going to be
+// closed anyway, the reason of rejection is more useful to the caller than
+// the write error.
+func (r *Reader) reject(code ws.StatusCode, err error) error {
+	if r.Dst != nil {
+		_ = writeFrame(r.Dst, r.State, ws.OpClose, true, ws.NewCloseFrameBody(code, ""))
+	}
+	return err
+}
+
+func opCodeAllowed(op ws.OpCode, allowed []ws.OpCode) bool {
+	for _, x := range allowed {
+		if x == op {
+			return true
+		}
+	}
+	return false
+}
@@ -2,17 +2,19 @@ package wsutil
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
+	"reflect"
 	"testing"
+	"time"
 	"unicode/utf8"
 
 	"github.com/gobwas/ws"
 )
 
-// TODO(gobwas): test continuation discard.
-//				 test discard when NextFrame().
-
 var eofReader = bytes.NewReader(nil)
 
 func TestReadFromWithIntermediateControl(t *testing.T) {
@@ -77,6 +79,71 @@ func TestReadFromWithIntermediateControl(t *testing.T) {
 	}
 }
 
+func TestReaderDiscard(t *testing.T) {
+	const (
+		fragments = 16
+		size      = 64 << 10
+	)
+	var buf bytes.Buffer
+	for i := 0; i < fragments; i++ {
+		op := ws.OpContinuation
+		if i == 0 {
+			op = ws.OpBinary
+		}
+		ws.MustWriteFrame(&buf, ws.NewFrame(op, i == fragments-1, make([]byte, size)))
+		if i == fragments/2 {
+			ws.MustWriteFrame(&buf, ws.NewPingFrame([]byte("ping")))
+		}
+	}
+	ws.MustWriteFrame(&buf, ws.NewTextFrame([]byte("next")))
+
+	var pings int
+	r := Reader{
+		Source: &buf,
+		OnIntermediate: func(h ws.Header, r io.Reader) error {
+			if h.OpCode == ws.OpPing {
+				pings++
+			}
+			return nil
+		},
+	}
+	h, err := r.NextFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act, exp := h.OpCode, ws.OpBinary; act != exp {
+		t.Fatalf("unexpected first frame opcode: %v; want %v", act, exp)
+	}
+	// Read some bytes of the current frame before discarding.
+	if _, err := io.ReadFull(&r, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Discard(); err != nil {
+		t.Fatalf("unexpected Discard() error: %v", err)
+	}
+	if act, exp := pings, 1; act != exp {
+		t.Errorf("unexpected intermediate pings: %d; want %d", act, exp)
+	}
+
+	h, err = r.NextFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act, exp := h.OpCode, ws.OpText; act != exp {
+		t.Fatalf("unexpected next frame opcode: %v; want %v", act, exp)
+	}
+	act, err := ioutil.ReadAll(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []byte("next"); !bytes.Equal(act, exp) {
+		t.Errorf("unexpected next message: %q; want %q", act, exp)
+	}
+	if n := buf.Len(); n != 0 {
+		t.Errorf("unexpected %d unread bytes", n)
+	}
+}
+
 func TestReaderNoFrameAdvance(t *testing.T) {
 	r := Reader{
 		Source: eofReader,
@@ -194,6 +261,56 @@ func TestMaxFrameSize(t *testing.T) {
 	}
 }
 
+func TestMaxFragments(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		fragments int
+		max       int
+		err       error
+	}{
+		{name: "single", fragments: 1, max: 1},
+		{name: "exact", fragments: 4, max: 4},
+		{name: "exceeded", fragments: 5, max: 4, err: ErrTooManyFragments},
+		{name: "unlimited", fragments: 100},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			for j := 0; j < 2; j++ {
+				for i := 0; i < test.fragments; i++ {
+					op := ws.OpContinuation
+					if i == 0 {
+						op = ws.OpText
+					}
+					ws.MustWriteFrame(&buf, ws.NewFrame(op, i == test.fragments-1, []byte("x")))
+					ws.MustWriteFrame(&buf, ws.NewPingFrame(nil))
+				}
+			}
+			r := Reader{
+				Source:         &buf,
+				MaxFragments:   test.max,
+				OnIntermediate: func(ws.Header, io.Reader) error { return nil },
+			}
+			// Read two messages to check that counter is reset between them.
+			for j := 0; j < 2; j++ {
+				_, err := r.NextFrame()
+				if err == nil {
+					_, err = ioutil.ReadAll(&r)
+				}
+				if err != test.err {
+					t.Fatalf("unexpected error: %v; want %v", err, test.err)
+				}
+				if err != nil {
+					return
+				}
+				// Skip trailing ping frame.
+				if _, err := r.NextFrame(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func TestReaderUTF8(t *testing.T) {
 	yo := []byte("Ё")
 	if !utf8.ValidString(string(yo)) {
@@ -336,6 +453,93 @@ func TestNextReader(t *testing.T) {
 	}
 }
 
+func TestReaderUnmaskChunks(t *testing.T) {
+	payload := make([]byte, 1<<16)
+	rand.Read(payload)
+
+	frame := ws.NewBinaryFrame(payload)
+	frame = ws.MaskFrame(frame)
+
+	var buf bytes.Buffer
+	if err := ws.WriteFrame(&buf, frame); err != nil {
+		t.Fatal(err)
+	}
+	for _, sz := range []int{1, 3, 7, 100, 4096} {
+		t.Run(fmt.Sprintf("%d", sz), func(t *testing.T) {
+			r := Reader{
+				Source: bytes.NewReader(buf.Bytes()),
+				State:  ws.StateServerSide,
+			}
+			if _, err := r.NextFrame(); err != nil {
+				t.Fatal(err)
+			}
+			act, err := ioutil.ReadAll(chopReader{&r, sz})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(act, payload) {
+				t.Fatalf("unexpected unmasked payload")
+			}
+		})
+	}
+}
+
+// frameSink prevents dead code elimination in benchmarks.
+var frameSink ws.Frame
+
+func BenchmarkReaderUnmask(b *testing.B) {
+	payload := make([]byte, 1<<20)
+	rand.Read(payload)
+
+	frame := ws.NewBinaryFrame(payload)
+	frame = ws.MaskFrame(frame)
+
+	var buf bytes.Buffer
+	if err := ws.WriteFrame(&buf, frame); err != nil {
+		b.Fatal(err)
+	}
+	src := bytes.NewReader(buf.Bytes())
+
+	b.Run("ReadFrame", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		for i := 0; i < b.N; i++ {
+			src.Reset(buf.Bytes())
+			f, err := ws.ReadFrame(src)
+			if err != nil {
+				b.Fatal(err)
+			}
+			frameSink = ws.UnmaskFrameInPlace(f)
+		}
+	})
+	b.Run("Reader", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		var (
+			p = make([]byte, 32<<10)
+			r = Reader{
+				Source: src,
+				State:  ws.StateServerSide,
+			}
+		)
+		for i := 0; i < b.N; i++ {
+			src.Reset(buf.Bytes())
+			if _, err := r.NextFrame(); err != nil {
+				b.Fatal(err)
+			}
+			for {
+				_, err := r.Read(p)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
 type chopReader struct {
 	src io.Reader
 	sz  int
@@ -351,3 +555,914 @@ func (c chopReader) Read(p []byte) (n int, err error) {
 	}
 	return c.src.Read(p[:sz])
 }
+
+func TestReaderMessageTimeout(t *testing.T) {
+	const (
+		timeout = 50 * time.Millisecond
+		delay   = 20 * time.Millisecond
+	)
+	frames := []ws.Frame{
+		ws.NewFrame(ws.OpText, false, []byte("a")),
+		ws.NewPingFrame(nil),
+		ws.NewFrame(ws.OpContinuation, false, []byte("b")),
+		ws.NewPingFrame(nil),
+		ws.NewFrame(ws.OpContinuation, false, []byte("c")),
+		ws.NewFrame(ws.OpContinuation, true, []byte("d")),
+	}
+	var buf bytes.Buffer
+	for _, f := range frames {
+		if err := ws.WriteFrame(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		name  string
+		delay time.Duration
+		err   error
+	}{
+		{
+			name: "fast",
+		},
+		{
+			name:  "trickle",
+			delay: delay,
+			err:   ErrMessageTimeout,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := Reader{
+				Source: &slowReader{
+					src:   bytes.NewReader(buf.Bytes()),
+					delay: test.delay,
+				},
+				State:          ws.StateClientSide,
+				MessageTimeout: timeout,
+				OnIntermediate: func(ws.Header, io.Reader) error {
+					return nil
+				},
+			}
+			_, err := r.NextFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			bts, err := ioutil.ReadAll(&r)
+			if err != test.err {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			if err == nil && string(bts) != "abcd" {
+				t.Fatalf("unexpected message: %q", bts)
+			}
+		})
+	}
+}
+
+func TestReaderMessageTimeoutDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		// Send only header of the frame and hang.
+		ws.WriteHeader(client, ws.Header{
+			Fin:    true,
+			OpCode: ws.OpBinary,
+			Length: 10,
+		})
+	}()
+	r := Reader{
+		Source:         server,
+		State:          ws.StateClientSide,
+		MessageTimeout: 50 * time.Millisecond,
+	}
+	if _, err := r.NextFrame(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ioutil.ReadAll(&r)
+	if err != ErrMessageTimeout {
+		t.Fatalf("unexpected error: %v; want %v", err, ErrMessageTimeout)
+	}
+}
+
+func TestReaderFirstByteTimeout(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		delay time.Duration
+		err   error
+	}{
+		{
+			name: "fast",
+		},
+		{
+			name:  "stalled",
+			delay: 200 * time.Millisecond,
+			err:   ErrFirstByteTimeout,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			go func() {
+				time.Sleep(test.delay)
+				// Send frame byte by byte with delays after the first one
+				// to check that timeout is cleared after it.
+				bts := ws.MustCompileFrame(ws.NewTextFrame([]byte("hello")))
+				for i := range bts {
+					if _, err := client.Write(bts[i : i+1]); err != nil {
+						return
+					}
+					time.Sleep(20 * time.Millisecond)
+				}
+			}()
+			r := Reader{
+				Source:           server,
+				State:            ws.StateClientSide,
+				FirstByteTimeout: 50 * time.Millisecond,
+			}
+			_, err := r.NextFrame()
+			if err != test.err {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			bts, err := ioutil.ReadAll(&r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(bts) != "hello" {
+				t.Fatalf("unexpected message: %q", bts)
+			}
+		})
+	}
+}
+
+func TestReaderSetReadDeadline(t *testing.T) {
+	var (
+		now  = time.Now()
+		late = now.Add(time.Hour)
+		soon = now.Add(time.Second)
+	)
+	for _, test := range []struct {
+		name     string
+		deadline time.Time
+		err      error
+		active   time.Time // Deadline expected while message is read.
+	}{
+		{
+			name:     "later than timeouts",
+			deadline: late,
+		},
+		{
+			name:     "earlier than timeouts",
+			deadline: soon,
+			active:   soon,
+		},
+		{
+			name:     "exceeded",
+			deadline: now.Add(-time.Second),
+			err:      errDeadlineExceeded{},
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			ws.MustWriteFrame(&buf, ws.NewTextFrame([]byte("hello")))
+
+			src := &deadlineSource{Reader: &buf}
+			rd := Reader{
+				Source:           src,
+				State:            ws.StateClientSide,
+				MessageTimeout:   time.Minute,
+				FirstByteTimeout: time.Minute,
+			}
+			if err := rd.SetReadDeadline(test.deadline); err != nil {
+				t.Fatal(err)
+			}
+			_, err := rd.NextFrame()
+			if err != test.err {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if act := src.deadline; test.active.IsZero() && !act.Before(late) {
+				t.Errorf("message deadline is not set: %v", act)
+			} else if !test.active.IsZero() && !act.Equal(test.active) {
+				t.Errorf("unexpected read deadline: %v; want %v", act, test.active)
+			}
+			if _, err := ioutil.ReadAll(&rd); err != nil {
+				t.Fatal(err)
+			}
+			if !src.deadline.Equal(test.deadline) {
+				t.Errorf(
+					"unexpected read deadline after message: %v; want %v",
+					src.deadline, test.deadline,
+				)
+			}
+		})
+	}
+}
+
+type slowReader struct {
+	src   io.Reader
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.src.Read(p)
+}
+
+func xorTransform(key byte) TransformFunc {
+	return func(_ ws.OpCode, p []byte) ([]byte, error) {
+		for i := range p {
+			p[i] ^= key
+		}
+		return p, nil
+	}
+}
+
+func TestReaderWriterTransform(t *testing.T) {
+	const key = 0x42
+	msg := bytes.Repeat([]byte("hello, transform! "), 1024)
+
+	var buf bytes.Buffer
+	w := NewWriterSize(&buf, ws.StateClientSide, ws.OpText, 128)
+	w.SetTransform(xorTransform(key))
+	if _, err := w.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check that the message was sent as a single transformed frame.
+	wire := append([]byte(nil), buf.Bytes()...)
+	f, err := ws.ReadFrame(bytes.NewReader(wire))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = ws.UnmaskFrameInPlace(f)
+	if !f.Header.Fin {
+		t.Fatalf("unexpected fragmented message")
+	}
+	exp := append([]byte(nil), msg...)
+	xorTransform(key)(ws.OpText, exp)
+	if !bytes.Equal(f.Payload, exp) {
+		t.Fatalf("unexpected frame payload on the wire")
+	}
+
+	r := Reader{
+		Source:    &buf,
+		State:     ws.StateServerSide,
+		CheckUTF8: true,
+		Transform: xorTransform(key),
+	}
+	h, err := r.NextFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.OpCode != ws.OpText || h.Length != int64(len(msg)) {
+		t.Fatalf("unexpected header: %+v", h)
+	}
+	act, err := ioutil.ReadAll(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(act, msg) {
+		t.Fatalf("unexpected message after transform")
+	}
+}
+
+func TestReaderTransformFragmented(t *testing.T) {
+	const key = 0x17
+	msg := []byte("foobarbaz")
+	enc := append([]byte(nil), msg...)
+	xorTransform(key)(ws.OpBinary, enc)
+
+	var buf bytes.Buffer
+	ws.MustWriteFrame(&buf, ws.NewFrame(ws.OpBinary, false, enc[:3]))
+	ws.MustWriteFrame(&buf, ws.NewPingFrame([]byte("ping")))
+	ws.MustWriteFrame(&buf, ws.NewFrame(ws.OpContinuation, false, enc[3:6]))
+	ws.MustWriteFrame(&buf, ws.NewFrame(ws.OpContinuation, true, enc[6:]))
+	ws.MustWriteFrame(&buf, ws.NewTextFrame(enc[:3]))
+
+	var (
+		calls int
+		pings int
+	)
+	r := Reader{
+		Source: &buf,
+		Transform: func(op ws.OpCode, p []byte) ([]byte, error) {
+			calls++
+			return xorTransform(key)(op, p)
+		},
+		OnIntermediate: func(h ws.Header, _ io.Reader) error {
+			pings++
+			return nil
+		},
+	}
+	for _, exp := range []struct {
+		op      ws.OpCode
+		payload []byte
+	}{
+		{ws.OpBinary, msg},
+		{ws.OpText, msg[:3]},
+	} {
+		h, err := r.NextFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !h.Fin || h.OpCode != exp.op {
+			t.Fatalf("unexpected header: %+v", h)
+		}
+		act, err := ioutil.ReadAll(&r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(act, exp.payload) {
+			t.Errorf("unexpected payload: %q; want %q", act, exp.payload)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("unexpected number of Transform calls: %d; want 2", calls)
+	}
+	if pings != 1 {
+		t.Errorf("unexpected number of intermediate frames: %d; want 1", pings)
+	}
+}
+
+func TestReaderMaskRequired(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		src  []byte
+	}{
+		{
+			name: "unmasked frame",
+			src:  ws.MustCompileFrame(ws.NewTextFrame([]byte("hello"))),
+		},
+		{
+			// Only first 2 bytes of header are present. Reader must not try
+			// to read extended length or mask bytes.
+			name: "truncated header",
+			src:  []byte{0x81, 127},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			src := bytes.NewReader(test.src)
+			r := NewServerSideReader(src)
+			_, err := r.NextFrame()
+			if err != ws.ErrProtocolMaskRequired {
+				t.Fatalf("unexpected error: %v; want %v", err, ws.ErrProtocolMaskRequired)
+			}
+			if act, exp := len(test.src)-src.Len(), ws.MinHeaderSize; act != exp {
+				t.Errorf("unexpected number of bytes read: %d; want %d", act, exp)
+			}
+		})
+	}
+}
+
+func TestReaderAllowedOpcodes(t *testing.T) {
+	var buf bytes.Buffer
+	for _, f := range []ws.Frame{
+		ws.NewFrame(ws.OpBinary, false, []byte("bin")),
+		ws.NewPingFrame(nil),
+		ws.NewContinuationFrame(true, []byte("ary")),
+		ws.NewTextFrame([]byte("text")),
+	} {
+		ws.MustWriteFrame(&buf, f)
+	}
+	var out bytes.Buffer
+	r := Reader{
+		Source:         &buf,
+		Dst:            &out,
+		State:          ws.StateClientSide,
+		AllowedOpcodes: []ws.OpCode{ws.OpBinary},
+		OnIntermediate: func(ws.Header, io.Reader) error {
+			return nil
+		},
+	}
+	h, err := r.NextFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.OpCode != ws.OpBinary {
+		t.Fatalf("unexpected op code: %v", h.OpCode)
+	}
+	p, err := ioutil.ReadAll(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != "binary" {
+		t.Errorf("unexpected payload: %q", p)
+	}
+
+	if out.Len() != 0 {
+		t.Fatalf("unexpected bytes written before rejection: %d", out.Len())
+	}
+
+	_, err = r.NextFrame()
+	if err != ErrUnsupportedOpCode {
+		t.Fatalf("unexpected error: %v; want %v", err, ErrUnsupportedOpCode)
+	}
+	f, err := ws.ReadFrame(&out)
+	if err != nil {
+		t.Fatalf("can't read close frame: %v", err)
+	}
+	if f.Header.OpCode != ws.OpClose || !f.Header.Masked {
+		t.Fatalf("unexpected frame header: %+v; want masked close frame", f.Header)
+	}
+	f = ws.UnmaskFrame(f)
+	if code, _ := ws.ParseCloseFrameData(f.Payload); code != ws.StatusUnsupportedData {
+		t.Errorf("unexpected close code: %v; want %v", code, ws.StatusUnsupportedData)
+	}
+	if out.Len() != 0 {
+		t.Errorf("unexpected bytes after close frame: %d", out.Len())
+	}
+}
+
+func TestReaderFragmentedControl(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		fin  bool
+		err  error
+	}{
+		{name: "final", fin: true},
+		{name: "fragmented", err: ws.ErrProtocolControlFragmented},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			ws.MustWriteFrame(&buf, ws.NewFrame(ws.OpPing, test.fin, []byte("ping")))
+
+			r := NewClientSideReader(&buf)
+			_, err := r.NextFrame()
+			if err != test.err {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			if err == nil {
+				return
+			}
+			if _, ok := err.(ws.ProtocolError); !ok {
+				t.Errorf("unexpected error type: %T; want ws.ProtocolError", err)
+			}
+		})
+	}
+}
+
+func TestReaderStrictClose(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		next ws.Frame
+	}{
+		{
+			name: "close then ping",
+			next: ws.NewPingFrame([]byte("ping")),
+		},
+		{
+			name: "close then close",
+			next: ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "")),
+		},
+		{
+			name: "close then text",
+			next: ws.NewTextFrame([]byte("text")),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, strict := range []bool{false, true} {
+				var buf bytes.Buffer
+				ws.MustWriteFrame(&buf, ws.NewCloseFrame(
+					ws.NewCloseFrameBody(ws.StatusGoingAway, "bye"),
+				))
+				ws.MustWriteFrame(&buf, test.next)
+
+				r := Reader{
+					Source:      &buf,
+					State:       ws.StateClientSide,
+					StrictClose: strict,
+				}
+				h, err := r.NextFrame()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if h.OpCode != ws.OpClose {
+					t.Fatalf("unexpected op code: %v", h.OpCode)
+				}
+				if err := r.Discard(); err != nil {
+					t.Fatal(err)
+				}
+				h, err = r.NextFrame()
+				if strict {
+					if err != ws.ErrProtocolFrameAfterClose {
+						t.Errorf("unexpected error: %v; want %v", err, ws.ErrProtocolFrameAfterClose)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if h.OpCode != test.next.Header.OpCode {
+					t.Errorf("unexpected op code: %v; want %v", h.OpCode, test.next.Header.OpCode)
+				}
+			}
+		})
+	}
+}
+
+func TestReaderLenientClose(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		payload []byte
+		exp     []byte // Expected payload in lenient mode.
+		err     error  // Expected ControlHandler error in strict mode.
+	}{
+		{
+			name:    "one byte",
+			payload: []byte{0x03},
+			exp:     []byte{},
+			err:     ws.ErrProtocolStatusCodeNotInUse,
+		},
+		{
+			name:    "invalid code",
+			payload: ws.NewCloseFrameBody(ws.StatusNoStatusRcvd, ""),
+			exp:     []byte{},
+			err:     ws.ErrProtocolStatusCodeApplicationLevel,
+		},
+		{
+			name:    "invalid reason",
+			payload: append(ws.NewCloseFrameBody(ws.StatusNormalClosure, ""), 0xff),
+			exp:     []byte{},
+			err:     ws.ErrProtocolInvalidUTF8,
+		},
+		{
+			name:    "valid",
+			payload: ws.NewCloseFrameBody(ws.StatusGoingAway, "bye"),
+			exp:     ws.NewCloseFrameBody(ws.StatusGoingAway, "bye"),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, lenient := range []bool{false, true} {
+				var buf bytes.Buffer
+				f := ws.NewCloseFrame(test.payload)
+				ws.MustWriteFrame(&buf, ws.MaskFrame(f))
+
+				r := Reader{
+					Source:  &buf,
+					State:   ws.StateServerSide,
+					Lenient: lenient,
+				}
+				h, err := r.NextFrame()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if lenient {
+					act, err := ioutil.ReadAll(&r)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if h.Length != int64(len(test.exp)) || !bytes.Equal(act, test.exp) {
+						t.Errorf("unexpected lenient close payload: %x (%d); want %x", act, h.Length, test.exp)
+					}
+					continue
+				}
+				err = ControlHandler{
+					Src:                 &r,
+					Dst:                 ioutil.Discard,
+					State:               ws.StateServerSide,
+					DisableSrcCiphering: true,
+				}.Handle(h)
+				if test.err == nil {
+					if _, ok := err.(ClosedError); !ok {
+						t.Errorf("unexpected error: %v; want ClosedError", err)
+					}
+					continue
+				}
+				if err != test.err {
+					t.Errorf("unexpected strict mode error: %v; want %v", err, test.err)
+				}
+			}
+		})
+	}
+}
+
+func TestReaderOnMessage(t *testing.T) {
+	var buf bytes.Buffer
+	ws.MustWriteFrame(&buf, ws.NewFrame(ws.OpText, false, []byte("foo")))
+	ws.MustWriteFrame(&buf, ws.NewPingFrame([]byte("ping")))
+	ws.MustWriteFrame(&buf, ws.NewFrame(ws.OpContinuation, false, []byte("bar")))
+	ws.MustWriteFrame(&buf, ws.NewFrame(ws.OpContinuation, true, []byte("baz")))
+	ws.MustWriteFrame(&buf, ws.NewBinaryFrame([]byte("discarded")))
+	ws.MustWriteFrame(&buf, ws.NewFrame(ws.OpBinary, false, []byte("a")))
+	ws.MustWriteFrame(&buf, ws.NewFrame(ws.OpContinuation, true, []byte("b")))
+
+	type message struct {
+		op   ws.OpCode
+		size int64
+	}
+	var act []message
+	r := Reader{
+		Source: &buf,
+		State:  ws.StateClientSide,
+		OnMessage: func(op ws.OpCode, size int64) {
+			act = append(act, message{op, size})
+		},
+	}
+	// Read the first message.
+	if _, err := r.NextFrame(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(&r); err != nil {
+		t.Fatal(err)
+	}
+	// Discard the second one.
+	if _, err := r.NextFrame(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	// Partially read and discard the third one.
+	if _, err := r.NextFrame(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	exp := []message{
+		{ws.OpText, 9},
+		{ws.OpBinary, 9},
+		{ws.OpBinary, 2},
+	}
+	if !reflect.DeepEqual(act, exp) {
+		t.Errorf("unexpected messages reported: %v; want %v", act, exp)
+	}
+}
+
+func TestReaderCancel(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	rd := NewReader(client, ws.StateClientSide)
+	readMessage := func() (string, error) {
+		if _, err := rd.NextFrame(); err != nil {
+			return "", err
+		}
+		p, err := ioutil.ReadAll(rd)
+		return string(p), err
+	}
+	cancel := func() {
+		time.Sleep(10 * time.Millisecond)
+		rd.Cancel()
+	}
+
+	// Cancel waiting for the next message.
+	go cancel()
+	if _, err := readMessage(); err != ErrReadCanceled {
+		t.Fatalf("unexpected error: %v; want %v", err, ErrReadCanceled)
+	}
+	if _, err := readMessage(); err != ErrReadCanceled {
+		t.Fatalf("unexpected error after cancelation: %v; want %v", err, ErrReadCanceled)
+	}
+
+	// Cancel in the middle of fragmented message.
+	rd.Reset(client)
+	go func() {
+		ws.MustWriteFrame(server, ws.NewFrame(ws.OpText, false, []byte("hello, ")))
+		cancel()
+	}()
+	if _, err := readMessage(); err != ErrReadCanceled {
+		t.Fatalf("unexpected error: %v; want %v", err, ErrReadCanceled)
+	}
+
+	// Reuse reader after reset.
+	rd.Reset(client)
+	go ws.MustWriteFrame(server, ws.NewTextFrame([]byte("world")))
+	p, err := readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != "world" {
+		t.Errorf("unexpected message: %q", p)
+	}
+}
+
+func TestReaderCancelRace(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		rd   Reader
+		read int
+	}{
+		{
+			// First byte deadline is set after Cancel() check.
+			name: "first byte",
+			rd: Reader{
+				FirstByteTimeout: time.Minute,
+			},
+			read: 0,
+		},
+		{
+			// Message deadline is set after frame header is read.
+			name: "message",
+			rd: Reader{
+				MessageTimeout: time.Minute,
+			},
+			read: 2,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			ws.MustWriteFrame(&buf, ws.NewFrame(ws.OpText, false, []byte("hello, ")))
+			ws.MustWriteFrame(&buf, ws.NewFrame(ws.OpContinuation, true, []byte("world")))
+
+			src := &deadlineSource{Reader: &buf}
+			rd := test.rd
+			rd.Source = src
+			rd.State = ws.StateClientSide
+
+			// Emulate Cancel() called concurrently right before Reader sets
+			// its own deadline.
+			src.beforeDeadline = func(t time.Time) {
+				if !t.IsZero() {
+					rd.Cancel()
+				}
+			}
+			_, err := rd.NextFrame()
+			if err == nil {
+				_, err = ioutil.ReadAll(&rd)
+			}
+			if err != ErrReadCanceled {
+				t.Fatalf("unexpected error: %v; want %v", err, ErrReadCanceled)
+			}
+			if src.n != test.read {
+				t.Errorf("unexpected number of bytes read: %d; want %d", src.n, test.read)
+			}
+			if !src.deadline.Equal(aLongTimeAgo) {
+				t.Fatalf("unexpected read deadline: %v; want %v", src.deadline, aLongTimeAgo)
+			}
+		})
+	}
+}
+
+// deadlineSource fails reads with timeout error when its read deadline is
+// exceeded. It calls beforeDeadline (once) before setting read deadline.
+type deadlineSource struct {
+	io.Reader
+	n              int
+	deadline       time.Time
+	beforeDeadline func(time.Time)
+}
+
+func (s *deadlineSource) Read(p []byte) (int, error) {
+	if !s.deadline.IsZero() && !time.Now().Before(s.deadline) {
+		return 0, errDeadlineExceeded{}
+	}
+	n, err := s.Reader.Read(p)
+	s.n += n
+	return n, err
+}
+
+func (s *deadlineSource) SetReadDeadline(t time.Time) error {
+	if fn := s.beforeDeadline; fn != nil {
+		s.beforeDeadline = nil
+		fn(t)
+	}
+	s.deadline = t
+	return nil
+}
+
+type errDeadlineExceeded struct{}
+
+func (errDeadlineExceeded) Error() string   { return "deadline exceeded" }
+func (errDeadlineExceeded) Timeout() bool   { return true }
+func (errDeadlineExceeded) Temporary() bool { return true }
+
+func TestReaderPeekMessage(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\nimage data")
+
+	var buf bytes.Buffer
+	ws.MustWriteFrame(&buf, ws.NewFrame(ws.OpBinary, false, png[:2]))
+	ws.MustWriteFrame(&buf, ws.NewPingFrame(nil))
+	ws.MustWriteFrame(&buf, ws.NewFrame(ws.OpContinuation, false, png[2:6]))
+	ws.MustWriteFrame(&buf, ws.NewFrame(ws.OpContinuation, true, png[6:]))
+	ws.MustWriteFrame(&buf, ws.NewBinaryFrame([]byte("short")))
+	ws.MustWriteFrame(&buf, ws.NewBinaryFrame([]byte("discarded")))
+	ws.MustWriteFrame(&buf, ws.NewTextFrame([]byte("next")))
+
+	var (
+		pings    int
+		messages []int64
+	)
+	r := Reader{
+		Source: &buf,
+		State:  ws.StateClientSide,
+		OnIntermediate: func(ws.Header, io.Reader) error {
+			pings++
+			return nil
+		},
+		OnMessage: func(_ ws.OpCode, size int64) {
+			messages = append(messages, size)
+		},
+	}
+	if _, err := r.PeekMessage(4); err != ErrNoFrameAdvance {
+		t.Fatalf("unexpected error: %v; want %v", err, ErrNoFrameAdvance)
+	}
+
+	// Sniff magic bytes spanning fragments and then stream the rest.
+	if _, err := r.NextFrame(); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{4, 2, 4} {
+		p, err := r.PeekMessage(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, png[:n]) {
+			t.Fatalf("unexpected peeked bytes: %q; want %q", p, png[:n])
+		}
+	}
+	if pings != 1 {
+		t.Errorf("intermediate ping was not handled")
+	}
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, &r); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), png) {
+		t.Errorf("unexpected streamed message: %q; want %q", out.Bytes(), png)
+	}
+
+	// Peek more than message length.
+	if _, err := r.NextFrame(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := r.PeekMessage(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != "short" {
+		t.Errorf("unexpected peeked bytes: %q", p)
+	}
+	if p, err := ioutil.ReadAll(&r); err != nil || string(p) != "short" {
+		t.Errorf("unexpected read after peek: %q %v", p, err)
+	}
+
+	// Discard the rest after peek.
+	if _, err := r.NextFrame(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.PeekMessage(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.NextFrame(); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := ioutil.ReadAll(&r); err != nil || string(p) != "next" {
+		t.Errorf("unexpected message after discard: %q %v", p, err)
+	}
+
+	if exp := []int64{int64(len(png)), 5, 9, 4}; !reflect.DeepEqual(messages, exp) {
+		t.Errorf("unexpected messages sizes: %v; want %v", messages, exp)
+	}
+}
+
+func TestReaderPeekMessageNextFrame(t *testing.T) {
+	var buf bytes.Buffer
+	ws.MustWriteFrame(&buf, ws.NewBinaryFrame([]byte("sniffed")))
+	ws.MustWriteFrame(&buf, ws.NewBinaryFrame([]byte("next")))
+
+	r := Reader{
+		Source: &buf,
+		State:  ws.StateClientSide,
+	}
+	// Peek the whole first message and skip it without reading.
+	if _, err := r.NextFrame(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := r.PeekMessage(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != "sniffed" {
+		t.Fatalf("unexpected peeked bytes: %q", p)
+	}
+	if _, err := r.NextFrame(); err != nil {
+		t.Fatal(err)
+	}
+	act, err := ioutil.ReadAll(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(act) != "next" {
+		t.Errorf("unexpected message after NextFrame(): %q; want %q", act, "next")
+	}
+}
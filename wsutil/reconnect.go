@@ -0,0 +1,336 @@
+package wsutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// Default backoff bounds used by ReconnectingConn.
+const (
+	DefaultReconnectMinBackoff = 100 * time.Millisecond
+	DefaultReconnectMaxBackoff = 30 * time.Second
+)
+
+// ErrReconnectingConnClosed is returned by ReconnectingConn methods after it
+// has been closed.
+var ErrReconnectingConnClosed = errors.New("reconnecting connection closed")
+
+// ConnState represents state of the connection managed by ReconnectingConn.
+type ConnState uint8
+
+// ConnState values.
+const (
+	// ConnConnecting means that dial attempt is started.
+	ConnConnecting ConnState = iota
+	// ConnConnected means that connection is established and OnConnect
+	// callback (if any) succeeded.
+	ConnConnected
+	// ConnDisconnected means that dial attempt failed or established
+	// connection is broken. ConnEvent.Err holds the cause.
+	ConnDisconnected
+	// ConnClosed means that ReconnectingConn is closed and will not dial
+	// anymore.
+	ConnClosed
+)
+
+// String implements fmt.Stringer.
+func (s ConnState) String() string {
+	switch s {
+	case ConnConnecting:
+		return "connecting"
+	case ConnConnected:
+		return "connected"
+	case ConnDisconnected:
+		return "disconnected"
+	case ConnClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// ConnEvent describes change of the ReconnectingConn state.
+type ConnEvent struct {
+	State ConnState
+	Err   error
+}
+
+// reconnectEventsBuffer is the capacity of ReconnectingConn events channel.
+const reconnectEventsBuffer = 16
+
+// ReconnectingConn is a client side connection to the WebSocket server which
+// re-dials with exponential backoff and jitter when connection is broken.
+//
+// When Read() on the underlying connection fails, connection is dropped and
+// Read() is transparently retried on a new one. Note that bytes of the frame
+// which was being read are lost, so reconnect is transparent only at message
+// boundary, e.g. when waiting for the next message; ConnConnected event could
+// be used to detect that message in progress must be discarded.
+//
+// When Write() fails, the error is returned to the caller and connection is
+// dropped; the next Write() or Read() call dials again. The error is not
+// hidden because it is unknown how much of the written frame was received by
+// the server, thus caller should decide whether to write the message again.
+//
+// Dial errors are retried (with backoff) only if ws.IsRetryable() reports so.
+// Otherwise, such as for 401 or 403 response status, the error is returned to
+// the caller of Read(), Write() or Connect().
+//
+// Note that the first dial is made lazily by the first Read() or Write() call
+// (or explicitly by Connect()). Bytes buffered by the Dialer during handshake
+// are read before the connection bytes.
+//
+// Exported fields must not be changed after first use.
+type ReconnectingConn struct {
+	// OnConnect is an optional callback that will be called after each
+	// successful dial, before the connection is used. It could be used to
+	// re-send authentication or subscription messages. If it returns
+	// non-nil error, connection is closed and dial is retried regardless of
+	// the error.
+	OnConnect func(conn net.Conn) error
+
+	// MinBackoff and MaxBackoff are bounds of the delay between dial
+	// attempts. Delay starts from MinBackoff and doubles after each failed
+	// attempt up to MaxBackoff. Each delay is randomized in [d/2, d) range
+	// to prevent synchronized reconnects of many clients.
+	//
+	// If a value is zero then DefaultReconnectMinBackoff and
+	// DefaultReconnectMaxBackoff are used respectively.
+	MinBackoff, MaxBackoff time.Duration
+
+	dialer ws.Dialer
+	url    string
+	events chan ConnEvent
+	done   chan struct{}
+	once   sync.Once
+
+	dial sync.Mutex // Serializes dials.
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader io.Reader
+}
+
+// NewReconnectingConn creates new ReconnectingConn which dials urlstr with
+// given dialer.
+func NewReconnectingConn(d ws.Dialer, urlstr string) *ReconnectingConn {
+	return &ReconnectingConn{
+		dialer: d,
+		url:    urlstr,
+		events: make(chan ConnEvent, reconnectEventsBuffer),
+		done:   make(chan struct{}),
+	}
+}
+
+// Events returns channel of connection state events. Channel is buffered;
+// events are dropped if it is full, thus it should be read continuously when
+// used. Channel is not closed; ConnClosed event is the last one sent.
+func (c *ReconnectingConn) Events() <-chan ConnEvent {
+	return c.events
+}
+
+// Conn returns current underlying connection. It returns nil if connection
+// is not established.
+func (c *ReconnectingConn) Conn() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// Connect makes sure that connection is established, dialing with backoff
+// if needed. It returns when connection is established, ctx is done or c is
+// closed.
+func (c *ReconnectingConn) Connect(ctx context.Context) error {
+	_, _, err := c.connect(ctx)
+	return err
+}
+
+// Read implements io.Reader. It retries on a new connection if the current
+// one is broken.
+func (c *ReconnectingConn) Read(p []byte) (int, error) {
+	for {
+		conn, r, err := c.connect(context.Background())
+		if err != nil {
+			return 0, err
+		}
+		n, err := r.Read(p)
+		if err == nil {
+			return n, nil
+		}
+		c.drop(conn, err)
+		if n > 0 {
+			// Return read bytes now; next call will read from the new
+			// connection.
+			return n, nil
+		}
+	}
+}
+
+// Write implements io.Writer.
+func (c *ReconnectingConn) Write(p []byte) (int, error) {
+	conn, _, err := c.connect(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	n, err := conn.Write(p)
+	if err != nil {
+		c.drop(conn, err)
+	}
+	return n, err
+}
+
+// Close closes current connection and stops reconnecting. Blocked dials are
+// interrupted.
+func (c *ReconnectingConn) Close() (err error) {
+	c.once.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		if c.conn != nil {
+			err = c.conn.Close()
+			c.release()
+		}
+		c.mu.Unlock()
+		c.emit(ConnEvent{State: ConnClosed})
+	})
+	return err
+}
+
+func (c *ReconnectingConn) current() (net.Conn, io.Reader, error) {
+	select {
+	case <-c.done:
+		return nil, nil, ErrReconnectingConnClosed
+	default:
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn, c.reader, nil
+}
+
+func (c *ReconnectingConn) connect(ctx context.Context) (net.Conn, io.Reader, error) {
+	if conn, r, err := c.current(); conn != nil || err != nil {
+		return conn, r, err
+	}
+	c.dial.Lock()
+	defer c.dial.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	backoff := nonZeroDuration(c.MinBackoff, DefaultReconnectMinBackoff)
+	for {
+		// Connection could be established by concurrent call while we were
+		// waiting for the lock.
+		if conn, r, err := c.current(); conn != nil || err != nil {
+			return conn, r, err
+		}
+		c.emit(ConnEvent{State: ConnConnecting})
+		conn, br, _, err := c.dialer.Dial(ctx, c.url)
+		if err != nil && !ws.IsRetryable(err) {
+			select {
+			case <-c.done:
+				// Dial is interrupted by Close().
+				return nil, nil, ErrReconnectingConnClosed
+			default:
+			}
+			c.emit(ConnEvent{State: ConnDisconnected, Err: err})
+			return nil, nil, err
+		}
+		if err == nil && c.OnConnect != nil {
+			if err = c.OnConnect(conn); err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil {
+			// NOTE: br is not returned to the pool when connection is
+			// dropped, because it could still be used by concurrent Read().
+			var r io.Reader = conn
+			if br != nil {
+				r = br
+			}
+			c.mu.Lock()
+			select {
+			case <-c.done:
+				// Closed while dialing.
+				c.mu.Unlock()
+				conn.Close()
+				return nil, nil, ErrReconnectingConnClosed
+			default:
+			}
+			c.conn, c.reader = conn, r
+			c.mu.Unlock()
+			c.emit(ConnEvent{State: ConnConnected})
+			return conn, r, nil
+		}
+		c.emit(ConnEvent{State: ConnDisconnected, Err: err})
+
+		select {
+		case <-c.done:
+			return nil, nil, ErrReconnectingConnClosed
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(jitter(backoff)):
+		}
+		if backoff *= 2; backoff > nonZeroDuration(c.MaxBackoff, DefaultReconnectMaxBackoff) {
+			backoff = nonZeroDuration(c.MaxBackoff, DefaultReconnectMaxBackoff)
+		}
+	}
+}
+
+// drop closes conn if it is still the current connection.
+func (c *ReconnectingConn) drop(conn net.Conn, err error) {
+	c.mu.Lock()
+	if c.conn != conn {
+		c.mu.Unlock()
+		return
+	}
+	conn.Close()
+	c.release()
+	c.mu.Unlock()
+
+	select {
+	case <-c.done:
+	default:
+		c.emit(ConnEvent{State: ConnDisconnected, Err: err})
+	}
+}
+
+// release must be called with c.mu held.
+func (c *ReconnectingConn) release() {
+	c.conn, c.reader = nil, nil
+}
+
+func (c *ReconnectingConn) emit(e ConnEvent) {
+	select {
+	case c.events <- e:
+	default:
+	}
+}
+
+// jitter returns random duration in [d/2, d) range.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+func nonZeroDuration(a, b time.Duration) time.Duration {
+	if a != 0 {
+		return a
+	}
+	return b
+}
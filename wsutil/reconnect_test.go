@@ -0,0 +1,188 @@
+package wsutil
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+func TestReconnectingConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Flapping server: it drops first two connections in the middle of
+	// handshake, and then echoes single message and closes each next
+	// connection.
+	var accepted int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if atomic.AddInt32(&accepted, 1) <= 2 {
+				// Read request before close to not reset the connection.
+				http.ReadRequest(bufio.NewReader(conn))
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := ws.Upgrade(conn); err != nil {
+					return
+				}
+				msg, op, err := ReadClientData(conn)
+				if err != nil {
+					return
+				}
+				_ = WriteServerMessage(conn, op, msg)
+			}()
+		}
+	}()
+
+	c := NewReconnectingConn(ws.Dialer{}, "ws://"+ln.Addr().String())
+	c.MinBackoff = time.Millisecond
+	c.MaxBackoff = 10 * time.Millisecond
+
+	// Subscribe on each connection to get message from the server.
+	var connects int
+	c.OnConnect = func(conn net.Conn) error {
+		connects++
+		return WriteClientText(conn, []byte(fmt.Sprintf("hello #%d", connects)))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if c.Conn() == nil {
+		t.Fatalf("no underlying connection after Connect()")
+	}
+	for i := 1; i <= 3; i++ {
+		// Server closes connection after echo, so each next message is
+		// read from the new connection.
+		msg, err := ReadServerText(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := fmt.Sprintf("hello #%d", i); string(msg) != exp {
+			t.Fatalf("unexpected message: %q; want %q", msg, exp)
+		}
+	}
+	if connects != 3 {
+		t.Errorf("unexpected OnConnect calls: %d; want 3", connects)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("x")); err != ErrReconnectingConnClosed {
+		t.Errorf("unexpected error after Close(): %v; want %v", err, ErrReconnectingConnClosed)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != ErrReconnectingConnClosed {
+		t.Errorf("unexpected error after Close(): %v; want %v", err, ErrReconnectingConnClosed)
+	}
+
+	var (
+		events []ConnState
+		failed int
+	)
+	for len(c.Events()) > 0 {
+		e := <-c.Events()
+		events = append(events, e.State)
+		if e.State == ConnDisconnected && e.Err == nil {
+			t.Errorf("disconnected event without error")
+		}
+		if e.State == ConnDisconnected && len(events) > 1 && events[len(events)-2] == ConnConnecting {
+			failed++
+		}
+	}
+	if failed < 2 {
+		t.Errorf("expected at least two failed dials; events: %v", events)
+	}
+	if n := len(events); n == 0 || events[n-1] != ConnClosed {
+		t.Errorf("unexpected last event; events: %v", events)
+	}
+}
+
+func TestReconnectingConnNotRetryable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var accepted int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				u := ws.Upgrader{
+					OnRequest: func([]byte) error {
+						return ws.RejectConnectionError(
+							ws.RejectionStatus(http.StatusForbidden),
+						)
+					},
+				}
+				u.Upgrade(conn)
+			}()
+		}
+	}()
+
+	c := NewReconnectingConn(ws.Dialer{}, "ws://"+ln.Addr().String())
+	c.MinBackoff = time.Millisecond
+	c.MaxBackoff = time.Millisecond
+	defer c.Close()
+
+	_, err = c.Read(make([]byte, 1))
+	if exp := ws.StatusError(http.StatusForbidden); err != exp {
+		t.Fatalf("unexpected error: %v; want %v", err, exp)
+	}
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Errorf("unexpected number of dials: %d; want 1", n)
+	}
+}
+
+func TestReconnectingConnCloseInterruptsDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c := NewReconnectingConn(ws.Dialer{}, "ws://"+addr)
+	c.MinBackoff = time.Hour
+	c.MaxBackoff = time.Hour
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Connect(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+
+	select {
+	case err := <-done:
+		if err != ErrReconnectingConnClosed {
+			t.Fatalf("unexpected error: %v; want %v", err, ErrReconnectingConnClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Close() did not interrupt dial backoff")
+	}
+}
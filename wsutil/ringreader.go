@@ -0,0 +1,194 @@
+package wsutil
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/gobwas/ws"
+)
+
+// DefaultRingReaderSize is the default capacity of RingReader buffer.
+const DefaultRingReaderSize = 4096
+
+// RingReader reads WebSocket frames from source into fixed-capacity buffer
+// and returns frame payloads as views into that buffer. It is intended for
+// the low-allocation use cases like proxies, where payload is processed (or
+// forwarded) right after it is read.
+//
+// Returned payload is valid only until the next call to Next(): buffer is
+// reused and payload bytes are overwritten. Caller must copy the payload if
+// it needs to retain it.
+//
+// Frames which payload (together with header) does not fit into the buffer
+// are read into freshly allocated slice; Allocated() reports it. Such payload
+// is owned by the caller.
+//
+// Note that RingReader does not check frames and does not unmask payload; it
+// is up to the caller (see ws.CheckHeader() and ws.Cipher()). Also note that
+// RingReader reads ahead, thus source must not be read by others while
+// RingReader is used.
+type RingReader struct {
+	src io.Reader
+	buf []byte
+	r   int // Read position.
+	w   int // Write position.
+
+	allocated bool
+}
+
+// NewRingReader creates new RingReader with buffer of given size. If size is
+// less or equal to zero DefaultRingReaderSize is used. Size is at least
+// ws.MaxHeaderSize.
+func NewRingReader(src io.Reader, size int) *RingReader {
+	if size <= 0 {
+		size = DefaultRingReaderSize
+	}
+	if size < ws.MaxHeaderSize {
+		size = ws.MaxHeaderSize
+	}
+	return &RingReader{
+		src: src,
+		buf: make([]byte, size),
+	}
+}
+
+// Reset resets RingReader to read from src. It discards any buffered data.
+func (r *RingReader) Reset(src io.Reader) {
+	r.src = src
+	r.r = 0
+	r.w = 0
+	r.allocated = false
+}
+
+// Allocated reports whether payload returned by the last Next() call was
+// allocated because it did not fit into the buffer.
+func (r *RingReader) Allocated() bool {
+	return r.allocated
+}
+
+// Next reads next frame and returns its header and payload. Payload is valid
+// until the next call to Next() unless Allocated() returns true.
+//
+// It returns io.EOF only if there are no bytes of the next frame read.
+// io.ErrUnexpectedEOF is returned if source ends in the middle of the frame.
+func (r *RingReader) Next() (h ws.Header, payload []byte, err error) {
+	r.allocated = false
+
+	if err = r.fill(ws.MinHeaderSize); err != nil {
+		if err == io.ErrUnexpectedEOF && r.r == r.w {
+			err = io.EOF
+		}
+		return h, nil, err
+	}
+	n := r.headerSize(r.buf[r.r+1])
+	if err = r.fill(n); err != nil {
+		return h, nil, noEOF(err)
+	}
+	h, err = parseHeader(r.buf[r.r : r.r+n])
+	if err != nil {
+		return h, nil, err
+	}
+	r.r += n
+
+	if h.Length > int64(len(r.buf)-n) {
+		// Payload does not fit into the buffer. Copy buffered part of it
+		// and read the rest from the source.
+		payload = make([]byte, h.Length)
+		m := copy(payload, r.buf[r.r:r.w])
+		r.r += m
+		if _, err = io.ReadFull(r.src, payload[m:]); err != nil {
+			return h, nil, noEOF(err)
+		}
+		r.allocated = true
+		return h, payload, nil
+	}
+
+	length := int(h.Length)
+	if err = r.fill(length); err != nil {
+		return h, nil, noEOF(err)
+	}
+	payload = r.buf[r.r : r.r+length : r.r+length]
+	r.r += length
+
+	return h, payload, nil
+}
+
+// fill makes sure that at least n bytes are buffered after the read
+// position. It moves buffered bytes to the beginning of the buffer if there
+// is not enough space after them. It must be called with n not greater than
+// buffer size.
+func (r *RingReader) fill(n int) error {
+	if r.w-r.r >= n {
+		return nil
+	}
+	if len(r.buf)-r.r < n {
+		// Previously returned payload is not valid anymore, thus it is safe
+		// to overwrite it.
+		r.w = copy(r.buf, r.buf[r.r:r.w])
+		r.r = 0
+	}
+	for r.w-r.r < n {
+		m, err := r.src.Read(r.buf[r.w:])
+		r.w += m
+		if r.w-r.r >= n {
+			return nil
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RingReader) headerSize(b byte) int {
+	n := ws.MinHeaderSize
+	if b&0x80 != 0 {
+		n += 4
+	}
+	switch b & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	return n
+}
+
+// parseHeader parses frame header from bts, which must hold the whole
+// header. It is the same as ws.ReadHeader() but does not allocate.
+func parseHeader(bts []byte) (h ws.Header, err error) {
+	h.Fin = bts[0]&0x80 != 0
+	h.Rsv = (bts[0] & 0x70) >> 4
+	h.OpCode = ws.OpCode(bts[0] & 0x0f)
+	h.Masked = bts[1]&0x80 != 0
+
+	length := bts[1] & 0x7f
+	bts = bts[2:]
+	switch length {
+	case 126:
+		h.Length = int64(binary.BigEndian.Uint16(bts))
+		bts = bts[2:]
+	case 127:
+		if bts[0]&0x80 != 0 {
+			return h, ws.ErrHeaderLengthMSB
+		}
+		h.Length = int64(binary.BigEndian.Uint64(bts))
+		bts = bts[8:]
+	default:
+		h.Length = int64(length)
+	}
+	if h.Masked {
+		copy(h.Mask[:], bts)
+	}
+	return h, nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package wsutil
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/gobwas/ws"
+)
+
+func TestRingReader(t *testing.T) {
+	frames := []ws.Frame{
+		ws.NewTextFrame([]byte("hello")),
+		ws.NewBinaryFrame(bytes.Repeat([]byte("a"), 20)),
+		ws.MaskFrame(ws.NewTextFrame([]byte("masked"))),
+		ws.NewBinaryFrame(bytes.Repeat([]byte("b"), 200)), // Larger than ring.
+		ws.NewFrame(ws.OpPing, true, nil),
+		ws.NewTextFrame([]byte("world")),
+	}
+	var buf bytes.Buffer
+	for _, f := range frames {
+		ws.MustWriteFrame(&buf, f)
+	}
+
+	// Read byte by byte to make sure partial reads are handled.
+	r := NewRingReader(iotest.OneByteReader(&buf), 32)
+	for i, exp := range frames {
+		h, p, err := r.Next()
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if h != exp.Header {
+			t.Errorf("#%d: unexpected header: %+v; want %+v", i, h, exp.Header)
+		}
+		if !bytes.Equal(p, exp.Payload) {
+			t.Errorf("#%d: unexpected payload: %q; want %q", i, p, exp.Payload)
+		}
+		if act, exp := r.Allocated(), len(p) > 32-ws.MinHeaderSize; act != exp {
+			t.Errorf("#%d: unexpected Allocated(): %v; want %v", i, act, exp)
+		}
+	}
+	if _, _, err := r.Next(); err != io.EOF {
+		t.Errorf("unexpected error at the end: %v; want %v", err, io.EOF)
+	}
+}
+
+func TestRingReaderUnexpectedEOF(t *testing.T) {
+	bts := ws.MustCompileFrame(ws.NewTextFrame([]byte("hello")))
+	for _, n := range []int{1, 3, len(bts) - 1} {
+		r := NewRingReader(bytes.NewReader(bts[:n]), 0)
+		if _, _, err := r.Next(); err != io.ErrUnexpectedEOF {
+			t.Errorf("unexpected error for %d bytes: %v; want %v", n, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func BenchmarkRingReader(b *testing.B) {
+	var buf bytes.Buffer
+	for i := 0; i < 1024; i++ {
+		ws.MustWriteFrame(&buf, ws.NewTextFrame([]byte("small frame payload")))
+	}
+	src := bytes.NewReader(buf.Bytes())
+	r := NewRingReader(src, 0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := r.Next(); err == io.EOF {
+			src.Reset(buf.Bytes())
+			r.Reset(src)
+		} else if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package wsutil
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// shutdownWorkers is the maximum number of goroutines used by
+// GracefulShutdown().
+const shutdownWorkers = 64
+
+// GracefulShutdown sends close frame with ws.StatusGoingAway code to each of
+// given server side connections and waits for peers to echo close frame back
+// at most timeout. Data frames received from peer while waiting are
+// discarded.
+//
+// Connections are processed concurrently by a bounded number of goroutines.
+// It returns slice of errors, where i-th error is the result of shutdown of
+// i-th connection. Nil error means that the closing handshake completed
+// successfully.
+//
+// Note that GracefulShutdown() changes connections deadlines and does not
+// close connections; it is caller's responsibility to close them afterwards.
+func GracefulShutdown(conns []net.Conn, timeout time.Duration) []error {
+	var (
+		errs = make([]error, len(conns))
+		jobs = make(chan int)
+		wg   sync.WaitGroup
+	)
+	deadline := time.Now().Add(timeout)
+	n := shutdownWorkers
+	if len(conns) < n {
+		n = len(conns)
+	}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				errs[j] = shutdown(conns[j], deadline)
+			}
+		}()
+	}
+	for i := range conns {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return errs
+}
+
+func shutdown(conn net.Conn, deadline time.Time) error {
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	err := ws.WriteFrame(conn, ws.NewCloseFrame(ws.NewCloseFrameBody(
+		ws.StatusGoingAway, "",
+	)))
+	if err != nil {
+		return err
+	}
+	for {
+		h, err := ws.ReadHeader(conn)
+		if err != nil {
+			return err
+		}
+		if _, err = io.CopyN(ioutil.Discard, conn, h.Length); err != nil {
+			return err
+		}
+		if h.OpCode == ws.OpClose {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package wsutil
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	const n = 100
+
+	var (
+		servers = make([]net.Conn, n)
+		clients = make([]net.Conn, n)
+	)
+	for i := range servers {
+		clients[i], servers[i] = tcpPair(t)
+		defer clients[i].Close()
+		defer servers[i].Close()
+	}
+	for i, conn := range clients {
+		if i%2 != 0 {
+			// Odd clients never respond.
+			go ws.ReadFrame(conn)
+			continue
+		}
+		go func(conn net.Conn) {
+			// Send some data before acknowledging the closure.
+			if err := WriteClientText(conn, []byte("hello")); err != nil {
+				return
+			}
+			for {
+				f, err := ws.ReadFrame(conn)
+				if err != nil {
+					return
+				}
+				if f.Header.OpCode != ws.OpClose {
+					continue
+				}
+				code, _ := ws.ParseCloseFrameData(f.Payload)
+				if code != ws.StatusGoingAway {
+					t.Errorf("unexpected close code: %v", code)
+				}
+				WriteClientMessage(conn, ws.OpClose, f.Payload)
+				return
+			}
+		}(conn)
+	}
+
+	const timeout = 100 * time.Millisecond
+	start := time.Now()
+	errs := GracefulShutdown(servers, timeout)
+	if elapsed := time.Since(start); elapsed > 5*timeout {
+		t.Errorf("shutdown took %s; want about %s", elapsed, timeout)
+	}
+	if len(errs) != n {
+		t.Fatalf("unexpected number of results: %d; want %d", len(errs), n)
+	}
+	for i, err := range errs {
+		if i%2 == 0 && err != nil {
+			t.Errorf("unexpected #%d error: %v", i, err)
+		}
+		if ne, ok := err.(net.Error); i%2 != 0 && !(ok && ne.Timeout()) {
+			t.Errorf("unexpected #%d error: %v; want timeout", i, err)
+		}
+	}
+}
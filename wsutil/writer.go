@@ -1,6 +1,7 @@
 package wsutil
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
 
@@ -113,6 +114,18 @@ func PutWriter(w *Writer) {
 	writers.Put(w, w.Size())
 }
 
+// WriteStats contains statistics of frames written by Writer. Its arrays are
+// indexed by message operation code, e.g. stats.Bytes[ws.OpText]. Continuation
+// frames are accounted under operation code of the message they belong to.
+type WriteStats struct {
+	// Frames holds number of frames written.
+	Frames [16]int64
+
+	// Bytes holds number of payload bytes written, not including frame
+	// headers.
+	Bytes [16]int64
+}
+
 // Writer contains logic of buffering output data into a WebSocket fragments.
 // It is much the same as bufio.Writer, except the thing that it works with
 // WebSocket frames, not the raw data.
@@ -131,6 +144,51 @@ func PutWriter(w *Writer) {
 // After all data has been written, the client should call the Flush() method
 // to guarantee all data has been forwarded to the underlying io.Writer.
 type Writer struct {
+	// LengthEncoding controls the form used to encode payload length of
+	// written frame headers. Default is LengthMinimal.
+	//
+	// Note that any value other than LengthMinimal produces non-minimal
+	// encoding which is not compliant with RFC6455. It is intended for
+	// testing robustness of peers only.
+	LengthEncoding LengthEncoding
+
+	// MaxBufferSize is the maximum size of the buffer in bytes (including
+	// reserved header bytes) which Writer keeps after Flush(). If the buffer
+	// grew beyond MaxBufferSize (e.g. after a huge message written with
+	// flushes disabled), it is shrunk back to its initial size after the
+	// message is flushed.
+	//
+	// Zero value means the buffer is never shrunk.
+	MaxBufferSize int
+
+	// AutoFlush makes Writer flush the underlying io.Writer at each message
+	// boundary, that is, after the frame with "fin" flag set is written by
+	// Flush() or WriteFrameStream(). It has effect only if the underlying
+	// io.Writer implements Flush() error method (such as *bufio.Writer
+	// does). Write() and ReadFrom() calls are not affected and still could
+	// form a single message.
+	//
+	// It is intended for request/response scenarios, where forgotten flush
+	// of the buffered connection leads to hangs. The tradeoff is throughput:
+	// each message costs at least one write to the underlying connection,
+	// while with manual flushing multiple messages could be batched (e.g. by
+	// bufio.Writer) and sent with a single syscall.
+	AutoFlush bool
+
+	// Coalesce makes Flush() keep the message in the buffer, so that bytes
+	// of consecutive messages are merged into fewer frames. When the buffer
+	// gets full, its content is sent as a single frame with "fin" flag set,
+	// that is, as a complete message instead of a fragment. Bytes left in
+	// the buffer are sent by FlushCoalesced().
+	//
+	// WARNING: Coalesce breaks message semantics. Peer receives the same
+	// bytes in the same order, but split into messages differently than they
+	// were written, and empty messages are not sent at all. It is intended
+	// only for cases where messages are treated as a byte stream, such as
+	// log shipping. It must not be used along with SetTransform(),
+	// DisableFlush() or compression, since they rely on message boundaries.
+	Coalesce bool
+
 	// dest specifies a destination of buffer flushes.
 	dest io.Writer
 
@@ -148,9 +206,22 @@ type Writer struct {
 	// noFlush reports whether buffer must grow instead of being flushed.
 	noFlush bool
 
+	// transform is applied to the whole message payload before framing.
+	transform TransformFunc
+
+	// compress overrides RSV1 bit of the next message when it is non-zero:
+	// 1 means set and -1 means clear. See SetNextCompressed().
+	compress int8
+
+	// stats holds statistics of written frames.
+	stats WriteStats
+
 	// Raw representation of the buffer, including reserved header bytes.
 	raw []byte
 
+	// size is the initial size of raw buffer.
+	size int
+
 	// Writeable part of buffer, without reserved header bytes.
 	// Resetting this to nil will not result in reallocation if raw is not nil.
 	// And vice versa: if buf is not nil, then Writer is assumed as ready and
@@ -165,6 +236,67 @@ type Writer struct {
 	err   error
 }
 
+// LengthEncoding represents a form of frame payload length encoding.
+type LengthEncoding uint8
+
+// LengthEncoding values.
+const (
+	// LengthMinimal makes payload length to be encoded in the minimal number
+	// of bytes, as RFC6455 requires.
+	LengthMinimal LengthEncoding = iota
+	// LengthMin16 makes payload length to be encoded at least in 16-bit
+	// extended form, even if it would fit in 7 bits.
+	LengthMin16
+	// LengthMin64 makes payload length to be always encoded in 64-bit
+	// extended form.
+	LengthMin64
+)
+
+// headerSize returns number of bytes needed to encode header h with e.
+func (e LengthEncoding) headerSize(h ws.Header) int {
+	n := ws.HeaderSize(h)
+	switch {
+	case e == LengthMin16 && h.Length <= len7:
+		n += 2
+	case e == LengthMin64 && h.Length <= len7:
+		n += 8
+	case e == LengthMin64 && h.Length <= len16:
+		n += 6
+	}
+	return n
+}
+
+// writeHeader writes binary representation of header h into w using e to
+// encode payload length.
+func (e LengthEncoding) writeHeader(w io.Writer, h ws.Header) error {
+	if e == LengthMinimal {
+		return ws.WriteHeader(w, h)
+	}
+	var bts [ws.MaxHeaderSize]byte
+	if h.Fin {
+		bts[0] |= 0x80
+	}
+	bts[0] |= h.Rsv << 4
+	bts[0] |= byte(h.OpCode)
+
+	n := ws.MinHeaderSize
+	if e == LengthMin16 && h.Length <= len16 {
+		bts[1] = 126
+		binary.BigEndian.PutUint16(bts[2:4], uint16(h.Length))
+		n += 2
+	} else {
+		bts[1] = 127
+		binary.BigEndian.PutUint64(bts[2:10], uint64(h.Length))
+		n += 8
+	}
+	if h.Masked {
+		bts[1] |= 0x80
+		n += copy(bts[n:], h.Mask[:])
+	}
+	_, err := w.Write(bts[:n])
+	return err
+}
+
 // NewWriter returns a new Writer whose buffer has the DefaultWriteBuffer size.
 func NewWriter(dest io.Writer, state ws.State, op ws.OpCode) *Writer {
 	return NewWriterBufferSize(dest, state, op, 0)
@@ -211,6 +343,7 @@ func NewWriterBuffer(dest io.Writer, state ws.State, op ws.OpCode, buf []byte) *
 		state: state,
 		op:    op,
 		raw:   buf,
+		size:  len(buf),
 	}
 	w.initBuf()
 	return w
@@ -239,11 +372,20 @@ func (w *Writer) Reset(dest io.Writer, state ws.State, op ws.OpCode) {
 	w.fseq = 0
 	w.extensions = w.extensions[:0]
 	w.noFlush = false
+	w.transform = nil
+	w.compress = 0
+	w.stats = WriteStats{}
+
+	w.LengthEncoding = LengthMinimal
+	w.MaxBufferSize = 0
+	w.AutoFlush = false
+	w.Coalesce = false
 }
 
 // ResetOp is an quick version of Reset().
 // ResetOp does reset unwritten fragments and does not reset results of
-// SetExtensions() or DisableFlush() methods.
+// SetExtensions(), SetTransform() or DisableFlush() methods. It also keeps
+// statistics returned by Stats().
 func (w *Writer) ResetOp(op ws.OpCode) {
 	w.op = op
 	w.n = 0
@@ -252,15 +394,67 @@ func (w *Writer) ResetOp(op ws.OpCode) {
 }
 
 // SetExtensions adds xs as extensions to be used during writes.
+//
+// Extensions are applied to each frame header in given order. Bits set by
+// each extension are combined, so every extension should only set bits it
+// is responsible for. Reader applies the same list of extensions in reverse
+// order (see Reader.Extensions).
 func (w *Writer) SetExtensions(xs ...SendExtension) {
 	w.extensions = xs
 }
 
+// SetNextCompressed overrides the Per-Message Compressed bit (RSV1) of the
+// next message written by w. Unlike wsflate.MessageState.SetCompressed() it
+// affects only the next message; bit of the following messages is defined by
+// extensions again. It is useful to skip compression of particular messages,
+// e.g. of already compressed payload.
+//
+// Writer does not compress data itself, thus caller is responsible to
+// write payload accordingly: through wsflate.Writer if v is true, or
+// directly to w otherwise:
+//
+//	w.SetNextCompressed(false)
+//	w.Write(jpeg)
+//	w.Flush()
+//
+// It must be called before the first byte of the message is written.
+func (w *Writer) SetNextCompressed(v bool) {
+	if v {
+		w.compress = 1
+	} else {
+		w.compress = -1
+	}
+}
+
 // DisableFlush denies Writer to write fragments.
 func (w *Writer) DisableFlush() {
 	w.noFlush = true
 }
 
+// SetTransform sets fn to be applied to each message payload right before it
+// is framed and sent. To make fn receive the whole message, SetTransform also
+// denies Writer to write fragments just like DisableFlush() does. Thus
+// FlushFragment() and WriteThrough() must not be used along with transform.
+//
+// Writer may modify bytes returned by fn (e.g. to mask them).
+//
+// Transform runs outside of compression: when Writer is wrapped by
+// compressor such as wsflate.Writer, fn receives already compressed payload
+// and its result is sent as is, with the RSV bits set by extensions. See
+// Reader.Transform for the reverse operation.
+func (w *Writer) SetTransform(fn TransformFunc) {
+	w.transform = fn
+	w.noFlush = true
+}
+
+// Stats returns statistics of frames written since Writer initialization or
+// last Reset() call.
+//
+// Note that Stats is not safe to be called concurrently with writes.
+func (w *Writer) Stats() WriteStats {
+	return w.stats
+}
+
 // Size returns the size of the underlying buffer in bytes (not including
 // WebSocket header bytes).
 func (w *Writer) Size() int {
@@ -299,11 +493,15 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 			// io.Writer when writing frame header.
 			//
 			// On large buffers additional write is better than copying.
-			nn, _ = w.WriteThrough(p)
+			if w.Coalesce {
+				nn, _ = w.writeThrough(p, true)
+			} else {
+				nn, _ = w.WriteThrough(p)
+			}
 		} else {
 			nn = copy(w.buf[w.n:], p)
 			w.n += nn
-			w.FlushFragment()
+			w.flushFull()
 		}
 		n += nn
 		p = p[nn:]
@@ -384,19 +582,80 @@ func (w *Writer) WriteThrough(p []byte) (n int, err error) {
 		return 0, ErrNotEmpty
 	}
 
+	n, err = w.writeThrough(p, false)
+	if err != nil && w.err == nil {
+		// Extensions error; nothing is written.
+		return 0, err
+	}
+	w.dirty = true
+	w.fseq++
+
+	return n, err
+}
+
+// ErrMessageInProgress is returned by Writer.StartStream() to indicate that
+// previous message is not finalized yet.
+var ErrMessageInProgress = fmt.Errorf("message in progress")
+
+// StartStream prepares Writer to stream new message with given operation
+// code via WriteFrameStream(). It returns ErrMessageInProgress if previous
+// message is not finalized yet, either by WriteFrameStream() with final flag
+// set or by Flush().
+func (w *Writer) StartStream(op ws.OpCode) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.dirty || w.fseq > 0 || w.Buffered() != 0 {
+		return ErrMessageInProgress
+	}
+	w.op = op
+	return nil
+}
+
+// WriteFrameStream writes p as a single frame bypassing the buffer. The
+// first frame of the message is sent with Writer's operation code (see
+// StartStream()) and the next ones are sent as continuation frames until
+// final is true. That is, Writer remembers that message is in progress, so
+// streaming could be interrupted and resumed later (e.g. from another
+// goroutine, with appropriate synchronization) without manual framing.
+//
+// Note that Writer's buffer must be empty before calling WriteFrameStream(),
+// otherwise ErrNotEmpty is returned. Transform set by SetTransform() is not
+// applied.
+func (w *Writer) WriteFrameStream(p []byte, final bool) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.Buffered() != 0 {
+		return ErrNotEmpty
+	}
+	if _, err := w.writeThrough(p, final); err != nil && w.err == nil {
+		// Extensions error; nothing is written.
+		return err
+	}
+	if final {
+		w.dirty = false
+		w.fseq = 0
+		w.flushDest()
+	} else {
+		w.dirty = true
+		w.fseq++
+	}
+	return w.err
+}
+
+func (w *Writer) writeThrough(p []byte, fin bool) (n int, err error) {
 	var frame ws.Frame
 	frame.Header = ws.Header{
 		OpCode: w.opCode(),
-		Fin:    false,
+		Fin:    fin,
 		Length: int64(len(p)),
 	}
-	for _, x := range w.extensions {
-		frame.Header, err = x.SetBits(frame.Header)
-		if err != nil {
-			return 0, err
-		}
+	frame.Header, err = w.setBits(frame.Header)
+	if err != nil {
+		return 0, err
 	}
-	if w.state.ClientSide() {
+	if masked(w.state) {
 		// Should copy bytes to prevent corruption of caller data.
 		payload := pbytes.GetLen(len(p))
 		defer pbytes.Put(payload)
@@ -408,14 +667,12 @@ func (w *Writer) WriteThrough(p []byte) (n int, err error) {
 		frame.Payload = p
 	}
 
-	w.err = ws.WriteFrame(w.dest, frame)
+	w.err = w.writeFrame(frame)
 	if w.err == nil {
 		n = len(p)
+		w.account(n)
 	}
 
-	w.dirty = true
-	w.fseq++
-
 	return n, w.err
 }
 
@@ -427,7 +684,7 @@ func (w *Writer) ReadFrom(src io.Reader) (n int64, err error) {
 			if w.noFlush {
 				w.Grow(w.Buffered()) // Twice bigger.
 			} else {
-				err = w.FlushFragment()
+				err = w.flushFull()
 			}
 			continue
 		}
@@ -465,20 +722,62 @@ func (w *Writer) ReadFrom(src io.Reader) (n int64, err error) {
 // Flush writes any buffered data to the underlying io.Writer.
 // It sends the frame with "fin" flag set to true.
 //
-// If no Write() or ReadFrom() was made, then Flush() does nothing.
+// If no Write() or ReadFrom() was made, then Flush() does nothing. If
+// Coalesce is set, Flush() does nothing as well; see FlushCoalesced().
 func (w *Writer) Flush() error {
 	if (!w.dirty && w.Buffered() == 0) || w.err != nil {
 		return w.err
 	}
+	if w.Coalesce {
+		return nil
+	}
+	return w.flush()
+}
+
+// FlushCoalesced writes data of messages buffered due to Coalesce option to
+// the underlying io.Writer as a single frame with "fin" flag set to true. It
+// does nothing if buffer is empty.
+func (w *Writer) FlushCoalesced() error {
+	if w.Buffered() == 0 || w.err != nil {
+		w.dirty = false
+		return w.err
+	}
+	return w.flush()
+}
+
+// flushFull writes the full buffer to the underlying io.Writer: as a fragment
+// or, if Coalesce is set, as a complete message.
+func (w *Writer) flushFull() error {
+	if w.Coalesce {
+		return w.flush()
+	}
+	return w.FlushFragment()
+}
+
+func (w *Writer) flush() error {
 
 	w.err = w.flushFragment(true)
 	w.n = 0
 	w.dirty = false
 	w.fseq = 0
 
+	w.flushDest()
+
+	if max := w.MaxBufferSize; max > 0 && len(w.raw) > max && len(w.raw) > w.size {
+		w.raw = make([]byte, w.size)
+		w.initBuf()
+	}
+
 	return w.err
 }
 
+// flushDest flushes the underlying io.Writer if AutoFlush is set.
+func (w *Writer) flushDest() {
+	if f, ok := w.dest.(interface{ Flush() error }); ok && w.AutoFlush && w.err == nil {
+		w.err = f.Flush()
+	}
+}
+
 // FlushFragment writes any buffered data to the underlying io.Writer.
 // It sends the frame with "fin" flag set to false.
 func (w *Writer) FlushFragment() error {
@@ -494,41 +793,84 @@ func (w *Writer) FlushFragment() error {
 }
 
 func (w *Writer) flushFragment(fin bool) (err error) {
+	payload := w.buf[:w.n]
+	if fn := w.transform; fn != nil {
+		if payload, err = fn(w.op, payload); err != nil {
+			return err
+		}
+	}
 	var (
-		payload = w.buf[:w.n]
-		header  = ws.Header{
+		header = ws.Header{
 			OpCode: w.opCode(),
 			Fin:    fin,
 			Length: int64(len(payload)),
 		}
 	)
-	for _, ext := range w.extensions {
-		header, err = ext.SetBits(header)
-		if err != nil {
-			return err
-		}
+	header, err = w.setBits(header)
+	if err != nil {
+		return err
 	}
-	if w.state.ClientSide() {
+	if masked(w.state) {
 		header.Masked = true
 		header.Mask = ws.NewMask()
 		ws.Cipher(payload, header.Mask, 0)
 	}
-	// Write header to the header segment of the raw buffer.
 	var (
 		offset = len(w.raw) - len(w.buf)
-		skip   = offset - ws.HeaderSize(header)
+		size   = w.LengthEncoding.headerSize(header)
 	)
-	buf := bytesWriter{
-		buf: w.raw[skip:offset],
+	if w.transform != nil || size > offset {
+		// Transformed payload is not placed in the raw buffer. Header of
+		// non-minimal length encoding may not fit the reserved space.
+		err = w.writeFrame(ws.Frame{
+			Header:  header,
+			Payload: payload,
+		})
+	} else {
+		// Write header to the header segment of the raw buffer.
+		skip := offset - size
+		buf := bytesWriter{
+			buf: w.raw[skip:offset],
+		}
+		if err := w.LengthEncoding.writeHeader(&buf, header); err != nil {
+			// Must never be reached.
+			panic("dump header error: " + err.Error())
+		}
+		_, err = w.dest.Write(w.raw[skip : offset+w.n])
+	}
+	if err == nil {
+		w.account(len(payload))
+	}
+	return err
+}
+
+// setBits applies extensions to the frame header h along with RSV1 bit
+// override made by SetNextCompressed().
+func (w *Writer) setBits(h ws.Header) (ws.Header, error) {
+	h, err := setBits(h, w.extensions)
+	if err != nil || w.compress == 0 || !h.OpCode.IsData() || h.OpCode == ws.OpContinuation {
+		return h, err
 	}
-	if err := ws.WriteHeader(&buf, header); err != nil {
-		// Must never be reached.
-		panic("dump header error: " + err.Error())
+	_, r2, r3 := ws.RsvBits(h.Rsv)
+	h.Rsv = ws.Rsv(w.compress > 0, r2, r3)
+	w.compress = 0
+	return h, nil
+}
+
+func (w *Writer) writeFrame(f ws.Frame) error {
+	if err := w.LengthEncoding.writeHeader(w.dest, f.Header); err != nil {
+		return err
 	}
-	_, err = w.dest.Write(w.raw[skip : offset+w.n])
+	_, err := w.dest.Write(f.Payload)
 	return err
 }
 
+func (w *Writer) account(n int) {
+	op := w.op & 0x0f
+	w.stats.Frames[op]++
+	w.stats.Bytes[op] += int64(n)
+}
+
 func (w *Writer) opCode() ws.OpCode {
 	if w.fseq > 0 {
 		return ws.OpContinuation
@@ -554,7 +896,7 @@ func (w *bytesWriter) Write(p []byte) (int, error) {
 
 func writeFrame(w io.Writer, s ws.State, op ws.OpCode, fin bool, p []byte) error {
 	var frame ws.Frame
-	if s.ClientSide() {
+	if masked(s) {
 		// Should copy bytes to prevent corruption of caller data.
 		payload := pbytes.GetLen(len(p))
 		defer pbytes.Put(payload)
@@ -576,7 +918,7 @@ func writeFrame(w io.Writer, s ws.State, op ws.OpCode, fin bool, p []byte) error
 // size, not the payload size.
 func reserve(state ws.State, n int) (offset int) {
 	var mask int
-	if state.ClientSide() {
+	if masked(state) {
 		mask = 4
 	}
 	switch {
@@ -594,6 +936,11 @@ func reserve(state ws.State, n int) (offset int) {
 func headerSize(s ws.State, n int) int {
 	return ws.HeaderSize(ws.Header{
 		Length: int64(n),
-		Masked: s.ClientSide(),
+		Masked: masked(s),
 	})
 }
+
+// masked reports whether frames sent with given state must be masked.
+func masked(s ws.State) bool {
+	return s.ClientSide() && !s.Unmasked()
+}
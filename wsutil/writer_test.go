@@ -1,10 +1,12 @@
 package wsutil
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/rand"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"reflect"
 	"strconv"
 	"testing"
@@ -577,6 +579,387 @@ func TestWriterWriteCount(t *testing.T) {
 	}
 }
 
+func TestWriterStats(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriterSize(&buf, ws.StateClientSide, ws.OpText, 16)
+
+	// Text message written in multiple fragments.
+	if _, err := w.Write(bytes.Repeat([]byte{'x'}, 40)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Binary message written through the buffer.
+	w.ResetOp(ws.OpBinary)
+	if _, err := w.Write([]byte("bin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var frames int64
+	for r := bytes.NewReader(buf.Bytes()); r.Len() > 0; frames++ {
+		if _, err := ws.ReadFrame(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := w.Stats()
+	if act, exp := stats.Bytes[ws.OpText], int64(40); act != exp {
+		t.Errorf("unexpected text bytes: %d; want %d", act, exp)
+	}
+	if act, exp := stats.Bytes[ws.OpBinary], int64(3); act != exp {
+		t.Errorf("unexpected binary bytes: %d; want %d", act, exp)
+	}
+	if act, exp := stats.Frames[ws.OpBinary], int64(1); act != exp {
+		t.Errorf("unexpected binary frames: %d; want %d", act, exp)
+	}
+	if act, exp := stats.Frames[ws.OpText]+stats.Frames[ws.OpBinary], frames; act != exp {
+		t.Errorf("unexpected total frames: %d; want %d", act, exp)
+	}
+	if stats.Frames[ws.OpText] < 2 {
+		t.Errorf("expected text message to be fragmented")
+	}
+	if stats.Frames[ws.OpContinuation] != 0 {
+		t.Errorf("unexpected continuation frames accounted")
+	}
+
+	w.Reset(&buf, ws.StateClientSide, ws.OpText)
+	if act := w.Stats(); act != (WriteStats{}) {
+		t.Errorf("unexpected stats after Reset(): %+v", act)
+	}
+}
+
+func TestWriterAutoFlush(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		autoFlush bool
+		msg       []byte
+		write     func(*Writer, []byte) error
+	}{
+		{
+			name: "manual",
+			write: func(w *Writer, p []byte) error {
+				if _, err := w.Write(p); err != nil {
+					return err
+				}
+				return w.Flush()
+			},
+		},
+		{
+			name:      "write",
+			autoFlush: true,
+			write: func(w *Writer, p []byte) error {
+				if _, err := w.Write(p); err != nil {
+					return err
+				}
+				return w.Flush()
+			},
+		},
+		{
+			name:      "multiple writes",
+			autoFlush: true,
+			msg:       bytes.Repeat([]byte("hello"), 100),
+			write: func(w *Writer, p []byte) error {
+				for i := 0; i < 100; i++ {
+					if _, err := w.Write(p); err != nil {
+						return err
+					}
+				}
+				return w.Flush()
+			},
+		},
+		{
+			name:      "read from",
+			autoFlush: true,
+			write: func(w *Writer, p []byte) error {
+				if _, err := w.ReadFrom(bytes.NewReader(p)); err != nil {
+					return err
+				}
+				return w.Flush()
+			},
+		},
+		{
+			name:      "stream",
+			autoFlush: true,
+			write: func(w *Writer, p []byte) error {
+				if err := w.WriteFrameStream(p[:2], false); err != nil {
+					return err
+				}
+				return w.WriteFrameStream(p[2:], true)
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				buf  bytes.Buffer
+				conn = bufio.NewWriter(&buf)
+				w    = NewWriterSize(conn, ws.StateServerSide, ws.OpText, 128)
+			)
+			w.AutoFlush = test.autoFlush
+			for i := 0; i < 2; i++ {
+				if err := test.write(w, []byte("hello")); err != nil {
+					t.Fatal(err)
+				}
+				if !test.autoFlush {
+					if buf.Len() != 0 {
+						t.Fatalf("unexpected bytes on the wire without flush")
+					}
+					return
+				}
+				msg, err := ReadServerText(&struct {
+					io.Reader
+					io.Writer
+				}{&buf, ioutil.Discard})
+				if err != nil {
+					t.Fatal(err)
+				}
+				exp := test.msg
+				if exp == nil {
+					exp = []byte("hello")
+				}
+				if !bytes.Equal(msg, exp) {
+					t.Fatalf("unexpected message: %q", msg)
+				}
+				if buf.Len() != 0 {
+					t.Fatalf("unexpected bytes after message: %d", buf.Len())
+				}
+			}
+		})
+	}
+}
+
+func TestWriterResetOptions(t *testing.T) {
+	check := func(w *Writer) {
+		t.Helper()
+		if w.AutoFlush || w.LengthEncoding != LengthMinimal || w.MaxBufferSize != 0 || w.Coalesce {
+			t.Errorf(
+				"unexpected options of reused writer: AutoFlush=%t LengthEncoding=%d MaxBufferSize=%d Coalesce=%t",
+				w.AutoFlush, w.LengthEncoding, w.MaxBufferSize, w.Coalesce,
+			)
+		}
+	}
+	configure := func(w *Writer) {
+		w.AutoFlush = true
+		w.LengthEncoding = LengthMin64
+		w.MaxBufferSize = 256
+		w.Coalesce = true
+	}
+
+	w := NewWriterSize(ioutil.Discard, ws.StateServerSide, ws.OpText, 128)
+	configure(w)
+	w.Reset(ioutil.Discard, ws.StateServerSide, ws.OpText)
+	check(w)
+
+	// Writer may be reused from the pool or created from scratch; in both
+	// cases options must be in their default state.
+	w = GetWriter(ioutil.Discard, ws.StateServerSide, ws.OpText, 128)
+	configure(w)
+	PutWriter(w)
+	w = GetWriter(ioutil.Discard, ws.StateServerSide, ws.OpText, 128)
+	defer PutWriter(w)
+	check(w)
+}
+
+func TestWriterCoalesce(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		state ws.State
+		sizes []int
+		merge bool // Whether less frames than messages are expected.
+	}{
+		{
+			name:  "small",
+			state: ws.StateServerSide,
+			sizes: []int{1, 5, 10, 3, 0, 7, 20, 13, 9, 2},
+			merge: true,
+		},
+		{
+			name:  "large",
+			state: ws.StateServerSide,
+			sizes: []int{10, 100, 30, 200, 5},
+		},
+		{
+			name:  "masked",
+			state: ws.StateClientSide,
+			sizes: []int{10, 50, 30, 20, 1, 60},
+			merge: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				buf bytes.Buffer
+				exp []byte
+			)
+			w := NewWriterSize(&buf, test.state, ws.OpBinary, 64)
+			w.Coalesce = true
+			for _, n := range test.sizes {
+				p := make([]byte, n)
+				rand.Read(p)
+				exp = append(exp, p...)
+				if _, err := w.Write(p); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.FlushCoalesced(); err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				act    []byte
+				frames int
+			)
+			for buf.Len() > 0 {
+				f, err := ws.ReadFrame(&buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !f.Header.Fin || f.Header.OpCode != ws.OpBinary {
+					t.Fatalf("unexpected frame header: %+v", f.Header)
+				}
+				if f.Header.Masked {
+					ws.Cipher(f.Payload, f.Header.Mask, 0)
+				}
+				act = append(act, f.Payload...)
+				frames++
+			}
+			if !bytes.Equal(act, exp) {
+				t.Errorf("unexpected coalesced payload:\nact: %x\nexp: %x", act, exp)
+			}
+			if test.merge && frames >= len(test.sizes) {
+				t.Errorf("messages are not coalesced: %d frames for %d messages", frames, len(test.sizes))
+			}
+		})
+	}
+}
+
+func TestWriterMaxBufferSize(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		max    int
+		shrink bool
+	}{
+		{name: "never", max: 0},
+		{name: "shrink", max: 1024, shrink: true},
+		{name: "above", max: 1 << 20},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriterBufferSize(&buf, ws.StateServerSide, ws.OpBinary, 512)
+			w.MaxBufferSize = test.max
+			w.DisableFlush()
+
+			initial := w.Size()
+			large := bytes.Repeat([]byte{'x'}, 64<<10)
+			if _, err := w.Write(large); err != nil {
+				t.Fatal(err)
+			}
+			grown := w.Size()
+			if grown <= initial {
+				t.Fatalf("expected buffer to grow")
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				if _, err := w.Write([]byte("small")); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			exp := grown
+			if test.shrink {
+				exp = initial
+			}
+			if act := w.Size(); act != exp {
+				t.Errorf("unexpected buffer size: %d; want %d", act, exp)
+			}
+
+			frame, err := ws.ReadFrame(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(frame.Payload, large) {
+				t.Errorf("unexpected large frame payload")
+			}
+			for i := 0; i < 10; i++ {
+				frame, err := ws.ReadFrame(&buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(frame.Payload) != "small" {
+					t.Errorf("unexpected payload: %q", frame.Payload)
+				}
+			}
+		})
+	}
+}
+
+func TestWriterLengthEncoding(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		enc  LengthEncoding
+		n    int
+		bits byte // Expected 7-bit length value.
+	}{
+		{name: "minimal/7", enc: LengthMinimal, n: 5, bits: 5},
+		{name: "minimal/16", enc: LengthMinimal, n: 300, bits: 126},
+		{name: "min16/7", enc: LengthMin16, n: 5, bits: 126},
+		{name: "min16/16", enc: LengthMin16, n: 300, bits: 126},
+		{name: "min64/7", enc: LengthMin64, n: 5, bits: 127},
+		{name: "min64/16", enc: LengthMin64, n: 300, bits: 127},
+	} {
+		for _, state := range []ws.State{ws.StateServerSide, ws.StateClientSide} {
+			for _, size := range []int{0, 512} {
+				side := "server"
+				if state.ClientSide() {
+					side = "client"
+				}
+				name := fmt.Sprintf("%s/%s/size=%d", test.name, side, size)
+				t.Run(name, func(t *testing.T) {
+					var buf bytes.Buffer
+					w := NewWriterBufferSize(&buf, state, ws.OpBinary, size)
+					w.LengthEncoding = test.enc
+
+					exp := bytes.Repeat([]byte{'x'}, test.n)
+					if _, err := w.Write(exp); err != nil {
+						t.Fatal(err)
+					}
+					if err := w.Flush(); err != nil {
+						t.Fatal(err)
+					}
+					if act := buf.Bytes()[1] & 0x7f; act != test.bits {
+						t.Errorf("unexpected length bits: %d; want %d", act, test.bits)
+					}
+					f, err := ws.ReadFrame(&buf)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if f.Header.Masked {
+						f = ws.UnmaskFrameInPlace(f)
+					}
+					if !f.Header.Fin || f.Header.OpCode != ws.OpBinary {
+						t.Errorf("unexpected header: %+v", f.Header)
+					}
+					if !bytes.Equal(f.Payload, exp) {
+						t.Errorf("unexpected payload")
+					}
+					if buf.Len() != 0 {
+						t.Errorf("unexpected %d trailing bytes", buf.Len())
+					}
+				})
+			}
+		}
+	}
+}
+
 func TestWriterNoPreemtiveFlush(t *testing.T) {
 	n := writeCounter{}
 	w := NewWriterSize(&n, 0, 0, 10)
@@ -664,3 +1047,68 @@ func chunks(p []byte, n int, fn func(p []byte) error) error {
 	}
 	return nil
 }
+
+func TestWriterFrameStream(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, ws.StateServerSide, ws.OpText)
+
+	if err := w.StartStream(ws.OpBinary); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteFrameStream([]byte("foo"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stream is interrupted: resume it from another goroutine.
+	done := make(chan error, 1)
+	go func() {
+		if err := w.StartStream(ws.OpText); err != ErrMessageInProgress {
+			done <- fmt.Errorf("unexpected StartStream() error: %v; want %v", err, ErrMessageInProgress)
+			return
+		}
+		if err := w.WriteFrameStream([]byte("bar"), false); err != nil {
+			done <- err
+			return
+		}
+		done <- w.WriteFrameStream([]byte("baz"), true)
+	}()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// New message could be started once previous one is finalized.
+	if err := w.StartStream(ws.OpText); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteFrameStream([]byte("next"), true); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []ws.Frame{
+		ws.NewFrame(ws.OpBinary, false, []byte("foo")),
+		ws.NewFrame(ws.OpContinuation, false, []byte("bar")),
+		ws.NewFrame(ws.OpContinuation, true, []byte("baz")),
+		ws.NewFrame(ws.OpText, true, []byte("next")),
+	}
+	for i, f := range exp {
+		act, err := ws.ReadFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act.Header != f.Header || !bytes.Equal(act.Payload, f.Payload) {
+			t.Errorf("#%d: unexpected frame: %+v; want %+v", i, act, f)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("unexpected bytes left: %d", buf.Len())
+	}
+
+	// Buffered data must be flushed first.
+	w.Write([]byte("buffered"))
+	if err := w.WriteFrameStream([]byte("stream"), true); err != ErrNotEmpty {
+		t.Errorf("unexpected error: %v; want %v", err, ErrNotEmpty)
+	}
+	if err := w.StartStream(ws.OpText); err != ErrMessageInProgress {
+		t.Errorf("unexpected error: %v; want %v", err, ErrMessageInProgress)
+	}
+}